@@ -1,6 +1,9 @@
 package frbnc
 
 import (
+	"errors"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/dwdwow/cex"
@@ -13,14 +16,26 @@ type Account struct {
 	Time          int64                                `json:"time"`
 	Spot          bnc.SpotAccount                      `json:"spot"`
 	Futures       bnc.FuturesAccount                   `json:"futures"`
+	CMFutures     CMFuturesAccount                     `json:"cmFutures"`
 	EarnPositions []bnc.SimpleEarnFlexiblePosition     `json:"earnPositions"`
 	LoanOrders    []bnc.CryptoLoanFlexibleOngoingOrder `json:"loanOrders"`
 
+	// MarkPrices key is futures symbol, including cm symbol
+	MarkPrices map[string]float64 `json:"markPrices"`
+
+	// PartialErr is error of best-effort queries, cm futures account, mark prices and cm pairs,
+	// fields of failed queries are empty, prices fall back to positions or querying.
+	PartialErr error `json:"-"`
+
 	spBals map[string]bnc.SpotBalance
 	fuAsts map[string]bnc.FuturesAccountAsset
 	fuPoss map[string]bnc.FuturesAccountPosition
+	cmAsts map[string]bnc.FuturesAccountAsset
+	cmPoss map[string]bnc.FuturesAccountPosition
 	enPoss map[string]bnc.SimpleEarnFlexiblePosition
 	lnOrds map[string]bnc.CryptoLoanFlexibleOngoingOrder // key is loanCoin+"_"+collateralCoin
+
+	cmPairs map[string]cex.Pair
 }
 
 func (a *Account) EarnProductId(asset string) (id string, ok bool) {
@@ -47,11 +62,22 @@ func (a *Account) FuAsset(asset string) (ass bnc.FuturesAccountAsset, ok bool) {
 	return
 }
 
-func (a *Account) FuPos(symbol string) (pos bnc.FuturesAccountPosition, ok bool) {
-	if a.fuPoss == nil {
-		return
+// FuPos
+// side is BOTH in one-way mode, LONG or SHORT in hedge mode.
+func (a *Account) FuPos(symbol string, side bnc.FuturesPositionSide) (pos bnc.FuturesAccountPosition, ok bool) {
+	return mapGetter(a.fuPoss, fuPosKey(symbol, side))
+}
+
+// FuPoss returns positions of all sides of symbol.
+func (a *Account) FuPoss(symbol string) []bnc.FuturesAccountPosition {
+	return posGetter(a.fuPoss, symbol)
+}
+
+// FuNetPosAmt returns sum of signed position amount of all sides.
+func (a *Account) FuNetPosAmt(symbol string) (amt float64) {
+	for _, pos := range a.FuPoss(symbol) {
+		amt += pos.SignPositionAmt
 	}
-	pos, ok = a.fuPoss[symbol]
 	return
 }
 
@@ -73,25 +99,118 @@ func (a *Account) LoanOrd(pair string) (ord bnc.CryptoLoanFlexibleOngoingOrder,
 	return
 }
 
-// MarginRatio returns totalMarginBalance / totalPos
-// If return 0, totalPos = 0
-func (a *Account) MarginRatio() (ratio, margin, totalPos float64) {
-	acct := a.Futures
-	margin = acct.TotalMarginBalance
+// FuMarkPrice returns mark price of futures symbol,
+// if there is no mark price, use price of position or orderbook.
+func (a *Account) FuMarkPrice(symbol string) (price float64, err error) {
+	price, ok := mapGetter(a.MarkPrices, symbol)
+	if ok && price > 0 {
+		return
+	}
+	if poss := a.FuPoss(symbol); len(poss) > 0 {
+		return fuPrice(poss...)
+	}
+	return fuPriceByQuerying(symbol)
+}
 
-	for _, pos := range acct.Positions {
-		totalPos += pos.PositionInitialMargin * pos.Leverage
+// FuPosNotional returns mark price notional of position.
+func (a *Account) FuPosNotional(pos bnc.FuturesAccountPosition) float64 {
+	price, ok := mapGetter(a.MarkPrices, pos.Symbol)
+	if ok && price > 0 {
+		return pos.AbsPositionAmt() * price
 	}
+	return pos.PositionInitialMargin * pos.Leverage
+}
 
-	if totalPos <= 0 {
-		return
+// FuMarginValue returns USD value of futures margin.
+// In multi-assets mode, non USD assets count as margin with haircut,
+// haircut is PledgeRatio of validMarginCoins.
+// Positive balance of asset not in validMarginCoins is skipped, it counts as no margin,
+// negative balance of any asset is debt and is always counted.
+func (a *Account) FuMarginValue() (margin float64, err error) {
+	acct := a.Futures
+	if !acct.MultiAssetsMargin {
+		return acct.TotalMarginBalance, nil
+	}
+	var errs []error
+	for _, asset := range acct.Assets {
+		bal := asset.MarginBalance
+		if bal == 0 {
+			continue
+		}
+		if usdChecker.isUsd(asset.Asset) {
+			margin += bal
+			continue
+		}
+		price, err := a.FuMarkPrice(asset.Asset + "USDT")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		value := bal * price
+		if value < 0 {
+			// debt is not discounted
+			margin += value
+			continue
+		}
+		i := slices.IndexFunc(validMarginCoins, func(coin MarginCoin) bool {
+			return coin.Coin == asset.Asset
+		})
+		if i < 0 {
+			// not margin coin of this module
+			continue
+		}
+		margin += value * validMarginCoins[i].PledgeRatio
 	}
+	return margin, errors.Join(errs...)
+}
+
+type FuturesMarginRatio struct {
+	Margin      float64
+	Notional    float64
+	MaintMargin float64
 
-	ratio = margin / totalPos
+	// InitialRatio = Margin / Notional
+	// If Notional is 0, InitialRatio is 0.
+	InitialRatio float64
+
+	// MaintRatio = Margin / MaintMargin
+	// account is liquidated when MaintRatio <= 1.
+	// If MaintMargin is 0, MaintRatio is 0.
+	MaintRatio float64
+
+	Err error
+}
+
+// FuMarginRatio uses mark price notional and maintenance margin of every position,
+// both long and short legs in hedge mode are added up.
+func (a *Account) FuMarginRatio() (ratio FuturesMarginRatio) {
+	ratio.Margin, ratio.Err = a.FuMarginValue()
+
+	for _, pos := range a.Futures.Positions {
+		if pos.SignPositionAmt == 0 {
+			continue
+		}
+		ratio.Notional += a.FuPosNotional(pos)
+		ratio.MaintMargin += pos.MaintMargin
+	}
+
+	if ratio.Notional > 0 {
+		ratio.InitialRatio = ratio.Margin / ratio.Notional
+	}
+	if ratio.MaintMargin > 0 {
+		ratio.MaintRatio = ratio.Margin / ratio.MaintMargin
+	}
 
 	return
 }
 
+// MarginRatio returns margin / mark price notional
+// If return 0, totalPos = 0
+func (a *Account) MarginRatio() (ratio, margin, totalPos float64) {
+	r := a.FuMarginRatio()
+	return r.InitialRatio, r.Margin, r.Notional
+}
+
 func QueryAccount(user *bnc.User) (resp *resty.Response, acct *Account, err cex.RequestError) {
 	resp, spot, err := user.SpotAccount()
 	if err.IsNotNil() {
@@ -109,28 +228,75 @@ func QueryAccount(user *bnc.User) (resp *resty.Response, acct *Account, err cex.
 	if err.IsNotNil() {
 		return
 	}
-	return resp, &Account{
+
+	// cm futures and mark prices are best-effort,
+	// loan and um risk handlers still work without them.
+	var partialErrs []error
+	_, cmFutures, cmErr := QueryCMFuturesAccount(user)
+	if cmErr.IsNotNil() {
+		partialErrs = append(partialErrs, fmt.Errorf("query cm futures account: %w", cmErr.Err))
+	}
+	markPrices := map[string]float64{}
+	if rates, _err := bnc.QueryFundingRates(); _err != nil {
+		partialErrs = append(partialErrs, fmt.Errorf("query um mark prices: %w", _err))
+	} else {
+		for _, rate := range rates {
+			markPrices[rate.Symbol] = rate.MarkPrice
+		}
+	}
+	var cmPairs map[string]cex.Pair
+	if len(cmFutures.Positions) > 0 {
+		if cmPrices, _err := QueryCMMarkPrices(); _err != nil {
+			partialErrs = append(partialErrs, fmt.Errorf("query cm mark prices: %w", _err))
+		} else {
+			for symbol, price := range cmPrices {
+				markPrices[symbol] = price
+			}
+		}
+		var _err error
+		cmPairs, _err = cachedCMFuPairs()
+		if _err != nil {
+			partialErrs = append(partialErrs, fmt.Errorf("query cm pairs: %w", _err))
+		}
+	}
+
+	acct = &Account{
 		ApiKey:        user.Api().ApiKey,
 		Time:          time.Now().UnixMilli(),
 		Spot:          spot,
 		Futures:       futures,
+		CMFutures:     cmFutures,
 		EarnPositions: poss.Rows,
 		LoanOrders:    ords.Rows,
+		MarkPrices:    markPrices,
+		PartialErr:    errors.Join(partialErrs...),
+		cmPairs:       cmPairs,
+	}
+	acct.index()
+	return resp, acct, cex.RequestError{}
+}
 
-		spBals: slice2map(spot.Balances, func(bal bnc.SpotBalance) string {
-			return bal.Asset
-		}),
-		fuAsts: slice2map(futures.Assets, func(asset bnc.FuturesAccountAsset) string {
-			return asset.Asset
-		}),
-		fuPoss: slice2map(futures.Positions, func(pos bnc.FuturesAccountPosition) string {
-			return pos.Symbol
-		}),
-		enPoss: slice2map(poss.Rows, func(pos bnc.SimpleEarnFlexiblePosition) string {
-			return pos.Asset
-		}),
-		lnOrds: slice2map(ords.Rows, func(ord bnc.CryptoLoanFlexibleOngoingOrder) string {
-			return ord.LoanCoin + "_" + ord.CollateralCoin
-		}),
-	}, cex.RequestError{}
+// index builds indexes of account slices.
+func (a *Account) index() {
+	a.spBals = slice2map(a.Spot.Balances, func(bal bnc.SpotBalance) string {
+		return bal.Asset
+	})
+	a.fuAsts = slice2map(a.Futures.Assets, func(asset bnc.FuturesAccountAsset) string {
+		return asset.Asset
+	})
+	a.fuPoss = slice2map(a.Futures.Positions, func(pos bnc.FuturesAccountPosition) string {
+		return fuPosKey(pos.Symbol, pos.PositionSide)
+	})
+	a.cmAsts = slice2map(a.CMFutures.Assets, func(asset bnc.FuturesAccountAsset) string {
+		return asset.Asset
+	})
+	a.cmPoss = slice2map(a.CMFutures.Positions, func(pos bnc.FuturesAccountPosition) string {
+		return fuPosKey(pos.Symbol, pos.PositionSide)
+	})
+	a.enPoss = slice2map(a.EarnPositions, func(pos bnc.SimpleEarnFlexiblePosition) string {
+		return pos.Asset
+	})
+	a.lnOrds = slice2map(a.LoanOrders, func(ord bnc.CryptoLoanFlexibleOngoingOrder) string {
+		return ord.LoanCoin + "_" + ord.CollateralCoin
+	})
 }
@@ -0,0 +1,241 @@
+package frbnc
+
+import (
+	"math"
+	"slices"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+// Clone deep copies balances, positions and orders of acct,
+// other fields are shared, should not be modified.
+func (a Account) Clone() *Account {
+	a.Spot.Balances = slices.Clone(a.Spot.Balances)
+	a.Futures.Assets = slices.Clone(a.Futures.Assets)
+	a.Futures.Positions = slices.Clone(a.Futures.Positions)
+	a.CMFutures.Assets = slices.Clone(a.CMFutures.Assets)
+	a.CMFutures.Positions = slices.Clone(a.CMFutures.Positions)
+	a.EarnPositions = slices.Clone(a.EarnPositions)
+	a.LoanOrders = slices.Clone(a.LoanOrders)
+	a.index()
+	return &a
+}
+
+// WithActions returns hypothetical account after all actions succeed.
+// Fees, slippage and interest are ignored.
+func (a Account) WithActions(actions ...Action) *Account {
+	acct := a.Clone()
+	for _, action := range actions {
+		acct.applyAction(action)
+	}
+	acct.index()
+	return acct
+}
+
+func (a *Account) applyAction(action Action) {
+	switch action.Type {
+	case ActionTypeTransfer:
+		switch action.TransferType {
+		case bnc.TransferTypeMainUmfuture:
+			a.addSpotBal(action.Asset, -action.Qty)
+			a.addFuAsset(action.Asset, action.Qty)
+		case bnc.TransferTypeUmfutureMain:
+			a.addFuAsset(action.Asset, -action.Qty)
+			a.addSpotBal(action.Asset, action.Qty)
+		case bnc.TransferTypeMainCmfuture:
+			a.addSpotBal(action.Asset, -action.Qty)
+			a.addCMAsset(action.Asset, action.Qty)
+		case bnc.TransferTypeCmfutureMain:
+			a.addCMAsset(action.Asset, -action.Qty)
+			a.addSpotBal(action.Asset, action.Qty)
+		}
+	case ActionTypeAdjustLTV:
+		qty := action.Qty
+		if action.LtvDirection == bnc.LTVReduced {
+			qty = -qty
+		}
+		a.addSpotBal(action.Asset, -qty)
+		a.updateLoanOrd(action.LoanCoin, action.Asset, func(ord *bnc.CryptoLoanFlexibleOngoingOrder) {
+			coll := ord.CollateralAmount + qty
+			if coll > 0 {
+				ord.CurrentLTV *= ord.CollateralAmount / coll
+			}
+			ord.CollateralAmount = coll
+		})
+	case ActionTypeRepay:
+		a.addSpotBal(action.LoanCoin, -action.Qty)
+		a.updateLoanOrd(action.LoanCoin, action.Asset, func(ord *bnc.CryptoLoanFlexibleOngoingOrder) {
+			debt := ord.TotalDebt - action.Qty
+			if ord.TotalDebt > 0 {
+				ord.CurrentLTV *= debt / ord.TotalDebt
+			}
+			ord.TotalDebt = debt
+		})
+	case ActionTypeRepayCollateral:
+		a.updateLoanOrd(action.LoanCoin, action.Asset, func(ord *bnc.CryptoLoanFlexibleOngoingOrder) {
+			if ord.TotalDebt <= 0 || ord.CollateralAmount <= 0 || action.Price <= 0 {
+				return
+			}
+			debt := ord.TotalDebt - action.Qty
+			coll := ord.CollateralAmount - action.Qty/action.Price
+			if coll > 0 {
+				ord.CurrentLTV *= debt / ord.TotalDebt * ord.CollateralAmount / coll
+			}
+			ord.TotalDebt = debt
+			ord.CollateralAmount = coll
+		})
+	case ActionTypeVIPRepay:
+		a.addSpotBal(action.LoanCoin, -action.Qty)
+	case ActionTypeBorrow:
+		a.addSpotBal(action.Asset, -action.CollateralQty)
+		a.addSpotBal(action.LoanCoin, action.Qty)
+		a.updateLoanOrd(action.LoanCoin, action.Asset, func(ord *bnc.CryptoLoanFlexibleOngoingOrder) {
+			var collValue float64
+			if ord.CurrentLTV > 0 {
+				collValue = ord.TotalDebt / ord.CurrentLTV
+				if ord.CollateralAmount > 0 {
+					collValue *= (ord.CollateralAmount + action.CollateralQty) / ord.CollateralAmount
+				}
+			} else {
+				collValue = (ord.CollateralAmount + action.CollateralQty) * action.Price
+			}
+			ord.TotalDebt += action.Qty
+			ord.CollateralAmount += action.CollateralQty
+			if collValue > 0 {
+				ord.CurrentLTV = ord.TotalDebt / collValue
+			}
+		})
+	case ActionTypeRedeem:
+		a.addSpotBal("LD"+action.Asset, -action.Qty)
+		a.addSpotBal(action.Asset, action.Qty)
+		a.addEarnPos(action.Asset, action.ProductId, -action.Qty)
+	case ActionTypeSubscribe:
+		a.addSpotBal(action.Asset, -action.Qty)
+		a.addSpotBal("LD"+action.Asset, action.Qty)
+		a.addEarnPos(action.Asset, action.ProductId, action.Qty)
+	case ActionTypeMarketOrder:
+		qty := action.Qty
+		if action.Side == cex.OrderSideSell {
+			qty = -qty
+		}
+		switch {
+		case action.PairType == cex.PairTypeSpot:
+			a.addSpotBal(action.Asset, qty)
+			a.addSpotBal(action.Quote, -qty*action.Price)
+		case action.IsCM:
+			a.addCMPos(action.Asset+action.Quote+"_PERP", qty)
+		default:
+			a.addFuPos(action.Asset+action.Quote, qty)
+		}
+	}
+}
+
+func (a *Account) addSpotBal(asset string, qty float64) {
+	i := slices.IndexFunc(a.Spot.Balances, func(bal bnc.SpotBalance) bool { return bal.Asset == asset })
+	if i < 0 {
+		a.Spot.Balances = append(a.Spot.Balances, bnc.SpotBalance{Asset: asset})
+		i = len(a.Spot.Balances) - 1
+	}
+	a.Spot.Balances[i].Free += qty
+}
+
+func addFuturesAsset(assets []bnc.FuturesAccountAsset, asset string, qty float64) []bnc.FuturesAccountAsset {
+	i := slices.IndexFunc(assets, func(ast bnc.FuturesAccountAsset) bool { return ast.Asset == asset })
+	if i < 0 {
+		assets = append(assets, bnc.FuturesAccountAsset{Asset: asset})
+		i = len(assets) - 1
+	}
+	assets[i].WalletBalance += qty
+	assets[i].CrossWalletBalance += qty
+	assets[i].MarginBalance += qty
+	assets[i].AvailableBalance += qty
+	assets[i].MaxWithdrawAmount += qty
+	return assets
+}
+
+// addFuturesPos adds signed qty to position of symbol.
+// In hedge mode, symbol has LONG and SHORT positions,
+// buying closes SHORT first and selling closes LONG first,
+// the rest opens position of the other side.
+func addFuturesPos(poss []bnc.FuturesAccountPosition, symbol string, qty float64) []bnc.FuturesAccountPosition {
+	find := func(side bnc.FuturesPositionSide) int {
+		return slices.IndexFunc(poss, func(pos bnc.FuturesAccountPosition) bool {
+			return fuPosKey(pos.Symbol, pos.PositionSide) == fuPosKey(symbol, side)
+		})
+	}
+	add := func(side bnc.FuturesPositionSide, qty float64) {
+		i := find(side)
+		if i < 0 {
+			poss = append(poss, bnc.FuturesAccountPosition{Symbol: symbol, PositionSide: side})
+			i = len(poss) - 1
+		}
+		poss[i].SignPositionAmt += qty
+	}
+
+	long, short := find(bnc.FuturesPositionSideLong), find(bnc.FuturesPositionSideShort)
+	if long < 0 && short < 0 {
+		add(bnc.FuturesPositionSideBoth, qty)
+		return poss
+	}
+
+	var closing, opening bnc.FuturesPositionSide = bnc.FuturesPositionSideShort, bnc.FuturesPositionSideLong
+	if qty < 0 {
+		closing, opening = opening, closing
+	}
+	if i := find(closing); i >= 0 {
+		// amt of closing side has opposite sign of qty
+		closed := math.Min(math.Abs(qty), math.Abs(poss[i].SignPositionAmt))
+		if qty < 0 {
+			closed = -closed
+		}
+		poss[i].SignPositionAmt += closed
+		qty -= closed
+	}
+	if qty != 0 {
+		add(opening, qty)
+	}
+	return poss
+}
+
+func (a *Account) addFuAsset(asset string, qty float64) {
+	a.Futures.Assets = addFuturesAsset(a.Futures.Assets, asset, qty)
+	if usdChecker.isUsd(asset) {
+		a.Futures.TotalWalletBalance += qty
+		a.Futures.TotalMarginBalance += qty
+		a.Futures.AvailableBalance += qty
+		a.Futures.MaxWithdrawAmount += qty
+	}
+}
+
+func (a *Account) addCMAsset(asset string, qty float64) {
+	a.CMFutures.Assets = addFuturesAsset(a.CMFutures.Assets, asset, qty)
+}
+
+func (a *Account) addFuPos(symbol string, qty float64) {
+	a.Futures.Positions = addFuturesPos(a.Futures.Positions, symbol, qty)
+}
+
+func (a *Account) addCMPos(symbol string, qty float64) {
+	a.CMFutures.Positions = addFuturesPos(a.CMFutures.Positions, symbol, qty)
+}
+
+func (a *Account) addEarnPos(asset, productId string, qty float64) {
+	i := slices.IndexFunc(a.EarnPositions, func(pos bnc.SimpleEarnFlexiblePosition) bool { return pos.Asset == asset })
+	if i < 0 {
+		a.EarnPositions = append(a.EarnPositions, bnc.SimpleEarnFlexiblePosition{Asset: asset, ProductId: productId, CanRedeem: true})
+		i = len(a.EarnPositions) - 1
+	}
+	a.EarnPositions[i].TotalAmount += qty
+}
+
+func (a *Account) updateLoanOrd(loanCoin, collateralCoin string, update func(ord *bnc.CryptoLoanFlexibleOngoingOrder)) {
+	i := slices.IndexFunc(a.LoanOrders, func(ord bnc.CryptoLoanFlexibleOngoingOrder) bool {
+		return ord.LoanCoin == loanCoin && ord.CollateralCoin == collateralCoin
+	})
+	if i < 0 {
+		a.LoanOrders = append(a.LoanOrders, bnc.CryptoLoanFlexibleOngoingOrder{LoanCoin: loanCoin, CollateralCoin: collateralCoin})
+		i = len(a.LoanOrders) - 1
+	}
+	update(&a.LoanOrders[i])
+}
@@ -0,0 +1,130 @@
+package frbnc
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestAccountFuMarginRatio(t *testing.T) {
+	acct := &Account{
+		Futures: bnc.FuturesAccount{
+			MultiAssetsMargin: true,
+			Assets: []bnc.FuturesAccountAsset{
+				{Asset: "USDT", MarginBalance: -1000},
+				{Asset: "BNB", MarginBalance: 10},
+				{Asset: "ETH", MarginBalance: 1},
+			},
+			Positions: []bnc.FuturesAccountPosition{
+				{Symbol: "ETHUSDT", PositionSide: bnc.FuturesPositionSideShort, SignPositionAmt: -2, MaintMargin: 50, PositionInitialMargin: 1, Leverage: 1},
+				{Symbol: "ETHUSDT", PositionSide: bnc.FuturesPositionSideLong, SignPositionAmt: 1, MaintMargin: 25, PositionInitialMargin: 1, Leverage: 1},
+			},
+		},
+		MarkPrices: map[string]float64{"ETHUSDT": 3000, "BNBUSDT": 500},
+	}
+
+	ratio := acct.FuMarginRatio()
+	if ratio.Err != nil {
+		t.Fatal(ratio.Err)
+	}
+	// -1000 + 5000 * 0.95 + 3000 * 0.95
+	if math.Abs(ratio.Margin-6600) > 1e-9 {
+		t.Errorf("margin %v, want 6600", ratio.Margin)
+	}
+	if ratio.Notional != 9000 || ratio.MaintMargin != 75 {
+		t.Errorf("notional %v, maint margin %v, want 9000, 75", ratio.Notional, ratio.MaintMargin)
+	}
+	if math.Abs(ratio.MaintRatio-88) > 1e-9 {
+		t.Errorf("maint ratio %v, want 88", ratio.MaintRatio)
+	}
+}
+
+func TestAccountHedgeModePositions(t *testing.T) {
+	poss := []bnc.FuturesAccountPosition{
+		{Symbol: "ETHUSDT", PositionSide: bnc.FuturesPositionSideShort, SignPositionAmt: -2, PositionInitialMargin: 6000, Leverage: 1},
+		{Symbol: "ETHUSDT", PositionSide: bnc.FuturesPositionSideLong, SignPositionAmt: 1, PositionInitialMargin: 3300, Leverage: 1},
+	}
+	acct := &Account{
+		Futures: bnc.FuturesAccount{Positions: poss},
+		fuPoss: slice2map(poss, func(pos bnc.FuturesAccountPosition) string {
+			return fuPosKey(pos.Symbol, pos.PositionSide)
+		}),
+	}
+
+	if pos, ok := acct.FuPos("ETHUSDT", bnc.FuturesPositionSideLong); !ok || pos.SignPositionAmt != 1 {
+		t.Errorf("long pos %v, %v, want 1, true", pos.SignPositionAmt, ok)
+	}
+	if pos, ok := acct.FuPos("ETHUSDT", bnc.FuturesPositionSideShort); !ok || pos.SignPositionAmt != -2 {
+		t.Errorf("short pos %v, %v, want -2, true", pos.SignPositionAmt, ok)
+	}
+	if _, ok := acct.FuPos("ETHUSDT", bnc.FuturesPositionSideBoth); ok {
+		t.Error("both pos should not exist in hedge mode")
+	}
+	if amt := acct.FuNetPosAmt("ETHUSDT"); amt != -1 {
+		t.Errorf("net pos amt %v, want -1", amt)
+	}
+	// (6000 + 3300) / 3
+	if price, err := acct.FuMarkPrice("ETHUSDT"); err != nil || math.Abs(price-3100) > 1e-9 {
+		t.Errorf("price %v, %v, want 3100", price, err)
+	}
+}
+
+func TestAccountAddFuturesPos(t *testing.T) {
+	hedge := []bnc.FuturesAccountPosition{
+		{Symbol: "ETHUSDT", PositionSide: bnc.FuturesPositionSideLong, SignPositionAmt: 1},
+		{Symbol: "ETHUSDT", PositionSide: bnc.FuturesPositionSideShort, SignPositionAmt: -2},
+	}
+
+	tests := []struct {
+		name  string
+		poss  []bnc.FuturesAccountPosition
+		qty   float64
+		both  float64
+		long  float64
+		short float64
+	}{
+		{"one way", nil, -3, -3, 0, 0},
+		{"one way existing", []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", PositionSide: bnc.FuturesPositionSideBoth, SignPositionAmt: -2}}, 0.5, -1.5, 0, 0},
+		{"hedge buy closes short", hedge, 1.5, 0, 1, -0.5},
+		{"hedge buy opens long", hedge, 3, 0, 2, 0},
+		{"hedge sell closes long", hedge, -0.5, 0, 0.5, -2},
+		{"hedge sell opens short", hedge, -3, 0, 0, -4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[bnc.FuturesPositionSide]float64{}
+			for _, pos := range addFuturesPos(slices.Clone(tt.poss), "ETHUSDT", tt.qty) {
+				got[pos.PositionSide] += pos.SignPositionAmt
+			}
+			if got[bnc.FuturesPositionSideBoth] != tt.both || got[bnc.FuturesPositionSideLong] != tt.long || got[bnc.FuturesPositionSideShort] != tt.short {
+				t.Errorf("positions %v, want both %v, long %v, short %v", got, tt.both, tt.long, tt.short)
+			}
+		})
+	}
+}
+
+func TestAccountCachedCMFuPairs(t *testing.T) {
+	cmPairsCache.mux.Lock()
+	cmPairsCache.pairs = map[string]cex.Pair{"BTCUSD_PERP": {ContractSize: 100}}
+	cmPairsCache.time = time.Now()
+	cmPairsCache.mux.Unlock()
+	t.Cleanup(func() {
+		cmPairsCache.mux.Lock()
+		cmPairsCache.pairs = nil
+		cmPairsCache.mux.Unlock()
+	})
+
+	// cached pairs are returned without querying
+	pairs, err := cachedCMFuPairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairs["BTCUSD_PERP"].ContractSize != 100 {
+		t.Errorf("pairs %+v, want cached pairs", pairs)
+	}
+}
@@ -55,6 +55,9 @@ func (aw *AcctWatcher) update() (acct *Account, err error) {
 	if respErr.IsNotNil() {
 		return nil, respErr.Err
 	}
+	if acct.PartialErr != nil {
+		aw.logger.Warn("Account Partially Updated", "err", acct.PartialErr)
+	}
 	aw.acct = acct
 	return acct, nil
 }
@@ -0,0 +1,364 @@
+package frbnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+type ActionType string
+
+const (
+	ActionTypeTransfer    ActionType = "TRANSFER"
+	ActionTypeAdjustLTV   ActionType = "ADJUST_LTV"
+	ActionTypeRepay       ActionType = "REPAY"
+	ActionTypeBorrow      ActionType = "BORROW"
+	ActionTypeRedeem      ActionType = "REDEEM"
+	ActionTypeSubscribe   ActionType = "SUBSCRIBE"
+	ActionTypeMarketOrder ActionType = "MARKET_ORDER"
+
+	ActionTypeRepayCollateral ActionType = "REPAY_COLLATERAL"
+	ActionTypeVIPRepay        ActionType = "VIP_REPAY"
+)
+
+var ErrActionNotSupported = errors.New("action is not supported")
+
+// ActionEffect is expected change of one metric after action is done.
+type ActionEffect struct {
+	// Subject e.g. loan pair, futures account
+	Subject string
+	// Metric e.g. ltv, marginRatio
+	Metric string
+	Before float64
+	After  float64
+}
+
+// Action is one mutating exchange call planned from analyses.
+// Only fields used by Type are set.
+type Action struct {
+	Type   ActionType
+	Reason FindingCode
+
+	// Asset is transferred, redeemed or subscribed asset,
+	// collateral coin of loan actions,
+	// or base asset of market order.
+	Asset string
+	// Qty is amount of Asset,
+	// or amount of LoanCoin if Type is REPAY, REPAY_COLLATERAL, BORROW or VIP_REPAY.
+	Qty float64
+
+	// TRANSFER
+	TransferType bnc.TransferType
+
+	// ADJUST_LTV, REPAY, REPAY_COLLATERAL, BORROW, VIP_REPAY
+	LoanCoin     string
+	LtvDirection bnc.LTVAdjustDirection
+	// CollateralQty is collateral amount of BORROW
+	CollateralQty float64
+	// Price is estimated price of Asset,
+	// in Quote for MARKET_ORDER, in USDT for BORROW and REPAY_COLLATERAL.
+	// Only used by dry run.
+	Price float64
+
+	// REDEEM, SUBSCRIBE
+	ProductId string
+
+	// VIP_REPAY
+	OrderId string
+
+	// MARKET_ORDER
+	Quote    string
+	PairType cex.PairType
+	Side     cex.OrderSide
+	IsCM     bool
+
+	Effects []ActionEffect
+}
+
+func (a Action) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("type", string(a.Type)),
+		slog.String("reason", string(a.Reason)),
+		slog.String("asset", a.Asset),
+		slog.Float64("qty", a.Qty),
+	}
+	switch a.Type {
+	case ActionTypeTransfer:
+		attrs = append(attrs, slog.String("transferType", string(a.TransferType)))
+	case ActionTypeAdjustLTV:
+		attrs = append(attrs, slog.String("loanCoin", a.LoanCoin), slog.String("direction", string(a.LtvDirection)))
+	case ActionTypeRepay, ActionTypeRepayCollateral:
+		attrs = append(attrs, slog.String("loanCoin", a.LoanCoin))
+	case ActionTypeVIPRepay:
+		attrs = append(attrs, slog.String("loanCoin", a.LoanCoin), slog.String("orderId", a.OrderId))
+	case ActionTypeBorrow:
+		attrs = append(attrs, slog.String("loanCoin", a.LoanCoin), slog.Float64("collateralQty", a.CollateralQty))
+	case ActionTypeRedeem, ActionTypeSubscribe:
+		attrs = append(attrs, slog.String("productId", a.ProductId))
+	case ActionTypeMarketOrder:
+		attrs = append(attrs, slog.String("quote", a.Quote), slog.String("pairType", string(a.PairType)),
+			slog.String("side", string(a.Side)), slog.Bool("isCM", a.IsCM))
+	}
+	for _, effect := range a.Effects {
+		attrs = append(attrs, slog.Group("effect",
+			"subject", effect.Subject, "metric", effect.Metric, "before", effect.Before, "after", effect.After))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+type ActionResult struct {
+	Action Action
+	// Result is response of exchange, e.g. bnc.UniversalTransferResp, *cex.Order.
+	Result any
+	// Estimated is true if action is not sent in dry run.
+	Estimated bool
+	Err       error
+}
+
+// ActionExecutor runs planned actions one by one.
+type ActionExecutor struct {
+	user *bnc.User
+
+	// DryRun only logs actions and returns estimated results,
+	// no exchange call is sent.
+	DryRun bool
+
+	// Interval between two actions, avoid high frequency.
+	Interval time.Duration
+
+	// OrderTimeout is max time waiting for market order to be finished,
+	// 0 means waiting until order is finished.
+	OrderTimeout time.Duration
+
+	// Audit records every executed action, including dry run ones.
+	// Nil means no audit log.
+	Audit *AuditRecorder
+
+	logger *slog.Logger
+}
+
+func NewActionExecutor(user *bnc.User, logger *slog.Logger) *ActionExecutor {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+	return &ActionExecutor{
+		user:         user,
+		Interval:     time.Second * 2,
+		OrderTimeout: time.Second * 10,
+		logger:       logger,
+	}
+}
+
+// Execute runs all actions, failed action does not stop the others.
+func (e *ActionExecutor) Execute(actions []Action) (results []ActionResult) {
+	return e.executeAll(actions, false)
+}
+
+// ExecuteUntilErr runs actions until one fails,
+// used by dependent actions, e.g. two legs of a hedge.
+// Actions after the failed one are not in results.
+func (e *ActionExecutor) ExecuteUntilErr(actions []Action) (results []ActionResult) {
+	return e.executeAll(actions, true)
+}
+
+func (e *ActionExecutor) executeAll(actions []Action, stopOnErr bool) (results []ActionResult) {
+	for i, action := range actions {
+		if e.DryRun {
+			result := e.estimate(action)
+			e.logger.Info("Dry Run Action", "action", action, "estimatedResult", result)
+			res := ActionResult{Action: action, Result: result, Estimated: true}
+			e.Audit.Record(res)
+			results = append(results, res)
+			continue
+		}
+		if i > 0 {
+			time.Sleep(e.Interval)
+		}
+		e.logger.Info("Executing Action", "action", action)
+		result, err := e.execute(action)
+		if err != nil {
+			e.logger.Error("Cannot Execute Action", "action", action, "err", err)
+		} else {
+			e.logger.Info("Action Executed", "action", action, "result", result)
+		}
+		res := ActionResult{Action: action, Result: result, Err: err}
+		e.Audit.Record(res)
+		results = append(results, res)
+		if err != nil && stopOnErr {
+			break
+		}
+	}
+	return
+}
+
+func (e *ActionExecutor) execute(action Action) (result any, err error) {
+	var reqErr cex.RequestError
+	switch action.Type {
+	case ActionTypeTransfer:
+		_, result, reqErr = e.user.Transfer(action.TransferType, action.Asset, action.Qty)
+	case ActionTypeAdjustLTV:
+		_, result, reqErr = e.user.CryptoLoanFlexibleAdjustLtv(action.LoanCoin, action.Asset, action.Qty, action.LtvDirection)
+	case ActionTypeRepay:
+		_, result, reqErr = cex.Request(e.user, bnc.CryptoLoanFlexibleRepayConfig, flexibleRepayParams(action))
+	case ActionTypeRepayCollateral:
+		_, result, reqErr = CryptoLoanFlexibleRepayWithCollateral(e.user, action.LoanCoin, action.Asset, action.Qty)
+	case ActionTypeVIPRepay:
+		orderId, perr := strconv.ParseInt(action.OrderId, 10, 64)
+		if perr != nil {
+			return nil, fmt.Errorf("parse vip loan order id %q: %w", action.OrderId, perr)
+		}
+		_, result, reqErr = e.user.VIPLoanRepay(orderId, action.Qty)
+	case ActionTypeBorrow:
+		_, result, reqErr = e.user.CryptoLoanFlexibleBorrow(action.LoanCoin, action.Asset, action.Qty, action.CollateralQty)
+	case ActionTypeRedeem:
+		_, result, reqErr = e.user.SimpleEarnFlexibleRedeem(action.ProductId, false, action.Qty, bnc.SimpleEarnFlexibleRedeemDestinationSpot)
+	case ActionTypeSubscribe:
+		_, result, reqErr = SimpleEarnFlexibleSubscribe(e.user, action.ProductId, action.Qty)
+	case ActionTypeMarketOrder:
+		return e.marketOrder(action)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrActionNotSupported, action.Type)
+	}
+	if reqErr.IsNotNil() {
+		err = reqErr.Err
+	}
+	return
+}
+
+// flexibleRepayParams keeps collateral in loan,
+// so ltv goes down after repaying.
+func flexibleRepayParams(action Action) bnc.CryptoLoanFlexibleRepayParams {
+	return bnc.CryptoLoanFlexibleRepayParams{
+		LoanCoin:         action.LoanCoin,
+		CollateralCoin:   action.Asset,
+		RepayAmount:      action.Qty,
+		CollateralReturn: bnc.BigFalse,
+		FullRepayment:    bnc.BigFalse,
+	}
+}
+
+// effectAfter returns expected value of metric after action,
+// 0 if action has no effect of metric.
+func effectAfter(action Action, metric string) float64 {
+	for _, effect := range action.Effects {
+		if effect.Metric == metric {
+			return effect.After
+		}
+	}
+	return 0
+}
+
+// estimate returns result of action as if it had succeeded,
+// loan ltv is taken from effects of action.
+func (e *ActionExecutor) estimate(action Action) any {
+	ltv := effectAfter(action, "ltv")
+	switch action.Type {
+	case ActionTypeTransfer:
+		return bnc.UniversalTransferResp{}
+	case ActionTypeAdjustLTV:
+		return bnc.CryptoLoanFlexibleLoanAdjustLtvResult{
+			LoanCoin:         action.LoanCoin,
+			CollateralCoin:   action.Asset,
+			Direction:        action.LtvDirection,
+			AdjustmentAmount: action.Qty,
+			CurrentLTV:       ltv,
+		}
+	case ActionTypeRepay, ActionTypeRepayCollateral:
+		return bnc.CryptoLoanFlexibleRepayResult{
+			LoanCoin:       action.LoanCoin,
+			CollateralCoin: action.Asset,
+			CurrentLTV:     strconv.FormatFloat(ltv, 'f', -1, 64),
+			RepayStatus:    bnc.CryptoLoanFlexibleRepayRepaid,
+		}
+	case ActionTypeVIPRepay:
+		return bnc.VIPLoanRepayResult{
+			LoanCoin:    action.LoanCoin,
+			RepayAmount: action.Qty,
+			CurrentLTV:  ltv,
+			RepayStatus: bnc.VIPLoanRepayStatusRepaid,
+		}
+	case ActionTypeBorrow:
+		return bnc.CryptoLoanFlexibleBorrowResult{
+			LoanCoin:         action.LoanCoin,
+			LoanAmount:       action.Qty,
+			CollateralCoin:   action.Asset,
+			CollateralAmount: action.CollateralQty,
+			Status:           bnc.CryptoLoanFlexibleBorrowSucceeds,
+		}
+	case ActionTypeRedeem:
+		return bnc.SimpleEarnFlexibleRedeemResponse{Success: true}
+	case ActionTypeSubscribe:
+		return SimpleEarnFlexibleSubscribeResponse{Success: true}
+	case ActionTypeMarketOrder:
+		symbol := action.Asset + action.Quote
+		if action.IsCM {
+			symbol += "_PERP"
+		}
+		return &cex.Order{
+			Cex:            cex.BINANCE,
+			PairType:       action.PairType,
+			OrderType:      cex.OrderTypeMarket,
+			OrderSide:      action.Side,
+			Symbol:         symbol,
+			OriQty:         action.Qty,
+			Status:         cex.OrderStatusFilled,
+			FilledQty:      action.Qty,
+			FilledQuote:    action.Qty * action.Price,
+			FilledAvgPrice: action.Price,
+		}
+	}
+	return nil
+}
+
+func (e *ActionExecutor) marketOrder(action Action) (*cex.Order, error) {
+	var trader cex.MarketTraderFunc
+	switch {
+	case action.PairType == cex.PairTypeSpot && action.Side == cex.OrderSideBuy:
+		trader = e.user.NewSpotMarketBuyOrder
+	case action.PairType == cex.PairTypeSpot && action.Side == cex.OrderSideSell:
+		trader = e.user.NewSpotMarketSellOrder
+	case action.IsCM && action.Side == cex.OrderSideBuy:
+		trader = e.user.NewFuturesMarketBuyCMOrder
+	case action.IsCM && action.Side == cex.OrderSideSell:
+		trader = e.user.NewFuturesMarketSellCMOrder
+	case action.Side == cex.OrderSideBuy:
+		trader = e.user.NewFuturesMarketBuyOrder
+	case action.Side == cex.OrderSideSell:
+		trader = e.user.NewFuturesMarketSellOrder
+	default:
+		return nil, fmt.Errorf("%w: market order side %v", ErrActionNotSupported, action.Side)
+	}
+
+	_, ord, reqErr := trader(action.Asset, action.Quote, action.Qty)
+	if reqErr.IsNotNil() {
+		return ord, reqErr.Err
+	}
+
+	ctx := context.Background()
+	if e.OrderTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.OrderTimeout)
+		defer cancel()
+	}
+	select {
+	case reqErr = <-e.user.WaitOrder(ctx, ord):
+	case <-ctx.Done():
+		return ord, fmt.Errorf("wait market order: %w", ctx.Err())
+	}
+	if reqErr.IsNotNil() {
+		return ord, reqErr.Err
+	}
+
+	if !ord.IsFinished() {
+		return ord, errors.New("market order is not finished")
+	}
+
+	return ord, nil
+}
@@ -0,0 +1,119 @@
+package frbnc
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanReleaseActions(t *testing.T) {
+	acct := &Account{
+		Futures: bnc.FuturesAccount{
+			TotalMarginBalance: 10000,
+			Assets:             []bnc.FuturesAccountAsset{{Asset: "USDT", MarginBalance: 10000, MaxWithdrawAmount: 5000}},
+			Positions:          []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -10, MaintMargin: 100}},
+		},
+		MarkPrices: map[string]float64{"ETHUSDT": 2000},
+		lnOrds: map[string]bnc.CryptoLoanFlexibleOngoingOrder{
+			"USDT_BTC": {LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 100, CollateralAmount: 1, CurrentLTV: 0.3},
+		},
+	}
+
+	cfg := DefaultAllocationConfig()
+	actions := append(planLoanReleaseActions(acct, cfg), planFuReleaseActions(acct, cfg)...)
+	if len(actions) != 2 {
+		t.Fatalf("actions len %v, want 2", len(actions))
+	}
+
+	adj := actions[0]
+	if adj.Type != ActionTypeAdjustLTV || adj.LtvDirection != bnc.LTVReduced || adj.Asset != "BTC" || adj.Qty != 0.5 {
+		t.Errorf("adjust ltv action %+v, want reduce 0.5 BTC", adj)
+	}
+
+	tran := actions[1]
+	if tran.Type != ActionTypeTransfer || tran.TransferType != bnc.TransferTypeUmfutureMain || tran.Asset != "USDT" || tran.Qty != 3960 {
+		t.Errorf("transfer action %+v, want 3960 USDT from um futures", tran)
+	}
+	if len(tran.Effects) != 1 || math.Abs(tran.Effects[0].After-0.302) > 1e-9 {
+		t.Errorf("transfer effects %+v, want margin ratio 0.302", tran.Effects)
+	}
+}
+
+func TestActionExecutorDryRun(t *testing.T) {
+	acct := &Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "USDT", Free: 100}}},
+		Futures: bnc.FuturesAccount{
+			TotalMarginBalance: 10000,
+			Assets:             []bnc.FuturesAccountAsset{{Asset: "USDT", MarginBalance: 10000, MaxWithdrawAmount: 5000}},
+			Positions:          []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -10, MaintMargin: 100}},
+		},
+		LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+			{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 100, CollateralAmount: 1, CurrentLTV: 0.3},
+		},
+		MarkPrices: map[string]float64{"ETHUSDT": 2000},
+	}
+	acct = acct.Clone()
+
+	cfg := DefaultAllocationConfig()
+	actions := append(planLoanReleaseActions(acct, cfg), planFuReleaseActions(acct, cfg)...)
+	executor := &ActionExecutor{DryRun: true, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	for _, res := range executor.Execute(actions) {
+		if !res.Estimated || res.Err != nil {
+			t.Errorf("dry run result %+v, want estimated without error", res)
+		}
+	}
+
+	simAcct := acct.WithActions(actions...)
+	if bal, _ := simAcct.SpotBal("USDT"); bal.Free != 4060 {
+		t.Errorf("spot USDT %v, want 4060", bal.Free)
+	}
+	if bal, _ := simAcct.SpotBal("BTC"); bal.Free != 0.5 {
+		t.Errorf("spot BTC %v, want 0.5", bal.Free)
+	}
+	if ord, _ := simAcct.LoanOrd("USDT_BTC"); math.Abs(ord.CurrentLTV-0.6) > 1e-9 {
+		t.Errorf("ltv %v, want 0.6", ord.CurrentLTV)
+	}
+	if ratio := simAcct.FuMarginRatio(); math.Abs(ratio.InitialRatio-0.302) > 1e-9 {
+		t.Errorf("margin ratio %v, want 0.302", ratio.InitialRatio)
+	}
+	if bal, _ := acct.SpotBal("USDT"); bal.Free != 100 {
+		t.Errorf("original spot USDT is modified, %v", bal.Free)
+	}
+}
+
+func TestActionExecutorEstimate(t *testing.T) {
+	executor := &ActionExecutor{DryRun: true, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	effects := []ActionEffect{{Subject: "USDT_BTC", Metric: "ltv", Before: 0.8, After: 0.6}}
+	for _, typ := range []ActionType{
+		ActionTypeTransfer, ActionTypeAdjustLTV, ActionTypeRepay, ActionTypeBorrow, ActionTypeRedeem,
+		ActionTypeSubscribe, ActionTypeMarketOrder, ActionTypeRepayCollateral, ActionTypeVIPRepay,
+	} {
+		action := Action{Type: typ, Asset: "BTC", LoanCoin: "USDT", Qty: 1, Quote: "USDT", Effects: effects}
+		res := executor.Execute([]Action{action})
+		if len(res) != 1 || res[0].Result == nil {
+			t.Errorf("%v estimated result is nil", typ)
+		}
+	}
+
+	res := executor.estimate(Action{Type: ActionTypeAdjustLTV, LoanCoin: "USDT", Asset: "BTC", Qty: 1, Effects: effects})
+	if adj, ok := res.(bnc.CryptoLoanFlexibleLoanAdjustLtvResult); !ok || adj.CurrentLTV != 0.6 || adj.AdjustmentAmount != 1 {
+		t.Errorf("adjust ltv estimate %+v, want ltv 0.6 and amount 1", res)
+	}
+}
+
+func TestFlexibleRepayParams(t *testing.T) {
+	params := flexibleRepayParams(Action{Type: ActionTypeRepay, LoanCoin: "USDT", Asset: "BTC", Qty: 100})
+	want := bnc.CryptoLoanFlexibleRepayParams{
+		LoanCoin:         "USDT",
+		CollateralCoin:   "BTC",
+		RepayAmount:      100,
+		CollateralReturn: bnc.BigFalse,
+		FullRepayment:    bnc.BigFalse,
+	}
+	if params != want {
+		t.Errorf("repay params %+v, want %+v", params, want)
+	}
+}
@@ -9,6 +9,18 @@ import (
 	"github.com/dwdwow/mathy"
 )
 
+const (
+	minAnalysisLoanDebt   = 10.0
+	minLoanAdditionalUsdt = 10.0
+
+	minFuturesUsdtWalletBalance = -5000.0
+	minFuturesMarginDemand      = 1.0
+
+	// ratio = margin / maintMargin, liquidated at 1
+	minFuturesAccountMaintRatio    = 3.0
+	middleFuturesAccountMaintRatio = 4.0
+)
+
 type RiskyLoanDemand struct {
 	Order            bnc.CryptoLoanFlexibleOngoingOrder
 	TargetLtv        float64
@@ -17,22 +29,51 @@ type RiskyLoanDemand struct {
 	AdditionalUsd    float64
 }
 
-func AnalyzeLoan(acct *Account, ord bnc.CryptoLoanFlexibleOngoingOrder) (demand RiskyLoanDemand, risky bool) {
+func AnalyzeLoan(acct *Account, ord bnc.CryptoLoanFlexibleOngoingOrder) (demand RiskyLoanDemand, risky bool, finding Finding) {
+	finding = Finding{
+		Subject: ord.LoanCoin + "_" + ord.CollateralCoin,
+		Inputs: map[string]float64{
+			"currentLtv":       ord.CurrentLTV,
+			"totalDebt":        ord.TotalDebt,
+			"collateralAmount": ord.CollateralAmount,
+		},
+	}
+
+	skip := func(code FindingCode, severity FindingSeverity, thresholds map[string]float64) {
+		finding.Code = code
+		finding.Severity = severity
+		finding.Skipped = true
+		finding.Thresholds = thresholds
+	}
+
 	switch {
-	case ord.LoanCoin != "USDT", ord.CurrentLTV <= 0, ord.TotalDebt < 10:
+	case ord.LoanCoin != "USDT":
+		skip(FindingLoanCoinNotUsdt, FindingSeverityInfo, nil)
+		return
+	case ord.CurrentLTV <= 0:
+		skip(FindingLoanLtvNotPositive, FindingSeverityWarn, nil)
+		return
+	case ord.TotalDebt < minAnalysisLoanDebt:
+		skip(FindingLoanDebtTooSmall, FindingSeverityInfo, map[string]float64{"minDebt": minAnalysisLoanDebt})
 		return
 	}
 
 	currtLtv := ord.CurrentLTV
 	quality := qualityCollts[ord.CollateralCoin]
-	high := (quality && currtLtv > maxQualityCollateralLtv) || (!quality && currtLtv > maxSubordinateCollateralLtv)
-	if !high {
-		return
-	}
+	maxLtv := maxSubordinateCollateralLtv
 	targetLtv := middleSubordinateCollateralLtv
 	if quality {
+		maxLtv = maxQualityCollateralLtv
 		targetLtv = middleQualityCollateralLtv
 	}
+	finding.Thresholds = map[string]float64{"maxLtv": maxLtv, "targetLtv": targetLtv}
+
+	if currtLtv <= maxLtv {
+		finding.Code = FindingLoanLtvNormal
+		finding.Severity = FindingSeverityInfo
+		return
+	}
+
 	collDemand := ord.CollateralAmount * (currtLtv/targetLtv - 1)
 
 	coll := ord.CollateralCoin
@@ -45,14 +86,24 @@ func AnalyzeLoan(acct *Account, ord bnc.CryptoLoanFlexibleOngoingOrder) (demand
 	pColl := ord.TotalDebt / currtLtv / ord.CollateralAmount
 	addUsdt := ord.TotalDebt - (ord.CollateralAmount+addColl)*pColl*targetLtv
 
-	if addUsdt < 10 {
+	if addUsdt < minLoanAdditionalUsdt {
 		addUsdt = 0
 	}
 
+	finding.Inputs["spotCollateral"] = sp
+	finding.Inputs["collateralDemand"] = collDemand
+	finding.Inputs["additionalCollateral"] = addColl
+	finding.Inputs["additionalUsdt"] = addUsdt
+	finding.Thresholds["minAdditionalUsdt"] = minLoanAdditionalUsdt
+
 	if addColl == 0 && addUsdt == 0 {
+		skip(FindingLoanNoActionPossible, FindingSeverityWarn, finding.Thresholds)
 		return
 	}
 
+	finding.Code = FindingLoanLtvHigh
+	finding.Severity = FindingSeverityCritical
+
 	demand = RiskyLoanDemand{
 		Order:            ord,
 		TargetLtv:        targetLtv,
@@ -61,29 +112,33 @@ func AnalyzeLoan(acct *Account, ord bnc.CryptoLoanFlexibleOngoingOrder) (demand
 		AdditionalUsd:    addUsdt,
 	}
 
-	return demand, true
+	return demand, true, finding
 }
 
 type LoansAnalysis struct {
-	Demands []RiskyLoanDemand
-	Risky   bool
-	Err     error
+	Demands  []RiskyLoanDemand
+	Risky    bool
+	Findings []Finding
+	Err      error
 }
 
 func AnalyzeRiskyLoans(acct *Account) LoansAnalysis {
 	var demands []RiskyLoanDemand
+	var findings []Finding
 	for _, ord := range acct.LoanOrders {
-		result, risky := AnalyzeLoan(acct, ord)
+		result, risky, finding := AnalyzeLoan(acct, ord)
+		findings = append(findings, finding)
 		if risky {
 			demands = append(demands, result)
 		}
 	}
-	return LoansAnalysis{demands, len(demands) > 0, nil}
+	return LoansAnalysis{demands, len(demands) > 0, findings, nil}
 }
 
 type FuturesUsdtAnalysis struct {
 	WalletBalance float64
 	Risky         bool
+	Findings      []Finding
 	Err           error
 }
 
@@ -91,11 +146,28 @@ func AnalyzeFuturesUsdt(acct *Account) (analysis FuturesUsdtAnalysis) {
 	usdt, ok := acct.FuAsset("USDT")
 	if !ok {
 		analysis.Err = errors.New("can not get usdt futures wallet balance")
+		analysis.Findings = append(analysis.Findings, Finding{
+			Code:     FindingFuUsdtMissing,
+			Severity: FindingSeverityWarn,
+			Subject:  "USDT",
+			Skipped:  true,
+		})
 		return
 	}
-	if usdt.WalletBalance > -5000 {
+	finding := Finding{
+		Subject:    "USDT",
+		Thresholds: map[string]float64{"minWalletBalance": minFuturesUsdtWalletBalance},
+		Inputs:     map[string]float64{"walletBalance": usdt.WalletBalance},
+	}
+	if usdt.WalletBalance > minFuturesUsdtWalletBalance {
+		finding.Code = FindingFuUsdtWalletNormal
+		finding.Severity = FindingSeverityInfo
+		analysis.Findings = append(analysis.Findings, finding)
 		return
 	}
+	finding.Code = FindingFuUsdtWalletNegative
+	finding.Severity = FindingSeverityCritical
+	analysis.Findings = append(analysis.Findings, finding)
 	analysis.WalletBalance = usdt.WalletBalance
 	analysis.Risky = true
 	return
@@ -109,18 +181,28 @@ type MarginableSpotBal struct {
 	Err             error
 }
 
-func AnalyzeMarginableSpotBals(acct *Account) (bals []MarginableSpotBal) {
+func AnalyzeMarginableSpotBals(acct *Account) (bals []MarginableSpotBal, findings []Finding) {
 	for _, coin := range validMarginCoins {
 		bal, ok := acct.SpotBal(coin.Coin)
-		if !ok {
+		if !ok || bal.Free <= 0 {
+			findings = append(findings, Finding{
+				Code:     FindingFuMarginableSpotEmpty,
+				Severity: FindingSeverityInfo,
+				Subject:  coin.Coin,
+				Skipped:  true,
+				Inputs:   map[string]float64{"free": bal.Free},
+			})
 			continue
 		}
-		if bal.Free <= 0 {
-			continue
+		price, err := acct.FuMarkPrice(coin.Coin + "USDT")
+		if err != nil {
+			findings = append(findings, Finding{
+				Code:     FindingFuMarginablePriceErr,
+				Severity: FindingSeverityWarn,
+				Subject:  coin.Coin,
+				Inputs:   map[string]float64{"free": bal.Free},
+			})
 		}
-		symbol := coin.Coin + "USDT"
-		fuPos, _ := acct.FuPos(symbol)
-		price, err := fuPrice(fuPos)
 		bals = append(bals, MarginableSpotBal{
 			Coin:            coin,
 			Qty:             bal.Free,
@@ -137,51 +219,175 @@ func AnalyzeMarginableSpotBals(acct *Account) (bals []MarginableSpotBal) {
 
 type FuturesMarginAnalysis struct {
 	CurrentMargin             float64
-	CurrentTotalPos           float64
-	CurrentMarginRatio        float64
+	CurrentTotalPos           float64 // mark price notional
+	CurrentMaintMargin        float64
+	CurrentMarginRatio        float64 // margin / notional
+	CurrentMaintRatio         float64 // margin / maint margin
 	TargetMarginRatio         float64
+	TargetMaintRatio          float64
 	MarginRemand              float64
 	MarginableSpotBals        []MarginableSpotBal
 	TotalMarginableSpotsValue float64
 	Risky                     bool
+	Findings                  []Finding
 }
 
 func AnalyzeMarginFutures(acct *Account) (analysis FuturesMarginAnalysis) {
-	ratio, margin, totalPos := acct.MarginRatio()
+	marginRatio := acct.FuMarginRatio()
+	ratio, margin, totalPos := marginRatio.InitialRatio, marginRatio.Margin, marginRatio.Notional
+	maintRatio, maintMargin := marginRatio.MaintRatio, marginRatio.MaintMargin
 
 	analysis.CurrentMargin = margin
 	analysis.CurrentTotalPos = totalPos
+	analysis.CurrentMaintMargin = maintMargin
 	analysis.CurrentMarginRatio = ratio
+	analysis.CurrentMaintRatio = maintRatio
+
+	finding := Finding{
+		Subject: "FUTURES",
+		Thresholds: map[string]float64{
+			"minMarginRatio":    minFuturesAccountMarginRatio,
+			"targetMarginRatio": middleFuturesAccountMarginRatio,
+			"minMaintRatio":     minFuturesAccountMaintRatio,
+			"targetMaintRatio":  middleFuturesAccountMaintRatio,
+		},
+		Inputs: map[string]float64{
+			"marginRatio": ratio,
+			"maintRatio":  maintRatio,
+			"margin":      margin,
+			"totalPos":    totalPos,
+			"maintMargin": maintMargin,
+		},
+	}
+	defer func() {
+		analysis.Findings = append([]Finding{finding}, analysis.Findings...)
+	}()
+
+	if totalPos <= 0 {
+		finding.Code = FindingFuNoPosition
+		finding.Severity = FindingSeverityInfo
+		finding.Skipped = true
+		return
+	}
+
+	maintLow := maintMargin > 0 && maintRatio < minFuturesAccountMaintRatio
 
-	if ratio > minFuturesAccountMarginRatio {
+	if ratio > minFuturesAccountMarginRatio && !maintLow {
+		finding.Code = FindingFuMarginRatioNormal
+		finding.Severity = FindingSeverityInfo
 		return
 	}
 
 	analysis.TargetMarginRatio = middleFuturesAccountMarginRatio
+	analysis.TargetMaintRatio = middleFuturesAccountMaintRatio
 
-	marginRemand := (middleFuturesAccountMarginRatio - ratio) * totalPos
+	marginRemand := math.Max(
+		(middleFuturesAccountMarginRatio-ratio)*totalPos,
+		middleFuturesAccountMaintRatio*maintMargin-margin,
+	)
 
 	analysis.MarginRemand = marginRemand
 
-	if marginRemand <= 1 {
+	finding.Inputs["marginDemand"] = marginRemand
+	finding.Thresholds["minMarginDemand"] = minFuturesMarginDemand
+
+	if marginRemand <= minFuturesMarginDemand {
+		finding.Code = FindingFuMarginDemandTooLow
+		finding.Severity = FindingSeverityWarn
+		finding.Skipped = true
 		return
 	}
 
 	analysis.Risky = true
 
-	marginableSpotBals := AnalyzeMarginableSpotBals(acct)
+	marginableSpotBals, findings := AnalyzeMarginableSpotBals(acct)
 	analysis.MarginableSpotBals = marginableSpotBals
+	analysis.Findings = findings
 
 	for _, bal := range marginableSpotBals {
 		analysis.TotalMarginableSpotsValue += bal.MarginAvailable
 	}
 
+	finding.Code = FindingFuMarginRatioLow
+	finding.Severity = FindingSeverityCritical
+	finding.Inputs["marginableSpotValue"] = analysis.TotalMarginableSpotsValue
+
+	return
+}
+
+type CMFuturesMarginDemand struct {
+	Ratio CMFuturesMarginRatio
+	// MarginRemand is USDT value,
+	// should be added as Ratio.Asset to cm account.
+	MarginRemand float64
+}
+
+type CMFuturesMarginAnalysis struct {
+	Ratios   []CMFuturesMarginRatio
+	Demands  []CMFuturesMarginDemand
+	Risky    bool
+	Findings []Finding
+}
+
+func AnalyzeMarginCMFutures(acct *Account) (analysis CMFuturesMarginAnalysis) {
+	analysis.Ratios = acct.CMFuMarginRatios()
+	for _, ratio := range analysis.Ratios {
+		finding := Finding{
+			Code:     FindingCMMarginRatioNormal,
+			Severity: FindingSeverityInfo,
+			Subject:  ratio.Asset,
+			Thresholds: map[string]float64{
+				"minMarginRatio":    minFuturesAccountMarginRatio,
+				"targetMarginRatio": middleFuturesAccountMarginRatio,
+				"minMaintRatio":     minFuturesAccountMaintRatio,
+				"targetMaintRatio":  middleFuturesAccountMaintRatio,
+			},
+			Inputs: map[string]float64{
+				"marginRatio": ratio.InitialRatio,
+				"maintRatio":  ratio.MaintRatio,
+				"margin":      ratio.Margin,
+				"notional":    ratio.Notional,
+				"maintMargin": ratio.MaintMargin,
+			},
+		}
+		if ratio.Err != nil {
+			finding.Code = FindingCMMarginErr
+			finding.Severity = FindingSeverityWarn
+			finding.Skipped = true
+			analysis.Findings = append(analysis.Findings, finding)
+			continue
+		}
+		maintLow := ratio.MaintMargin > 0 && ratio.MaintRatio < minFuturesAccountMaintRatio
+		if ratio.InitialRatio > minFuturesAccountMarginRatio && !maintLow {
+			analysis.Findings = append(analysis.Findings, finding)
+			continue
+		}
+		demand := math.Max(
+			(middleFuturesAccountMarginRatio-ratio.InitialRatio)*ratio.Notional,
+			middleFuturesAccountMaintRatio*ratio.MaintMargin-ratio.Margin,
+		)
+		finding.Inputs["marginDemand"] = demand
+		finding.Thresholds["minMarginDemand"] = minFuturesMarginDemand
+		if demand <= minFuturesMarginDemand {
+			finding.Code = FindingFuMarginDemandTooLow
+			finding.Severity = FindingSeverityWarn
+			finding.Skipped = true
+			analysis.Findings = append(analysis.Findings, finding)
+			continue
+		}
+		finding.Code = FindingCMMarginRatioLow
+		finding.Severity = FindingSeverityCritical
+		analysis.Findings = append(analysis.Findings, finding)
+		analysis.Demands = append(analysis.Demands, CMFuturesMarginDemand{Ratio: ratio, MarginRemand: demand})
+		analysis.Risky = true
+	}
 	return
 }
 
 type FuturesAnalysis struct {
 	USDT   FuturesUsdtAnalysis
 	Margin FuturesMarginAnalysis
+	CM     CMFuturesMarginAnalysis
 	Risky  bool
 	Err    error
 }
@@ -189,19 +395,41 @@ type FuturesAnalysis struct {
 func AnalyzeFutures(acct *Account) (analysis FuturesAnalysis) {
 	usdt := AnalyzeFuturesUsdt(acct)
 	margin := AnalyzeMarginFutures(acct)
+	cm := AnalyzeMarginCMFutures(acct)
 	analysis.USDT = usdt
 	analysis.Margin = margin
-	analysis.Risky = usdt.Risky || margin.Risky
+	analysis.CM = cm
+	analysis.Risky = usdt.Risky || margin.Risky || cm.Risky
 	return
 }
 
+func (a FuturesAnalysis) Findings() []Finding {
+	var findings []Finding
+	findings = append(findings, a.USDT.Findings...)
+	findings = append(findings, a.Margin.Findings...)
+	findings = append(findings, a.CM.Findings...)
+	return findings
+}
+
 type AccountAnalysis struct {
 	Loans   LoansAnalysis
 	Futures FuturesAnalysis
+	Hedges  HedgeAnalysis
 }
 
 func AnalyzeAccount(acct *Account) (analysis AccountAnalysis) {
 	analysis.Loans = AnalyzeRiskyLoans(acct)
 	analysis.Futures = AnalyzeFutures(acct)
+	analysis.Hedges = AnalyzeHedges(acct)
 	return
 }
+
+// Findings returns all findings of analysis,
+// so every decision can be audited.
+func (a AccountAnalysis) Findings() []Finding {
+	var findings []Finding
+	findings = append(findings, a.Loans.Findings...)
+	findings = append(findings, a.Futures.Findings()...)
+	findings = append(findings, a.Hedges.Findings...)
+	return findings
+}
@@ -0,0 +1,92 @@
+package frbnc
+
+import (
+	"testing"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestAnalyzeLoanFinding(t *testing.T) {
+	acct := &Account{
+		spBals: map[string]bnc.SpotBalance{"BTC": {Asset: "BTC", Free: 1}},
+	}
+	tests := []struct {
+		name    string
+		ord     bnc.CryptoLoanFlexibleOngoingOrder
+		risky   bool
+		code    FindingCode
+		skipped bool
+	}{
+		{"Not USDT", bnc.CryptoLoanFlexibleOngoingOrder{LoanCoin: "USDC", CollateralCoin: "BTC", TotalDebt: 100, CurrentLTV: 0.7}, false, FindingLoanCoinNotUsdt, true},
+		{"Zero LTV", bnc.CryptoLoanFlexibleOngoingOrder{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 100}, false, FindingLoanLtvNotPositive, true},
+		{"Small Debt", bnc.CryptoLoanFlexibleOngoingOrder{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 5, CurrentLTV: 0.7}, false, FindingLoanDebtTooSmall, true},
+		{"Normal", bnc.CryptoLoanFlexibleOngoingOrder{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 100, CollateralAmount: 1, CurrentLTV: 0.6}, false, FindingLoanLtvNormal, false},
+		{"High", bnc.CryptoLoanFlexibleOngoingOrder{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 700, CollateralAmount: 1, CurrentLTV: 0.7}, true, FindingLoanLtvHigh, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, risky, finding := AnalyzeLoan(acct, tt.ord)
+			if risky != tt.risky || finding.Code != tt.code || finding.Skipped != tt.skipped {
+				t.Errorf("AnalyzeLoan() = %v, %v, %v, want %v, %v, %v", risky, finding.Code, finding.Skipped, tt.risky, tt.code, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestAnalyzeHedgesCM(t *testing.T) {
+	acct := &Account{
+		CMFutures: CMFuturesAccount{
+			Positions: []bnc.FuturesAccountPosition{{Symbol: "BTCUSD_PERP", SignPositionAmt: -500}},
+		},
+		MarkPrices: map[string]float64{"BTCUSD_PERP": 50000, "BTCUSDT": 50000},
+		spBals:     map[string]bnc.SpotBalance{"BTC": {Asset: "BTC", Free: 0.5}},
+		cmAsts:     map[string]bnc.FuturesAccountAsset{"BTC": {Asset: "BTC", WalletBalance: 1}},
+		cmPairs:    map[string]cex.Pair{"BTCUSD_PERP": {Asset: "BTC", ContractSize: 100}},
+	}
+	analysis := AnalyzeHedges(acct)
+	if len(analysis.Mismatches) != 1 {
+		t.Fatalf("mismatches %v, want 1", len(analysis.Mismatches))
+	}
+	m := analysis.Mismatches[0]
+	if m.Coin != "BTC" || m.SpotQty != 1.5 || m.FuShortQty != 1 || m.Residual != 0.5 {
+		t.Errorf("mismatch %v %v %v %v, want BTC 1.5 1 0.5", m.Coin, m.SpotQty, m.FuShortQty, m.Residual)
+	}
+	if len(m.Repairs) != 1 || !m.Repairs[0].IsCM || m.Repairs[0].Qty != 250 || m.Repairs[0].Side != cex.OrderSideSell {
+		t.Errorf("repairs %+v, want sell 250 BTCUSD_PERP contracts", m.Repairs)
+	}
+}
+
+func TestAnalyzeHedgesSpotOnly(t *testing.T) {
+	acct := &Account{
+		Futures: bnc.FuturesAccount{
+			Positions: []bnc.FuturesAccountPosition{{Symbol: "BTCUSDT", SignPositionAmt: -1}},
+		},
+		MarkPrices: map[string]float64{"BTCUSDT": 50000, "ETHUSDT": 2000},
+		spBals: map[string]bnc.SpotBalance{
+			"BTC":   {Asset: "BTC", Free: 1},
+			"LDETH": {Asset: "LDETH", Free: 2},
+			"USDT":  {Asset: "USDT", Free: 1000},
+		},
+		enPoss: map[string]bnc.SimpleEarnFlexiblePosition{"ETH": {Asset: "ETH"}},
+	}
+	analysis := AnalyzeHedges(acct)
+	if len(analysis.Mismatches) != 1 {
+		t.Fatalf("mismatches %+v, want only ETH", analysis.Mismatches)
+	}
+	m := analysis.Mismatches[0]
+	if m.Coin != "ETH" || m.SpotQty != 2 || m.FuShortQty != 0 || m.ResidualValue != 4000 || len(m.Repairs) != 0 {
+		t.Errorf("mismatch %+v, want unhedged 2 ETH without repairs", m)
+	}
+	if !analysis.Unhedged {
+		t.Error("spot only ETH should be unhedged")
+	}
+
+	codes := map[string]FindingCode{}
+	for _, f := range analysis.Findings {
+		codes[f.Subject] = f.Code
+	}
+	if codes["BTC"] != FindingHedgeBalanced || codes["ETH"] != FindingHedgeResidual {
+		t.Errorf("finding codes %v, want BTC balanced and ETH residual", codes)
+	}
+}
@@ -0,0 +1,328 @@
+package frbnc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dwdwow/cex"
+)
+
+type AuditEntryKind string
+
+const (
+	AuditEntryKindAction   AuditEntryKind = "ACTION"
+	AuditEntryKindSnapshot AuditEntryKind = "SNAPSHOT"
+)
+
+// AuditEntry is one line of audit log.
+// ACTION entry is one mutating exchange call,
+// SNAPSHOT entry is account seen before or after actions of a decision cycle.
+type AuditEntry struct {
+	Kind    AuditEntryKind `json:"kind"`
+	Time    time.Time      `json:"time"`
+	Account string         `json:"account"`
+	// CorrelationId is same for all entries of one decision cycle.
+	CorrelationId string `json:"correlationId"`
+
+	// ACTION
+	Action Action `json:"action"`
+	// Result is exchange response, e.g. bnc.UniversalTransferResp, cex.Order.
+	Result json.RawMessage `json:"result,omitempty"`
+	Err    string          `json:"err,omitempty"`
+	// Estimated is true if action is not sent in dry run.
+	Estimated        bool   `json:"estimated,omitempty"`
+	BeforeSnapshotId string `json:"beforeSnapshotId,omitempty"`
+	// AfterSnapshotId is not written with action,
+	// it is filled by Query from the next snapshot of the same cycle.
+	AfterSnapshotId string `json:"afterSnapshotId,omitempty"`
+
+	// SNAPSHOT
+	SnapshotId string          `json:"snapshotId,omitempty"`
+	Snapshot   json.RawMessage `json:"snapshot,omitempty"`
+}
+
+// AuditQuery filters action entries, zero field matches all.
+type AuditQuery struct {
+	Account string
+	// From is inclusive, To is exclusive.
+	From  time.Time
+	To    time.Time
+	Types []ActionType
+}
+
+func (q AuditQuery) match(entry AuditEntry) bool {
+	if q.Account != "" && entry.Account != q.Account {
+		return false
+	}
+	if !q.From.IsZero() && entry.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !entry.Time.Before(q.To) {
+		return false
+	}
+	if len(q.Types) > 0 && !slices.Contains(q.Types, entry.Action.Type) {
+		return false
+	}
+	return true
+}
+
+// AuditLog is append-only json lines file,
+// every entry is synced to disk before Append returns.
+type AuditLog struct {
+	mux  sync.Mutex
+	path string
+	file *os.File
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+func (l *AuditLog) Append(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, err := l.file.Write(data); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Query returns action entries matching q, in written order.
+func (l *AuditLog) Query(q AuditQuery) (entries []AuditEntry, err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var actions []AuditEntry
+	// waiting is indices of actions without after snapshot, key is correlation id
+	waiting := map[string][]int{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("audit log line %v: %w", line, err)
+		}
+		switch entry.Kind {
+		case AuditEntryKindAction:
+			waiting[entry.CorrelationId] = append(waiting[entry.CorrelationId], len(actions))
+			actions = append(actions, entry)
+		case AuditEntryKindSnapshot:
+			for _, i := range waiting[entry.CorrelationId] {
+				actions[i].AfterSnapshotId = entry.SnapshotId
+			}
+			delete(waiting, entry.CorrelationId)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range actions {
+		if q.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+func (l *AuditLog) Close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.file.Close()
+}
+
+// SnapshotId returns content id of account snapshot,
+// same snapshot always has same id.
+func SnapshotId(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newRandomId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AuditRecorder writes actions of one decision cycle of one account to audit log,
+// tracking account snapshots of the cycle.
+// Begin returns recorder of a new cycle with its own correlation id,
+// so cycles running at the same time are not mixed up.
+// Snapshot is only written if actions are recorded after or before it,
+// so cycles without actions leave nothing in audit log.
+// All methods of nil recorder do nothing.
+type AuditRecorder struct {
+	log     *AuditLog
+	account string
+
+	mux           sync.Mutex
+	correlationId string
+	snapshotId    string
+	snapshot      json.RawMessage
+	// written is true if current snapshot is in audit log
+	written bool
+	// dirty is true if actions are recorded after current snapshot
+	dirty bool
+
+	logger *slog.Logger
+}
+
+func NewAuditRecorder(log *AuditLog, account string, logger *slog.Logger) *AuditRecorder {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+	return &AuditRecorder{
+		log:     log,
+		account: account,
+		logger:  logger,
+	}
+}
+
+// Begin returns recorder of a new decision cycle from acct, acct can be nil.
+func (r *AuditRecorder) Begin(acct any) *AuditRecorder {
+	if r == nil {
+		return nil
+	}
+	cycle := NewAuditRecorder(r.log, r.account, r.logger)
+	cycle.correlationId = newRandomId()
+	cycle.setSnapshot(acct)
+	return cycle
+}
+
+// Snapshot records acct refreshed after actions of current cycle.
+func (r *AuditRecorder) Snapshot(acct any) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.setSnapshot(acct)
+	if r.dirty {
+		r.writeSnapshot()
+		r.dirty = false
+	}
+}
+
+func (r *AuditRecorder) setSnapshot(acct any) {
+	r.snapshotId, r.snapshot, r.written = "", nil, false
+	if acct == nil {
+		return
+	}
+	data, err := json.Marshal(acct)
+	if err != nil {
+		r.logger.Error("Cannot Marshal Audit Snapshot", "err", err)
+		return
+	}
+	if string(data) == "null" {
+		return
+	}
+	r.snapshotId = SnapshotId(data)
+	r.snapshot = data
+}
+
+func (r *AuditRecorder) writeSnapshot() {
+	if r.written || r.snapshotId == "" {
+		return
+	}
+	err := r.log.Append(AuditEntry{
+		Kind:          AuditEntryKindSnapshot,
+		Time:          time.Now(),
+		Account:       r.account,
+		CorrelationId: r.correlationId,
+		SnapshotId:    r.snapshotId,
+		Snapshot:      r.snapshot,
+	})
+	if err != nil {
+		r.logger.Error("Cannot Write Audit Snapshot", "err", err)
+		return
+	}
+	r.written = true
+}
+
+// Record writes result of action executed in current cycle.
+func (r *AuditRecorder) Record(res ActionResult) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.correlationId == "" {
+		r.correlationId = newRandomId()
+	}
+	r.writeSnapshot()
+
+	entry := AuditEntry{
+		Kind:             AuditEntryKindAction,
+		Time:             time.Now(),
+		Account:          r.account,
+		CorrelationId:    r.correlationId,
+		Action:           res.Action,
+		Estimated:        res.Estimated,
+		BeforeSnapshotId: r.snapshotId,
+	}
+	if res.Result != nil {
+		data, err := json.Marshal(res.Result)
+		if err != nil {
+			r.logger.Error("Cannot Marshal Audit Result", "action", res.Action, "err", err)
+		} else {
+			entry.Result = data
+		}
+	}
+	if res.Err != nil {
+		entry.Err = res.Err.Error()
+	}
+	if err := r.log.Append(entry); err != nil {
+		r.logger.Error("Cannot Write Audit Action", "action", res.Action, "err", err)
+		return
+	}
+	r.dirty = true
+}
+
+// RecordOrder writes market order placed out of ActionExecutor, e.g. by position traders.
+func (r *AuditRecorder) RecordOrder(pair cex.Pair, side cex.OrderSide, isCM bool, qty float64, ord *cex.Order, err error) {
+	if r == nil {
+		return
+	}
+	res := ActionResult{
+		Action: Action{
+			Type:     ActionTypeMarketOrder,
+			Asset:    pair.Asset,
+			Qty:      qty,
+			Quote:    pair.Quote,
+			PairType: pair.Type,
+			Side:     side,
+			IsCM:     isCM,
+		},
+		Err: err,
+	}
+	if ord != nil {
+		res.Result = ord
+	}
+	r.Record(res)
+}
@@ -0,0 +1,131 @@
+package frbnc
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestAuditLog(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	start := time.Now()
+
+	log, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newAcct := func(usdt float64) *VIPPortmarAccount {
+		return (&VIPPortmarAccount{Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "USDT", Free: usdt}}}}).Clone()
+	}
+	snapshotId := func(acct *VIPPortmarAccount) string {
+		data, err := json.Marshal(acct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return SnapshotId(data)
+	}
+	acct0, acct1, acct2 := newAcct(300), newAcct(100), newAcct(50)
+
+	rec := NewAuditRecorder(log, "k1", logger)
+	executor := NewActionExecutor(bnc.NewUser("", ""), logger)
+	executor.DryRun = true
+
+	cycle := rec.Begin(acct0)
+	// position trade running at the same time has its own cycle
+	trade := rec.Begin(nil)
+	executor.Audit = cycle
+	executor.Execute([]Action{
+		{Type: ActionTypeTransfer, Asset: "USDT", Qty: 100, TransferType: bnc.TransferTypeMainPortfolioMargin},
+		{Type: ActionTypeTransfer, Asset: "USDT", Qty: 100, TransferType: bnc.TransferTypeMainPortfolioMargin},
+	})
+	trade.RecordOrder(cex.Pair{Type: cex.PairTypeSpot, Asset: "ETH", Quote: "USDT"}, cex.OrderSideBuy, false, 1, &cex.Order{OrderId: "1"}, nil)
+	cycle.Snapshot(acct1)
+	executor.Execute([]Action{{Type: ActionTypeVIPRepay, LoanCoin: "USDT", Qty: 50, OrderId: "1"}})
+	cycle.Snapshot(acct2)
+
+	// cycle without actions writes nothing
+	empty := rec.Begin(newAcct(1))
+	empty.Snapshot(newAcct(2))
+
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopened log keeps old entries
+	log, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	rec2 := NewAuditRecorder(log, "k2", logger)
+	rec2.Begin(nil).RecordOrder(cex.Pair{Type: cex.PairTypeSpot, Asset: "ETH", Quote: "USDT"}, cex.OrderSideSell, false, 1, nil, errors.New("insufficient balance"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 8 {
+		t.Errorf("lines %v, want 3 snapshots and 5 actions", lines)
+	}
+
+	all, err := log.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 {
+		t.Fatalf("entries %v, want 5", len(all))
+	}
+	for i, entry := range all[:2] {
+		if entry.BeforeSnapshotId != snapshotId(acct0) || entry.AfterSnapshotId != snapshotId(acct1) {
+			t.Errorf("transfer %v snapshots %v -> %v", i, entry.BeforeSnapshotId, entry.AfterSnapshotId)
+		}
+		if !entry.Estimated || entry.CorrelationId != all[3].CorrelationId {
+			t.Errorf("transfer %v estimated %v, correlation id %v", i, entry.Estimated, entry.CorrelationId)
+		}
+	}
+	if ord := all[2]; ord.Err != "" || ord.AfterSnapshotId != "" || ord.CorrelationId == all[0].CorrelationId {
+		t.Errorf("order entry of other cycle %+v", ord)
+	}
+	if repay := all[3]; repay.BeforeSnapshotId != snapshotId(acct1) || repay.AfterSnapshotId != snapshotId(acct2) {
+		t.Errorf("repay snapshots %v -> %v", repay.BeforeSnapshotId, repay.AfterSnapshotId)
+	}
+	if ord := all[4]; ord.Err != "insufficient balance" || ord.BeforeSnapshotId != "" || ord.CorrelationId == all[0].CorrelationId {
+		t.Errorf("order entry %+v", ord)
+	}
+
+	tests := []struct {
+		name  string
+		query AuditQuery
+		want  int
+	}{
+		{"account", AuditQuery{Account: "k1"}, 4},
+		{"type", AuditQuery{Types: []ActionType{ActionTypeVIPRepay, ActionTypeMarketOrder}}, 3},
+		{"account and type", AuditQuery{Account: "k2", Types: []ActionType{ActionTypeTransfer}}, 0},
+		{"from", AuditQuery{From: time.Now().Add(time.Minute)}, 0},
+		{"to", AuditQuery{To: start}, 0},
+		{"time range", AuditQuery{From: start, To: time.Now().Add(time.Minute)}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := log.Query(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.want {
+				t.Errorf("entries %v, want %v", len(entries), tt.want)
+			}
+		})
+	}
+}
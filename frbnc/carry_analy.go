@@ -0,0 +1,199 @@
+package frbnc
+
+import (
+	"fmt"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+// fundingPeriodsPerYear most um symbols settle funding every 8 hours.
+const fundingPeriodsPerYear = 365 * 3
+
+type CarryKind string
+
+const (
+	CarryKindFunding  CarryKind = "FUNDING"
+	CarryKindEarn     CarryKind = "EARN"
+	CarryKindInterest CarryKind = "INTEREST"
+)
+
+// CarryItem is annual income of one um position, earn position or loan.
+type CarryItem struct {
+	Kind CarryKind
+	// Subject is futures symbol, earn asset, loanCoin_collateralCoin of flexible loan,
+	// or order id of vip loan.
+	Subject string
+	// Value is USDT value of position notional, earn amount or debt.
+	Value float64
+	// Rate is annual rate.
+	Rate float64
+	// Income is annual USDT income, negative is cost.
+	Income float64
+	Err    error
+}
+
+// CarryAnalysis is annual carry at current rates.
+// Funding of cm positions is not included.
+type CarryAnalysis struct {
+	Items    []CarryItem
+	Funding  float64
+	Earn     float64
+	Interest float64
+	// Net is Funding + Earn - Interest.
+	Net      float64
+	Negative bool
+	Findings []Finding
+}
+
+// QueryFundingRateMap returns latest funding rates of um symbols,
+// key is symbol.
+func QueryFundingRateMap() (map[string]bnc.FuturesFundingRate, error) {
+	rates, err := bnc.QueryFundingRates()
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]bnc.FuturesFundingRate{}
+	for _, rate := range rates {
+		m[rate.Symbol] = rate
+	}
+	return m, nil
+}
+
+// carryUsdtPrice returns USDT price of coin by mark price of its um symbol.
+func carryUsdtPrice(coin string, fundingRates map[string]bnc.FuturesFundingRate) (float64, error) {
+	if usdChecker.isUsd(coin) {
+		return 1, nil
+	}
+	rate, ok := fundingRates[coin+"USDT"]
+	if !ok || rate.MarkPrice <= 0 {
+		return 0, fmt.Errorf("%v has no mark price", coin)
+	}
+	return rate.MarkPrice, nil
+}
+
+// fundingCarryItem short position receives funding if rate is positive.
+func fundingCarryItem(symbol string, signAmt float64, fundingRates map[string]bnc.FuturesFundingRate) CarryItem {
+	item := CarryItem{Kind: CarryKindFunding, Subject: symbol}
+	rate, ok := fundingRates[symbol]
+	if !ok || rate.MarkPrice <= 0 {
+		item.Err = fmt.Errorf("%v has no funding rate", symbol)
+		return item
+	}
+	item.Value = signAmt * rate.MarkPrice
+	item.Rate = rate.LastFundingRate * fundingPeriodsPerYear
+	item.Income = -item.Value * item.Rate
+	return item
+}
+
+func (a *CarryAnalysis) add(item CarryItem) {
+	a.Items = append(a.Items, item)
+	if item.Err != nil {
+		a.Findings = append(a.Findings, Finding{
+			Code:     FindingCarryRateMissing,
+			Severity: FindingSeverityWarn,
+			Subject:  item.Subject,
+			Skipped:  true,
+		})
+		return
+	}
+	switch item.Kind {
+	case CarryKindFunding:
+		a.Funding += item.Income
+	case CarryKindEarn:
+		a.Earn += item.Income
+	case CarryKindInterest:
+		a.Interest -= item.Income
+	}
+}
+
+func (a *CarryAnalysis) finish() {
+	a.Net = a.Funding + a.Earn - a.Interest
+	a.Negative = a.Net < 0
+	code, severity := FindingCarryPositive, FindingSeverityInfo
+	if a.Negative {
+		code, severity = FindingCarryNegative, FindingSeverityWarn
+	}
+	a.Findings = append(a.Findings, Finding{
+		Code:       code,
+		Severity:   severity,
+		Subject:    "CARRY",
+		Thresholds: map[string]float64{"net": 0},
+		Inputs:     map[string]float64{"funding": a.Funding, "earn": a.Earn, "interest": a.Interest, "net": a.Net},
+	})
+}
+
+// AnalyzeCarry returns annual carry of classic account,
+// funding of um positions, flexible earn APR and interest of flexible loans.
+// loanRates are annual interest rates of flexible loans, key is loan coin,
+// same as RepayPolicy.LoanRates.
+func AnalyzeCarry(acct *Account, fundingRates map[string]bnc.FuturesFundingRate, loanRates map[string]float64) (analysis CarryAnalysis) {
+	for _, pos := range acct.Futures.Positions {
+		if pos.SignPositionAmt == 0 {
+			continue
+		}
+		analysis.add(fundingCarryItem(pos.Symbol, pos.SignPositionAmt, fundingRates))
+	}
+
+	for _, pos := range acct.EarnPositions {
+		if pos.TotalAmount <= 0 {
+			continue
+		}
+		item := CarryItem{Kind: CarryKindEarn, Subject: pos.Asset, Rate: pos.LatestAnnualPercentageRate}
+		price, err := carryUsdtPrice(pos.Asset, fundingRates)
+		item.Value = pos.TotalAmount * price
+		item.Income = item.Value * item.Rate
+		item.Err = err
+		analysis.add(item)
+	}
+
+	for _, ord := range acct.LoanOrders {
+		if ord.TotalDebt <= 0 {
+			continue
+		}
+		item := CarryItem{Kind: CarryKindInterest, Subject: ord.LoanCoin + "_" + ord.CollateralCoin}
+		rate, ok := loanRates[ord.LoanCoin]
+		price, err := carryUsdtPrice(ord.LoanCoin, fundingRates)
+		if err == nil && !ok {
+			err = fmt.Errorf("%v has no loan rate", ord.LoanCoin)
+		}
+		item.Value = ord.TotalDebt * price
+		item.Rate = rate
+		item.Income = -item.Value * item.Rate
+		item.Err = err
+		analysis.add(item)
+	}
+
+	analysis.finish()
+	return
+}
+
+// AnalyzePortmarCarry returns annual carry of portfolio margin account,
+// funding of um positions and interest of vip loans by LoanRate of orders.
+func AnalyzePortmarCarry(acct *VIPPortmarAccount, fundingRates map[string]bnc.FuturesFundingRate) (analysis CarryAnalysis) {
+	for _, pos := range acct.PortmarAccountUMDetail.Positions {
+		if pos.SignPositionAmt == 0 {
+			continue
+		}
+		analysis.add(fundingCarryItem(pos.Symbol, pos.SignPositionAmt, fundingRates))
+	}
+
+	for _, ord := range acct.LoanOrders {
+		if ord.TotalDebt <= 0 {
+			continue
+		}
+		item := CarryItem{Kind: CarryKindInterest, Subject: ord.OrderId}
+		rate, rateErr := parseRate(ord.LoanRate)
+		price, err := carryUsdtPrice(ord.LoanCoin, fundingRates)
+		if err == nil && rateErr != nil {
+			err = fmt.Errorf("parse loan rate of vip loan %v: %w", ord.OrderId, rateErr)
+		}
+		item.Value = ord.TotalDebt * price
+		item.Rate = rate
+		item.Income = -item.Value * item.Rate
+		item.Err = err
+		analysis.add(item)
+	}
+
+	analysis.finish()
+	return
+}
@@ -0,0 +1,83 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestAnalyzeCarry(t *testing.T) {
+	fundingRates := map[string]bnc.FuturesFundingRate{
+		"ETHUSDT": {Symbol: "ETHUSDT", MarkPrice: 2000, LastFundingRate: 0.0001},
+		"BTCUSDT": {Symbol: "BTCUSDT", MarkPrice: 50000, LastFundingRate: 0.0001},
+	}
+	acct := (&Account{
+		Futures: bnc.FuturesAccount{Positions: []bnc.FuturesAccountPosition{
+			{Symbol: "ETHUSDT", SignPositionAmt: -10},
+			{Symbol: "XRPUSDT", SignPositionAmt: -100},
+		}},
+		EarnPositions: []bnc.SimpleEarnFlexiblePosition{{Asset: "USDT", TotalAmount: 1000, LatestAnnualPercentageRate: 0.05}},
+		LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+			{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 10000, CollateralAmount: 1},
+		},
+	}).Clone()
+
+	tests := []struct {
+		name      string
+		loanRates map[string]float64
+		funding   float64
+		interest  float64
+		code      FindingCode
+	}{
+		// 20000 short * 0.0001 * 1095
+		{"positive", map[string]float64{"USDT": 0.1}, 2190, 1000, FindingCarryPositive},
+		{"negative", map[string]float64{"USDT": 0.3}, 2190, 3000, FindingCarryNegative},
+		{"no loan rate", nil, 2190, 0, FindingCarryPositive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AnalyzeCarry(acct, fundingRates, tt.loanRates)
+			if len(got.Items) != 4 {
+				t.Fatalf("items %+v, want 4", got.Items)
+			}
+			if math.Abs(got.Funding-tt.funding) > 1e-6 || math.Abs(got.Earn-50) > 1e-9 || math.Abs(got.Interest-tt.interest) > 1e-9 {
+				t.Errorf("funding %v, earn %v, interest %v, want %v, 50, %v", got.Funding, got.Earn, got.Interest, tt.funding, tt.interest)
+			}
+			if net := tt.funding + 50 - tt.interest; math.Abs(got.Net-net) > 1e-6 || got.Negative != (net < 0) {
+				t.Errorf("net %v, negative %v, want %v", got.Net, got.Negative, net)
+			}
+			if got.Items[1].Err == nil {
+				t.Error("XRPUSDT has no funding rate, want error")
+			}
+			if code := got.Findings[len(got.Findings)-1].Code; code != tt.code {
+				t.Errorf("finding %v, want %v", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestAnalyzePortmarCarry(t *testing.T) {
+	fundingRates := map[string]bnc.FuturesFundingRate{
+		"ETHUSDT": {Symbol: "ETHUSDT", MarkPrice: 2000, LastFundingRate: -0.0001},
+	}
+	acct := &VIPPortmarAccount{
+		PortmarAccountUMDetail: bnc.PortfolioMarginAccountDetail{Positions: []bnc.PortfolioMarginAccountPosition{
+			{Symbol: "ETHUSDT", SignPositionAmt: -10},
+		}},
+		LoanOrders: []bnc.VIPLoanOngoingOrder{
+			{OrderId: "1", LoanCoin: "USDT", TotalDebt: 10000, LoanRate: "5%"},
+			{OrderId: "2", LoanCoin: "USDT", TotalDebt: 10000, LoanRate: "bad"},
+		},
+	}
+
+	got := AnalyzePortmarCarry(acct, fundingRates)
+	// short pays negative funding, 20000 * 0.0001 * 1095
+	if math.Abs(got.Funding+2190) > 1e-6 || math.Abs(got.Interest-500) > 1e-9 {
+		t.Errorf("funding %v, interest %v, want -2190, 500", got.Funding, got.Interest)
+	}
+	if !got.Negative || got.Items[2].Err == nil {
+		t.Errorf("negative %v, bad rate err %v", got.Negative, got.Items[2].Err)
+	}
+}
@@ -0,0 +1,194 @@
+package frbnc
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+	"github.com/go-resty/resty/v2"
+)
+
+// CMFuturesAccount is coin-margined futures account,
+// asset balances are in coin, position amounts are in contracts.
+type CMFuturesAccount struct {
+	FeeTier     float64                      `json:"feeTier"`
+	CanTrade    bool                         `json:"canTrade"`
+	CanDeposit  bool                         `json:"canDeposit"`
+	CanWithdraw bool                         `json:"canWithdraw"`
+	UpdateTime  int64                        `json:"updateTime"`
+	Assets      []bnc.FuturesAccountAsset    `json:"assets"`
+	Positions   []bnc.FuturesAccountPosition `json:"positions"`
+}
+
+// CMFuturesAccountConfig
+// bnc does not support coin-margined account of classic account yet.
+var CMFuturesAccountConfig = cex.ReqConfig[cex.NilReqData, CMFuturesAccount]{
+	ReqBaseConfig: cex.ReqBaseConfig{
+		BaseUrl:          bnc.DapiBaseUrl,
+		Path:             bnc.DapiV1 + "/account",
+		Method:           http.MethodGet,
+		IsUserData:       true,
+		UserTimeInterval: 0,
+		IpTimeInterval:   0,
+	},
+	HTTPStatusCodeChecker: bnc.HTTPStatusCodeChecker,
+	RespBodyUnmarshaler:   cex.StdBodyUnmarshaler[CMFuturesAccount],
+}
+
+func QueryCMFuturesAccount(user *bnc.User, opts ...cex.CltOpt) (*resty.Response, CMFuturesAccount, cex.RequestError) {
+	return cex.Request(user, CMFuturesAccountConfig, nil, opts...)
+}
+
+func QueryCMFuPairs() (map[string]cex.Pair, error) {
+	return queryPairs(bnc.QueryCMFuturesPairs)
+}
+
+// cmPairsTTL cm pairs rarely change,
+// exchange info is not downloaded on every account refresh.
+const cmPairsTTL = time.Hour
+
+var cmPairsCache struct {
+	mux   sync.Mutex
+	pairs map[string]cex.Pair
+	time  time.Time
+}
+
+// cachedCMFuPairs returns cm pairs queried within cmPairsTTL,
+// if querying fails, stale pairs are returned with error.
+func cachedCMFuPairs() (map[string]cex.Pair, error) {
+	cmPairsCache.mux.Lock()
+	defer cmPairsCache.mux.Unlock()
+	if cmPairsCache.pairs != nil && time.Since(cmPairsCache.time) < cmPairsTTL {
+		return cmPairsCache.pairs, nil
+	}
+	pairs, err := QueryCMFuPairs()
+	if err != nil {
+		return cmPairsCache.pairs, err
+	}
+	cmPairsCache.pairs = pairs
+	cmPairsCache.time = time.Now()
+	return pairs, nil
+}
+
+// QueryCMMarkPrices key is cm symbol, e.g. BTCUSD_PERP
+func QueryCMMarkPrices() (map[string]float64, error) {
+	indexes, err := bnc.QueryCMPremiumIndex("", "")
+	if err != nil {
+		return nil, err
+	}
+	prices := map[string]float64{}
+	for _, index := range indexes {
+		prices[index.Symbol] = index.MarkPrice
+	}
+	return prices, nil
+}
+
+func (a *Account) CMFuAsset(asset string) (ass bnc.FuturesAccountAsset, ok bool) {
+	return mapGetter(a.cmAsts, asset)
+}
+
+func (a *Account) CMFuPos(symbol string, side bnc.FuturesPositionSide) (pos bnc.FuturesAccountPosition, ok bool) {
+	return mapGetter(a.cmPoss, fuPosKey(symbol, side))
+}
+
+func (a *Account) CMFuPoss(symbol string) []bnc.FuturesAccountPosition {
+	return posGetter(a.cmPoss, symbol)
+}
+
+func (a *Account) CMFuPair(symbol string) (pair cex.Pair, ok bool) {
+	return mapGetter(a.cmPairs, symbol)
+}
+
+// CMPosCoinQty converts contracts of cm position to coin qty,
+// coin qty = contracts * contract size / mark price.
+// Short position is negative.
+func (a *Account) CMPosCoinQty(pos bnc.FuturesAccountPosition) (qty float64, err error) {
+	pair, ok := a.CMFuPair(pos.Symbol)
+	if !ok || pair.ContractSize <= 0 {
+		return 0, fmt.Errorf("no %v cm pair contract size", pos.Symbol)
+	}
+	price, ok := mapGetter(a.MarkPrices, pos.Symbol)
+	if !ok || price <= 0 {
+		return 0, fmt.Errorf("no %v mark price", pos.Symbol)
+	}
+	return pos.SignPositionAmt * pair.ContractSize / price, nil
+}
+
+// CMPosNotional returns USD notional of cm position,
+// notional = contracts * contract size.
+func (a *Account) CMPosNotional(pos bnc.FuturesAccountPosition) (notional float64, err error) {
+	pair, ok := a.CMFuPair(pos.Symbol)
+	if !ok || pair.ContractSize <= 0 {
+		return 0, fmt.Errorf("no %v cm pair contract size", pos.Symbol)
+	}
+	return math.Abs(pos.SignPositionAmt) * pair.ContractSize, nil
+}
+
+// CMFuturesMarginRatio is margin ratio of one coin-margined asset,
+// every asset of cm account is margin of its own positions.
+type CMFuturesMarginRatio struct {
+	Asset string
+	Price float64
+
+	// USDT values
+	Margin      float64
+	Notional    float64
+	MaintMargin float64
+
+	InitialRatio float64
+	MaintRatio   float64
+
+	Err error
+}
+
+func (a *Account) CMFuMarginRatios() (ratios []CMFuturesMarginRatio) {
+	byAsset := map[string]*CMFuturesMarginRatio{}
+	var assets []string
+	get := func(asset string) *CMFuturesMarginRatio {
+		r, ok := byAsset[asset]
+		if !ok {
+			r = &CMFuturesMarginRatio{Asset: asset}
+			r.Price, r.Err = a.FuMarkPrice(asset + "USDT")
+			byAsset[asset] = r
+			assets = append(assets, asset)
+		}
+		return r
+	}
+
+	for _, pos := range a.CMFutures.Positions {
+		if pos.SignPositionAmt == 0 {
+			continue
+		}
+		pair, ok := a.CMFuPair(pos.Symbol)
+		if !ok {
+			continue
+		}
+		r := get(pair.Asset)
+		notional, err := a.CMPosNotional(pos)
+		if err != nil {
+			r.Err = err
+			continue
+		}
+		r.Notional += notional
+		r.MaintMargin += pos.MaintMargin * r.Price
+	}
+
+	for _, asset := range assets {
+		r := byAsset[asset]
+		ast, _ := a.CMFuAsset(asset)
+		r.Margin = ast.MarginBalance * r.Price
+		if r.Notional > 0 {
+			r.InitialRatio = r.Margin / r.Notional
+		}
+		if r.MaintMargin > 0 {
+			r.MaintRatio = r.Margin / r.MaintMargin
+		}
+		ratios = append(ratios, *r)
+	}
+
+	return
+}
@@ -32,6 +32,9 @@ const (
 	middleSubordinateCollateralLtv = 0.6
 	maxSubordinateCollateralLtv    = 0.65
 
+	// flexibleLoanLiquidationLtv is liquidation ltv of flexible loan
+	flexibleLoanLiquidationLtv = 0.91
+
 	// ratio = totalMarginBalance / totalPositionValue
 	minFuturesAccountMarginRatio    = 0.25
 	middleFuturesAccountMarginRatio = 0.3
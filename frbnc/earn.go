@@ -0,0 +1,240 @@
+package frbnc
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+	"github.com/dwdwow/mathy"
+	"github.com/go-resty/resty/v2"
+)
+
+type SimpleEarnFlexibleSubscribeParams struct {
+	ProductId     string  `s2m:"productId,omitempty"`
+	Amount        float64 `s2m:"amount,omitempty"`
+	AutoSubscribe bool    `s2m:"autoSubscribe"`           // default to true by binance
+	SourceAccount string  `s2m:"sourceAccount,omitempty"` // SPOT, FUND, ALL, default to SPOT
+}
+
+type SimpleEarnFlexibleSubscribeResponse struct {
+	PurchaseId int64 `json:"purchaseId"`
+	Success    bool  `json:"success"`
+}
+
+// SimpleEarnFlexibleSubscribeConfig
+// bnc does not support subscribing flexible products yet.
+var SimpleEarnFlexibleSubscribeConfig = cex.ReqConfig[SimpleEarnFlexibleSubscribeParams, SimpleEarnFlexibleSubscribeResponse]{
+	ReqBaseConfig: cex.ReqBaseConfig{
+		BaseUrl:          bnc.ApiBaseUrl,
+		Path:             bnc.SapiV1 + "/simple-earn/flexible/subscribe",
+		Method:           http.MethodPost,
+		IsUserData:       true,
+		UserTimeInterval: 0,
+		IpTimeInterval:   0,
+	},
+	HTTPStatusCodeChecker: bnc.HTTPStatusCodeChecker,
+	RespBodyUnmarshaler:   cex.StdBodyUnmarshaler[SimpleEarnFlexibleSubscribeResponse],
+}
+
+func SimpleEarnFlexibleSubscribe(user *bnc.User, productId string, amount float64, opts ...cex.CltOpt) (*resty.Response, SimpleEarnFlexibleSubscribeResponse, cex.RequestError) {
+	return cex.Request(user, SimpleEarnFlexibleSubscribeConfig, SimpleEarnFlexibleSubscribeParams{ProductId: productId, Amount: amount, SourceAccount: "SPOT"}, opts...)
+}
+
+type EarnConfig struct {
+	// Reserves are spot free qty never swept, key is asset.
+	Reserves map[string]float64
+	// SweepAssets are assets whose idle spot qty is subscribed.
+	// Empty means no sweeping.
+	SweepAssets map[string]bool
+	// RedeemQuotas are max qty redeemed in 24 hours, key is asset.
+	// Asset not in RedeemQuotas is not limited.
+	RedeemQuotas map[string]float64
+	// SettlementDelay is time before redeemed coin can be used in spot account.
+	SettlementDelay time.Duration
+}
+
+func DefaultEarnConfig() EarnConfig {
+	return EarnConfig{
+		Reserves:        map[string]float64{"USDT": minUsdt},
+		SettlementDelay: time.Second * 5,
+	}
+}
+
+type earnRedemption struct {
+	qty       float64
+	time      time.Time
+	settledAt time.Time
+}
+
+// EarnManager redeems flexible earn positions when risk handlers need coins,
+// and sweeps idle spot coins into flexible products.
+// Redemptions are recorded, so quotas and settlement delay are respected.
+type EarnManager struct {
+	cfg EarnConfig
+
+	mux         sync.Mutex
+	redemptions map[string][]earnRedemption
+
+	now func() time.Time
+}
+
+func NewEarnManager(cfg EarnConfig) *EarnManager {
+	return &EarnManager{
+		cfg:         cfg,
+		redemptions: map[string][]earnRedemption{},
+		now:         time.Now,
+	}
+}
+
+// RedeemLeft returns qty of asset can be redeemed now,
+// limited by LD spot balance and quota of last 24 hours.
+func (e *EarnManager) RedeemLeft(acct *Account, asset string) float64 {
+	pos, ok := acct.EarnPos(asset)
+	if !ok || !pos.CanRedeem {
+		return 0
+	}
+	ldBal, _ := acct.SpotBal("LD" + asset)
+	left := ldBal.Free
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.prune(asset)
+	if quota, ok := e.cfg.RedeemQuotas[asset]; ok {
+		var redeemed float64
+		for _, r := range e.redemptions[asset] {
+			redeemed += r.qty
+		}
+		left = math.Min(left, quota-redeemed)
+	}
+	return math.Max(left, 0)
+}
+
+// PlanRedeem plans redeeming qty of asset to spot, qty is limited by RedeemLeft.
+// Qty of unsettled redemptions is deducted, because it is on the way to spot.
+func (e *EarnManager) PlanRedeem(acct *Account, asset string, qty float64, reason FindingCode) (action Action, ok bool) {
+	qty -= e.Unsettled(asset)
+	qty = mathy.RoundFloor(math.Min(qty, e.RedeemLeft(acct, asset)), 6)
+	if qty <= 0 {
+		return
+	}
+	productId, ok := acct.EarnProductId(asset)
+	if !ok {
+		return
+	}
+	return Action{
+		Type:      ActionTypeRedeem,
+		Reason:    reason,
+		Asset:     asset,
+		Qty:       qty,
+		ProductId: productId,
+	}, true
+}
+
+// Limit caps redeem action by quota and settlement,
+// and cancels subscribe action of asset being redeemed,
+// other actions are returned as they are.
+func (e *EarnManager) Limit(acct *Account, action Action) (Action, bool) {
+	switch action.Type {
+	case ActionTypeRedeem:
+		return e.PlanRedeem(acct, action.Asset, action.Qty, action.Reason)
+	case ActionTypeSubscribe:
+		return action, e.Unsettled(action.Asset) <= 0
+	}
+	return action, true
+}
+
+// Redeemed records executed redeem action.
+// Returns time when redeemed coin is settled in spot account.
+func (e *EarnManager) Redeemed(action Action) time.Time {
+	if action.Type != ActionTypeRedeem {
+		return e.now()
+	}
+	now := e.now()
+	settledAt := now.Add(e.cfg.SettlementDelay)
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.redemptions[action.Asset] = append(e.redemptions[action.Asset], earnRedemption{action.Qty, now, settledAt})
+	return settledAt
+}
+
+// Unsettled returns redeemed qty of asset which has not arrived in spot account.
+func (e *EarnManager) Unsettled(asset string) (qty float64) {
+	now := e.now()
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for _, r := range e.redemptions[asset] {
+		if r.settledAt.After(now) {
+			qty += r.qty
+		}
+	}
+	return
+}
+
+func (e *EarnManager) prune(asset string) {
+	from := e.now().Add(-time.Hour * 24)
+	e.redemptions[asset] = slices.DeleteFunc(e.redemptions[asset], func(r earnRedemption) bool {
+		return r.time.Before(from)
+	})
+}
+
+// PlanSweep subscribes spot free qty of SweepAssets above reserves to flexible products.
+// Qty needed by risk handlers is reserved too,
+// and asset with unsettled redemption is not swept,
+// so sweeping never starves risk handlers.
+func (e *EarnManager) PlanSweep(acct *Account) (actions []Action) {
+	demands := RiskDemandQtys(acct)
+
+	var assets []string
+	for asset, ok := range e.cfg.SweepAssets {
+		if ok {
+			assets = append(assets, asset)
+		}
+	}
+	slices.Sort(assets)
+
+	for _, asset := range assets {
+		if e.Unsettled(asset) > 0 {
+			continue
+		}
+		productId, ok := acct.EarnProductId(asset)
+		if !ok {
+			continue
+		}
+		bal, _ := acct.SpotBal(asset)
+		qty := mathy.RoundFloor(bal.Free-e.cfg.Reserves[asset]-demands[asset], 6)
+		if qty <= 0 {
+			continue
+		}
+		actions = append(actions, Action{
+			Type:      ActionTypeSubscribe,
+			Reason:    FindingSpotIdle,
+			Asset:     asset,
+			Qty:       qty,
+			ProductId: productId,
+		})
+	}
+	return
+}
+
+// RiskDemandQtys returns spot qty needed by risk handlers of acct, key is asset.
+// Loans need collateral coin and USDT, futures need USDT, cm futures need its own coin.
+func RiskDemandQtys(acct *Account) map[string]float64 {
+	demands := map[string]float64{}
+	for _, demand := range AnalyzeRiskyLoans(acct).Demands {
+		demands[demand.Order.CollateralCoin] += demand.TotalColltDemand
+		demands[demand.Order.LoanCoin] += demand.AdditionalUsd
+	}
+	if fu := AnalyzeMarginFutures(acct); fu.Risky {
+		demands["USDT"] += fu.MarginRemand
+	}
+	for _, demand := range AnalyzeMarginCMFutures(acct).Demands {
+		if demand.Ratio.Price > 0 {
+			demands[demand.Ratio.Asset] += demand.MarginRemand / demand.Ratio.Price
+		}
+	}
+	return demands
+}
@@ -0,0 +1,80 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestEarnManagerRedeem(t *testing.T) {
+	acct := (&Account{
+		Spot:          bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "LDUSDT", Free: 1000}}},
+		EarnPositions: []bnc.SimpleEarnFlexiblePosition{{Asset: "USDT", ProductId: "USDT001", CanRedeem: true, TotalAmount: 1000}},
+	}).Clone()
+
+	now := time.Now()
+	e := NewEarnManager(EarnConfig{RedeemQuotas: map[string]float64{"USDT": 500}, SettlementDelay: time.Minute})
+	e.now = func() time.Time { return now }
+
+	action, ok := e.PlanRedeem(acct, "USDT", 300, FindingFuMarginRatioLow)
+	if !ok || action.Qty != 300 || action.ProductId != "USDT001" {
+		t.Fatalf("redeem %+v %v, want 300 USDT001", action, ok)
+	}
+	e.Redeemed(action)
+	acct = acct.WithActions(action)
+
+	// 300 is not settled, only 100 more is needed
+	if action, _ = e.PlanRedeem(acct, "USDT", 400, FindingFuMarginRatioLow); action.Qty != 100 {
+		t.Errorf("redeem qty %v, want 100 after unsettled is deducted", action.Qty)
+	}
+
+	now = now.Add(time.Hour)
+	// quota of 24 hours is 500, 300 is used
+	if action, _ = e.PlanRedeem(acct, "USDT", 400, FindingFuMarginRatioLow); action.Qty != 200 {
+		t.Errorf("redeem qty %v, want 200 limited by quota", action.Qty)
+	}
+
+	now = now.Add(time.Hour * 24)
+	if left := e.RedeemLeft(acct, "USDT"); left != 500 {
+		t.Errorf("redeem left %v, want 500 after quota window", left)
+	}
+}
+
+func TestEarnManagerPlanSweep(t *testing.T) {
+	acct := (&Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{
+			{Asset: "USDT", Free: 1000},
+			{Asset: "ETH", Free: 0.3},
+		}},
+		LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+			{LoanCoin: "USDT", CollateralCoin: "ETH", TotalDebt: 1600, CollateralAmount: 1, CurrentLTV: 0.8},
+		},
+		EarnPositions: []bnc.SimpleEarnFlexiblePosition{
+			{Asset: "USDT", ProductId: "USDT001", CanRedeem: true},
+			{Asset: "ETH", ProductId: "ETH001", CanRedeem: true},
+		},
+	}).Clone()
+
+	e := NewEarnManager(EarnConfig{
+		Reserves:        map[string]float64{"USDT": 100},
+		SweepAssets:     map[string]bool{"USDT": true, "ETH": true},
+		SettlementDelay: time.Minute,
+	})
+
+	actions := e.PlanSweep(acct)
+	// ETH and part of USDT are needed by the risky loan
+	want := 900 - RiskDemandQtys(acct)["USDT"]
+	if len(actions) != 1 || actions[0].Asset != "USDT" || math.Abs(actions[0].Qty-want) > 1e-5 {
+		t.Fatalf("sweep actions %+v, want %v USDT", actions, want)
+	}
+
+	e.Redeemed(Action{Type: ActionTypeRedeem, Asset: "USDT", Qty: 10})
+	if _, ok := e.Limit(acct, actions[0]); ok {
+		t.Error("sweep of asset being redeemed should be cancelled")
+	}
+	if actions = e.PlanSweep(acct); len(actions) != 0 {
+		t.Errorf("sweep actions %+v, want none while USDT is redeemed", actions)
+	}
+}
@@ -0,0 +1,120 @@
+package frbnc
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+type FindingSeverity string
+
+const (
+	FindingSeverityInfo     FindingSeverity = "INFO"
+	FindingSeverityWarn     FindingSeverity = "WARN"
+	FindingSeverityCritical FindingSeverity = "CRITICAL"
+)
+
+type FindingCode string
+
+const (
+	FindingLoanCoinNotUsdt      FindingCode = "LOAN_COIN_NOT_USDT"
+	FindingLoanLtvNotPositive   FindingCode = "LOAN_LTV_NOT_POSITIVE"
+	FindingLoanDebtTooSmall     FindingCode = "LOAN_DEBT_TOO_SMALL"
+	FindingLoanLtvNormal        FindingCode = "LOAN_LTV_NORMAL"
+	FindingLoanLtvHigh          FindingCode = "LOAN_LTV_HIGH"
+	FindingLoanNoActionPossible FindingCode = "LOAN_NO_ACTION_POSSIBLE"
+
+	FindingFuUsdtMissing        FindingCode = "FU_USDT_MISSING"
+	FindingFuUsdtWalletNormal   FindingCode = "FU_USDT_WALLET_NORMAL"
+	FindingFuUsdtWalletNegative FindingCode = "FU_USDT_WALLET_NEGATIVE"
+
+	FindingFuNoPosition          FindingCode = "FU_NO_POSITION"
+	FindingFuMarginRatioNormal   FindingCode = "FU_MARGIN_RATIO_NORMAL"
+	FindingFuMarginDemandTooLow  FindingCode = "FU_MARGIN_DEMAND_TOO_LOW"
+	FindingFuMarginRatioLow      FindingCode = "FU_MARGIN_RATIO_LOW"
+	FindingFuMarginableSpotEmpty FindingCode = "FU_MARGINABLE_SPOT_EMPTY"
+	FindingFuMarginablePriceErr  FindingCode = "FU_MARGINABLE_PRICE_ERR"
+
+	FindingCMMarginRatioNormal FindingCode = "CM_MARGIN_RATIO_NORMAL"
+	FindingCMMarginRatioLow    FindingCode = "CM_MARGIN_RATIO_LOW"
+	FindingCMMarginErr         FindingCode = "CM_MARGIN_ERR"
+
+	FindingHedgeBalanced FindingCode = "HEDGE_BALANCED"
+	FindingHedgeResidual FindingCode = "HEDGE_RESIDUAL"
+	FindingHedgePriceErr FindingCode = "HEDGE_PRICE_ERR"
+
+	FindingPmUniMMRLow       FindingCode = "PM_UNIMMR_LOW"
+	FindingPmUniMMRBalanced  FindingCode = "PM_UNIMMR_BALANCED"
+	FindingPmUniMMRHigh      FindingCode = "PM_UNIMMR_HIGH"
+	FindingPmNegativeAsset   FindingCode = "PM_NEGATIVE_ASSET"
+	FindingPmCollNoPrice     FindingCode = "PM_COLL_NO_PRICE"
+	FindingPmCollNotEligible FindingCode = "PM_COLL_NOT_ELIGIBLE"
+
+	FindingVIPLoanLtvNormal FindingCode = "VIP_LOAN_LTV_NORMAL"
+	FindingVIPLoanLtvHigh   FindingCode = "VIP_LOAN_LTV_HIGH"
+	FindingVIPLoanBadConfig FindingCode = "VIP_LOAN_BAD_CONFIG"
+	FindingVIPLoanBadLtv    FindingCode = "VIP_LOAN_BAD_LTV"
+	FindingVIPLoanNotActive FindingCode = "VIP_LOAN_NOT_ACTIVE"
+
+	FindingCarryPositive    FindingCode = "CARRY_POSITIVE"
+	FindingCarryNegative    FindingCode = "CARRY_NEGATIVE"
+	FindingCarryRateMissing FindingCode = "CARRY_RATE_MISSING"
+
+	FindingSpotIdle FindingCode = "SPOT_IDLE"
+)
+
+// Finding explains one decision of analyses,
+// including items skipped, so "why not act" can be answered by logs.
+type Finding struct {
+	Code     FindingCode
+	Severity FindingSeverity
+	// Subject is the item analysed, e.g. loan pair, symbol or asset.
+	Subject    string
+	Skipped    bool
+	Thresholds map[string]float64
+	Inputs     map[string]float64
+}
+
+func (f Finding) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("code", string(f.Code)),
+		slog.String("severity", string(f.Severity)),
+		slog.String("subject", f.Subject),
+		slog.Bool("skipped", f.Skipped),
+	}
+	for _, group := range []struct {
+		name string
+		m    map[string]float64
+	}{{"thresholds", f.Thresholds}, {"inputs", f.Inputs}} {
+		if len(group.m) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(group.m))
+		for k := range group.m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var kvs []any
+		for _, k := range keys {
+			kvs = append(kvs, slog.Float64(k, group.m[k]))
+		}
+		attrs = append(attrs, slog.Group(group.name, kvs...))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (s FindingSeverity) level() slog.Level {
+	switch s {
+	case FindingSeverityCritical:
+		return slog.LevelError
+	case FindingSeverityWarn:
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+func LogFindings(logger *slog.Logger, findings []Finding) {
+	for _, f := range findings {
+		logger.Log(context.Background(), f.Severity.level(), "Analysis Finding", "finding", f)
+	}
+}
@@ -0,0 +1,303 @@
+package frbnc
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+	"github.com/dwdwow/mathy"
+)
+
+// HedgeRepairOrder is a suggested futures market order,
+// which makes the short leg equal to spot holdings again.
+type HedgeRepairOrder struct {
+	Symbol   string
+	PairType cex.PairType
+	Side     cex.OrderSide
+	// PositionSide is SHORT if account is in hedge mode, else BOTH
+	PositionSide bnc.FuturesPositionSide
+	// Qty is contracts if IsCM
+	Qty  float64
+	IsCM bool
+}
+
+type HedgeMismatch struct {
+	Coin     string
+	FuSymbol string
+	FuExp    float64
+	CMSymbol string
+
+	// SpotQty includes free and locked spot balance,
+	// LD earn token, flexible loan collateral
+	// and coin moved to futures as margin.
+	SpotQty    float64
+	FuShortQty float64 // coin qty, um qty * fuExp + cm contracts * contract size / mark price
+
+	// Residual = SpotQty - FuShortQty
+	// Residual > 0, spot is not hedged,
+	// Residual < 0, futures short is naked.
+	Residual      float64
+	Price         float64
+	ResidualValue float64
+
+	Repairs []HedgeRepairOrder
+	Err     error
+}
+
+type HedgeAnalysis struct {
+	Mismatches         []HedgeMismatch
+	TotalResidualValue float64
+	Unhedged           bool
+	Findings           []Finding
+}
+
+// minHedgeResidualUsdt residual value below it is seen as hedged
+const minHedgeResidualUsdt = minFuTradeUsdt
+
+// SpotHoldingQty returns long qty of coin held out of futures positions,
+// spot free and locked, LD earn token, loan collateral and um and cm futures margin.
+func SpotHoldingQty(acct *Account, coin string) (qty float64) {
+	bal, _ := acct.SpotBal(coin)
+	ldBal, _ := acct.SpotBal("LD" + coin)
+	fuAsset, _ := acct.FuAsset(coin)
+	cmAsset, _ := acct.CMFuAsset(coin)
+	qty = bal.Free + bal.Locked + ldBal.Free + ldBal.Locked + fuAsset.WalletBalance + cmAsset.WalletBalance
+	for _, ord := range acct.LoanOrders {
+		if ord.CollateralCoin == coin {
+			qty += ord.CollateralAmount
+		}
+	}
+	return
+}
+
+// heldCoins returns non USD coins counted by SpotHoldingQty, sorted.
+func heldCoins(acct *Account) []string {
+	held := map[string]bool{}
+	add := func(coin string) {
+		if coin != "" && !usdChecker.isUsd(coin) {
+			held[coin] = true
+		}
+	}
+	for asset, bal := range acct.spBals {
+		if bal.Free+bal.Locked == 0 {
+			continue
+		}
+		// LD token of Simple Earn
+		if coin, ok := strings.CutPrefix(asset, "LD"); ok {
+			if _, ok := acct.EarnPos(coin); ok {
+				asset = coin
+			}
+		}
+		add(asset)
+	}
+	for asset, ast := range acct.fuAsts {
+		if ast.WalletBalance != 0 {
+			add(asset)
+		}
+	}
+	for asset, ast := range acct.cmAsts {
+		if ast.WalletBalance != 0 {
+			add(asset)
+		}
+	}
+	for _, ord := range acct.LoanOrders {
+		if ord.CollateralAmount != 0 {
+			add(ord.CollateralCoin)
+		}
+	}
+	coins := make([]string, 0, len(held))
+	for coin := range held {
+		coins = append(coins, coin)
+	}
+	slices.Sort(coins)
+	return coins
+}
+
+// AnalyzeHedges compares spot holdings of every coin with its um and cm futures shorts,
+// coins only held out of futures are unhedged too.
+// Repairs are only suggested for coins with futures legs.
+func AnalyzeHedges(acct *Account) (analysis HedgeAnalysis) {
+	type fuLeg struct {
+		symbol    string
+		fuExp     float64
+		netAmt    float64
+		price     float64
+		posSide   bnc.FuturesPositionSide
+		cmPosSide bnc.FuturesPositionSide
+
+		cmSymbol string
+		cmNetQty float64 // coin qty
+
+		err error
+	}
+
+	var coins []string
+	legs := map[string]*fuLeg{}
+	getLeg := func(coin string) *fuLeg {
+		leg, ok := legs[coin]
+		if !ok {
+			leg = &fuLeg{fuExp: 1, posSide: bnc.FuturesPositionSideBoth, cmPosSide: bnc.FuturesPositionSideBoth}
+			legs[coin] = leg
+			coins = append(coins, coin)
+		}
+		return leg
+	}
+
+	for _, pos := range acct.Futures.Positions {
+		coin, fuExp, ok := FuSymbolCoin(pos.Symbol, "USDT")
+		if !ok {
+			continue
+		}
+		leg := getLeg(coin)
+		if leg.symbol == "" {
+			leg.symbol = pos.Symbol
+			leg.fuExp = fuExp
+		}
+		// both LONG and SHORT legs are added up in hedge mode
+		leg.netAmt += pos.SignPositionAmt
+		if pos.PositionSide != "" && pos.PositionSide != bnc.FuturesPositionSideBoth {
+			leg.posSide = bnc.FuturesPositionSideShort
+		}
+	}
+
+	for _, pos := range acct.CMFutures.Positions {
+		if pos.SignPositionAmt == 0 {
+			continue
+		}
+		pair, ok := acct.CMFuPair(pos.Symbol)
+		if !ok {
+			continue
+		}
+		leg := getLeg(pair.Asset)
+		if leg.cmSymbol == "" {
+			leg.cmSymbol = pos.Symbol
+		}
+		if pos.PositionSide != "" && pos.PositionSide != bnc.FuturesPositionSideBoth {
+			leg.cmPosSide = bnc.FuturesPositionSideShort
+		}
+		qty, err := acct.CMPosCoinQty(pos)
+		if err != nil {
+			leg.err = err
+			continue
+		}
+		leg.cmNetQty += qty
+	}
+
+	// coins without futures legs are unhedged spot exposure
+	for _, coin := range heldCoins(acct) {
+		getLeg(coin)
+	}
+
+	for _, coin := range coins {
+		leg := legs[coin]
+		spQty := SpotHoldingQty(acct, coin)
+		if spQty == 0 && leg.netAmt == 0 && leg.cmNetQty == 0 && leg.err == nil {
+			continue
+		}
+
+		if leg.err == nil {
+			if leg.symbol != "" {
+				leg.price, leg.err = acct.FuMarkPrice(leg.symbol)
+			} else {
+				leg.price, leg.err = acct.FuMarkPrice(coin + "USDT")
+			}
+		}
+
+		shortQty := -leg.netAmt*leg.fuExp - leg.cmNetQty
+		residual := spQty - shortQty
+		// fuExp is the qty multiplier, price of futures is fuExp times of spot
+		price := leg.price / leg.fuExp
+		residualValue := math.Abs(residual) * price
+
+		inputs := map[string]float64{
+			"spotQty":       spQty,
+			"fuShortQty":    shortQty,
+			"cmShortQty":    -leg.cmNetQty,
+			"residual":      residual,
+			"residualValue": residualValue,
+		}
+		thresholds := map[string]float64{"minResidualValue": minHedgeResidualUsdt}
+
+		if leg.err == nil && residualValue < minHedgeResidualUsdt {
+			analysis.Findings = append(analysis.Findings, Finding{
+				Code:       FindingHedgeBalanced,
+				Severity:   FindingSeverityInfo,
+				Subject:    coin,
+				Skipped:    true,
+				Thresholds: thresholds,
+				Inputs:     inputs,
+			})
+			continue
+		}
+
+		mismatch := HedgeMismatch{
+			Coin:          coin,
+			FuSymbol:      leg.symbol,
+			FuExp:         leg.fuExp,
+			CMSymbol:      leg.cmSymbol,
+			SpotQty:       spQty,
+			FuShortQty:    shortQty,
+			Residual:      residual,
+			Price:         price,
+			ResidualValue: residualValue,
+			Err:           leg.err,
+		}
+
+		if leg.err == nil {
+			side := cex.OrderSideSell
+			if residual < 0 {
+				side = cex.OrderSideBuy
+			}
+			// repair on um leg first, cm contracts can not be traded in small qty
+			if leg.symbol != "" {
+				mismatch.Repairs = append(mismatch.Repairs, HedgeRepairOrder{
+					Symbol:       leg.symbol,
+					PairType:     cex.PairTypeFutures,
+					Side:         side,
+					PositionSide: leg.posSide,
+					Qty:          mathy.RoundFloor(math.Abs(residual)/leg.fuExp, 6),
+				})
+			} else if pair, ok := acct.CMFuPair(leg.cmSymbol); ok {
+				cmPrice, _ := mapGetter(acct.MarkPrices, leg.cmSymbol)
+				contracts := math.Floor(math.Abs(residual) * cmPrice / pair.ContractSize)
+				if contracts > 0 {
+					mismatch.Repairs = append(mismatch.Repairs, HedgeRepairOrder{
+						Symbol:       leg.cmSymbol,
+						PairType:     cex.PairTypeFutures,
+						Side:         side,
+						PositionSide: leg.cmPosSide,
+						Qty:          contracts,
+						IsCM:         true,
+					})
+				}
+			}
+		}
+
+		finding := Finding{
+			Code:       FindingHedgeResidual,
+			Severity:   FindingSeverityWarn,
+			Subject:    coin,
+			Thresholds: thresholds,
+			Inputs:     inputs,
+		}
+		if leg.err != nil {
+			finding.Code = FindingHedgePriceErr
+			finding.Skipped = true
+		}
+		analysis.Findings = append(analysis.Findings, finding)
+
+		analysis.Mismatches = append(analysis.Mismatches, mismatch)
+		analysis.TotalResidualValue += residualValue
+	}
+
+	sort.Slice(analysis.Mismatches, func(i, j int) bool {
+		return analysis.Mismatches[i].ResidualValue > analysis.Mismatches[j].ResidualValue
+	})
+
+	analysis.Unhedged = len(analysis.Mismatches) > 0
+
+	return
+}
@@ -20,9 +20,21 @@ import (
 type Main struct {
 	user        *bnc.User
 	acctWatcher *AcctWatcher
+	// Audit of executor is recorder of current handle cycle,
+	// only changed while muxHandling is held.
+	executor    *ActionExecutor
+	allocCfg    AllocationConfig
+	earn        *EarnManager
+	repayPolicy RepayPolicy
+	unwindCfg   UnwindConfig
+	audit       *AuditRecorder
+	posStore    *PosTradeStore
 
 	muxHandling sync.Mutex
 
+	muxStarted sync.Mutex
+	started    bool
+
 	logger *slog.Logger
 }
 
@@ -31,19 +43,86 @@ func NewMain(user *bnc.User, logger *slog.Logger) (*Main, error) {
 		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 	}
 	logger = logger.With("cex", user.Api().Cex, "apiKey", user.Api().ApiKey)
-	watcher := NewAcctWatcher(user, logger)
-	// TODO
-	//err := watcher.Start()
-	//if err != nil {
-	//	return nil, err
-	//}
 	return &Main{
 		user:        user,
-		acctWatcher: watcher,
+		acctWatcher: NewAcctWatcher(user, logger),
+		executor:    NewActionExecutor(user, logger),
+		allocCfg:    DefaultAllocationConfig(),
+		earn:        NewEarnManager(DefaultEarnConfig()),
+		repayPolicy: DefaultRepayPolicy(),
+		unwindCfg:   DefaultUnwindConfig(),
 		logger:      logger,
 	}, nil
 }
 
+// SetDryRun
+// In dry run, mutating exchange calls are only logged,
+// the account snapshot is updated as if they had succeeded.
+// Should be set before starting.
+func (m *Main) SetDryRun(dryRun bool) {
+	m.executor.DryRun = dryRun
+}
+
+// SetAllocationConfig
+// Should be set before starting.
+func (m *Main) SetAllocationConfig(cfg AllocationConfig) {
+	m.allocCfg = cfg
+}
+
+// SetEarnConfig
+// Should be set before starting.
+func (m *Main) SetEarnConfig(cfg EarnConfig) {
+	m.earn = NewEarnManager(cfg)
+}
+
+// SetRepayPolicy
+// No trigger is enabled by default.
+// Should be set before starting.
+func (m *Main) SetRepayPolicy(policy RepayPolicy) {
+	m.repayPolicy = policy
+}
+
+// SetUnwindConfig
+// Should be set before starting.
+func (m *Main) SetUnwindConfig(cfg UnwindConfig) {
+	m.unwindCfg = cfg
+}
+
+// SetAuditLog writes every mutating action to log.
+// Should be set before starting.
+func (m *Main) SetAuditLog(log *AuditLog) {
+	m.audit = NewAuditRecorder(log, m.user.Api().ApiKey, m.logger)
+}
+
+// SetPosTradeStore saves in-flight positions of NewPos and NewPosSlowly to store,
+// so they can be resumed by Start after restart.
+// Should be set before starting.
+func (m *Main) SetPosTradeStore(store *PosTradeStore) {
+	m.posStore = store
+}
+
+// Start resumes position trades left in store,
+// then starts account watcher and handles every account it fans out.
+func (m *Main) Start() error {
+	m.muxStarted.Lock()
+	if m.started {
+		m.muxStarted.Unlock()
+		return errors.New("main is started")
+	}
+	m.started = true
+	m.muxStarted.Unlock()
+
+	if _, err := m.ResumePosTrades(); err != nil {
+		m.logger.Error("Cannot Resume Position Trades", "err", err)
+	}
+
+	if err := m.acctWatcher.Start(); err != nil {
+		return err
+	}
+	go m.wait()
+	return nil
+}
+
 func (m *Main) wait() {
 	suber := m.acctWatcher.Sub()
 	for {
@@ -62,151 +141,406 @@ func (m *Main) handle(acct *Account) {
 	}
 	defer m.muxHandling.Unlock()
 
-	m.handleRedundant(acct)
+	m.executor.Audit = m.audit.Begin(acct)
+
+	acct = m.handleRedundant(acct)
+	acct = m.handleRepay(acct)
 
 	analysis := AnalyzeAccount(acct)
+	LogFindings(m.logger, analysis.Findings())
 	m.handleAnalysis(acct, analysis)
 }
 
-func (m *Main) handleRedundant(acct *Account) {
-	m.handleLowLtvOrds(acct)
-	m.adjustLowRiskFutureAccount(acct)
-}
+// handleRedundant returns account to be analysed after capital is allocated by bands and yields.
+// If funding rates can not be queried, um futures are not ranked.
+func (m *Main) handleRedundant(acct *Account) *Account {
+	rates := AllocationRates{LoanRates: m.repayPolicy.LoanRates}
+	fundingRates, err := QueryFundingRateMap()
+	if err != nil {
+		m.logger.Warn("Cannot Query Funding Rates", "err", err)
+	}
+	rates.FundingRates = fundingRates
 
-func (m *Main) handleLowLtvOrds(acct *Account) {
-	lowOrds, _ := m.ClassifyLoanOrds(acct)
-	results, errs := m.AdjustLowLtvLoanOrds(m.user, lowOrds)
-	for _, res := range results {
-		m.logger.Info("Low Ltv Order Adjusted", "result", res)
+	var actions []Action
+	for _, action := range PlanAllocationActions(acct, m.allocCfg, rates) {
+		if action, ok := m.earn.Limit(acct, action); ok {
+			actions = append(actions, action)
+		}
 	}
-	for _, err := range errs {
-		m.logger.Error("Cannot Adjust Low Ltv Order", "err", err)
+	if len(actions) == 0 {
+		return acct
 	}
-	updating, _, err := m.acctWatcher.Update()
-	if err != nil {
-		m.logger.Error("Cannot Update Account", "err", err)
+	for _, action := range actions {
+		m.logger.Info("Allocation Action Planned", "action", action)
 	}
-	if updating {
-		m.logger.Warn("Account Is Updating")
-		time.Sleep(time.Second)
-		_, _, err := m.acctWatcher.Update()
-		if err != nil {
-			m.logger.Error("Cannot Update Account", "err", err)
+	var done []Action
+	for _, res := range m.executor.Execute(actions) {
+		if res.Err == nil {
+			m.settleEarn(res.Action)
+			done = append(done, res.Action)
 		}
 	}
+	return m.refreshAccount(acct, done...)
 }
 
-func (m *Main) adjustLowRiskFutureAccount(acct *Account) {
-	marginRatio, marginValue, totalPos := acct.MarginRatio()
+// handleRepay repays loans by triggers of repay policy,
+// account is refreshed after every action.
+func (m *Main) handleRepay(acct *Account) *Account {
+	actions, unmet := PlanFlexibleRepayActions(acct, m.repayPolicy, m.allocCfg, time.Now())
+	for _, action := range actions {
+		action, ok := m.earn.Limit(acct, action)
+		if !ok {
+			continue
+		}
+		m.logger.Info("Repay Action Planned", "action", action)
+		if res := m.executor.Execute([]Action{action})[0]; res.Err != nil {
+			continue
+		}
+		m.settleEarn(action)
+		acct = m.refreshAccount(acct, action)
+	}
+	for _, need := range unmet {
+		m.logger.Warn("Repay Need Not Met", "trigger", need.Trigger, "subject", need.Subject, "qty", need.Qty)
+	}
+	return acct
+}
 
-	var marginGap float64
+// redeemEarn redeems asset to spot if spot free qty is less than need,
+// and waits until redeemed coin is settled.
+func (m *Main) redeemEarn(acct *Account, asset string, need float64, reason FindingCode) *Account {
+	bal, _ := acct.SpotBal(asset)
+	action, ok := m.earn.PlanRedeem(acct, asset, need-bal.Free, reason)
+	if !ok {
+		return acct
+	}
+	m.logger.Info("Earn Redeem Planned", "action", action)
+	if res := m.executor.Execute([]Action{action})[0]; res.Err != nil {
+		return acct
+	}
+	m.settleEarn(action)
+	return m.refreshAccount(acct, action)
+}
 
-	if totalPos <= 0 {
-		m.logger.Info("Future Total Position Is 0")
+// settleEarn records executed redeem action,
+// and waits until redeemed coin can be used in spot account.
+func (m *Main) settleEarn(action Action) {
+	if action.Type != ActionTypeRedeem {
 		return
-	} else {
-		marginRatio = marginValue / totalPos
-		marginGap = totalPos * math.Abs(marginRatio-middleFuturesAccountMarginRatio)
 	}
+	settledAt := m.earn.Redeemed(action)
+	if !m.executor.DryRun {
+		time.Sleep(time.Until(settledAt))
+	}
+}
 
-	remainMarginGap := marginGap
-
-	var validCoins []string
-	var usdtAsset bnc.FuturesAccountAsset
-	for _, asset := range acct.fuAsts {
-		// Here must be 0,
-		// because is asset amount, not USDT,
-		// be careful.
-		if asset.MaxWithdrawAmount <= 0 {
-			continue
-		}
+func (m *Main) handleAnalysis(acct *Account, analysis AccountAnalysis) {
+	loanAnaly := analysis.Loans
+	fuAnaly := analysis.Futures
+	switch {
+	case loanAnaly.Risky && fuAnaly.Risky:
+		m.handleBothRisky(acct, analysis)
+	case loanAnaly.Risky:
+		m.handleLoanRisky(acct, analysis)
+	case fuAnaly.Risky:
+		m.handleFuRisky(acct, analysis)
+	}
+}
 
-		coin := asset.Asset
+func (m *Main) handleBothRisky(acct *Account, analysis AccountAnalysis) {
+	spPairs, err := QuerySpotPairs()
+	if err != nil {
+		m.logger.Error("Cannot Query Spot Pairs", "err", err)
+		return
+	}
+	actions := PlanJointRiskyActions(acct, spPairs)
+	for _, action := range actions {
+		m.logger.Info("Joint Risky Action Planned", "action", action)
+	}
 
-		if coin == "USDT" {
-			usdtAsset = asset
-			continue
+	var done []Action
+	for _, res := range m.executor.Execute(actions) {
+		if res.Err == nil {
+			done = append(done, res.Action)
 		}
-
-		validCoins = append(validCoins, coin)
 	}
+	acct = m.refreshAccount(acct, done...)
 
-	if usdtAsset.MaxWithdrawAmount > 1 {
-		validCoins = slices.Insert(validCoins, 0, usdtAsset.Asset)
+	for _, item := range jointRiskItems(acct) {
+		m.logger.Error("Joint Risky Item Not Fixed", "subject", item.Subject, "distance", item.Distance, "demand", item.Demand)
 	}
+}
+
+func (m *Main) handleLoanRisky(acct *Account, analysis AccountAnalysis) {
+	m.fixLoanDemands(acct, analysis.Loans.Demands)
+}
 
-	_acct := acct
+// fixLoanDemands carries out demands from high ltv to low ltv,
+// redeeming LD collateral, adding collateral and repaying USDT.
+// Account is refreshed after every step.
+// Returns the latest account and demands which are not met.
+func (m *Main) fixLoanDemands(acct *Account, demands []RiskyLoanDemand) (*Account, []RiskyLoanDemand) {
+	demands = slices.Clone(demands)
+	sort.SliceStable(demands, func(i, j int) bool {
+		return demands[i].Order.CurrentLTV > demands[j].Order.CurrentLTV
+	})
+
+	var unmet []RiskyLoanDemand
+
+	for _, demand := range demands {
+		logger := m.logger.With("loanCoin", demand.Order.LoanCoin, "collateralCoin", demand.Order.CollateralCoin)
+
+		for _, planner := range []func(*Account, RiskyLoanDemand) (Action, bool){
+			PlanLoanRedeemAction,
+			PlanLoanCollateralAction,
+			PlanLoanRepayAction,
+		} {
+			action, ok := planner(acct, demand)
+			if !ok {
+				continue
+			}
+			if action, ok = m.earn.Limit(acct, action); !ok {
+				continue
+			}
+			logger.Info("Loan Action Planned", "action", action)
+			res := m.executor.Execute([]Action{action})[0]
+			if res.Err != nil {
+				continue
+			}
+			m.settleEarn(action)
+			acct = m.refreshAccount(acct, action)
+		}
 
-	for _, coin := range validCoins {
-		// The asset status may change,
-		// so should get new asset timely.
-		asset, ok := _acct.FuAsset(coin)
+		ord, ok := acct.LoanOrd(demand.Order.LoanCoin + "_" + demand.Order.CollateralCoin)
 		if !ok {
 			continue
 		}
+		if remain := LoanRepayNeed(ord, demand.TargetLtv); remain >= minLoanAdditionalUsdt {
+			bal, _ := acct.SpotBal(ord.LoanCoin)
+			var unmet float64
+			acct, unmet = m.BorrowMoreUsdt(acct, remain-bal.Free, FindingLoanLtvHigh)
+			if unmet >= minUsdt {
+				acct, _ = m.cutPositions(acct, unmet, FindingLoanLtvHigh)
+			}
+			if action, ok := PlanLoanRepayAction(acct, demand); ok {
+				logger.Info("Loan Action Planned", "action", action)
+				if res := m.executor.Execute([]Action{action})[0]; res.Err == nil {
+					acct = m.refreshAccount(acct, action)
+				}
+			}
+			if ord, ok = acct.LoanOrd(demand.Order.LoanCoin + "_" + demand.Order.CollateralCoin); !ok {
+				continue
+			}
+		}
+		if remain := LoanRepayNeed(ord, demand.TargetLtv); remain >= minLoanAdditionalUsdt {
+			logger.Error("Loan Demand Not Met", "ltv", ord.CurrentLTV, "targetLtv", demand.TargetLtv, "remainingUsdt", remain)
+			unmet = append(unmet, demand)
+		}
+	}
 
-		widrValue, tranRes, err := m.ReduceFuCollats(m.user, acct, asset, remainMarginGap)
+	return acct, unmet
+}
 
-		if err != nil {
-			m.logger.Error("Cannot Reduce Futures Collaterals", "err", err)
+// BorrowMoreUsdt borrows need USDT against spare loan collateral to spot account,
+// account is refreshed after every borrowing.
+// Returns the latest account and USDT still unmet.
+func (m *Main) BorrowMoreUsdt(acct *Account, need float64, reason FindingCode) (*Account, float64) {
+	if need < minUsdt {
+		return acct, math.Max(need, 0)
+	}
+	colls, err := QueryLoanCollateralCoins(m.user)
+	if err != nil {
+		m.logger.Error("Cannot Query Loan Collateral Coins", "err", err)
+		return acct, need
+	}
+	actions, unmet := PlanBorrowUsdtActions(acct, colls, m.allocCfg, need, reason)
+	for _, action := range actions {
+		m.logger.Info("Borrow Action Planned", "action", action)
+		if res := m.executor.Execute([]Action{action})[0]; res.Err != nil {
+			unmet += action.Qty
 			continue
 		}
+		acct = m.refreshAccount(acct, action)
+	}
+	if unmet >= minUsdt {
+		m.logger.Warn("Borrow Demand Not Met", "need", need, "unmet", unmet)
+	}
+	return acct, unmet
+}
 
-		m.logger.Info("Futures Collateral Reduced", "result", tranRes)
+// cutPositions unwinds um hedges by unwind config until usdtNeed is released,
+// futures short is bought back before spot coin is sold.
+// Account is refreshed after every hedge.
+// Returns the latest account and what is actually released.
+func (m *Main) cutPositions(acct *Account, usdtNeed float64, reason FindingCode) (*Account, UnwindReport) {
+	return m.cutPositionsBy(acct, usdtNeed, m.unwindCfg, reason)
+}
 
-		remainMarginGap -= widrValue
-		if remainMarginGap <= 10 {
-			break
-		}
+// cutPositionsBy is cutPositions by cfg instead of unwind config.
+func (m *Main) cutPositionsBy(acct *Account, usdtNeed float64, cfg UnwindConfig, reason FindingCode) (*Account, UnwindReport) {
+	var report UnwindReport
 
-		if widrValue > 0 {
-			// Should sleep 2 seconds, avoid high frequency.
-			time.Sleep(time.Second * 2)
+	spPairs, err := QuerySpotPairs()
+	if err != nil {
+		m.logger.Error("Cannot Query Spot Pairs", "err", err)
+		return acct, report
+	}
+	fuPairs, err := QueryFuPairs()
+	if err != nil {
+		m.logger.Error("Cannot Query Futures Pairs", "err", err)
+		return acct, report
+	}
 
-			// The withdrawal action may change other assets' maxWithdrawAmount,
-			// so should query future assets again.
-			// Query future account info may result in high frequency,
-			// so can calculate the influence of previous withdrawal action.
-			_, newAcct, err := m.acctWatcher.Update()
-			if err != nil {
-				m.logger.Error("Cannot Update Account", "err", err)
-				continue
+	actions, planned := PlanCutPositions(acct, spPairs, fuPairs, usdtNeed, cfg, reason)
+	m.logger.Info("Cutting Positions", "usdtNeed", usdtNeed, "planned", planned, "orders", len(actions))
+
+	executor := *m.executor
+	executor.OrderTimeout = cfg.FillTimeout
+
+	fuUsdt0, _ := acct.FuAsset("USDT")
+	for i := 0; i+1 < len(actions); i += 2 {
+		legs := actions[i : i+2]
+		results := executor.ExecuteUntilErr(legs)
+		report.addLegs(results)
+		var done []Action
+		for _, res := range results {
+			if res.Err == nil {
+				done = append(done, res.Action)
 			}
-			_acct = newAcct
+		}
+		if len(done) == 1 {
+			m.logger.Error("Cut Position Leg Failed, Spot Is Unhedged", "futuresLeg", legs[0], "spotLeg", legs[1])
+		}
+		if len(done) > 0 {
+			acct = m.refreshAccount(acct, done...)
 		}
 	}
 
-	if remainMarginGap > 10 {
-		m.logger.Error("Futures Collateral Remaining Value > 10")
+	fuUsdt1, _ := acct.FuAsset("USDT")
+	report.FuturesUsdt = math.Max(fuUsdt1.MaxWithdrawAmount-fuUsdt0.MaxWithdrawAmount, 0)
+
+	if qty := mathy.RoundFloor(report.FuturesUsdt, 2); cfg.Withdraw && qty >= minUsdt {
+		action := Action{
+			Type:         ActionTypeTransfer,
+			Reason:       reason,
+			Asset:        "USDT",
+			Qty:          qty,
+			TransferType: bnc.TransferTypeUmfutureMain,
+		}
+		if res := m.executor.Execute([]Action{action})[0]; res.Err == nil {
+			report.WithdrawnUsdt = qty
+			acct = m.refreshAccount(acct, action)
+		}
 	}
+
+	m.logger.Info("Positions Cut", "usdtNeed", usdtNeed, "released", report.Released(),
+		"spotUsdt", report.SpotUsdt, "futuresUsdt", report.FuturesUsdt, "withdrawnUsdt", report.WithdrawnUsdt)
+	return acct, report
 }
 
-func (m *Main) handleAnalysis(acct *Account, analysis AccountAnalysis) {
-	loanAnaly := analysis.Loans
-	fuAnaly := analysis.Futures
-	switch {
-	case loanAnaly.Risky && fuAnaly.Risky:
-		m.handleBothRisky(acct, analysis)
-	case loanAnaly.Risky:
-		m.handleLoanRisky(acct, analysis)
-	case fuAnaly.Risky:
-		m.handleFuRisky(acct, analysis)
+// refreshAccount returns account after actions are executed,
+// in dry run, it is the hypothetical account.
+// If account cannot be updated, returns acct.
+func (m *Main) refreshAccount(acct *Account, actions ...Action) *Account {
+	acct = m.nextAccount(acct, actions...)
+	m.executor.Audit.Snapshot(acct)
+	return acct
+}
+
+func (m *Main) nextAccount(acct *Account, actions ...Action) *Account {
+	if m.executor.DryRun {
+		return acct.WithActions(actions...)
 	}
+	for range 3 {
+		updating, newAcct, err := m.acctWatcher.Update()
+		if err != nil {
+			m.logger.Error("Cannot Update Account", "err", err)
+			return acct
+		}
+		if !updating && newAcct != nil {
+			return newAcct
+		}
+		m.logger.Warn("Account Is Updating")
+		time.Sleep(time.Second)
+	}
+	return acct
 }
 
-func (m *Main) handleBothRisky(acct *Account, analysis AccountAnalysis) {
-	// TODO
+func (m *Main) handleFuRisky(acct *Account, analysis AccountAnalysis) {
+	acct = m.fixFuMargin(acct)
+	m.fixCMMargin(acct)
 }
 
-func (m *Main) handleLoanRisky(acct *Account, analysis AccountAnalysis) {
+// fixFuMargin moves spot coins to um futures until target margin ratio is reached,
+// LD USDT is redeemed first if spot USDT is not enough,
+// if spot coins are not enough, borrows USDT against spare loan collateral,
+// then partly unwinds hedges by cutPositions and moves USDT got again.
+func (m *Main) fixFuMargin(acct *Account) *Account {
+	if analysis := AnalyzeMarginFutures(acct); analysis.Risky {
+		acct = m.redeemEarn(acct, "USDT", analysis.MarginRemand, FindingFuMarginRatioLow)
+	}
+	acct = m.transferFuMargin(acct)
+
+	analysis := AnalyzeMarginFutures(acct)
+	if !analysis.Risky {
+		return acct
+	}
+
+	usdt, _ := acct.SpotBal("USDT")
+	acct, _ = m.BorrowMoreUsdt(acct, analysis.MarginRemand-usdt.Free, FindingFuMarginRatioLow)
+	acct = m.transferFuMargin(acct)
+	if analysis = AnalyzeMarginFutures(acct); !analysis.Risky {
+		return acct
+	}
+
+	value := FuUnwindValue(analysis.CurrentMargin, analysis.CurrentTotalPos, middleFuturesAccountMarginRatio)
+	m.logger.Warn("Spot Is Not Enough For Futures Margin, Unwinding Hedges", "marginDemand", analysis.MarginRemand, "unwindValue", value)
+
+	cfg := m.unwindCfg
+	// released futures margin is kept for margin ratio
+	cfg.Withdraw = false
+	acct, _ = m.cutPositionsBy(acct, value, cfg, FindingFuMarginRatioLow)
+
+	acct = m.transferFuMargin(acct)
 
+	if analysis = AnalyzeMarginFutures(acct); analysis.Risky {
+		m.logger.Error("Futures Margin Demand Not Met", "marginRatio", analysis.CurrentMarginRatio, "marginDemand", analysis.MarginRemand)
+	}
+
+	return acct
 }
 
-func (m *Main) handleFuRisky(acct *Account, analysis AccountAnalysis) {
+// transferFuMargin moves spot coins to um futures one by one,
+// account is refreshed after every transfer.
+func (m *Main) transferFuMargin(acct *Account) *Account {
+	for _, action := range PlanFuMarginTransferActions(acct) {
+		m.logger.Info("Futures Margin Action Planned", "action", action)
+		if res := m.executor.Execute([]Action{action})[0]; res.Err != nil {
+			continue
+		}
+		acct = m.refreshAccount(acct, action)
+		if !AnalyzeMarginFutures(acct).Risky {
+			break
+		}
+	}
+	return acct
+}
 
+// fixCMMargin moves spot coins to cm futures as margin of their own positions.
+func (m *Main) fixCMMargin(acct *Account) *Account {
+	for _, action := range PlanCMMarginTransferActions(acct) {
+		m.logger.Info("CM Futures Margin Action Planned", "action", action)
+		if res := m.executor.Execute([]Action{action})[0]; res.Err != nil {
+			continue
+		}
+		acct = m.refreshAccount(acct, action)
+	}
+	for _, demand := range AnalyzeMarginCMFutures(acct).Demands {
+		m.logger.Error("CM Futures Margin Demand Not Met", "asset", demand.Ratio.Asset, "marginDemand", demand.MarginRemand)
+	}
+	return acct
 }
 
-func (m *Main) ClassifyLoanOrds(acct *Account) (lowLtvOrds, highLtvOrds []bnc.CryptoLoanFlexibleOngoingOrder) {
+func ClassifyLoanOrds(acct *Account) (lowLtvOrds, highLtvOrds []bnc.CryptoLoanFlexibleOngoingOrder) {
 	ords := acct.lnOrds
 
 	for _, ord := range ords {
@@ -270,518 +604,104 @@ func (m *Main) ClassifyLoanOrds(acct *Account) (lowLtvOrds, highLtvOrds []bnc.Cr
 //	//return flow.GetStatus()
 //}
 
-func (m *Main) AdjustLowLtvLoanOrds(user *bnc.User, ords []bnc.CryptoLoanFlexibleOngoingOrder) (adResults []bnc.CryptoLoanFlexibleLoanAdjustLtvResult, errs []error) {
-	for i, ord := range ords {
-		ltv0 := ord.CurrentLTV
-		var ltv1 float64
-		if qualityCollts[ord.CollateralCoin] {
-			ltv1 = middleQualityCollateralLtv
-		} else {
-			ltv1 = middleSubordinateCollateralLtv
-		}
-
-		redunColl := ord.CollateralAmount * (1 - ltv0/ltv1)
-		redunColl = mathy.RoundFloor(redunColl, 5)
-
-		_, adRes, err := user.CryptoLoanFlexibleAdjustLtv(ord.LoanCoin, ord.CollateralCoin, redunColl, bnc.LTVReduced)
-
-		if err.IsNotNil() {
-			errs = append(errs, err.Err)
-			adResults = append(adResults, adRes)
-		} else {
-			if i != len(ords)-1 {
-				time.Sleep(time.Second * 2)
-			}
-		}
-	}
-	return
+func (m *Main) NewPosSlowly(spPair, fuPair cex.Pair, spSide cex.OrderSide, spQty, fuExp float64, times int64) error {
+	everyTime := mathy.RoundFloor(spQty/float64(times), int32(spPair.QPrecision))
+	m.logger.Info("Every Position Qty", "qty", everyTime)
+	trade := newPosTrade(PosTradeKindSlowly)
+	trade.SpSide = spSide
+	trade.SpPair = spPair
+	trade.FuPair = fuPair
+	trade.SpQty = everyTime
+	trade.FuExp = fuExp
+	trade.Times = times
+	return m.runPosTrade(trade)
 }
 
-func (m *Main) ReduceFuCollats(user *bnc.User, acct *Account, asset bnc.FuturesAccountAsset, shouldWidrValue float64) (finalWidrValue float64, tranRes bnc.UniversalTransferResp, err error) {
-	coin := asset.Asset
-	maxWidrQty := asset.MaxWithdrawAmount
-	if maxWidrQty <= 0 {
-		return
-	}
-
-	var price = 1.0
+// NewPos
+// fuQty = spQty / fuExp
+func (m *Main) NewPos(spPair, fuPair cex.Pair, spSide cex.OrderSide, spQty, fuExp float64) error {
+	trade := newPosTrade(PosTradeKindSlowly)
+	trade.SpSide = spSide
+	trade.SpPair = spPair
+	trade.FuPair = fuPair
+	trade.SpQty = spQty
+	trade.FuExp = fuExp
+	trade.Times = 1
+	return m.runPosTrade(trade)
+}
 
-	if asset.Asset != "USDT" {
-		syb := coin + "USDT"
-		pos, ok := acct.FuPos(syb)
-		if ok {
-			price, err = fuPrice(pos)
-		} else {
-			price, err = fuPriceByQuerying(syb)
+// ResumePosTrades continues NEW_POS_SLOWLY trades left in position trade store by a crash.
+// Spot order placed before crash is waited, futures is traded to hedge it,
+// then the rest positions are opened.
+// Trades of other kinds are skipped, they are resumed by VIPPortmarAcctSimple.
+// In dry run, every trade is skipped.
+// Returns trades skipped, they are still in store.
+// Called by Start, should be called before opening new positions.
+func (m *Main) ResumePosTrades() (skipped []PosTrade, err error) {
+	trades, err := m.posStore.Load()
+	errs := []error{err}
+	for _, trade := range trades {
+		logger := m.logger.With("id", trade.Id, "kind", trade.Kind, "status", trade.Msg.Status(), "done", trade.Done, "times", trade.Times)
+		if trade.Kind != PosTradeKindSlowly {
+			logger.Info("Position Trade Skipped")
+			skipped = append(skipped, trade)
+			continue
 		}
-		if err != nil {
-			return
+		if m.executor.DryRun {
+			logger.Warn("Dry Run Unfinished Position Trade")
+			skipped = append(skipped, trade)
+			continue
 		}
+		logger.Warn("Resuming Position Trade")
+		// nothing of current position is traded
+		if trade.Msg.SpOrd.Status == VIPPortmarOrderStatusFailed {
+			trade.Msg.SpOrd = VIPPortmarOrd{}
+		}
+		errs = append(errs, m.runPosTrade(trade))
 	}
-
-	widrQty := math.Min(maxWidrQty, shouldWidrValue/price)
-
-	// Here must discount widrQty,
-	// because price is changing timely.
-	// While withdraw request sending to cex,
-	// the widrQty is changing with the asset price.
-	widrQty = mathy.RoundFloor(widrQty*0.99, 5)
-
-	_, tranRes, errResp := user.Transfer(bnc.TransferTypeUmfutureMain, coin, widrQty)
-	if errResp.IsNotNil() {
-		err = errResp.Err
-		return
-	}
-
-	finalWidrValue = widrQty * price
-	return
+	return skipped, errors.Join(errs...)
 }
 
-//func (m *Main) AdjustHighLtvOrds(user *bnc.User, acct *Account) (results []bnc.CryptoLoanFlexibleLoanAdjustLtvResult, errs []error) {
-//	var highLtvOrdNeeds []HighLtvOrdNeed
-//
-//	for i, ord := range acct.LoanOrders {
-//		ltv0 := ord.CurrentLTV
-//		if ltv0 <= 0 {
-//			continue
-//		}
-//		var ltv1 float64
-//		if quolityCollts[ord.CollateralCoin] {
-//			ltv1 = middleQualityCollateralLtv
-//		} else {
-//			ltv1 = middleSubordinateCollateralLtv
-//		}
-//		moreColl := ord.CollateralAmount * (ltv0/ltv1 - 1)
-//
-//		bal, _ := acct.SpotBal(ord.CollateralCoin)
-//		lbal, _ := acct.SpotBal("LD" + ord.CollateralCoin)
-//
-//		allSpot := mathy.RoundFloor((bal.Free+lbal.Free)*0.9999, 5)
-//
-//		addColl := math.Min(allSpot, moreColl)
-//		addColl = mathy.RoundFloor(addColl, 5)
-//
-//		if addColl < moreColl*0.001 {
-//			addColl = 0
-//		}
-//
-//		newLtv0 := ltv0 / (1 + addColl/ord.CollateralAmount)
-//
-//		usdtNeed := ord.TotalDebt * (1 - ltv1/newLtv0)
-//
-//		if addColl > 0 {
-//			_, adRes, err := user.CryptoLoanFlexibleAdjustLtv(ord.LoanCoin, ord.CollateralCoin, addColl, bnc.LTVAdditional)
-//			if err.IsNotNil() {
-//				usdtNeed = ord.TotalDebt * (1 - ltv1/ltv0)
-//				errs = append(errs, err.Err)
-//			} else {
-//				results = append(results, adRes)
-//			}
-//		}
-//
-//		if i != len(acct.lnOrds)-1 {
-//			time.Sleep(time.Second * 2)
-//		}
-//
-//		if usdtNeed/ord.TotalDebt < 0.01 {
-//			continue
-//		}
-//
-//		usdtNeed = mathy.RoundFloor(usdtNeed, 2)
-//
-//		need := HighLtvOrdNeed{ord: ord, usdtNeed: usdtNeed}
-//
-//		highLtvOrdNeeds = append(highLtvOrdNeeds, need)
-//	}
-//
-//	if len(highLtvOrdNeeds) <= 0 {
-//		return
-//	}
-//
-//	sort.Slice(highLtvOrdNeeds, func(i, j int) bool {
-//		needI := highLtvOrdNeeds[i]
-//		needJ := highLtvOrdNeeds[j]
-//		return needI.ord.CurrentLTV > needJ.ord.CurrentLTV
-//	})
-//
-//	var totalUsdtNeed float64
-//	for _, need := range highLtvOrdNeeds {
-//		totalUsdtNeed += need.usdtNeed
-//	}
-//
-//	usdtSpBal, _ := acct.SpotBal("USDT")
-//	usdtSpotRemaining := usdtSpBal.Free - minUsdt
-//
-//	usdtGap := math.Max(totalUsdtNeed-usdtSpotRemaining, 0)
-//
-//	if usdtGap > minUsdt {
-//		_usdtGap, newErrs := m.BorrowMoreUsdt(user, acct, usdtGap)
-//		for _, err := range newErrs {
-//			errs = append(errs, err)
-//		}
-//		usdtGap = _usdtGap
-//		// must sleep 2 seconds at least
-//		time.Sleep(time.Second * 2)
-//	}
-//
-//	if usdtGap > minUsdt {
-//		c.cutPositions(flow, usdtGap, true, true)
-//	}
-//
-//	if c.querySpotAcct(flow).Stopped() {
-//		return flow.GetStatus()
-//	}
-//
-//	usdtSpotRemaining = flow.SpBalance("USDT").Free - minUsdt
-//
-//	for _, need := range highLtvOrdNeeds {
-//		if usdtSpotRemaining < minUsdt {
-//			break
-//		}
-//		repayNum := math.Min(need.usdtNeed, usdtSpotRemaining)
-//		repayNum = mathy.RoundFloor(repayNum, 2)
-//		if repayNum < 1 {
-//			continue
-//		}
-//		flow.Info("Repaying", repayNum, need.ord.LoanCoin, "by", need.ord.CollateralCoin)
-//		resp, repayRes, err := c.user.CryptoLoanFlexibleRepay(need.ord.LoanCoin, need.ord.CollateralCoin, repayNum, bnc.BigFalse, bnc.BigFalse)
-//		if err.IsNotNil() {
-//			return flow.ReqErr(resp, err, 1, "Cannot repay", repayNum, need.ord.LoanCoin, "by", need.ord.CollateralCoin)
-//		} else {
-//			usdtSpotRemaining -= repayNum
-//			flow.Info(repayNum, repayRes.LoanCoin, "repayed")
-//		}
-//		time.Sleep(time.Second * 2)
-//	}
-//
-//	return flow.GetStatus()
-//}
-//
-//func (m *Main) BorrowMoreUsdt(user *bnc.User, acct *Account, totalBorrow float64) (remainingNeed float64, errs []error) {
-//	remainingNeed = totalBorrow
-//
-//	if totalBorrow < minUsdt {
-//		return
-//	}
-//
-//	//if c.queryLoanOngoingOrds(flow).Stopped() {
-//	//	return remainingNeed, flow.GetStatus()
-//	//}
-//	//
-//	//if c.querySpotAcct(flow).Stopped() {
-//	//	return remainingNeed, flow.GetStatus()
-//	//}
-//
-//	ords := acct.LoanOrders
-//
-//	_, _colls, errReq := user.CryptoLoanFlexibleCollateralAssets("")
-//	colls := map[string]bnc.CryptoLoanFlexibleCollateralCoin{}
-//
-//	if errReq.IsNotNil() {
-//		errs = append(errs, errReq.Err)
-//		return
-//	} else {
-//		for _, coll := range _colls.Rows {
-//			colls[coll.CollateralCoin] = coll
-//		}
-//	}
-//
-//	for _, ord := range ords {
-//		if remainingNeed < minUsdt {
-//			break
-//		}
-//
-//		coin := ord.CollateralCoin
-//		collInfo, ok := colls[coin]
-//		loanCap := 1000_0000.0
-//		if ok {
-//			loanCap = (collInfo.MaxLimit - ord.TotalDebt) * 0.9
-//		}
-//
-//		bal, _ := acct.SpotBal(coin)
-//		lbal, _ := acct.SpotBal("LD" + coin)
-//		collNum := bal.Free + lbal.Free
-//		if ord.CollateralAmount <= 0 {
-//			continue
-//		}
-//		borrowCap := collNum / ord.CollateralAmount * ord.TotalDebt
-//		borrowQty := math.Min(borrowCap, remainingNeed)
-//		borrowQty = math.Min(borrowQty, loanCap)
-//		borrowQty = mathy.RoundFloor(borrowQty, 2)
-//
-//		if borrowQty < minUsdt {
-//			continue
-//		}
-//
-//		_, res, errReq := user.CryptoLoanFlexibleBorrow(ord.LoanCoin, ord.CollateralCoin, borrowQty, 0)
-//		if errReq.IsNotNil() {
-//			errs = append(errs, errReq.Err)
-//		} else {
-//			remainingNeed -= borrowQty
-//			m.logger.Info("USDT Borrowed", "result", res)
-//		}
-//		time.Sleep(time.Second * 2)
-//	}
-//
-//	remainingNeed = math.Max(remainingNeed, 0)
-//
-//	return
-//}
-//
-//func (m *Main) cutPositions(acct *Account, usdtNeed float64, shouldWidrUsdt, cutFromHighProfitPos bool) (unCutUsdt float64, err error) {
-//	unCutUsdt = usdtNeed
-//
-//	fuUsdtAss, _ := acct.FuAsset("USDT")
-//
-//	if !shouldWidrUsdt && usdtNeed <= fuUsdtAss.MaxWithdrawAmount {
-//		flow.Info(fmt.Sprintf("future USDT max withdraw amount %v > usdt nedd %v", fuUsdtAss.MaxWithdrawAmount, usdtNeed))
-//		return unCutUsdt, flow.GetStatus()
-//	}
-//
-//	fuAcct := flow.LatestFuAcct()
-//
-//	spPairs, flowStatus := c.querySpotPairs(flow)
-//	if flowStatus.Stopped() {
-//		return
-//	}
-//	fuPairs, flowStatus := c.queryFuturesPairs(flow)
-//	if flowStatus.Stopped() {
-//		return
-//	}
-//
-//	poss := fuAcct.Positions
-//	sort.Slice(poss, func(i, j int) bool {
-//		pi := poss[i]
-//		pj := poss[j]
-//
-//		vi := pi.PositionInitialMargin * pi.Leverage
-//		vj := pj.PositionInitialMargin * pj.Leverage
-//
-//		var ri, rj = -99999999.0, -99999999.0
-//		if vi > 0 {
-//			ri = pi.UnrealizedProfit / vi
-//		}
-//
-//		if vj > 0 {
-//			rj = pj.UnrealizedProfit / pj.PositionInitialMargin * pj.Leverage
-//		}
-//
-//		return (ri > rj) == cutFromHighProfitPos
-//	})
-//
-//	// TODO should consider again
-//	if fuUsdtAss.MaxWithdrawAmount > 0 {
-//		unCutUsdt -= fuUsdtAss.MaxWithdrawAmount
-//	}
-//	if fuAcct.TotalUnrealizedProfit < 0 {
-//		unCutUsdt -= fuAcct.TotalUnrealizedProfit
-//	}
-//	if fuUsdtAss.WalletBalance < 0 {
-//		unCutUsdt -= fuUsdtAss.WalletBalance
-//	}
-//
-//	for _, pos := range poss {
-//		const minRelease = 10.0
-//
-//		if unCutUsdt < minRelease {
-//			break
-//		}
-//
-//		// TODO should confirm that UPNL is position UPNL or not
-//		totalPosRelease := pos.UnrealizedProfit + pos.PositionInitialMargin
-//		if totalPosRelease < minRelease {
-//			continue
-//		}
-//
-//		syb := pos.Symbol
-//		sybs := strings.Split(syb, "USDT")
-//		if len(sybs) != 2 {
-//			continue
-//		}
-//		coin := sybs[0]
-//
-//		price := c.priceByPos(pos)
-//		if price == 0 {
-//			continue
-//		}
-//
-//		posAmt := pos.AbsPositionAmt()
-//
-//		coinSpQty := flow.SpBalance(coin).Free
-//
-//		cutQty := math.Min(posAmt, coinSpQty)
-//
-//		releasePerQty := totalPosRelease/posAmt + price
-//
-//		cutQty = math.Min(cutQty, unCutUsdt/releasePerQty)
-//
-//		cutValue := cutQty / posAmt * pos.PositionInitialMargin * pos.Leverage
-//
-//		// TODO should query from binance
-//		if cutValue < minFuTradeUsdt || cutValue < minSpotTradeUsdt {
-//			continue
-//		}
-//
-//		spPair, ok := spPairs[syb]
-//		if !ok {
-//			flow.Err(fmt.Errorf("can not get %v spot pair info", syb), 1, "Cannot find", syb, "spot pair")
-//			continue
-//		}
-//
-//		fuPair, ok := fuPairs[syb]
-//		if !ok {
-//			flow.Err(fmt.Errorf("can not get %v future pair info", syb), 1, "Cannot find", syb, "futures pair")
-//			continue
-//		}
-//
-//		isFuCut, spReleaseUsdt, status := c.cutOneTokenPosition(flow, spPair, fuPair, cutQty)
-//		if status.Stopped() {
-//			flow.SetStatus(FlowWarn)
-//		}
-//
-//		if isFuCut {
-//			unCutUsdt -= cutQty * totalPosRelease / posAmt
-//		}
-//
-//		unCutUsdt -= spReleaseUsdt
-//
-//	}
-//
-//	flow.Info(false, fmt.Sprintf("remaining usdt is %v", unCutUsdt))
-//
-//	if !shouldWidrUsdt {
-//		return
-//	}
-//
-//	widrUsdt := usdtNeed
-//
-//	if !c.queryFuAcct(flow).Stopped() {
-//		widrUsdt = flow.FuAsset("USDT").MaxWithdrawAmount
-//	}
-//
-//	if widrUsdt < minUsdt {
-//		return
-//	}
-//
-//	widrUsdt = mathy.RoundFloor(widrUsdt, 2)
-//
-//	flow.Info("Transferring", widrUsdt, "USDT from futures to spot")
-//	resp, tranRes, errReq := c.user.Transfer(bnc.TransferTypeUmfutureMain, "USDT", widrUsdt)
-//	if errReq.IsNotNil() {
-//		return unCutUsdt, flow.ReqErr(resp, errReq, 1, "Cannot transfer", widrUsdt, "USDT from futures to spot")
-//	}
-//
-//	flow.Info(widrUsdt, "USDT transferred from futures to spot,", tranRes)
-//	return unCutUsdt, flow.GetStatus()
-//}
-//
-//func (m *Main) cutOneTokenPosition(flow *Flow, spPair, fuPair cex.Pair, qty float64) (isFuCut bool, spUsdt float64, flowStatus FlowStatus) {
-//	qPrec := int32(math.Min(float64(spPair.QPrecision), float64(fuPair.QPrecision)))
-//
-//	qty = mathy.RoundFloor(qty, qPrec)
-//
-//	flow.Info("Buying", qty, fuPair.Asset)
-//	resp, fuOpenOrd, err := c.user.NewFuturesMarketBuyOrder(fuPair.Asset, fuPair.Quote, qty)
-//	if err.IsNotNil() {
-//		return isFuCut, spUsdt, flow.ReqErr(resp, err, 1, "Cannot new", qty, fuPair.Asset, "futures market order")
-//	}
-//
-//	flow.AddOrder(*fuOpenOrd)
-//
-//	ctxFuWait, cancelFuWait := context.WithCancel(context.Background())
-//	defer cancelFuWait()
-//	chErr := c.user.WaitOrder(ctxFuWait, fuOpenOrd)
-//	select {
-//	case err = <-chErr:
-//	case <-time.After(time.Second * 10):
-//	}
-//
-//	flow.AddOrder(*fuOpenOrd)
-//
-//	if err.IsNotNil() || ctxFuWait.Err() != nil {
-//		flow.Err(fmt.Errorf("reqerr: %w, ctxerr: %w", err.Err, ctxFuWait.Err()), 1, "Cannot wait futures order")
-//		return isFuCut, spUsdt, flow.GetStatus()
-//	}
-//
-//	isFuCut = true
-//
-//	if c.queryFuAcct(flow).Stopped() {
-//		return isFuCut, spUsdt, flow.GetStatus()
-//	}
-//
-//	coinSpotBal := flow.SpBalance(spPair.Asset)
-//
-//	_ = c.querySpotAcct(flow)
-//
-//	coinSpotBal = flow.SpBalance(spPair.Asset)
-//
-//	coinSpotQty := mathy.RoundFloor(math.Min(coinSpotBal.Free, qty), int32(spPair.QPrecision))
-//
-//	if coinSpotQty < qty*0.9999 {
-//		flow.Disaster(fmt.Errorf("%v spot balance is %v, smaller than future close qty %v", spPair.Asset, coinSpotQty, qty), 1, "Spot account has no more coins!")
-//		return isFuCut, spUsdt, flow.GetStatus()
-//	}
-//
-//	spotResp, spotOrder, err := c.user.NewSpotMarketSellOrder(spPair.Asset, spPair.Quote, coinSpotQty, cex.CltOptRetryCount(3, time.Second*2))
-//	if err.IsNotNil() {
-//		return isFuCut, spUsdt, flow.ReqErr(spotResp, err, 1, "Cannot new market order")
-//	}
-//	flow.AddOrder(*spotOrder)
-//
-//	ctxSpWait, cancelSpWait := context.WithCancel(context.Background())
-//	defer cancelSpWait()
-//	chErr = c.user.WaitOrder(ctxSpWait, spotOrder)
-//	select {
-//	case err = <-chErr:
-//	case <-time.After(time.Second * 10):
-//	}
-//	flow.AddOrder(*spotOrder)
-//	if err.IsNotNil() || ctxFuWait.Err() != nil {
-//		flow.Err(fmt.Errorf("waiterr: %w, ctxerr: %w", err.Err, ctxFuWait.Err()), 1, "Cannot wait spot order")
-//		return
-//	}
-//
-//	spUsdt = spotOrder.FilledQuote
-//
-//	return
-//}
-
-func (m *Main) NewPosSlowly(spPair, fuPair cex.Pair, spSide cex.OrderSide, spQty, fuExp float64, times int64) error {
-	everyTime := mathy.RoundFloor(spQty/float64(times), int32(spPair.QPrecision))
-	m.logger.Info("Every Position Qty", "qty", everyTime)
-	for i := int64(0); i < times; i++ {
-		//_, acct, err := m.acctWatcher.Update()
-		//if err != nil {
-		//	return err
-		//}
-		//bal, _ := acct.SpotBal("USDT")
-		//if bal.Free < 1000 {
-		//	break
-		//}
-		err := m.NewPos(spPair, fuPair, spSide, everyTime, fuExp)
-		if err != nil {
+// runPosTrade opens positions of trade one by one from trade.Done.
+// Trade is saved after every transition, and deleted when it ends hedged.
+func (m *Main) runPosTrade(trade PosTrade) error {
+	audit := m.audit.Begin(nil)
+	for trade.Done < trade.Times {
+		if err := m.newPos(&trade, audit); err != nil {
+			// spot is not traded, position is still hedged
+			switch trade.Msg.SpOrd.Status {
+			case VIPPortmarOrderStatusNone, VIPPortmarOrderStatusFailed:
+				m.posStore.sync(trade, true)
+			}
 			return err
 		}
-		time.Sleep(time.Second)
+		trade.Done++
+		trade.Msg = VIPPortmarPosMsg{}
+		m.posStore.sync(trade, trade.Done >= trade.Times)
+		if trade.Done < trade.Times {
+			time.Sleep(time.Second)
+		}
 	}
 	return nil
 }
 
-// NewPos
-// fuQty = spQty / fuExp
-func (m *Main) NewPos(spPair, fuPair cex.Pair, spSide cex.OrderSide, spQty, fuExp float64) error {
+// newPos opens current position of trade, spot firstly.
+// Legs traded before restart are not traded again.
+func (m *Main) newPos(trade *PosTrade, audit *AuditRecorder) error {
 	m.logger.Info("New Position")
 
+	spPair, fuPair, spSide, fuExp := trade.SpPair, trade.FuPair, trade.SpSide, trade.FuExp
+
 	if fuExp == 0 {
 		m.logger.Error("fuExp Is 0")
 		return errors.New("fu exp is 0")
 	}
 
-	spQty = mathy.RoundFloor(spQty, int32(spPair.QPrecision))
+	spQty := mathy.RoundFloor(trade.SpQty, int32(spPair.QPrecision))
 
 	fuQty := spQty / fuExp
 	fuQty = mathy.RoundFloor(fuQty, int32(fuPair.QPrecision))
-	logger := m.logger.With("spotSide", spSide, "spotPair", spPair.PairSymbol, "fuPair", fuPair.PairSymbol, "spQty", spQty, "fuQty", fuQty)
+	logger := m.logger.With("tradeId", trade.Id, "spotSide", spSide, "spotPair", spPair.PairSymbol, "fuPair", fuPair.PairSymbol, "spQty", spQty, "fuQty", fuQty)
 
 	if spQty <= spPair.MinTradeQty {
 		m.logger.Error("Spot Qty Is Too Little", "qty", spQty)
@@ -794,53 +714,72 @@ func (m *Main) NewPos(spPair, fuPair cex.Pair, spSide cex.OrderSide, spQty, fuEx
 	}
 
 	var spTrader, fuTrader cex.MarketTraderFunc
+	var fuSide cex.OrderSide
 	if spSide == cex.OrderSideBuy {
 		spTrader = m.user.NewSpotMarketBuyOrder
 		fuTrader = m.user.NewFuturesMarketSellOrder
+		fuSide = cex.OrderSideSell
 	} else if spSide == cex.OrderSideSell {
 		spTrader = m.user.NewSpotMarketSellOrder
 		fuTrader = m.user.NewFuturesMarketBuyOrder
+		fuSide = cex.OrderSideBuy
 	}
 
-	logger.Info("Placing Spot Market Order")
-
-	_, spOrd, reqErr := spTrader(spPair.Asset, spPair.Quote, spQty)
-	if reqErr.IsNotNil() {
-		logger.Error("Cannot Place Spot Market Order", "err", reqErr.Err)
-		return reqErr.Err
+	if m.executor.DryRun {
+		return m.dryRunNewPos(trade, spQty, fuQty, fuSide, audit, logger)
 	}
 
-	logger.Info("Waiting Spot Market Order")
+	msg := &trade.Msg
+	save := func() { m.posStore.sync(*trade, false) }
+
+	logger.Info("Placing Spot Market Order", "status", msg.SpOrd.Status)
 
-	chReqErr := m.user.WaitOrder(context.Background(), spOrd)
-	reqErr = <-chReqErr
-	if reqErr.IsNotNil() {
-		logger.Error("Cannot Wait Spot Market Order", "err", reqErr.Err)
-		return reqErr.Err
+	placing := msg.SpOrd.Status == VIPPortmarOrderStatusNone
+	err := tradeVIPPortmarOrd(context.Background(), m.user, spPair, spTrader, spQty, &msg.SpOrd, save)
+	if placing {
+		audit.RecordOrder(spPair, spSide, false, spQty, &msg.SpOrd.Order, err)
 	}
+	if err != nil {
+		if msg.SpOrd.Status == VIPPortmarOrderStatusFailed {
+			logger.Error("Cannot Place Spot Market Order", "err", err)
+		} else {
+			logger.Error("Cannot Wait Spot Market Order", "err", err)
+		}
+		save()
+		return err
+	}
+
+	spOrd := &msg.SpOrd.Order
 
 	if !spOrd.IsFinished() {
-		logger.Error("Spot Market Order Is Not Finished", "err", reqErr.Err)
+		logger.Error("Spot Market Order Is Not Finished")
+		save()
 		return errors.New("spot market order is not finished")
 	}
 
 	logger.Info("Spot Market Order Is Finished", "filledQty", spOrd.FilledQty, "filledAvgPrice", spOrd.FilledAvgPrice)
 
 	for {
-		logger.Info("New Futures Market Order")
-		_, fuOrd, reqErr := fuTrader(fuPair.Asset, fuPair.Quote, fuQty)
-		if reqErr.IsNotNil() {
-			logger.Error("Cannot Trade Futures", "err", reqErr.Err)
-			time.Sleep(time.Second * 2)
-			continue
+		logger.Info("New Futures Market Order", "status", msg.FuOrd.Status)
+		placing := msg.FuOrd.Status == VIPPortmarOrderStatusNone
+		err := tradeVIPPortmarOrd(context.Background(), m.user, fuPair, fuTrader, fuQty, &msg.FuOrd, save)
+		if placing {
+			audit.RecordOrder(fuPair, fuSide, false, fuQty, &msg.FuOrd.Order, err)
 		}
-
-		logger.Info("Waiting Futures Order")
-
-		chReqErr := m.user.WaitOrder(context.Background(), fuOrd)
-		reqErr = <-chReqErr
-		if reqErr.IsNotNil() {
-			logger.Error("Cannot Wait Futures Market Order", "err", reqErr.Err)
+		if errors.Is(err, ErrVIPPortmarOrderUnknown) {
+			logger.Error("Futures Market Order Is Unknown, Check It Manually", "err", err)
+			save()
+			return err
+		}
+		if err != nil {
+			if msg.FuOrd.Status == VIPPortmarOrderStatusFailed {
+				logger.Error("Cannot Trade Futures", "err", err)
+				msg.FuOrd = VIPPortmarOrd{}
+			} else {
+				// same order is waited again
+				logger.Error("Cannot Wait Futures Market Order", "err", err)
+			}
+			save()
 			time.Sleep(time.Second * 2)
 			continue
 		}
@@ -850,6 +789,7 @@ func (m *Main) NewPos(spPair, fuPair cex.Pair, spSide cex.OrderSide, spQty, fuEx
 			break
 		} else {
 			logger.Error("Futures Market Order Is Not Finished")
+			save()
 			return errors.New("futures market order is not finished")
 		}
 	}
@@ -891,3 +831,53 @@ func NewHUANGYANMain() {
 	err = m.NewPosSlowly(spPair, fuPair, cex.OrderSideBuy, 1, fuExp, 1)
 	props.PanicIfNotNil(err)
 }
+
+// dryRunNewPos estimates both legs of position by executor,
+// and records account snapshot as if they had been filled.
+func (m *Main) dryRunNewPos(trade *PosTrade, spQty, fuQty float64, fuSide cex.OrderSide, audit *AuditRecorder, logger *slog.Logger) error {
+	_, acct := m.acctWatcher.Acct()
+
+	var price float64
+	if acct != nil {
+		var err error
+		price, err = acct.FuMarkPrice(trade.FuPair.PairSymbol)
+		if err != nil {
+			logger.Warn("Cannot Get Futures Price", "err", err)
+		}
+	}
+
+	legs := []Action{
+		{
+			Type:     ActionTypeMarketOrder,
+			Asset:    trade.SpPair.Asset,
+			Quote:    trade.SpPair.Quote,
+			Qty:      spQty,
+			Price:    price / trade.FuExp,
+			PairType: cex.PairTypeSpot,
+			Side:     trade.SpSide,
+		},
+		{
+			Type:     ActionTypeMarketOrder,
+			Asset:    trade.FuPair.Asset,
+			Quote:    trade.FuPair.Quote,
+			Qty:      fuQty,
+			Price:    price,
+			PairType: cex.PairTypeFutures,
+			Side:     fuSide,
+		},
+	}
+	// executor of handle cycle is not used, its audit recorder is changing
+	executor := NewActionExecutor(m.user, m.logger)
+	executor.DryRun = true
+	executor.Audit = audit
+	for _, res := range executor.ExecuteUntilErr(legs) {
+		if res.Err != nil {
+			return res.Err
+		}
+	}
+	if acct != nil {
+		audit.Snapshot(m.nextAccount(acct, legs...))
+	}
+	logger.Info("Dry Run Position Is Finished", "price", price)
+	return nil
+}
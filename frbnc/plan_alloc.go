@@ -0,0 +1,686 @@
+package frbnc
+
+import (
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/dwdwow/cex/bnc"
+	"github.com/dwdwow/mathy"
+)
+
+// Band is a risk band of one venue.
+// Metric below Min or above Max is moved back to Target.
+type Band struct {
+	Min    float64
+	Target float64
+	Max    float64
+}
+
+// AllocationConfig holds bands of every venue for PlanBandRebalanceActions and PlanAllocationActions.
+type AllocationConfig struct {
+	// LoanBands are ltv bands of flexible loan orders, key is collateral coin.
+	// DefaultLoanBand is used if collateral coin is not in LoanBands.
+	LoanBands       map[string]Band
+	DefaultLoanBand Band
+
+	// FuMarginBand is band of um futures margin ratio, margin / notional.
+	FuMarginBand Band
+	// FuMaintRatio is min margin / maintenance margin after withdrawal.
+	FuMaintRatio float64
+
+	// Reserves are spot free qty kept for risk handlers, key is asset.
+	Reserves map[string]float64
+	// EarnAssets are assets whose idle spot qty above Reserves is subscribed to Simple Earn.
+	// Empty means no sweeping.
+	EarnAssets map[string]bool
+}
+
+// DefaultAllocationConfig returns bands used by Main.
+func DefaultAllocationConfig() AllocationConfig {
+	quality := Band{minQualityCollateralLtv, middleQualityCollateralLtv, maxQualityCollateralLtv}
+	loanBands := map[string]Band{}
+	for coin := range qualityCollts {
+		loanBands[coin] = quality
+	}
+	return AllocationConfig{
+		LoanBands:       loanBands,
+		DefaultLoanBand: Band{minSubordinateCollateralLtv, middleSubordinateCollateralLtv, maxSubordinateCollateralLtv},
+		FuMarginBand:    Band{minFuturesAccountMarginRatio, middleFuturesAccountMarginRatio, maxFuturesAccountMarginRatio},
+		FuMaintRatio:    middleFuturesAccountMaintRatio,
+		Reserves:        map[string]float64{"USDT": minUsdt},
+	}
+}
+
+func (c AllocationConfig) loanBand(collateralCoin string) Band {
+	if band, ok := c.LoanBands[collateralCoin]; ok {
+		return band
+	}
+	return c.DefaultLoanBand
+}
+
+// PlanBandRebalanceActions moves capital of acct back into risk band of every venue.
+// 1. Surplus is released to spot: collateral of loans below band and margin of futures above band.
+// 2. Spot is moved to venues below band: loans first, then um futures.
+// 3. Spot above Reserves is subscribed to Simple Earn for EarnAssets.
+// Every phase plans on the hypothetical account after previous phases,
+// and transfers of the same asset and direction are merged,
+// so capital only moves as far as it is needed.
+// Idle capital inside bands is placed by PlanAllocationActions.
+func PlanBandRebalanceActions(acct *Account, cfg AllocationConfig) []Action {
+	actions := planBandActions(acct, cfg)
+	sim := acct.WithActions(actions...)
+	actions = append(actions, planEarnSweepActions(sim, cfg)...)
+	return mergeTransferActions(actions)
+}
+
+// planBandActions plans phase 1 and 2 of PlanBandRebalanceActions.
+func planBandActions(acct *Account, cfg AllocationConfig) []Action {
+	actions := planLoanReleaseActions(acct, cfg)
+	actions = append(actions, planFuReleaseActions(acct, cfg)...)
+	sim := acct.WithActions(actions...)
+
+	for _, action := range planLoanFundActions(sim, cfg) {
+		actions = append(actions, action)
+		sim = sim.WithActions(action)
+	}
+
+	return append(actions, planFuFundActions(sim, cfg)...)
+}
+
+// planLoanReleaseActions reduces collateral of USDT loan orders below band to target ltv.
+func planLoanReleaseActions(acct *Account, cfg AllocationConfig) (actions []Action) {
+	var ords []bnc.CryptoLoanFlexibleOngoingOrder
+	for _, ord := range acct.lnOrds {
+		if ord.LoanCoin != "USDT" || ord.TotalDebt < 20 || ord.CurrentLTV <= 0 {
+			continue
+		}
+		if ord.CurrentLTV < cfg.loanBand(ord.CollateralCoin).Min {
+			ords = append(ords, ord)
+		}
+	}
+	sort.Slice(ords, func(i, j int) bool {
+		return ords[i].CurrentLTV < ords[j].CurrentLTV
+	})
+
+	for _, ord := range ords {
+		ltv0 := ord.CurrentLTV
+		ltv1 := cfg.loanBand(ord.CollateralCoin).Target
+
+		redunColl := ord.CollateralAmount * (1 - ltv0/ltv1)
+		redunColl = mathy.RoundFloor(redunColl, 5)
+		if redunColl <= 0 {
+			continue
+		}
+
+		actions = append(actions, Action{
+			Type:         ActionTypeAdjustLTV,
+			Reason:       FindingLoanLtvNormal,
+			Asset:        ord.CollateralCoin,
+			Qty:          redunColl,
+			LoanCoin:     ord.LoanCoin,
+			LtvDirection: bnc.LTVReduced,
+			Effects: []ActionEffect{{
+				Subject: ord.LoanCoin + "_" + ord.CollateralCoin,
+				Metric:  "ltv",
+				Before:  ltv0,
+				After:   ltv1,
+			}},
+		})
+	}
+	return
+}
+
+// planFuReleaseActions withdraws um futures margin above band to target ratio,
+// margin / maintenance margin is kept above FuMaintRatio.
+// USDT is withdrawn first.
+func planFuReleaseActions(acct *Account, cfg AllocationConfig) (actions []Action) {
+	ratio := acct.FuMarginRatio()
+	if ratio.Notional <= 0 || ratio.Err != nil || ratio.InitialRatio <= cfg.FuMarginBand.Max {
+		return
+	}
+
+	marginGap := ratio.Notional * (ratio.InitialRatio - cfg.FuMarginBand.Target)
+	marginGap = math.Min(marginGap, ratio.Margin-ratio.MaintMargin*cfg.FuMaintRatio)
+	if marginGap <= 10 {
+		return
+	}
+
+	var validAssets []bnc.FuturesAccountAsset
+	for _, asset := range acct.Futures.Assets {
+		// Here must be 0,
+		// because is asset amount, not USDT,
+		// be careful.
+		if asset.MaxWithdrawAmount <= 0 {
+			continue
+		}
+		if asset.Asset == "USDT" {
+			if asset.MaxWithdrawAmount > 1 {
+				validAssets = slices.Insert(validAssets, 0, asset)
+			}
+			continue
+		}
+		validAssets = append(validAssets, asset)
+	}
+
+	prices := map[string]float64{"USDT": 1}
+	for _, asset := range validAssets {
+		if asset.Asset == "USDT" {
+			continue
+		}
+		if price, err := acct.FuMarkPrice(asset.Asset + "USDT"); err == nil {
+			prices[asset.Asset] = price
+		}
+	}
+
+	// In multi-assets mode, max withdraw amount of every asset
+	// is limited by the same available margin,
+	// so every withdrawal is capped by what earlier ones left.
+	shared := acct.Futures.MultiAssetsMargin
+	withdrawable := acct.Futures.MaxWithdrawAmount
+	if shared && withdrawable <= 0 {
+		for _, asset := range validAssets {
+			withdrawable = math.Max(withdrawable, asset.MaxWithdrawAmount*prices[asset.Asset])
+		}
+	}
+
+	remainMarginGap := marginGap
+	margin := ratio.Margin
+
+	for _, asset := range validAssets {
+		coin := asset.Asset
+		price, ok := prices[coin]
+		if !ok {
+			continue
+		}
+
+		// Here must discount widrQty,
+		// because price is changing timely.
+		widrQty := math.Min(asset.MaxWithdrawAmount, remainMarginGap/price)
+		if shared {
+			widrQty = math.Min(widrQty, withdrawable/price)
+		}
+		widrQty = mathy.RoundFloor(widrQty*0.99, 5)
+		if widrQty <= 0 {
+			continue
+		}
+
+		widrValue := widrQty * price
+		actions = append(actions, Action{
+			Type:         ActionTypeTransfer,
+			Reason:       FindingFuMarginRatioNormal,
+			Asset:        coin,
+			Qty:          widrQty,
+			TransferType: bnc.TransferTypeUmfutureMain,
+			Effects: []ActionEffect{{
+				Subject: "UM_FUTURES",
+				Metric:  "marginRatio",
+				Before:  margin / ratio.Notional,
+				After:   (margin - widrValue) / ratio.Notional,
+			}},
+		})
+		margin -= widrValue
+		withdrawable -= widrValue
+
+		remainMarginGap -= widrValue
+		if remainMarginGap <= 10 {
+			break
+		}
+	}
+
+	return
+}
+
+// planLoanFundActions brings USDT loan orders above band back to target ltv,
+// by redeeming LD collateral, adding collateral and repaying in turn.
+// Highest ltv is funded first.
+func planLoanFundActions(acct *Account, cfg AllocationConfig) (actions []Action) {
+	var demands []RiskyLoanDemand
+	for _, ord := range acct.lnOrds {
+		if ord.LoanCoin != "USDT" || ord.TotalDebt < 20 || ord.CurrentLTV <= 0 {
+			continue
+		}
+		band := cfg.loanBand(ord.CollateralCoin)
+		if ord.CurrentLTV <= band.Max {
+			continue
+		}
+		demands = append(demands, RiskyLoanDemand{
+			Order:           ord,
+			TargetLtv:       band.Target,
+			AdditionalCollt: ord.CollateralAmount * (ord.CurrentLTV/band.Target - 1),
+		})
+	}
+	sort.Slice(demands, func(i, j int) bool {
+		return demands[i].Order.CurrentLTV > demands[j].Order.CurrentLTV
+	})
+
+	sim := acct
+	for _, demand := range demands {
+		for _, plan := range []func(*Account, RiskyLoanDemand) (Action, bool){
+			PlanLoanRedeemAction, PlanLoanCollateralAction, PlanLoanRepayAction,
+		} {
+			action, ok := plan(sim, demand)
+			if !ok {
+				continue
+			}
+			actions = append(actions, action)
+			sim = sim.WithActions(action)
+		}
+	}
+	return
+}
+
+// planFuFundActions moves spot coin to um futures if margin ratio is below band,
+// until target ratio is restored.
+func planFuFundActions(acct *Account, cfg AllocationConfig) []Action {
+	ratio := acct.FuMarginRatio()
+	if ratio.Notional <= 0 || ratio.Err != nil || ratio.InitialRatio >= cfg.FuMarginBand.Min {
+		return nil
+	}
+	remand := ratio.Notional*cfg.FuMarginBand.Target - ratio.Margin
+	if remand <= minFuturesMarginDemand {
+		return nil
+	}
+	return planFuMarginTransfer(acct, remand, ratio.Margin, ratio.Notional, FindingFuMarginRatioLow)
+}
+
+// planEarnSweepActions subscribes spot free qty above Reserves of EarnAssets to Simple Earn.
+// Only assets with known flexible product are swept.
+func planEarnSweepActions(acct *Account, cfg AllocationConfig) []Action {
+	return NewEarnManager(EarnConfig{Reserves: cfg.Reserves, SweepAssets: cfg.EarnAssets}).PlanSweep(acct)
+}
+
+// mergeTransferActions merges transfers of the same asset between the same accounts,
+// and nets transfers of the same asset in opposite directions.
+// Other actions keep their order.
+func mergeTransferActions(actions []Action) (merged []Action) {
+	opposites := map[bnc.TransferType]bnc.TransferType{
+		bnc.TransferTypeMainUmfuture: bnc.TransferTypeUmfutureMain,
+		bnc.TransferTypeUmfutureMain: bnc.TransferTypeMainUmfuture,
+		bnc.TransferTypeMainCmfuture: bnc.TransferTypeCmfutureMain,
+		bnc.TransferTypeCmfutureMain: bnc.TransferTypeMainCmfuture,
+	}
+
+	for _, action := range actions {
+		if action.Type != ActionTypeTransfer {
+			merged = append(merged, action)
+			continue
+		}
+		i := slices.IndexFunc(merged, func(a Action) bool {
+			return a.Type == ActionTypeTransfer && a.Asset == action.Asset &&
+				(a.TransferType == action.TransferType || a.TransferType == opposites[action.TransferType])
+		})
+		if i < 0 {
+			merged = append(merged, action)
+			continue
+		}
+		prev := &merged[i]
+		prev.Effects = append(prev.Effects, action.Effects...)
+		if prev.TransferType == action.TransferType {
+			prev.Qty += action.Qty
+			continue
+		}
+		prev.Qty -= action.Qty
+		if prev.Qty < 0 {
+			prev.Qty = -prev.Qty
+			prev.TransferType = action.TransferType
+			prev.Reason = action.Reason
+		}
+		if prev.Qty == 0 {
+			merged = slices.Delete(merged, i, i+1)
+		}
+	}
+	return
+}
+
+// Venue is where idle USDT can be placed.
+type Venue string
+
+const (
+	VenueEarn      Venue = "EARN"
+	VenueLoan      Venue = "LOAN"
+	VenueUMFutures Venue = "UM_FUTURES"
+	VenuePortmar   Venue = "PORTFOLIO_MARGIN"
+	VenueVIPLoan   Venue = "VIP_LOAN"
+)
+
+// VenueYield is annual yield of one USDT placed in a venue.
+type VenueYield struct {
+	Venue Venue
+	// Subject is loanCoin_collateralCoin of flexible loan, order id of vip loan,
+	// asset of earn, or venue itself.
+	Subject string
+	// Yield is interest rate saved by repaying loan, funding received per USDT of margin,
+	// or APR of earn.
+	Yield float64
+	// Capacity is USDT the venue can take within its band, +Inf for earn.
+	Capacity float64
+}
+
+// AllocationRates are rates ranking venues of classic account.
+type AllocationRates struct {
+	// LoanRates are annual interest rates of flexible loans, key is loan coin,
+	// same as RepayPolicy.LoanRates.
+	LoanRates map[string]float64
+	// FundingRates key is um symbol, see QueryFundingRateMap.
+	FundingRates map[string]bnc.FuturesFundingRate
+}
+
+// sortVenues sorts venues by yield, from high to low.
+func sortVenues(venues []VenueYield) {
+	sort.SliceStable(venues, func(i, j int) bool {
+		return venues[i].Yield > venues[j].Yield
+	})
+}
+
+// fundingYield returns annual funding income of positions per USDT of margin,
+// ok is false if funding rate of any position is missing.
+func fundingYield(items []CarryItem, margin float64) (yield float64, ok bool) {
+	if margin <= 0 {
+		return 0, false
+	}
+	var income float64
+	for _, item := range items {
+		if item.Err != nil {
+			return 0, false
+		}
+		income += item.Income
+	}
+	return income / margin, true
+}
+
+// RankVenues returns venues idle USDT of classic account can be placed in, from highest yield.
+// USDT loans take repayment down to min ltv of band,
+// um futures take margin up to target ratio, Simple Earn takes any qty if USDT is in EarnAssets.
+// Venue whose rate is unknown is not ranked.
+func RankVenues(acct *Account, cfg AllocationConfig, rates AllocationRates) (venues []VenueYield) {
+	if rate, ok := rates.LoanRates["USDT"]; ok {
+		for _, ord := range acct.LoanOrders {
+			if ord.LoanCoin != "USDT" || ord.TotalDebt < 20 || ord.CurrentLTV <= 0 {
+				continue
+			}
+			venues = append(venues, VenueYield{
+				Venue:    VenueLoan,
+				Subject:  ord.LoanCoin + "_" + ord.CollateralCoin,
+				Yield:    rate,
+				Capacity: math.Max(LoanRepayNeed(ord, cfg.loanBand(ord.CollateralCoin).Min), 0),
+			})
+		}
+	}
+
+	if ratio := acct.FuMarginRatio(); ratio.Notional > 0 && ratio.Err == nil {
+		var items []CarryItem
+		for _, pos := range acct.Futures.Positions {
+			if pos.SignPositionAmt != 0 {
+				items = append(items, fundingCarryItem(pos.Symbol, pos.SignPositionAmt, rates.FundingRates))
+			}
+		}
+		if yield, ok := fundingYield(items, ratio.Margin); ok {
+			venues = append(venues, VenueYield{
+				Venue:    VenueUMFutures,
+				Subject:  "UM_FUTURES",
+				Yield:    yield,
+				Capacity: math.Max(ratio.Notional*cfg.FuMarginBand.Target-ratio.Margin, 0),
+			})
+		}
+	}
+
+	if cfg.EarnAssets["USDT"] {
+		if pos, ok := acct.EarnPos("USDT"); ok {
+			venues = append(venues, VenueYield{
+				Venue:    VenueEarn,
+				Subject:  "USDT",
+				Yield:    pos.LatestAnnualPercentageRate,
+				Capacity: math.Inf(1),
+			})
+		}
+	}
+
+	sortVenues(venues)
+	return
+}
+
+// PlanAllocationActions plans like PlanBandRebalanceActions,
+// and places spot USDT above Reserves in venues ranked by RankVenues before sweeping to earn.
+// Venue ranked below earn or not yielding takes nothing, the rest is swept to earn.
+// Um futures margin above target ratio is withdrawn,
+// as far as venues yielding more than its funding can take.
+// Portfolio margin account is allocated by PlanPortmarAllocationActions.
+func PlanAllocationActions(acct *Account, cfg AllocationConfig, rates AllocationRates) []Action {
+	actions := planBandActions(acct, cfg)
+	sim := acct.WithActions(actions...)
+
+	release := planYieldFuReleaseActions(sim, cfg, RankVenues(sim, cfg, rates))
+	actions = append(actions, release...)
+	sim = sim.WithActions(release...)
+
+	for _, action := range planYieldActions(sim, cfg, RankVenues(sim, cfg, rates)) {
+		actions = append(actions, action)
+		sim = sim.WithActions(action)
+	}
+
+	actions = append(actions, planEarnSweepActions(sim, cfg)...)
+	return mergeTransferActions(actions)
+}
+
+// idleUsdt returns spot free USDT above Reserves and qty needed by risk handlers.
+func idleUsdt(acct *Account, cfg AllocationConfig) float64 {
+	bal, _ := acct.SpotBal("USDT")
+	return bal.Free - cfg.Reserves["USDT"] - RiskDemandQtys(acct)["USDT"]
+}
+
+// planYieldFuReleaseActions withdraws um futures margin above target ratio,
+// if venues yielding more than its funding can take more than idle USDT.
+func planYieldFuReleaseActions(acct *Account, cfg AllocationConfig, venues []VenueYield) []Action {
+	i := slices.IndexFunc(venues, func(v VenueYield) bool { return v.Venue == VenueUMFutures })
+	if i < 0 {
+		return nil
+	}
+	better := -math.Max(idleUsdt(acct, cfg), 0)
+	for _, venue := range venues[:i] {
+		if venue.Yield > venues[i].Yield && venue.Yield > 0 {
+			better += venue.Capacity
+		}
+	}
+	ratio := acct.FuMarginRatio()
+	if better <= 0 || ratio.Notional <= 0 {
+		return nil
+	}
+	release := cfg
+	release.FuMarginBand.Max = cfg.FuMarginBand.Target
+	release.FuMarginBand.Target = math.Max(cfg.FuMarginBand.Target, ratio.InitialRatio-better/ratio.Notional)
+	return planFuReleaseActions(acct, release)
+}
+
+// planYieldActions places idle USDT in venues by rank, until earn is reached.
+func planYieldActions(acct *Account, cfg AllocationConfig, venues []VenueYield) (actions []Action) {
+	idle := idleUsdt(acct, cfg)
+	for _, venue := range venues {
+		if venue.Venue == VenueEarn || venue.Yield <= 0 {
+			break
+		}
+		qty := mathy.RoundFloor(math.Min(idle, venue.Capacity), 2)
+		if qty < minUsdt {
+			continue
+		}
+		switch venue.Venue {
+		case VenueLoan:
+			ord, ok := acct.LoanOrd(venue.Subject)
+			if !ok {
+				continue
+			}
+			actions = append(actions, Action{
+				Type:     ActionTypeRepay,
+				Reason:   FindingLoanLtvNormal,
+				Asset:    ord.CollateralCoin,
+				Qty:      qty,
+				LoanCoin: ord.LoanCoin,
+				Effects: []ActionEffect{{
+					Subject: venue.Subject,
+					Metric:  "ltv",
+					Before:  ord.CurrentLTV,
+					After:   ord.CurrentLTV * (ord.TotalDebt - qty) / ord.TotalDebt,
+				}},
+			})
+		case VenueUMFutures:
+			ratio := acct.FuMarginRatio()
+			actions = append(actions, Action{
+				Type:         ActionTypeTransfer,
+				Reason:       FindingFuMarginRatioNormal,
+				Asset:        "USDT",
+				Qty:          qty,
+				TransferType: bnc.TransferTypeMainUmfuture,
+				Effects: []ActionEffect{{
+					Subject: "UM_FUTURES",
+					Metric:  "marginRatio",
+					Before:  ratio.Margin / ratio.Notional,
+					After:   (ratio.Margin + qty) / ratio.Notional,
+				}},
+			})
+		default:
+			continue
+		}
+		idle -= qty
+	}
+	return
+}
+
+// RankPortmarVenues returns venues idle spot USDT of portfolio margin account can be placed in, from highest yield.
+// Active USDT vip loans take repayment of debt at LoanRate of order,
+// portfolio margin takes USDT up to BalancedUniMMR, yielding funding of um positions per adjusted equity.
+// Venue whose rate is unknown is not ranked.
+func RankPortmarVenues(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig, fundingRates map[string]bnc.FuturesFundingRate) (venues []VenueYield) {
+	for _, analysis := range AnalyseVIPLoan(acct, cfg).Orders {
+		ord := analysis.Order
+		rate, err := parseRate(ord.LoanRate)
+		if !analysis.Active || ord.LoanCoin != "USDT" || ord.TotalDebt <= 0 || err != nil {
+			continue
+		}
+		venues = append(venues, VenueYield{
+			Venue:    VenueVIPLoan,
+			Subject:  ord.OrderId,
+			Yield:    rate,
+			Capacity: ord.TotalDebt,
+		})
+	}
+
+	if res, err := CalUniMMREquity(acct); err == nil && res.MaintMargin > 0 {
+		var items []CarryItem
+		for _, pos := range acct.PortmarAccountUMDetail.Positions {
+			if pos.SignPositionAmt != 0 {
+				items = append(items, fundingCarryItem(pos.Symbol, pos.SignPositionAmt, fundingRates))
+			}
+		}
+		if yield, ok := fundingYield(items, res.AdjustedEquity); ok {
+			venues = append(venues, VenueYield{
+				Venue:    VenuePortmar,
+				Subject:  "PORTFOLIO_MARGIN",
+				Yield:    yield,
+				Capacity: math.Max(cfg.BalancedUniMMR*res.MaintMargin-res.AdjustedEquity, 0),
+			})
+		}
+	}
+
+	sortVenues(venues)
+	return
+}
+
+// PlanPortmarAllocationActions places spot USDT of portfolio margin account above minUsdt
+// in venues ranked by RankPortmarVenues, venue not yielding takes nothing.
+// Portfolio margin USDT above BalancedUniMMR is transferred back to spot first,
+// as far as venues yielding more than its funding can take.
+// Surplus above MaxUniMMR is planned by PlanPortmarSurplusActions.
+func PlanPortmarAllocationActions(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig, fundingRates map[string]bnc.FuturesFundingRate) (actions []Action) {
+	venues := RankPortmarVenues(acct, cfg, fundingRates)
+	if release, ok := planPortmarYieldRelease(acct, cfg, venues); ok {
+		actions = append(actions, release)
+		acct = acct.WithActions(release)
+		venues = RankPortmarVenues(acct, cfg, fundingRates)
+	}
+
+	bal, _ := acct.SpotBalance("USDT")
+	idle := bal.Free - minUsdt
+	for _, venue := range venues {
+		if venue.Yield <= 0 {
+			break
+		}
+		qty := mathy.RoundFloor(math.Min(idle, venue.Capacity), 2)
+		if qty < minUsdt {
+			continue
+		}
+		switch venue.Venue {
+		case VenueVIPLoan:
+			i := slices.IndexFunc(acct.LoanOrders, func(ord bnc.VIPLoanOngoingOrder) bool { return ord.OrderId == venue.Subject })
+			if i < 0 {
+				continue
+			}
+			actions = append(actions, Action{
+				Type:     ActionTypeVIPRepay,
+				Reason:   FindingVIPLoanLtvNormal,
+				Asset:    acct.LoanOrders[i].CollateralCoin,
+				Qty:      qty,
+				LoanCoin: "USDT",
+				OrderId:  venue.Subject,
+			})
+		case VenuePortmar:
+			res, _ := CalUniMMREquity(acct)
+			actions = append(actions, Action{
+				Type:         ActionTypeTransfer,
+				Reason:       FindingPmUniMMRBalanced,
+				Asset:        "USDT",
+				Qty:          qty,
+				TransferType: bnc.TransferTypeMainPortfolioMargin,
+				Effects: []ActionEffect{{
+					Subject: "UNIMMR",
+					Metric:  "uniMMR",
+					Before:  res.UniMMR,
+					After:   (res.AdjustedEquity + qty) / res.MaintMargin,
+				}},
+			})
+		default:
+			continue
+		}
+		idle -= qty
+	}
+	return
+}
+
+// planPortmarYieldRelease transfers portfolio margin USDT above BalancedUniMMR to spot,
+// if venues yielding more than its funding can take more than idle spot USDT.
+func planPortmarYieldRelease(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig, venues []VenueYield) (action Action, ok bool) {
+	i := slices.IndexFunc(venues, func(v VenueYield) bool { return v.Venue == VenuePortmar })
+	if i < 0 {
+		return
+	}
+	spot, _ := acct.SpotBalance("USDT")
+	better := -math.Max(spot.Free-minUsdt, 0)
+	for _, venue := range venues[:i] {
+		if venue.Yield > venues[i].Yield && venue.Yield > 0 {
+			better += venue.Capacity
+		}
+	}
+	res, err := CalUniMMREquity(acct)
+	if better <= 0 || err != nil || res.MaintMargin <= 0 {
+		return
+	}
+	// both cex and local uniMMR should stay at or above BalancedUniMMR
+	surplus := math.Min(res.AdjustedEquity, acct.PortmarAccountInformation.UniMMR*res.MaintMargin) - cfg.BalancedUniMMR*res.MaintMargin
+	bal, _ := acct.PortmarBalance("USDT")
+	qty := mathy.RoundFloor(math.Min(better, math.Min(surplus, bal.CrossMarginFree)), 2)
+	if qty < minUsdt {
+		return
+	}
+	return Action{
+		Type:         ActionTypeTransfer,
+		Reason:       FindingPmUniMMRBalanced,
+		Asset:        "USDT",
+		Qty:          qty,
+		TransferType: bnc.TransferTypePortfolioMarginMain,
+		Effects: []ActionEffect{{
+			Subject: "UNIMMR",
+			Metric:  "uniMMR",
+			Before:  res.UniMMR,
+			After:   (res.AdjustedEquity - qty) / res.MaintMargin,
+		}},
+	}, true
+}
@@ -0,0 +1,325 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanBandRebalanceActions(t *testing.T) {
+	acct := (&Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "USDT", Free: 1000}}},
+		Futures: bnc.FuturesAccount{
+			TotalMarginBalance: 1000,
+			Assets:             []bnc.FuturesAccountAsset{{Asset: "USDT", MarginBalance: 1000}},
+			Positions:          []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -10}},
+		},
+		LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+			{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 18000, CollateralAmount: 1, CurrentLTV: 0.3},
+			{LoanCoin: "USDT", CollateralCoin: "ETH", TotalDebt: 1600, CollateralAmount: 1, CurrentLTV: 0.8},
+		},
+		EarnPositions: []bnc.SimpleEarnFlexiblePosition{{Asset: "BTC", ProductId: "BTC001"}},
+		MarkPrices:    map[string]float64{"ETHUSDT": 2000},
+	}).Clone()
+
+	cfg := DefaultAllocationConfig()
+	cfg.EarnAssets = map[string]bool{"BTC": true}
+
+	actions := PlanBandRebalanceActions(acct, cfg)
+	want := []struct {
+		typ   ActionType
+		asset string
+		qty   float64
+	}{
+		{ActionTypeAdjustLTV, "BTC", 0.5},
+		{ActionTypeRepay, "ETH", 400},
+		{ActionTypeTransfer, "USDT", 600},
+		{ActionTypeSubscribe, "BTC", 0.5},
+	}
+	if len(actions) != len(want) {
+		t.Fatalf("actions len %v, want %v", len(actions), len(want))
+	}
+	for i, w := range want {
+		a := actions[i]
+		if a.Type != w.typ || a.Asset != w.asset || math.Abs(a.Qty-w.qty) > 1e-9 {
+			t.Errorf("action %v: %v %v %v, want %v %v %v", i, a.Type, a.Asset, a.Qty, w.typ, w.asset, w.qty)
+		}
+	}
+
+	sim := acct.WithActions(actions...)
+	if ord, _ := sim.LoanOrd("USDT_ETH"); math.Abs(ord.CurrentLTV-0.6) > 1e-9 {
+		t.Errorf("ETH loan ltv %v, want 0.6", ord.CurrentLTV)
+	}
+	if bal, _ := sim.SpotBal("BTC"); bal.Free != 0 {
+		t.Errorf("spot BTC %v, want 0 after sweeping", bal.Free)
+	}
+}
+
+func TestPlanFuReleaseActions(t *testing.T) {
+	newAcct := func(maxWithdraw float64) *Account {
+		return (&Account{
+			Futures: bnc.FuturesAccount{
+				MultiAssetsMargin: true,
+				MaxWithdrawAmount: maxWithdraw,
+				Assets: []bnc.FuturesAccountAsset{
+					{Asset: "BTC", MarginBalance: 0.1, MaxWithdrawAmount: 0.1},
+					{Asset: "USDT", MarginBalance: 10000, MaxWithdrawAmount: 3000},
+				},
+				Positions: []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -10, MaintMargin: 100}},
+			},
+			MarkPrices: map[string]float64{"ETHUSDT": 2000, "BTCUSDT": 60000},
+		}).Clone()
+	}
+
+	tests := []struct {
+		name string
+		acct *Account
+		usdt float64
+		btc  float64
+	}{
+		// USDT takes all withdrawable margin of account
+		{"shared", newAcct(3000), 2970, 0.00049},
+		// account max withdraw amount is unknown, btc max withdraw value is used
+		{"unknown account max withdraw", newAcct(0), 2970, 0.04999},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions := planFuReleaseActions(tt.acct, DefaultAllocationConfig())
+			if len(actions) != 2 {
+				t.Fatalf("actions len %v, want 2", len(actions))
+			}
+			if a := actions[0]; a.Asset != "USDT" || math.Abs(a.Qty-tt.usdt) > 1e-9 {
+				t.Errorf("first withdrawal %v %v, want USDT %v", a.Asset, a.Qty, tt.usdt)
+			}
+			if a := actions[1]; a.Asset != "BTC" || math.Abs(a.Qty-tt.btc) > 1e-9 {
+				t.Errorf("second withdrawal %v %v, want BTC %v", a.Asset, a.Qty, tt.btc)
+			}
+		})
+	}
+}
+
+func TestMergeTransferActions(t *testing.T) {
+	tran := func(typ bnc.TransferType, asset string, qty float64) Action {
+		return Action{Type: ActionTypeTransfer, TransferType: typ, Asset: asset, Qty: qty}
+	}
+
+	tests := []struct {
+		name    string
+		actions []Action
+		want    []Action
+	}{
+		{
+			name:    "same direction",
+			actions: []Action{tran(bnc.TransferTypeMainUmfuture, "USDT", 10), tran(bnc.TransferTypeMainUmfuture, "USDT", 5)},
+			want:    []Action{tran(bnc.TransferTypeMainUmfuture, "USDT", 15)},
+		},
+		{
+			name:    "opposite direction",
+			actions: []Action{tran(bnc.TransferTypeUmfutureMain, "USDT", 10), tran(bnc.TransferTypeMainUmfuture, "USDT", 15)},
+			want:    []Action{tran(bnc.TransferTypeMainUmfuture, "USDT", 5)},
+		},
+		{
+			name:    "cancelled",
+			actions: []Action{tran(bnc.TransferTypeMainCmfuture, "BTC", 1), tran(bnc.TransferTypeCmfutureMain, "BTC", 1)},
+		},
+		{
+			name:    "different assets",
+			actions: []Action{tran(bnc.TransferTypeMainUmfuture, "USDT", 10), tran(bnc.TransferTypeMainUmfuture, "BTC", 1)},
+			want:    []Action{tran(bnc.TransferTypeMainUmfuture, "USDT", 10), tran(bnc.TransferTypeMainUmfuture, "BTC", 1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeTransferActions(tt.actions)
+			if len(got) != len(tt.want) {
+				t.Fatalf("merged len %v, want %v", len(got), len(tt.want))
+			}
+			for i, w := range tt.want {
+				if got[i].TransferType != w.TransferType || got[i].Asset != w.Asset || got[i].Qty != w.Qty {
+					t.Errorf("merged %v: %+v, want %+v", i, got[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanAllocationActions(t *testing.T) {
+	newAcct := func(spot, margin float64) *Account {
+		return (&Account{
+			Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "USDT", Free: spot}}},
+			Futures: bnc.FuturesAccount{
+				TotalMarginBalance: margin,
+				Assets:             []bnc.FuturesAccountAsset{{Asset: "USDT", MarginBalance: margin, MaxWithdrawAmount: margin}},
+				Positions:          []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -1, MaintMargin: 10}},
+			},
+			LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+				{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 6000, CollateralAmount: 0.1, CurrentLTV: 0.6},
+			},
+			EarnPositions: []bnc.SimpleEarnFlexiblePosition{{Asset: "USDT", ProductId: "USDT001", LatestAnnualPercentageRate: 0.05}},
+			MarkPrices:    map[string]float64{"ETHUSDT": 2000},
+		}).Clone()
+	}
+	// short ETHUSDT receives 2000 * 0.0001 * 1095 = 219 USDT per year
+	fundingRates := map[string]bnc.FuturesFundingRate{"ETHUSDT": {Symbol: "ETHUSDT", MarkPrice: 2000, LastFundingRate: 0.0001}}
+
+	type want struct {
+		typ   ActionType
+		asset string
+		qty   float64
+	}
+
+	tests := []struct {
+		name   string
+		spot   float64
+		margin float64
+		earn   bool
+		rates  AllocationRates
+		want   []want
+	}{
+		{
+			// loan 0.5 > funding 219/560 > earn 0.05
+			name:   "loan first",
+			spot:   1000,
+			margin: 560,
+			earn:   true,
+			rates:  AllocationRates{LoanRates: map[string]float64{"USDT": 0.5}, FundingRates: fundingRates},
+			want:   []want{{ActionTypeRepay, "BTC", 500}, {ActionTypeTransfer, "USDT", 40}, {ActionTypeSubscribe, "USDT", 455}},
+		},
+		{
+			name:   "futures first",
+			spot:   1000,
+			margin: 560,
+			earn:   true,
+			rates:  AllocationRates{LoanRates: map[string]float64{"USDT": 0.1}, FundingRates: fundingRates},
+			want:   []want{{ActionTypeTransfer, "USDT", 40}, {ActionTypeRepay, "BTC", 500}, {ActionTypeSubscribe, "USDT", 455}},
+		},
+		{
+			name:   "earn above loan rate",
+			spot:   1000,
+			margin: 560,
+			earn:   true,
+			rates:  AllocationRates{LoanRates: map[string]float64{"USDT": 0.03}, FundingRates: fundingRates},
+			want:   []want{{ActionTypeTransfer, "USDT", 40}, {ActionTypeSubscribe, "USDT", 955}},
+		},
+		{
+			name:   "no rates",
+			spot:   1000,
+			margin: 560,
+			earn:   true,
+			want:   []want{{ActionTypeSubscribe, "USDT", 995}},
+		},
+		{
+			name:   "no earn",
+			spot:   1000,
+			margin: 560,
+			rates:  AllocationRates{LoanRates: map[string]float64{"USDT": 0.03}, FundingRates: fundingRates},
+			want:   []want{{ActionTypeTransfer, "USDT", 40}, {ActionTypeRepay, "BTC", 500}},
+		},
+		{
+			// funding 219/660 < loan 0.5, margin above target 0.3 is withdrawn for loan
+			name:   "release futures",
+			spot:   100,
+			margin: 660,
+			earn:   true,
+			rates:  AllocationRates{LoanRates: map[string]float64{"USDT": 0.5}, FundingRates: fundingRates},
+			want:   []want{{ActionTypeTransfer, "USDT", 59.4}, {ActionTypeRepay, "BTC", 154.4}},
+		},
+		{
+			// idle spot USDT covers loan, futures margin is kept
+			name:   "release not needed",
+			spot:   1000,
+			margin: 660,
+			rates:  AllocationRates{LoanRates: map[string]float64{"USDT": 0.5}, FundingRates: fundingRates},
+			want:   []want{{ActionTypeRepay, "BTC", 500}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultAllocationConfig()
+			if tt.earn {
+				cfg.EarnAssets = map[string]bool{"USDT": true}
+			}
+			actions := PlanAllocationActions(newAcct(tt.spot, tt.margin), cfg, tt.rates)
+			if len(actions) != len(tt.want) {
+				t.Fatalf("actions len %v, want %v: %+v", len(actions), len(tt.want), actions)
+			}
+			for i, w := range tt.want {
+				a := actions[i]
+				if a.Type != w.typ || a.Asset != w.asset || math.Abs(a.Qty-w.qty) > 1e-9 {
+					t.Errorf("action %v: %v %v %v, want %v %v %v", i, a.Type, a.Asset, a.Qty, w.typ, w.asset, w.qty)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanPortmarAllocationActions(t *testing.T) {
+	cfg := VIPPortmarAccountConfig{BalancedUniMMR: 2, MaxUniMMR: 3}
+
+	newAcct := func(spot, pmUsdt float64, loanRate string) *VIPPortmarAccount {
+		acct := &VIPPortmarAccount{
+			Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "USDT", Free: spot}}},
+			PortmarAccountUMDetail: bnc.PortfolioMarginAccountDetail{
+				Positions: []bnc.PortfolioMarginAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -1}},
+			},
+			PortmarAccountInformation: bnc.PortfolioMarginAccountInformation{UniMMR: pmUsdt / 1000, AccountMaintMargin: 1000},
+			PortmarBalances:           []bnc.PortfolioMarginBalance{{Asset: "USDT", CrossMarginAsset: pmUsdt, CrossMarginFree: pmUsdt}},
+			LoanOrders: []bnc.VIPLoanOngoingOrder{{
+				OrderId: "1", LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 1000, LoanRate: loanRate,
+				TotalCollateralValueAfterHaircut: 5000, CurrentLTV: 0.2, MarginCallLtv: "0.7", LiquidationLtv: "0.8",
+			}},
+		}
+		acct.pmCollRates = map[string]bnc.PortfolioMarginCollateralRate{"USDT": {Asset: "USDT", CollateralRate: 1}}
+		return acct.Clone()
+	}
+	// short ETHUSDT receives 219 USDT per year
+	fundingRates := map[string]bnc.FuturesFundingRate{"ETHUSDT": {Symbol: "ETHUSDT", MarkPrice: 2000, LastFundingRate: 0.0001}}
+
+	type want struct {
+		typ  ActionType
+		tran bnc.TransferType
+		qty  float64
+	}
+
+	tests := []struct {
+		name         string
+		acct         *VIPPortmarAccount
+		fundingRates map[string]bnc.FuturesFundingRate
+		want         []want
+	}{
+		// funding 219/1800 > loan 0.1, portmar takes 200 to BalancedUniMMR
+		{"portmar first", newAcct(1000, 1800, "10%"), fundingRates,
+			[]want{{ActionTypeTransfer, bnc.TransferTypeMainPortfolioMargin, 200}, {ActionTypeVIPRepay, "", 795}}},
+		{"vip loan first", newAcct(1000, 1800, "50%"), fundingRates,
+			[]want{{ActionTypeVIPRepay, "", 995}}},
+		// funding 219/2500 < loan 0.5, 500 above BalancedUniMMR is transferred back for loan
+		{"release portmar", newAcct(105, 2500, "50%"), fundingRates,
+			[]want{{ActionTypeTransfer, bnc.TransferTypePortfolioMarginMain, 500}, {ActionTypeVIPRepay, "", 600}}},
+		// idle spot USDT covers the whole debt
+		{"release not needed", newAcct(2000, 2500, "50%"), fundingRates,
+			[]want{{ActionTypeVIPRepay, "", 1000}}},
+		{"no funding rates", newAcct(1000, 1800, "10%"), nil,
+			[]want{{ActionTypeVIPRepay, "", 995}}},
+		{"bad loan rate", newAcct(1000, 1800, "x"), fundingRates,
+			[]want{{ActionTypeTransfer, bnc.TransferTypeMainPortfolioMargin, 200}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions := PlanPortmarAllocationActions(tt.acct, cfg, tt.fundingRates)
+			if len(actions) != len(tt.want) {
+				t.Fatalf("actions len %v, want %v: %+v", len(actions), len(tt.want), actions)
+			}
+			for i, w := range tt.want {
+				a := actions[i]
+				if a.Type != w.typ || a.TransferType != w.tran || math.Abs(a.Qty-w.qty) > 1e-9 {
+					t.Errorf("action %v: %v %v %v, want %v %v %v", i, a.Type, a.TransferType, a.Qty, w.typ, w.tran, w.qty)
+				}
+			}
+		})
+	}
+}
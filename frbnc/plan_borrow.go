@@ -0,0 +1,139 @@
+package frbnc
+
+import (
+	"math"
+	"sort"
+
+	"github.com/dwdwow/cex/bnc"
+	"github.com/dwdwow/mathy"
+)
+
+// loanMaxLimitDiscount keeps borrowing away from MaxLimit of collateral coin,
+// because debt grows with interest.
+const loanMaxLimitDiscount = 0.9
+
+// QueryLoanCollateralCoins key is collateral coin.
+func QueryLoanCollateralCoins(user *bnc.User) (map[string]bnc.CryptoLoanFlexibleCollateralCoin, error) {
+	_, page, err := user.CryptoLoanFlexibleCollateralAssets("")
+	if err.IsNotNil() {
+		return nil, err.Err
+	}
+	return slice2map(page.Rows, func(coll bnc.CryptoLoanFlexibleCollateralCoin) string {
+		return coll.CollateralCoin
+	}), nil
+}
+
+type borrowCapacity struct {
+	coll     string
+	price    float64
+	debt     float64
+	collAmt  float64
+	spotColl float64
+	curLtv   float64
+	ltv      float64
+	capacity float64
+}
+
+// PlanBorrowUsdtActions borrows need USDT against spare collateral,
+// spare collateral is collateral of USDT loan orders below target ltv and spot free collateral coins,
+// spot free coin hedged by futures short is kept for unwinding, only unhedged residual is spare.
+// Every order stays at or below target ltv of cfg and InitialLTV of colls,
+// and its debt stays below discounted MaxLimit of colls.
+// Borrowing is spread across collateral coins in proportion to their capacity.
+// Coins without order can be borrowed against if their um futures mark price is known.
+// colls can be nil, then InitialLTV and MaxLimit are not checked.
+// Returns actions and USDT still unmet.
+func PlanBorrowUsdtActions(acct *Account, colls map[string]bnc.CryptoLoanFlexibleCollateralCoin, cfg AllocationConfig, need float64, reason FindingCode) (actions []Action, unmet float64) {
+	unmet = math.Max(need, 0)
+	if unmet < minUsdt {
+		return
+	}
+
+	coins := map[string]bool{}
+	for _, ord := range acct.lnOrds {
+		if ord.LoanCoin == "USDT" {
+			coins[ord.CollateralCoin] = true
+		}
+	}
+	for coin := range colls {
+		if bal, _ := acct.SpotBal(coin); bal.Free > 0 {
+			coins[coin] = true
+		}
+	}
+
+	unhedged := map[string]float64{}
+	for _, mismatch := range AnalyzeHedges(acct).Mismatches {
+		unhedged[mismatch.Coin] = math.Max(mismatch.Residual, 0)
+	}
+
+	var caps []borrowCapacity
+	var total float64
+	for coin := range coins {
+		c := borrowCapacity{coll: coin}
+		ord, ok := acct.LoanOrd("USDT_" + coin)
+		if ok && ord.CurrentLTV > 0 && ord.CollateralAmount > 0 {
+			c.price = ord.TotalDebt / ord.CurrentLTV / ord.CollateralAmount
+			c.debt = ord.TotalDebt
+			c.collAmt = ord.CollateralAmount
+			c.curLtv = ord.CurrentLTV
+		} else if price, err := acct.FuMarkPrice(coin + "USDT"); err == nil {
+			c.price = price
+		}
+		if c.price <= 0 {
+			continue
+		}
+		c.ltv = cfg.loanBand(coin).Target
+		if info, ok := colls[coin]; ok && info.InitialLTV > 0 {
+			c.ltv = math.Min(c.ltv, info.InitialLTV)
+		}
+		bal, _ := acct.SpotBal(coin)
+		c.spotColl = math.Min(bal.Free, unhedged[coin])
+		c.capacity = (c.collAmt+c.spotColl)*c.price*c.ltv - c.debt
+		if info, ok := colls[coin]; ok && info.MaxLimit > 0 {
+			c.capacity = math.Min(c.capacity, info.MaxLimit*loanMaxLimitDiscount-c.debt)
+		}
+		if c.capacity < minUsdt {
+			continue
+		}
+		caps = append(caps, c)
+		total += c.capacity
+	}
+	if total <= 0 {
+		return
+	}
+
+	sort.Slice(caps, func(i, j int) bool {
+		return caps[i].capacity > caps[j].capacity
+	})
+
+	share := math.Min(unmet/total, 1)
+	for _, c := range caps {
+		borrow := c.capacity * share
+		addColl := (c.debt+borrow)/(c.price*c.ltv) - c.collAmt
+		addColl = mathy.RoundFloor(math.Min(math.Max(addColl, 0), c.spotColl), 6)
+		borrow = math.Min(borrow, (c.collAmt+addColl)*c.price*c.ltv-c.debt)
+		borrow = mathy.RoundFloor(borrow, 2)
+		if borrow < minUsdt {
+			continue
+		}
+		actions = append(actions, Action{
+			Type:          ActionTypeBorrow,
+			Reason:        reason,
+			Asset:         c.coll,
+			Qty:           borrow,
+			LoanCoin:      "USDT",
+			CollateralQty: addColl,
+			Price:         c.price,
+			Effects: []ActionEffect{{
+				Subject: "USDT_" + c.coll,
+				Metric:  "ltv",
+				Before:  c.curLtv,
+				After:   (c.debt + borrow) / ((c.collAmt + addColl) * c.price),
+			}},
+		})
+		unmet -= borrow
+	}
+
+	unmet = math.Max(unmet, 0)
+	return
+}
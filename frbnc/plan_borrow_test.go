@@ -0,0 +1,95 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanBorrowUsdtActions(t *testing.T) {
+	acct := (&Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "ETH", Free: 1}}},
+		LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+			{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 18000, CollateralAmount: 1, CurrentLTV: 0.3},
+			{LoanCoin: "USDT", CollateralCoin: "ETH", TotalDebt: 400, CollateralAmount: 1, CurrentLTV: 0.2},
+		},
+		MarkPrices: map[string]float64{"BTCUSDT": 60000, "ETHUSDT": 2000},
+	}).Clone()
+	colls := map[string]bnc.CryptoLoanFlexibleCollateralCoin{
+		// capacity of BTC is limited to 25000 * 0.9 - 18000 = 4500
+		"BTC": {CollateralCoin: "BTC", InitialLTV: 0.65, MaxLimit: 25000},
+		"ETH": {CollateralCoin: "ETH", InitialLTV: 0.65},
+	}
+
+	type borrow struct {
+		coll    string
+		qty     float64
+		collQty float64
+	}
+
+	tests := []struct {
+		name  string
+		need  float64
+		want  []borrow
+		unmet float64
+	}{
+		{"too small", 1, nil, 1},
+		// total capacity is 4500 + 2000, need is spread by 20%
+		{"spread", 1300, []borrow{{"BTC", 900, 0}, {"ETH", 400, 0}}, 0},
+		{"exceed capacity", 10000, []borrow{{"BTC", 4500, 0}, {"ETH", 2000, 1}}, 3500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions, unmet := PlanBorrowUsdtActions(acct, colls, DefaultAllocationConfig(), tt.need, FindingLoanLtvHigh)
+			if math.Abs(unmet-tt.unmet) > 1e-9 {
+				t.Errorf("unmet %v, want %v", unmet, tt.unmet)
+			}
+			if len(actions) != len(tt.want) {
+				t.Fatalf("actions len %v, want %v", len(actions), len(tt.want))
+			}
+			for i, w := range tt.want {
+				a := actions[i]
+				if a.Type != ActionTypeBorrow || a.Asset != w.coll || math.Abs(a.Qty-w.qty) > 1e-9 || math.Abs(a.CollateralQty-w.collQty) > 1e-9 {
+					t.Errorf("action %v: %v %v %v %v, want %v %v %v", i, a.Type, a.Asset, a.Qty, a.CollateralQty, w.coll, w.qty, w.collQty)
+				}
+			}
+			sim := acct.WithActions(actions...)
+			for _, ord := range sim.LoanOrders {
+				if ord.CurrentLTV > middleQualityCollateralLtv+1e-9 {
+					t.Errorf("%v ltv %v exceeds target after borrowing", ord.CollateralCoin, ord.CurrentLTV)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanBorrowUsdtActionsHedged(t *testing.T) {
+	// 1 spot ETH and 1 ETH collateral, 1.5 of them are hedged by futures short
+	acct := (&Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "ETH", Free: 1}}},
+		Futures: bnc.FuturesAccount{
+			Positions: []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -1.5}},
+		},
+		LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+			{LoanCoin: "USDT", CollateralCoin: "ETH", TotalDebt: 400, CollateralAmount: 1, CurrentLTV: 0.2},
+		},
+		MarkPrices: map[string]float64{"ETHUSDT": 2000},
+	}).Clone()
+	colls := map[string]bnc.CryptoLoanFlexibleCollateralCoin{
+		"ETH": {CollateralCoin: "ETH", InitialLTV: 0.65},
+	}
+
+	// only 0.5 unhedged spot ETH is added as collateral, (1 + 0.5) * 2000 * 0.6 - 400
+	actions, unmet := PlanBorrowUsdtActions(acct, colls, DefaultAllocationConfig(), 10000, FindingLoanLtvHigh)
+	if len(actions) != 1 {
+		t.Fatalf("actions len %v, want 1", len(actions))
+	}
+	if a := actions[0]; math.Abs(a.Qty-1400) > 1e-9 || math.Abs(a.CollateralQty-0.5) > 1e-9 {
+		t.Errorf("borrow %v with collateral %v, want 1400 with 0.5", a.Qty, a.CollateralQty)
+	}
+	if math.Abs(unmet-8600) > 1e-9 {
+		t.Errorf("unmet %v, want 8600", unmet)
+	}
+}
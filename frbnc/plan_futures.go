@@ -0,0 +1,113 @@
+package frbnc
+
+import (
+	"math"
+
+	"github.com/dwdwow/cex/bnc"
+	"github.com/dwdwow/mathy"
+)
+
+// PlanFuMarginTransferActions moves spot USDT, then BTC, ETH and BNB
+// to um futures until margin demand is met.
+// Non USDT coins are only moved in multi-assets mode,
+// and coin held in futures can not exceed MaxNum of validMarginCoins.
+func PlanFuMarginTransferActions(acct *Account) (actions []Action) {
+	analysis := AnalyzeMarginFutures(acct)
+	if !analysis.Risky {
+		return
+	}
+
+	return planFuMarginTransfer(acct, analysis.MarginRemand, analysis.CurrentMargin, analysis.CurrentTotalPos, FindingFuMarginRatioLow)
+}
+
+// planFuMarginTransfer moves spot coin to um futures until remand margin value is moved.
+func planFuMarginTransfer(acct *Account, remand, margin, notional float64, reason FindingCode) (actions []Action) {
+	add := func(coin string, qty, value float64) {
+		actions = append(actions, Action{
+			Type:         ActionTypeTransfer,
+			Reason:       reason,
+			Asset:        coin,
+			Qty:          qty,
+			TransferType: bnc.TransferTypeMainUmfuture,
+			Effects: []ActionEffect{{
+				Subject: "UM_FUTURES",
+				Metric:  "marginRatio",
+				Before:  margin / notional,
+				After:   (margin + value) / notional,
+			}},
+		})
+		margin += value
+		remand -= value
+	}
+
+	usdt, _ := acct.SpotBal("USDT")
+	if qty := mathy.RoundFloor(math.Min(remand, usdt.Free), 2); qty > 0 {
+		add("USDT", qty, qty)
+	}
+
+	if !acct.Futures.MultiAssetsMargin {
+		return
+	}
+
+	for _, coin := range validMarginCoins {
+		if remand <= minFuturesMarginDemand {
+			break
+		}
+		bal, _ := acct.SpotBal(coin.Coin)
+		if bal.Free <= 0 {
+			continue
+		}
+		price, err := acct.FuMarkPrice(coin.Coin + "USDT")
+		if err != nil || price <= 0 {
+			continue
+		}
+		fuAsset, _ := acct.FuAsset(coin.Coin)
+		room := coin.MaxNum - fuAsset.WalletBalance
+		qty := math.Min(remand/(price*coin.PledgeRatio), math.Min(bal.Free, room))
+		qty = mathy.RoundFloor(qty, 6)
+		if qty <= 0 {
+			continue
+		}
+		add(coin.Coin, qty, qty*price*coin.PledgeRatio)
+	}
+
+	return
+}
+
+// PlanCMMarginTransferActions moves spot coin to cm futures,
+// every cm asset is margin of its own positions.
+func PlanCMMarginTransferActions(acct *Account) (actions []Action) {
+	for _, demand := range AnalyzeMarginCMFutures(acct).Demands {
+		ratio := demand.Ratio
+		if ratio.Price <= 0 {
+			continue
+		}
+		bal, _ := acct.SpotBal(ratio.Asset)
+		qty := mathy.RoundFloor(math.Min(demand.MarginRemand/ratio.Price, bal.Free), 6)
+		if qty <= 0 {
+			continue
+		}
+		actions = append(actions, Action{
+			Type:         ActionTypeTransfer,
+			Reason:       FindingCMMarginRatioLow,
+			Asset:        ratio.Asset,
+			Qty:          qty,
+			TransferType: bnc.TransferTypeMainCmfuture,
+			Effects: []ActionEffect{{
+				Subject: "CM_FUTURES_" + ratio.Asset,
+				Metric:  "marginRatio",
+				Before:  ratio.InitialRatio,
+				After:   (ratio.Margin + qty*ratio.Price) / ratio.Notional,
+			}},
+		})
+	}
+	return
+}
+
+// FuUnwindValue returns hedge value should be unwound,
+// if spot USDT got by unwinding is moved to futures as margin,
+// (margin + v) / (notional - v) = target ratio.
+func FuUnwindValue(margin, notional, targetRatio float64) float64 {
+	v := (targetRatio*notional - margin) / (1 + targetRatio)
+	return math.Max(v, 0)
+}
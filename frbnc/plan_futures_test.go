@@ -0,0 +1,57 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanFuMarginTransferActions(t *testing.T) {
+	acct := (&Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{
+			{Asset: "USDT", Free: 100},
+			{Asset: "BTC", Free: 0.1},
+			{Asset: "ETH", Free: 10},
+		}},
+		Futures: bnc.FuturesAccount{
+			MultiAssetsMargin: true,
+			Assets: []bnc.FuturesAccountAsset{
+				{Asset: "USDT", MarginBalance: 1000},
+				// only 0.05 BTC can be moved, MaxNum is 10
+				{Asset: "BTC", WalletBalance: 9.95},
+			},
+			Positions: []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -20}},
+		},
+		MarkPrices: map[string]float64{"ETHUSDT": 2000, "BTCUSDT": 60000},
+	}).Clone()
+
+	actions := PlanFuMarginTransferActions(acct)
+	want := []struct {
+		asset string
+		qty   float64
+	}{{"USDT", 100}, {"BTC", 0.05}, {"ETH", 4.236842}}
+	if len(actions) != len(want) {
+		t.Fatalf("actions len %v, want %v", len(actions), len(want))
+	}
+	for i, w := range want {
+		a := actions[i]
+		if a.TransferType != bnc.TransferTypeMainUmfuture || a.Asset != w.asset || math.Abs(a.Qty-w.qty) > 1e-9 {
+			t.Errorf("action %v: %v %v %v, want %v %v", i, a.TransferType, a.Asset, a.Qty, w.asset, w.qty)
+		}
+	}
+
+	if AnalyzeMarginFutures(acct.WithActions(actions...)).Risky {
+		t.Error("futures should not be risky after transfers")
+	}
+}
+
+func TestPlanFuUnwindValue(t *testing.T) {
+	value := FuUnwindValue(1000, 20000, 0.3)
+	if math.Abs(value-5000/1.3) > 1e-9 {
+		t.Errorf("unwind value %v, want %v", value, 5000/1.3)
+	}
+	if value := FuUnwindValue(10000, 20000, 0.3); value != 0 {
+		t.Errorf("unwind value %v, want 0", value)
+	}
+}
@@ -0,0 +1,197 @@
+package frbnc
+
+import (
+	"math"
+	"sort"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/mathy"
+)
+
+const (
+	// jointChunkRatio every joint step only meets a part of demand of the closest item,
+	// so items are fixed alternately by liquidation distance.
+	jointChunkRatio   = 0.25
+	minJointChunkUsdt = 50
+	maxJointSteps     = 50
+)
+
+// LoanLiqDistance returns price drop ratio of collateral coin
+// before loan order is liquidated.
+func LoanLiqDistance(ltv float64) float64 {
+	return 1 - ltv/flexibleLoanLiquidationLtv
+}
+
+// FuLiqDistance returns price move ratio of positions
+// before futures account is liquidated,
+// loss of notional * distance exhausts margin above maintenance margin.
+func FuLiqDistance(ratio FuturesMarginRatio) float64 {
+	if ratio.Notional <= 0 {
+		return math.Inf(1)
+	}
+	return (ratio.Margin - ratio.MaintMargin) / ratio.Notional
+}
+
+// JointRiskItem is a risky loan order or the um futures account.
+type JointRiskItem struct {
+	Subject  string
+	Distance float64
+	// Demand is USDT value to restore target ltv or target margin ratio.
+	Demand float64
+
+	loan *RiskyLoanDemand
+}
+
+func jointRiskItems(acct *Account) (items []JointRiskItem) {
+	for _, demand := range AnalyzeRiskyLoans(acct).Demands {
+		items = append(items, JointRiskItem{
+			Subject:  demand.Order.LoanCoin + "_" + demand.Order.CollateralCoin,
+			Distance: LoanLiqDistance(demand.Order.CurrentLTV),
+			Demand:   LoanRepayNeed(demand.Order, demand.TargetLtv),
+			loan:     &demand,
+		})
+	}
+	if fu := AnalyzeMarginFutures(acct); fu.Risky {
+		items = append(items, JointRiskItem{
+			Subject:  "UM_FUTURES",
+			Distance: FuLiqDistance(acct.FuMarginRatio()),
+			Demand:   fu.MarginRemand,
+		})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Distance < items[j].Distance
+	})
+	return
+}
+
+// PlanJointRiskyActions splits spot USDT and coins between risky loans and futures margin,
+// when both are risky.
+// Every step helps the item closest to liquidation with a chunk of its demand,
+// and plans on the hypothetical account after previous steps.
+// Collateral coins of risky loans are reserved for loans,
+// because they count fully as loan collateral, but are discounted by pledge ratio as futures margin.
+// Scaled coin qty is rounded by QPrecision and MinTradeQty of spot pair.
+func PlanJointRiskyActions(acct *Account, spPairs map[string]cex.Pair) (actions []Action) {
+	sim := acct.Clone()
+
+	for range maxJointSteps {
+		items := jointRiskItems(sim)
+		reserved := map[string]bool{}
+		for _, item := range items {
+			if item.loan != nil {
+				reserved[item.loan.Order.CollateralCoin] = true
+			}
+		}
+
+		var planned bool
+		for _, item := range items {
+			action, ok := jointNextAction(sim, spPairs, item, reserved)
+			if !ok {
+				continue
+			}
+			actions = append(actions, action)
+			sim = sim.WithActions(action)
+			planned = true
+			break
+		}
+		if !planned {
+			break
+		}
+	}
+
+	return
+}
+
+func jointNextAction(acct *Account, spPairs map[string]cex.Pair, item JointRiskItem, reserved map[string]bool) (action Action, ok bool) {
+	var candidates []Action
+	if item.loan != nil {
+		for _, planner := range []func(*Account, RiskyLoanDemand) (Action, bool){
+			PlanLoanRedeemAction,
+			PlanLoanCollateralAction,
+			PlanLoanRepayAction,
+		} {
+			if action, ok := planner(acct, *item.loan); ok {
+				candidates = append(candidates, action)
+			}
+		}
+	} else {
+		for _, action := range PlanFuMarginTransferActions(acct) {
+			if !reserved[action.Asset] {
+				candidates = append(candidates, action)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	action = candidates[0]
+	// redeem does not change distance, it is done fully
+	if action.Type == ActionTypeRedeem {
+		return action, true
+	}
+
+	value, ok := jointActionValue(acct, action)
+	if !ok || value <= 0 {
+		return action, false
+	}
+	chunk := math.Max(item.Demand*jointChunkRatio, minJointChunkUsdt)
+	if value > chunk {
+		action = scaleAction(action, spPairs, chunk/value)
+	}
+	return action, action.Qty > 0
+}
+
+// jointActionValue returns USDT value of transfer, adjust ltv and repay action.
+func jointActionValue(acct *Account, action Action) (float64, bool) {
+	switch action.Type {
+	case ActionTypeRepay:
+		return action.Qty, true
+	case ActionTypeTransfer:
+		if usdChecker.isUsd(action.Asset) {
+			return action.Qty, true
+		}
+		price, err := acct.FuMarkPrice(action.Asset + "USDT")
+		if err != nil {
+			return 0, false
+		}
+		return action.Qty * price, true
+	case ActionTypeAdjustLTV:
+		ord, ok := acct.LoanOrd(action.LoanCoin + "_" + action.Asset)
+		if !ok || ord.CurrentLTV <= 0 || ord.CollateralAmount <= 0 {
+			return 0, false
+		}
+		return action.Qty * ord.TotalDebt / ord.CurrentLTV / ord.CollateralAmount, true
+	}
+	return 0, false
+}
+
+// scaleAction scales qty of action by f,
+// coin qty is rounded by QPrecision of spot pair and raised to MinTradeQty, but not above original qty.
+// CollateralQty and effects are scaled linearly by the rounded qty.
+func scaleAction(action Action, spPairs map[string]cex.Pair, f float64) Action {
+	if action.Qty <= 0 {
+		return action
+	}
+	var qty float64
+	pair, ok := spPairs[action.Asset+"USDT"]
+	switch {
+	case usdChecker.isUsd(action.Asset) || action.Type == ActionTypeRepay:
+		qty = mathy.RoundFloor(action.Qty*f, 2)
+	case ok:
+		qty = math.Max(action.Qty*f, pair.MinTradeQty)
+		qty = mathy.RoundFloor(math.Min(qty, action.Qty), int32(pair.QPrecision))
+	default:
+		qty = mathy.RoundFloor(action.Qty*f, 6)
+	}
+	f = qty / action.Qty
+	action.Qty = qty
+	action.CollateralQty *= f
+	effects := make([]ActionEffect, len(action.Effects))
+	for i, effect := range action.Effects {
+		effect.After = effect.Before + (effect.After-effect.Before)*f
+		effects[i] = effect
+	}
+	action.Effects = effects
+	return action
+}
@@ -0,0 +1,88 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanJointRiskyActions(t *testing.T) {
+	acct := (&Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{
+			{Asset: "USDT", Free: 6000},
+			{Asset: "BTC", Free: 0.2},
+		}},
+		Futures: bnc.FuturesAccount{
+			MultiAssetsMargin: true,
+			Assets:            []bnc.FuturesAccountAsset{{Asset: "USDT", MarginBalance: 1000}},
+			Positions:         []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -10, MaintMargin: 100}},
+		},
+		LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+			{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 800, CollateralAmount: 1, CurrentLTV: 0.8},
+		},
+		MarkPrices: map[string]float64{"ETHUSDT": 2000, "BTCUSDT": 1000},
+	}).Clone()
+
+	items := jointRiskItems(acct)
+	if len(items) != 2 || items[0].Subject != "UM_FUTURES" {
+		t.Fatalf("risk items %+v, want futures first", items)
+	}
+
+	spPairs := map[string]cex.Pair{"BTCUSDT": {QPrecision: 5, MinTradeQty: 0.0001}}
+	actions := PlanJointRiskyActions(acct, spPairs)
+	if len(actions) == 0 {
+		t.Fatal("no action planned")
+	}
+	if first := actions[0]; first.Type != ActionTypeTransfer || first.Asset != "USDT" {
+		t.Errorf("first action %v %v, want USDT transfer to futures", first.Type, first.Asset)
+	}
+	var hasLoanAction bool
+	for _, action := range actions {
+		if action.Type == ActionTypeTransfer && action.Asset == "BTC" {
+			t.Error("collateral coin of risky loan should not be moved to futures")
+		}
+		if action.Type == ActionTypeAdjustLTV || action.Type == ActionTypeRepay {
+			hasLoanAction = true
+		}
+	}
+	if !hasLoanAction {
+		t.Error("no loan action planned")
+	}
+
+	if items := jointRiskItems(acct.WithActions(actions...)); len(items) != 0 {
+		t.Errorf("risk items after plan %+v, want none", items)
+	}
+}
+
+func TestScaleAction(t *testing.T) {
+	spPairs := map[string]cex.Pair{"BTCUSDT": {QPrecision: 3, MinTradeQty: 0.01}}
+	effect := []ActionEffect{{Before: 0.8, After: 0.6}}
+
+	tests := []struct {
+		name   string
+		action Action
+		f      float64
+		qty    float64
+		after  float64
+	}{
+		{"usdt", Action{Type: ActionTypeTransfer, Asset: "USDT", Qty: 100, Effects: effect}, 0.33333, 33.33, 0.73334},
+		{"pair precision", Action{Type: ActionTypeAdjustLTV, Asset: "BTC", Qty: 1, Effects: effect}, 0.12345, 0.123, 0.7754},
+		{"raised to min qty", Action{Type: ActionTypeAdjustLTV, Asset: "BTC", Qty: 1, Effects: effect}, 0.001, 0.01, 0.798},
+		{"min qty above qty", Action{Type: ActionTypeAdjustLTV, Asset: "BTC", Qty: 0.005, Effects: effect}, 0.5, 0.005, 0.6},
+		{"no pair", Action{Type: ActionTypeTransfer, Asset: "ETH", Qty: 1, Effects: effect}, 0.1234567, 0.123456, 0.7753088},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scaleAction(tt.action, spPairs, tt.f)
+			if math.Abs(got.Qty-tt.qty) > 1e-9 {
+				t.Errorf("qty %v, want %v", got.Qty, tt.qty)
+			}
+			if after := got.Effects[0].After; math.Abs(after-tt.after) > 1e-9 {
+				t.Errorf("effect after %v, want %v", after, tt.after)
+			}
+		})
+	}
+}
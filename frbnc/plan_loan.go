@@ -0,0 +1,103 @@
+package frbnc
+
+import (
+	"math"
+
+	"github.com/dwdwow/cex/bnc"
+	"github.com/dwdwow/mathy"
+)
+
+// PlanLoanRedeemAction redeems LD collateral coin to spot,
+// if spot collateral coin is not enough for AdditionalCollt of demand.
+func PlanLoanRedeemAction(acct *Account, demand RiskyLoanDemand) (action Action, ok bool) {
+	coll := demand.Order.CollateralCoin
+	bal, _ := acct.SpotBal(coll)
+	short := demand.AdditionalCollt - bal.Free
+	if short <= 0 {
+		return
+	}
+	ldBal, _ := acct.SpotBal("LD" + coll)
+	qty := mathy.RoundFloor(math.Min(short, ldBal.Free), 6)
+	if qty <= 0 {
+		return
+	}
+	productId, ok := acct.EarnProductId(coll)
+	if !ok {
+		return
+	}
+	return Action{
+		Type:      ActionTypeRedeem,
+		Reason:    FindingLoanLtvHigh,
+		Asset:     coll,
+		Qty:       qty,
+		ProductId: productId,
+	}, true
+}
+
+// PlanLoanCollateralAction adds spot collateral coin to loan order,
+// qty is limited by spot free balance.
+func PlanLoanCollateralAction(acct *Account, demand RiskyLoanDemand) (action Action, ok bool) {
+	ord, ok := acct.LoanOrd(demand.Order.LoanCoin + "_" + demand.Order.CollateralCoin)
+	if !ok {
+		return
+	}
+	bal, _ := acct.SpotBal(ord.CollateralCoin)
+	qty := mathy.RoundFloor(math.Min(demand.AdditionalCollt, bal.Free), 6)
+	if qty <= 0 {
+		return action, false
+	}
+	return Action{
+		Type:         ActionTypeAdjustLTV,
+		Reason:       FindingLoanLtvHigh,
+		Asset:        ord.CollateralCoin,
+		Qty:          qty,
+		LoanCoin:     ord.LoanCoin,
+		LtvDirection: bnc.LTVAdditional,
+		Effects: []ActionEffect{{
+			Subject: ord.LoanCoin + "_" + ord.CollateralCoin,
+			Metric:  "ltv",
+			Before:  ord.CurrentLTV,
+			After:   ord.CurrentLTV * ord.CollateralAmount / (ord.CollateralAmount + qty),
+		}},
+	}, true
+}
+
+// PlanLoanRepayAction repays loan order to target ltv of demand,
+// order should be refreshed after collateral is added.
+// qty is limited by spot free USDT.
+func PlanLoanRepayAction(acct *Account, demand RiskyLoanDemand) (action Action, ok bool) {
+	ord, ok := acct.LoanOrd(demand.Order.LoanCoin + "_" + demand.Order.CollateralCoin)
+	if !ok || ord.CurrentLTV <= 0 {
+		return action, false
+	}
+	need := LoanRepayNeed(ord, demand.TargetLtv)
+	if need < minLoanAdditionalUsdt {
+		return action, false
+	}
+	bal, _ := acct.SpotBal(ord.LoanCoin)
+	qty := mathy.RoundFloor(math.Min(need, bal.Free), 2)
+	if qty <= 0 {
+		return action, false
+	}
+	return Action{
+		Type:     ActionTypeRepay,
+		Reason:   FindingLoanLtvHigh,
+		Asset:    ord.CollateralCoin,
+		Qty:      qty,
+		LoanCoin: ord.LoanCoin,
+		Effects: []ActionEffect{{
+			Subject: ord.LoanCoin + "_" + ord.CollateralCoin,
+			Metric:  "ltv",
+			Before:  ord.CurrentLTV,
+			After:   ord.CurrentLTV * (ord.TotalDebt - qty) / ord.TotalDebt,
+		}},
+	}, true
+}
+
+// LoanRepayNeed returns loan coin qty should be repaid to restore targetLtv.
+func LoanRepayNeed(ord bnc.CryptoLoanFlexibleOngoingOrder, targetLtv float64) float64 {
+	if ord.CurrentLTV <= 0 {
+		return 0
+	}
+	return ord.TotalDebt - ord.TotalDebt/ord.CurrentLTV*targetLtv
+}
@@ -0,0 +1,75 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanLoanActions(t *testing.T) {
+	ord := bnc.CryptoLoanFlexibleOngoingOrder{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 780, CollateralAmount: 1, CurrentLTV: 0.78}
+	tests := []struct {
+		name    string
+		bals    []bnc.SpotBalance
+		types   []ActionType
+		wantLtv float64
+	}{
+		{
+			"Redeem And Add Collateral",
+			[]bnc.SpotBalance{{Asset: "BTC", Free: 0.1}, {Asset: "LDBTC", Free: 0.5}, {Asset: "USDT", Free: 1000}},
+			[]ActionType{ActionTypeRedeem, ActionTypeAdjustLTV},
+			0.6,
+		},
+		{
+			"Repay",
+			[]bnc.SpotBalance{{Asset: "USDT", Free: 1000}},
+			[]ActionType{ActionTypeRepay},
+			0.6,
+		},
+		{
+			"Not Enough USDT",
+			[]bnc.SpotBalance{{Asset: "USDT", Free: 80}},
+			[]ActionType{ActionTypeRepay},
+			0.7,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acct := (&Account{
+				Spot:          bnc.SpotAccount{Balances: tt.bals},
+				EarnPositions: []bnc.SimpleEarnFlexiblePosition{{Asset: "BTC", ProductId: "BTC001", TotalAmount: 0.5}},
+				LoanOrders:    []bnc.CryptoLoanFlexibleOngoingOrder{ord},
+			}).Clone()
+			demand, risky, _ := AnalyzeLoan(acct, ord)
+			if !risky {
+				t.Fatal("loan should be risky")
+			}
+			var types []ActionType
+			for _, planner := range []func(*Account, RiskyLoanDemand) (Action, bool){
+				PlanLoanRedeemAction,
+				PlanLoanCollateralAction,
+				PlanLoanRepayAction,
+			} {
+				action, ok := planner(acct, demand)
+				if !ok {
+					continue
+				}
+				types = append(types, action.Type)
+				acct = acct.WithActions(action)
+			}
+			if len(types) != len(tt.types) {
+				t.Fatalf("action types %v, want %v", types, tt.types)
+			}
+			for i := range types {
+				if types[i] != tt.types[i] {
+					t.Errorf("action types %v, want %v", types, tt.types)
+				}
+			}
+			newOrd, _ := acct.LoanOrd("USDT_BTC")
+			if math.Abs(newOrd.CurrentLTV-tt.wantLtv) > 1e-4 {
+				t.Errorf("ltv %v, want %v", newOrd.CurrentLTV, tt.wantLtv)
+			}
+		})
+	}
+}
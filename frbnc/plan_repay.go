@@ -0,0 +1,435 @@
+package frbnc
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+	"github.com/dwdwow/mathy"
+	"github.com/go-resty/resty/v2"
+)
+
+type CryptoLoanFlexibleRepayWithCollateralParams struct {
+	LoanCoin       string  `s2m:"loanCoin,omitempty"`
+	CollateralCoin string  `s2m:"collateralCoin,omitempty"`
+	RepayAmount    float64 `s2m:"repayAmount,omitempty"`
+	RepaymentType  int     `s2m:"repaymentType,omitempty"` // 1: repay with loan coin, 2: repay with collateral
+}
+
+// CryptoLoanFlexibleRepayWithCollateralConfig
+// bnc does not support repaymentType of flexible loan yet.
+var CryptoLoanFlexibleRepayWithCollateralConfig = cex.ReqConfig[CryptoLoanFlexibleRepayWithCollateralParams, bnc.CryptoLoanFlexibleRepayResult]{
+	ReqBaseConfig: cex.ReqBaseConfig{
+		BaseUrl:          bnc.ApiBaseUrl,
+		Path:             bnc.SapiV2 + "/loan/flexible/repay",
+		Method:           http.MethodPost,
+		IsUserData:       true,
+		UserTimeInterval: 0,
+		IpTimeInterval:   0,
+	},
+	HTTPStatusCodeChecker: bnc.HTTPStatusCodeChecker,
+	RespBodyUnmarshaler:   cex.StdBodyUnmarshaler[bnc.CryptoLoanFlexibleRepayResult],
+}
+
+// CryptoLoanFlexibleRepayWithCollateral repays amount of loan coin by selling collateral.
+func CryptoLoanFlexibleRepayWithCollateral(user *bnc.User, loanCoin, collateralCoin string, amount float64, opts ...cex.CltOpt) (*resty.Response, bnc.CryptoLoanFlexibleRepayResult, cex.RequestError) {
+	return cex.Request(user, CryptoLoanFlexibleRepayWithCollateralConfig, CryptoLoanFlexibleRepayWithCollateralParams{
+		LoanCoin:       loanCoin,
+		CollateralCoin: collateralCoin,
+		RepayAmount:    amount,
+		RepaymentType:  2,
+	}, opts...)
+}
+
+type RepayTrigger string
+
+const (
+	RepayTriggerLtvHigh       RepayTrigger = "LTV_HIGH"
+	RepayTriggerScheduled     RepayTrigger = "SCHEDULED"
+	RepayTriggerNegativeCarry RepayTrigger = "NEGATIVE_CARRY"
+)
+
+const minRepayUsdt = 1.0
+
+// ScheduledDeleverage repays loan to TargetLtv from From.
+// Subject is loanCoin_collateralCoin of flexible loan, or order id of vip loan.
+type ScheduledDeleverage struct {
+	Subject   string
+	From      time.Time
+	TargetLtv float64
+}
+
+// RepayPolicy decides when and how much loans are repaid.
+// Triggers not enabled are ignored, so zero policy repays nothing.
+type RepayPolicy struct {
+	Triggers map[RepayTrigger]bool
+
+	// MinUsdtReserve is spot USDT never used for repayment.
+	MinUsdtReserve float64
+
+	// LoanRates are annual interest rates of flexible loans, key is loan coin.
+	// Loan is in negative carry if its rate is higher than APR of flexible earn product of loan coin,
+	// then all spare cash is used to repay it.
+	LoanRates map[string]float64
+
+	Schedules []ScheduledDeleverage
+
+	// UseFuturesUsdt allows withdrawing um futures USDT above target margin ratio,
+	// or portfolio margin USDT above balanced uniMMR for vip loans.
+	UseFuturesUsdt bool
+	// UseEarn allows redeeming flexible earn USDT, for flexible and vip loans.
+	UseEarn bool
+	// RepayWithCollateral allows repaying flexible loans with collateral if cash is not enough,
+	// only for LTV_HIGH and SCHEDULED.
+	// VIP loans can not be repaid with collateral.
+	RepayWithCollateral bool
+}
+
+func DefaultRepayPolicy() RepayPolicy {
+	return RepayPolicy{
+		MinUsdtReserve: minUsdt,
+		UseFuturesUsdt: true,
+		UseEarn:        true,
+	}
+}
+
+// RepayNeed is loan coin amount should be repaid for one loan.
+type RepayNeed struct {
+	Trigger RepayTrigger
+	// Subject is loanCoin_collateralCoin of flexible loan, or order id of vip loan.
+	Subject string
+	Qty     float64
+
+	flexible *bnc.CryptoLoanFlexibleOngoingOrder
+	vip      *bnc.VIPLoanOngoingOrder
+}
+
+var repayTriggerPriority = map[RepayTrigger]int{
+	RepayTriggerLtvHigh:       0,
+	RepayTriggerScheduled:     1,
+	RepayTriggerNegativeCarry: 2,
+}
+
+func sortRepayNeeds(needs []RepayNeed) {
+	sort.SliceStable(needs, func(i, j int) bool {
+		return repayTriggerPriority[needs[i].Trigger] < repayTriggerPriority[needs[j].Trigger]
+	})
+}
+
+func (p RepayPolicy) schedule(subject string, now time.Time) (ScheduledDeleverage, bool) {
+	for _, s := range p.Schedules {
+		if s.Subject == subject && !now.Before(s.From) {
+			return s, true
+		}
+	}
+	return ScheduledDeleverage{}, false
+}
+
+// negativeCarry is true if loan rate of loanCoin is higher than earn APR of it.
+func (p RepayPolicy) negativeCarry(acct *Account, loanCoin string) bool {
+	rate, ok := p.LoanRates[loanCoin]
+	if !ok {
+		return false
+	}
+	var apr float64
+	if pos, ok := acct.EarnPos(loanCoin); ok {
+		apr = pos.LatestAnnualPercentageRate
+	}
+	return rate > apr
+}
+
+// FlexibleRepayNeeds returns repay needs of USDT flexible loans by enabled triggers,
+// one loan has one need of the trigger with highest priority.
+func FlexibleRepayNeeds(acct *Account, policy RepayPolicy, bands AllocationConfig, now time.Time) (needs []RepayNeed) {
+	var ords []bnc.CryptoLoanFlexibleOngoingOrder
+	for _, ord := range acct.lnOrds {
+		if ord.LoanCoin == "USDT" && ord.TotalDebt > 0 && ord.CurrentLTV > 0 {
+			ords = append(ords, ord)
+		}
+	}
+	sort.Slice(ords, func(i, j int) bool {
+		return ords[i].CurrentLTV > ords[j].CurrentLTV
+	})
+
+	for _, ord := range ords {
+		subject := ord.LoanCoin + "_" + ord.CollateralCoin
+		need := RepayNeed{Subject: subject, flexible: &ord}
+		band := bands.loanBand(ord.CollateralCoin)
+		schedule, scheduled := policy.schedule(subject, now)
+		switch {
+		case policy.Triggers[RepayTriggerLtvHigh] && ord.CurrentLTV > band.Max:
+			need.Trigger = RepayTriggerLtvHigh
+			need.Qty = LoanRepayNeed(ord, band.Target)
+		case policy.Triggers[RepayTriggerScheduled] && scheduled && ord.CurrentLTV > schedule.TargetLtv:
+			need.Trigger = RepayTriggerScheduled
+			need.Qty = LoanRepayNeed(ord, schedule.TargetLtv)
+		case policy.Triggers[RepayTriggerNegativeCarry] && policy.negativeCarry(acct, ord.LoanCoin):
+			need.Trigger = RepayTriggerNegativeCarry
+			need.Qty = ord.TotalDebt
+		default:
+			continue
+		}
+		if need.Qty >= minRepayUsdt {
+			needs = append(needs, need)
+		}
+	}
+	sortRepayNeeds(needs)
+	return
+}
+
+// PlanFlexibleRepayActions repays USDT flexible loans by needs of enabled triggers.
+// Cash comes from spot USDT above MinUsdtReserve,
+// then um futures USDT above target margin ratio, then flexible earn USDT.
+// Cash is only raised for LTV_HIGH and SCHEDULED needs,
+// NEGATIVE_CARRY only uses spare spot USDT.
+// Repayment is partial if cash is not enough,
+// and the rest is repaid with collateral if RepayWithCollateral.
+// Returns actions and needs not met.
+func PlanFlexibleRepayActions(acct *Account, policy RepayPolicy, bands AllocationConfig, now time.Time) (actions []Action, unmet []RepayNeed) {
+	needs := FlexibleRepayNeeds(acct, policy, bands, now)
+	if len(needs) == 0 {
+		return
+	}
+
+	var urgent float64
+	for _, need := range needs {
+		if need.Trigger != RepayTriggerNegativeCarry {
+			urgent += need.Qty
+		}
+	}
+
+	sim := acct.Clone()
+	cash := func() float64 {
+		bal, _ := sim.SpotBal("USDT")
+		return math.Max(bal.Free-policy.MinUsdtReserve, 0)
+	}
+	add := func(action Action) {
+		actions = append(actions, action)
+		sim = sim.WithActions(action)
+	}
+
+	if short := urgent - cash(); short > 0 && policy.UseFuturesUsdt {
+		if action, ok := planRepayFuWithdrawal(sim, bands, short); ok {
+			add(action)
+		}
+	}
+	if short := urgent - cash(); short > 0 && policy.UseEarn {
+		bal, _ := sim.SpotBal("LDUSDT")
+		productId, ok := sim.EarnProductId("USDT")
+		if qty := mathy.RoundFloor(math.Min(short, bal.Free), 6); ok && qty > 0 {
+			add(Action{Type: ActionTypeRedeem, Reason: FindingLoanLtvHigh, Asset: "USDT", Qty: qty, ProductId: productId})
+		}
+	}
+
+	for _, need := range needs {
+		ord := *need.flexible
+		remain := need.Qty
+		reason := FindingLoanLtvNormal
+		if need.Trigger == RepayTriggerLtvHigh {
+			reason = FindingLoanLtvHigh
+		}
+
+		if qty := mathy.RoundFloor(math.Min(remain, cash()), 2); qty >= minRepayUsdt {
+			cur, _ := sim.LoanOrd(need.Subject)
+			add(Action{
+				Type:     ActionTypeRepay,
+				Reason:   reason,
+				Asset:    ord.CollateralCoin,
+				Qty:      qty,
+				LoanCoin: ord.LoanCoin,
+				Effects: []ActionEffect{{
+					Subject: need.Subject,
+					Metric:  "ltv",
+					Before:  cur.CurrentLTV,
+					After:   cur.CurrentLTV * (cur.TotalDebt - qty) / cur.TotalDebt,
+				}},
+			})
+			remain -= qty
+		}
+
+		if remain >= minRepayUsdt && policy.RepayWithCollateral && need.Trigger != RepayTriggerNegativeCarry {
+			cur, _ := sim.LoanOrd(need.Subject)
+			price := cur.TotalDebt / cur.CurrentLTV / cur.CollateralAmount
+			// collateral sold can not exceed collateral held
+			qty := mathy.RoundFloor(math.Min(remain, cur.CollateralAmount*price*0.99), 2)
+			if qty >= minRepayUsdt {
+				add(Action{
+					Type:     ActionTypeRepayCollateral,
+					Reason:   reason,
+					Asset:    ord.CollateralCoin,
+					Qty:      qty,
+					LoanCoin: ord.LoanCoin,
+					Price:    price,
+				})
+				remain -= qty
+			}
+		}
+
+		if remain >= minRepayUsdt {
+			need.Qty = remain
+			unmet = append(unmet, need)
+		}
+	}
+	return
+}
+
+// planRepayFuWithdrawal withdraws um futures USDT for repayment,
+// margin ratio is kept at or above target ratio.
+func planRepayFuWithdrawal(acct *Account, bands AllocationConfig, qty float64) (action Action, ok bool) {
+	asset, ok := acct.FuAsset("USDT")
+	if !ok {
+		return
+	}
+	room := asset.MaxWithdrawAmount
+	ratio := acct.FuMarginRatio()
+	if ratio.Err != nil {
+		return action, false
+	}
+	if ratio.Notional > 0 {
+		room = math.Min(room, ratio.Margin-ratio.Notional*bands.FuMarginBand.Target)
+	}
+	qty = mathy.RoundFloor(math.Min(qty, room)*0.99, 2)
+	if qty < minRepayUsdt {
+		return action, false
+	}
+	return Action{
+		Type:         ActionTypeTransfer,
+		Reason:       FindingLoanLtvHigh,
+		Asset:        "USDT",
+		Qty:          qty,
+		TransferType: bnc.TransferTypeUmfutureMain,
+	}, true
+}
+
+// VIPRepayNeeds returns repay needs of vip loans by enabled triggers.
+// Vip loan order carries its own rate, so negative carry compares LoanRate of order
+// with earnAPRs of loan coin, policy.LoanRates is not used.
+func VIPRepayNeeds(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig, policy RepayPolicy, earnAPRs map[string]float64, now time.Time) (needs []RepayNeed) {
+	for _, analysis := range AnalyseVIPLoan(acct, cfg).Orders {
+		ord := analysis.Order
+		debt := ord.TotalDebt + ord.ResidualInterest
+		need := RepayNeed{Subject: ord.OrderId, vip: &ord}
+		schedule, scheduled := policy.schedule(ord.OrderId, now)
+		rate, rateErr := parseRate(ord.LoanRate)
+		switch {
+		case policy.Triggers[RepayTriggerLtvHigh] && analysis.Risky:
+			need.Trigger = RepayTriggerLtvHigh
+			need.Qty = analysis.AdditionalUsdt
+		case policy.Triggers[RepayTriggerScheduled] && scheduled && analysis.CurrentLTV > schedule.TargetLtv:
+			need.Trigger = RepayTriggerScheduled
+			need.Qty = debt - ord.TotalCollateralValueAfterHaircut*schedule.TargetLtv
+		case policy.Triggers[RepayTriggerNegativeCarry] && rateErr == nil && rate > earnAPRs[ord.LoanCoin]:
+			need.Trigger = RepayTriggerNegativeCarry
+			need.Qty = debt
+		default:
+			continue
+		}
+		if need.Qty >= minRepayUsdt {
+			needs = append(needs, need)
+		}
+	}
+	sortRepayNeeds(needs)
+	return
+}
+
+// PlanVIPRepayActions repays vip loans by needs of enabled triggers.
+// Cash comes from spot loan coin, USDT above MinUsdtReserve,
+// then portfolio margin USDT above BalancedUniMMR, then flexible earn USDT.
+// Cash is only raised for LTV_HIGH and SCHEDULED needs of USDT loans,
+// NEGATIVE_CARRY only uses spare spot.
+// Repayment is partial if cash is not enough.
+// Returns actions and needs not met.
+func PlanVIPRepayActions(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig, policy RepayPolicy, earnAPRs map[string]float64, now time.Time) (actions []Action, unmet []RepayNeed) {
+	needs := VIPRepayNeeds(acct, cfg, policy, earnAPRs, now)
+	if len(needs) == 0 {
+		return
+	}
+
+	var urgent float64
+	for _, need := range needs {
+		if need.Trigger != RepayTriggerNegativeCarry && need.vip.LoanCoin == "USDT" {
+			urgent += need.Qty
+		}
+	}
+
+	sim := acct.Clone()
+	cash := func(coin string) float64 {
+		bal, _ := sim.SpotBalance(coin)
+		if coin == "USDT" {
+			return math.Max(bal.Free-policy.MinUsdtReserve, 0)
+		}
+		return math.Max(bal.Free, 0)
+	}
+	add := func(action Action) {
+		actions = append(actions, action)
+		sim = sim.WithActions(action)
+	}
+
+	if short := urgent - cash("USDT"); short > 0 && policy.UseFuturesUsdt {
+		if action, ok := planRepayPortmarWithdrawal(sim, cfg, short); ok {
+			add(action)
+		}
+	}
+	if short := urgent - cash("USDT"); short > 0 && policy.UseEarn {
+		pos, ok := sim.EarnPos("USDT")
+		if qty := mathy.RoundFloor(math.Min(short, pos.TotalAmount), 6); ok && pos.CanRedeem && qty > 0 {
+			add(Action{Type: ActionTypeRedeem, Reason: FindingVIPLoanLtvHigh, Asset: "USDT", Qty: qty, ProductId: pos.ProductId})
+		}
+	}
+
+	for _, need := range needs {
+		coin := need.vip.LoanCoin
+		if qty := mathy.RoundFloor(math.Min(need.Qty, cash(coin)), 2); qty >= minRepayUsdt {
+			reason := FindingVIPLoanLtvNormal
+			if need.Trigger == RepayTriggerLtvHigh {
+				reason = FindingVIPLoanLtvHigh
+			}
+			add(Action{
+				Type:     ActionTypeVIPRepay,
+				Reason:   reason,
+				Asset:    need.vip.CollateralCoin,
+				Qty:      qty,
+				LoanCoin: coin,
+				OrderId:  need.Subject,
+			})
+			need.Qty -= qty
+		}
+		if need.Qty >= minRepayUsdt {
+			unmet = append(unmet, need)
+		}
+	}
+	return
+}
+
+// planRepayPortmarWithdrawal transfers portfolio margin USDT for repayment,
+// uniMMR is kept at or above BalancedUniMMR.
+func planRepayPortmarWithdrawal(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig, qty float64) (action Action, ok bool) {
+	surplus := -AnalysePortmar(acct, cfg).EquityNeed
+	bal, _ := acct.PortmarBalance("USDT")
+	qty = mathy.RoundFloor(math.Min(qty, math.Min(surplus, bal.CrossMarginFree)), 2)
+	if qty < minRepayUsdt {
+		return action, false
+	}
+	return Action{
+		Type:         ActionTypeTransfer,
+		Reason:       FindingVIPLoanLtvHigh,
+		Asset:        "USDT",
+		Qty:          qty,
+		TransferType: bnc.TransferTypePortfolioMarginMain,
+	}, true
+}
+
+// parseRate parses rate like "0.05" or "5%".
+func parseRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		return rate / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,232 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanFlexibleRepayActions(t *testing.T) {
+	now := time.Now()
+	acct := (&Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{
+			{Asset: "USDT", Free: 1005},
+			{Asset: "LDUSDT", Free: 500},
+		}},
+		Futures: bnc.FuturesAccount{
+			TotalMarginBalance: 10000,
+			Assets:             []bnc.FuturesAccountAsset{{Asset: "USDT", MarginBalance: 10000, MaxWithdrawAmount: 2000}},
+			Positions:          []bnc.FuturesAccountPosition{{Symbol: "ETHUSDT", SignPositionAmt: -10}},
+		},
+		LoanOrders: []bnc.CryptoLoanFlexibleOngoingOrder{
+			// ltv high, 400 to target ltv
+			{LoanCoin: "USDT", CollateralCoin: "ETH", TotalDebt: 1600, CollateralAmount: 1, CurrentLTV: 0.8},
+			// scheduled to 0.45, 3000
+			{LoanCoin: "USDT", CollateralCoin: "BTC", TotalDebt: 30000, CollateralAmount: 1, CurrentLTV: 0.5},
+			// negative carry, 100
+			{LoanCoin: "USDT", CollateralCoin: "BNB", TotalDebt: 100, CollateralAmount: 1, CurrentLTV: 0.2},
+		},
+		EarnPositions: []bnc.SimpleEarnFlexiblePosition{{Asset: "USDT", ProductId: "USDT001", CanRedeem: true, LatestAnnualPercentageRate: 0.05}},
+		MarkPrices:    map[string]float64{"ETHUSDT": 2000},
+	}).Clone()
+
+	policy := DefaultRepayPolicy()
+	policy.Triggers = map[RepayTrigger]bool{RepayTriggerLtvHigh: true, RepayTriggerScheduled: true, RepayTriggerNegativeCarry: true}
+	policy.LoanRates = map[string]float64{"USDT": 0.1}
+	policy.Schedules = []ScheduledDeleverage{
+		{Subject: "USDT_BTC", From: now.Add(-time.Hour), TargetLtv: 0.45},
+		{Subject: "USDT_BNB", From: now.Add(time.Hour), TargetLtv: 0.1},
+	}
+
+	type want struct {
+		typ   ActionType
+		asset string
+		qty   float64
+	}
+
+	tests := []struct {
+		name   string
+		policy func(RepayPolicy) RepayPolicy
+		want   []want
+		unmet  map[string]float64
+	}{
+		{
+			name:   "all sources",
+			policy: func(p RepayPolicy) RepayPolicy { return p },
+			want: []want{
+				{ActionTypeTransfer, "USDT", 1980},
+				{ActionTypeRedeem, "USDT", 420},
+				{ActionTypeRepay, "ETH", 400},
+				{ActionTypeRepay, "BTC", 3000},
+			},
+			unmet: map[string]float64{"USDT_BNB": 100},
+		},
+		{
+			name: "spot and collateral",
+			policy: func(p RepayPolicy) RepayPolicy {
+				p.UseFuturesUsdt = false
+				p.UseEarn = false
+				p.RepayWithCollateral = true
+				return p
+			},
+			want: []want{
+				{ActionTypeRepay, "ETH", 400},
+				{ActionTypeRepay, "BTC", 600},
+				{ActionTypeRepayCollateral, "BTC", 2400},
+			},
+			unmet: map[string]float64{"USDT_BNB": 100},
+		},
+		{
+			name:   "no trigger",
+			policy: func(p RepayPolicy) RepayPolicy { return DefaultRepayPolicy() },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions, unmet := PlanFlexibleRepayActions(acct, tt.policy(policy), DefaultAllocationConfig(), now)
+			if len(actions) != len(tt.want) {
+				t.Fatalf("actions len %v, want %v: %+v", len(actions), len(tt.want), actions)
+			}
+			for i, w := range tt.want {
+				a := actions[i]
+				if a.Type != w.typ || a.Asset != w.asset || math.Abs(a.Qty-w.qty) > 1e-9 {
+					t.Errorf("action %v: %v %v %v, want %v %v %v", i, a.Type, a.Asset, a.Qty, w.typ, w.asset, w.qty)
+				}
+			}
+			if len(unmet) != len(tt.unmet) {
+				t.Fatalf("unmet %+v, want %v", unmet, tt.unmet)
+			}
+			for _, need := range unmet {
+				if math.Abs(need.Qty-tt.unmet[need.Subject]) > 1e-9 {
+					t.Errorf("unmet %v %v, want %v", need.Subject, need.Qty, tt.unmet[need.Subject])
+				}
+			}
+			if bal, _ := acct.WithActions(actions...).SpotBal("USDT"); bal.Free < policy.MinUsdtReserve-1e-9 {
+				t.Errorf("spot USDT %v, below reserve", bal.Free)
+			}
+		})
+	}
+}
+
+func TestPlanVIPRepayActions(t *testing.T) {
+	// order 1 needs 200 to target ltv 0.6, order 2 is in negative carry
+	newAcct := func(spot, pmUsdt, earn float64) *VIPPortmarAccount {
+		return (&VIPPortmarAccount{
+			Spot:                      bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "USDT", Free: spot}}},
+			PortmarAccountInformation: bnc.PortfolioMarginAccountInformation{UniMMR: pmUsdt / 1000, AccountMaintMargin: 1000},
+			PortmarBalances:           []bnc.PortfolioMarginBalance{{Asset: "USDT", CrossMarginAsset: pmUsdt, CrossMarginFree: pmUsdt}},
+			LoanOrders: []bnc.VIPLoanOngoingOrder{
+				{OrderId: "1", LoanCoin: "USDT", TotalDebt: 800, TotalCollateralValueAfterHaircut: 1000, CurrentLTV: 0.8, MarginCallLtv: "85%", LiquidationLtv: "91%"},
+				{OrderId: "2", LoanCoin: "USDT", TotalDebt: 500, TotalCollateralValueAfterHaircut: 1000, CurrentLTV: 0.5, LoanRate: "8%", MarginCallLtv: "85%", LiquidationLtv: "91%"},
+			},
+			EarnPositions: []bnc.SimpleEarnFlexiblePosition{{Asset: "USDT", ProductId: "USDT001", TotalAmount: earn, CanRedeem: true}},
+		}).Clone()
+	}
+	cfg := VIPPortmarAccountConfig{BalancedUniMMR: 2, VIPLoanMaxLTV: 0.75, VIPLoanTargetLTV: 0.6}
+
+	type want struct {
+		typ     ActionType
+		orderId string
+		qty     float64
+	}
+
+	tests := []struct {
+		name     string
+		acct     *VIPPortmarAccount
+		triggers []RepayTrigger
+		modify   func(*RepayPolicy)
+		want     []want
+		unmet    map[string]float64
+	}{
+		{
+			name:     "spot",
+			acct:     newAcct(255, 0, 0),
+			triggers: []RepayTrigger{RepayTriggerLtvHigh, RepayTriggerNegativeCarry},
+			want:     []want{{ActionTypeVIPRepay, "1", 200}, {ActionTypeVIPRepay, "2", 50}},
+			unmet:    map[string]float64{"2": 450},
+		},
+		{
+			// 100 of 1500 above BalancedUniMMR is withdrawn, negative carry gets nothing from it
+			name:     "portfolio margin",
+			acct:     newAcct(105, 2500, 0),
+			triggers: []RepayTrigger{RepayTriggerLtvHigh, RepayTriggerNegativeCarry},
+			want:     []want{{ActionTypeTransfer, "", 100}, {ActionTypeVIPRepay, "1", 200}},
+			unmet:    map[string]float64{"2": 500},
+		},
+		{
+			name:     "portfolio margin balanced",
+			acct:     newAcct(105, 2000, 0),
+			triggers: []RepayTrigger{RepayTriggerLtvHigh},
+			want:     []want{{ActionTypeVIPRepay, "1", 100}},
+			unmet:    map[string]float64{"1": 100},
+		},
+		{
+			name:     "earn",
+			acct:     newAcct(105, 2062.5, 60),
+			triggers: []RepayTrigger{RepayTriggerLtvHigh},
+			want:     []want{{ActionTypeTransfer, "", 62.5}, {ActionTypeRedeem, "", 37.5}, {ActionTypeVIPRepay, "1", 200}},
+		},
+		{
+			name:     "earn not used",
+			acct:     newAcct(105, 0, 60),
+			triggers: []RepayTrigger{RepayTriggerLtvHigh},
+			modify:   func(p *RepayPolicy) { p.UseEarn = false },
+			want:     []want{{ActionTypeVIPRepay, "1", 100}},
+			unmet:    map[string]float64{"1": 100},
+		},
+		{
+			// order 2 to 0.3
+			name:     "scheduled",
+			acct:     newAcct(5, 2500, 0),
+			triggers: []RepayTrigger{RepayTriggerScheduled},
+			modify: func(p *RepayPolicy) {
+				p.Schedules = []ScheduledDeleverage{{Subject: "2", TargetLtv: 0.3}}
+			},
+			want: []want{{ActionTypeTransfer, "", 200}, {ActionTypeVIPRepay, "2", 200}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := DefaultRepayPolicy()
+			policy.Triggers = map[RepayTrigger]bool{}
+			for _, trigger := range tt.triggers {
+				policy.Triggers[trigger] = true
+			}
+			if tt.modify != nil {
+				tt.modify(&policy)
+			}
+
+			actions, unmet := PlanVIPRepayActions(tt.acct, cfg, policy, map[string]float64{"USDT": 0.05}, time.Now())
+			if len(actions) != len(tt.want) {
+				t.Fatalf("actions %+v, want %v", actions, tt.want)
+			}
+			for i, w := range tt.want {
+				a := actions[i]
+				if a.Type != w.typ || a.OrderId != w.orderId || math.Abs(a.Qty-w.qty) > 1e-9 {
+					t.Errorf("action %v: %v %v %v, want %+v", i, a.Type, a.OrderId, a.Qty, w)
+				}
+				if a.Type == ActionTypeTransfer && a.TransferType != bnc.TransferTypePortfolioMarginMain {
+					t.Errorf("action %v: transfer %v, want portfolio margin -> main", i, a.TransferType)
+				}
+			}
+			if len(actions) > 0 && actions[len(actions)-1].OrderId == "1" && actions[len(actions)-1].Reason != FindingVIPLoanLtvHigh {
+				t.Errorf("action %+v, want vip repay of ltv high", actions[len(actions)-1])
+			}
+			if len(unmet) != len(tt.unmet) {
+				t.Fatalf("unmet %+v, want %v", unmet, tt.unmet)
+			}
+			for _, need := range unmet {
+				if math.Abs(need.Qty-tt.unmet[need.Subject]) > 1e-9 {
+					t.Errorf("unmet %v %v, want %v", need.Subject, need.Qty, tt.unmet[need.Subject])
+				}
+			}
+			if bal, _ := tt.acct.WithActions(actions...).SpotBalance("USDT"); bal.Free < policy.MinUsdtReserve-1e-9 {
+				t.Errorf("spot USDT %v, below reserve", bal.Free)
+			}
+		})
+	}
+}
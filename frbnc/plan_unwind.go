@@ -0,0 +1,218 @@
+package frbnc
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/mathy"
+)
+
+type UnwindOrder string
+
+const (
+	// UnwindOrderProfitDesc unwinds hedges whose futures short has highest profit ratio first,
+	// so most margin and profit is released per coin.
+	UnwindOrderProfitDesc UnwindOrder = "PROFIT_DESC"
+	// UnwindOrderProfitAsc unwinds hedges whose futures short has lowest profit ratio first,
+	// so positions near liquidation are reduced first.
+	UnwindOrderProfitAsc UnwindOrder = "PROFIT_ASC"
+	// UnwindOrderSizeDesc unwinds largest hedges first.
+	UnwindOrderSizeDesc UnwindOrder = "SIZE_DESC"
+)
+
+// UnwindConfig is rules to choose hedges to unwind.
+type UnwindConfig struct {
+	Order UnwindOrder
+	// Symbols are um symbols can be unwound, empty means all.
+	Symbols map[string]bool
+	// Excluded are um symbols never unwound.
+	Excluded map[string]bool
+	// MaxRatio is max ratio of every hedge unwound once, (0, 1].
+	MaxRatio float64
+	// FillTimeout is max time waiting for every order to be filled.
+	FillTimeout time.Duration
+	// Withdraw moves released futures USDT to spot.
+	Withdraw bool
+}
+
+func DefaultUnwindConfig() UnwindConfig {
+	return UnwindConfig{
+		Order:       UnwindOrderProfitDesc,
+		MaxRatio:    1,
+		FillTimeout: time.Second * 10,
+		Withdraw:    true,
+	}
+}
+
+// UnwindCandidate is a hedge of spot coin and um futures short.
+type UnwindCandidate struct {
+	Symbol string
+	SpPair cex.Pair
+	FuPair cex.Pair
+	FuExp  float64
+	// Qty is hedged coin qty, min of spot free qty and futures short.
+	Qty float64
+	// Price is coin price.
+	Price float64
+	// ProfitRatio is unrealized profit / notional of futures position.
+	ProfitRatio float64
+	// ReleasePerQty is USDT released by unwinding one coin,
+	// spot coin sold, futures initial margin and unrealized profit.
+	ReleasePerQty float64
+}
+
+// UnwindCandidates returns hedges of acct allowed by cfg, sorted by cfg.Order.
+func UnwindCandidates(acct *Account, spPairs, fuPairs map[string]cex.Pair, cfg UnwindConfig) (candidates []UnwindCandidate) {
+	for _, pos := range acct.Futures.Positions {
+		if pos.SignPositionAmt >= 0 {
+			continue
+		}
+		if (len(cfg.Symbols) > 0 && !cfg.Symbols[pos.Symbol]) || cfg.Excluded[pos.Symbol] {
+			continue
+		}
+		coin, fuExp, ok := FuSymbolCoin(pos.Symbol, "USDT")
+		if !ok {
+			continue
+		}
+		spPair, ok := spPairs[coin+"USDT"]
+		if !ok || !spPair.Tradable {
+			continue
+		}
+		fuPair, ok := fuPairs[pos.Symbol]
+		if !ok || !fuPair.Tradable {
+			continue
+		}
+		price, err := acct.FuMarkPrice(pos.Symbol)
+		if err != nil {
+			continue
+		}
+		bal, _ := acct.SpotBal(coin)
+		posQty := -pos.SignPositionAmt * fuExp
+		qty := math.Min(bal.Free, posQty)
+		if qty <= 0 {
+			continue
+		}
+		notional := posQty * price / fuExp
+		candidates = append(candidates, UnwindCandidate{
+			Symbol:        pos.Symbol,
+			SpPair:        spPair,
+			FuPair:        fuPair,
+			FuExp:         fuExp,
+			Qty:           qty,
+			Price:         price / fuExp,
+			ProfitRatio:   pos.UnrealizedProfit / notional,
+			ReleasePerQty: price/fuExp + math.Max(pos.PositionInitialMargin+pos.UnrealizedProfit, 0)/posQty,
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		switch cfg.Order {
+		case UnwindOrderProfitAsc:
+			return ci.ProfitRatio < cj.ProfitRatio
+		case UnwindOrderSizeDesc:
+			return ci.Qty*ci.Price > cj.Qty*cj.Price
+		default:
+			return ci.ProfitRatio > cj.ProfitRatio
+		}
+	})
+	return
+}
+
+// PlanCutPositions unwinds hedges until usdtNeed is released.
+// Every hedge is two market orders, futures short is bought back first,
+// then spot coin is sold, so acct is never short without hedge.
+// Qty respects precision, min qty and min notional of both pairs.
+// Returns actions and USDT estimated to be released.
+func PlanCutPositions(acct *Account, spPairs, fuPairs map[string]cex.Pair, usdtNeed float64, cfg UnwindConfig, reason FindingCode) (actions []Action, released float64) {
+	maxRatio := cfg.MaxRatio
+	if maxRatio <= 0 || maxRatio > 1 {
+		maxRatio = 1
+	}
+
+	for _, c := range UnwindCandidates(acct, spPairs, fuPairs, cfg) {
+		remain := usdtNeed - released
+		if remain < minUsdt {
+			break
+		}
+		qty := math.Min(c.Qty*maxRatio, remain/c.ReleasePerQty)
+		fuQty := mathy.RoundFloor(qty/c.FuExp, int32(c.FuPair.QPrecision))
+		spQty := mathy.RoundFloor(fuQty*c.FuExp, int32(c.SpPair.QPrecision))
+		// spot qty may be floored more than futures qty
+		fuQty = mathy.RoundFloor(spQty/c.FuExp, int32(c.FuPair.QPrecision))
+		if fuQty <= 0 || fuQty < c.FuPair.MinTradeQty || spQty < c.SpPair.MinTradeQty {
+			continue
+		}
+		value := spQty * c.Price
+		if value < math.Max(minSpotTradeUsdt, c.SpPair.MinTradeQuote) || value < math.Max(minFuTradeUsdt, c.FuPair.MinTradeQuote) {
+			continue
+		}
+		actions = append(actions,
+			Action{
+				Type:     ActionTypeMarketOrder,
+				Reason:   reason,
+				Asset:    c.FuPair.Asset,
+				Quote:    c.FuPair.Quote,
+				Qty:      fuQty,
+				Price:    c.Price * c.FuExp,
+				PairType: cex.PairTypeFutures,
+				Side:     cex.OrderSideBuy,
+			},
+			Action{
+				Type:     ActionTypeMarketOrder,
+				Reason:   reason,
+				Asset:    c.SpPair.Asset,
+				Quote:    c.SpPair.Quote,
+				Qty:      spQty,
+				Price:    c.Price,
+				PairType: cex.PairTypeSpot,
+				Side:     cex.OrderSideSell,
+			},
+		)
+		released += spQty * c.ReleasePerQty
+	}
+	return
+}
+
+// UnwindReport is result of cutting positions.
+type UnwindReport struct {
+	Results []ActionResult
+	// SpotUsdt is quote filled by spot sell orders.
+	SpotUsdt float64
+	// FuturesUsdt is increase of um futures USDT withdrawable.
+	FuturesUsdt float64
+	// WithdrawnUsdt is part of FuturesUsdt moved to spot.
+	WithdrawnUsdt float64
+	// Unhedged are futures legs filled without spot leg filled,
+	// spot coin of them is left without hedge.
+	Unhedged []Action
+}
+
+// Released returns USDT actually released.
+func (r UnwindReport) Released() float64 {
+	return r.SpotUsdt + r.FuturesUsdt
+}
+
+// addLegs adds results of one hedge, futures leg is the first.
+func (r *UnwindReport) addLegs(results []ActionResult) {
+	r.Results = append(r.Results, results...)
+	var fuFilled, spFilled bool
+	for _, res := range results {
+		ord, ok := res.Result.(*cex.Order)
+		if !ok || ord == nil {
+			continue
+		}
+		switch res.Action.PairType {
+		case cex.PairTypeFutures:
+			fuFilled = ord.FilledQty > 0
+		case cex.PairTypeSpot:
+			spFilled = ord.FilledQty > 0
+			r.SpotUsdt += ord.FilledQuote
+		}
+	}
+	if fuFilled && !spFilled {
+		r.Unhedged = append(r.Unhedged, results[0].Action)
+	}
+}
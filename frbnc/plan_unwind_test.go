@@ -0,0 +1,119 @@
+package frbnc
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanCutPositions(t *testing.T) {
+	acct := (&Account{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{
+			{Asset: "ETH", Free: 10},
+			{Asset: "BTC", Free: 0.5},
+		}},
+		Futures: bnc.FuturesAccount{
+			Positions: []bnc.FuturesAccountPosition{
+				// profit ratio 0.05, release 2000 + 3000 / 10 per ETH
+				{Symbol: "ETHUSDT", SignPositionAmt: -10, UnrealizedProfit: 1000, PositionInitialMargin: 2000},
+				// profit ratio -0.01, release 60000 + 5400 per BTC
+				{Symbol: "BTCUSDT", SignPositionAmt: -1, UnrealizedProfit: -600, PositionInitialMargin: 6000},
+			},
+		},
+		MarkPrices: map[string]float64{"ETHUSDT": 2000, "BTCUSDT": 60000},
+	}).Clone()
+	spPairs := map[string]cex.Pair{
+		"ETHUSDT": {Asset: "ETH", Quote: "USDT", QPrecision: 4, Tradable: true},
+		"BTCUSDT": {Asset: "BTC", Quote: "USDT", QPrecision: 5, Tradable: true},
+	}
+	fuPairs := map[string]cex.Pair{
+		"ETHUSDT": {Asset: "ETH", Quote: "USDT", QPrecision: 3, Tradable: true},
+		"BTCUSDT": {Asset: "BTC", Quote: "USDT", QPrecision: 3, MinTradeQty: 0.001, Tradable: true},
+	}
+
+	type hedge struct {
+		coin string
+		qty  float64
+	}
+
+	tests := []struct {
+		name     string
+		need     float64
+		cfg      func(UnwindConfig) UnwindConfig
+		want     []hedge
+		released float64
+	}{
+		{"profit desc part", 4600, nil, []hedge{{"ETH", 2}}, 4600},
+		{"profit desc all", 30000, nil, []hedge{{"ETH", 10}, {"BTC", 0.107}}, 23000 + 0.107*65400},
+		{"size desc", 10000, func(c UnwindConfig) UnwindConfig {
+			c.Order = UnwindOrderSizeDesc
+			return c
+		}, []hedge{{"BTC", 0.152}, {"ETH", 0.025}}, 0.152*65400 + 0.025*2300},
+		{"excluded", 4600, func(c UnwindConfig) UnwindConfig {
+			c.Excluded = map[string]bool{"BTCUSDT": true, "ETHUSDT": true}
+			return c
+		}, nil, 0},
+		{"max ratio", 30000, func(c UnwindConfig) UnwindConfig {
+			c.MaxRatio = 0.5
+			return c
+		}, []hedge{{"ETH", 5}, {"BTC", 0.25}}, 11500 + 0.25*65400},
+		{"below min notional", 10, nil, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultUnwindConfig()
+			if tt.cfg != nil {
+				cfg = tt.cfg(cfg)
+			}
+			actions, released := PlanCutPositions(acct, spPairs, fuPairs, tt.need, cfg, FindingLoanLtvHigh)
+			if math.Abs(released-tt.released) > 1e-6 {
+				t.Errorf("released %v, want %v", released, tt.released)
+			}
+			if len(actions) != len(tt.want)*2 {
+				t.Fatalf("actions len %v, want %v", len(actions), len(tt.want)*2)
+			}
+			for i, w := range tt.want {
+				fu, sp := actions[2*i], actions[2*i+1]
+				if fu.PairType != cex.PairTypeFutures || fu.Side != cex.OrderSideBuy || fu.Asset != w.coin || math.Abs(fu.Qty-w.qty) > 1e-9 {
+					t.Errorf("futures leg %v: %v %v %v %v, want buy %v %v", i, fu.PairType, fu.Side, fu.Asset, fu.Qty, w.coin, w.qty)
+				}
+				if sp.PairType != cex.PairTypeSpot || sp.Side != cex.OrderSideSell || sp.Asset != w.coin || math.Abs(sp.Qty-w.qty) > 1e-9 {
+					t.Errorf("spot leg %v: %v %v %v %v, want sell %v %v", i, sp.PairType, sp.Side, sp.Asset, sp.Qty, w.coin, w.qty)
+				}
+			}
+		})
+	}
+}
+
+func TestUnwindReport(t *testing.T) {
+	fuLeg := Action{Type: ActionTypeMarketOrder, Asset: "ETH", PairType: cex.PairTypeFutures, Side: cex.OrderSideBuy}
+	spLeg := Action{Type: ActionTypeMarketOrder, Asset: "ETH", PairType: cex.PairTypeSpot, Side: cex.OrderSideSell}
+
+	var report UnwindReport
+	report.addLegs([]ActionResult{
+		{Action: fuLeg, Result: &cex.Order{FilledQty: 1}},
+		{Action: spLeg, Result: &cex.Order{FilledQty: 1, FilledQuote: 2000}},
+	})
+	// spot order times out after partly filled
+	report.addLegs([]ActionResult{
+		{Action: fuLeg, Result: &cex.Order{FilledQty: 1}},
+		{Action: spLeg, Result: &cex.Order{FilledQty: 0.5, FilledQuote: 1000}, Err: errors.New("timeout")},
+	})
+	// spot order is rejected
+	report.addLegs([]ActionResult{
+		{Action: fuLeg, Result: &cex.Order{FilledQty: 1}},
+		{Action: spLeg, Err: errors.New("rejected")},
+	})
+	report.FuturesUsdt = 500
+
+	if report.SpotUsdt != 3000 || report.Released() != 3500 {
+		t.Errorf("spot usdt %v, released %v, want 3000, 3500", report.SpotUsdt, report.Released())
+	}
+	if len(report.Unhedged) != 1 {
+		t.Errorf("unhedged %+v, want 1 futures leg", report.Unhedged)
+	}
+}
@@ -0,0 +1,178 @@
+package frbnc
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dwdwow/cex"
+)
+
+type PosTradeKind string
+
+const (
+	// PosTradeKindVIPPortmar is trade of VIPPortmarPosTrader.
+	PosTradeKindVIPPortmar PosTradeKind = "VIP_PORTMAR_POS"
+	// PosTradeKindSlowly is trade of Main.NewPosSlowly and Main.NewPos.
+	PosTradeKindSlowly PosTradeKind = "NEW_POS_SLOWLY"
+)
+
+// PosTrade is in-flight hedge trade,
+// saved after every transition, so it can be resumed after crash.
+type PosTrade struct {
+	Id         string       `json:"id"`
+	Kind       PosTradeKind `json:"kind"`
+	CreateTime int64        `json:"createTime"`
+	UpdateTime int64        `json:"updateTime"`
+
+	SpSide cex.OrderSide `json:"spSide"`
+	IsCM   bool          `json:"isCM"`
+	SpPair cex.Pair      `json:"spPair"`
+	FuPair cex.Pair      `json:"fuPair"`
+	// SpQty and FuQty are planned qty of one position.
+	SpQty float64 `json:"spQty"`
+	FuQty float64 `json:"fuQty"`
+
+	// NEW_POS_SLOWLY
+	FuExp float64 `json:"fuExp"`
+	Times int64   `json:"times"`
+	// Done is number of finished positions.
+	Done int64 `json:"done"`
+
+	// Msg is state of current position.
+	Msg VIPPortmarPosMsg `json:"msg"`
+	// Errs are errors of Msg as strings, error can not be saved.
+	Errs []string `json:"errs"`
+}
+
+func newPosTrade(kind PosTradeKind) PosTrade {
+	now := time.Now().UnixMilli()
+	return PosTrade{
+		Id:         newRandomId(),
+		Kind:       kind,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+}
+
+// PosTradeStore saves every in-flight trade as one json file in dir.
+// File is replaced atomically, so a crash leaves the old or the new state.
+type PosTradeStore struct {
+	dir    string
+	logger *slog.Logger
+}
+
+func NewPosTradeStore(dir string, logger *slog.Logger) (*PosTradeStore, error) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &PosTradeStore{dir: dir, logger: logger}, nil
+}
+
+func (s *PosTradeStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Save writes trade, nil store does nothing.
+func (s *PosTradeStore) Save(trade PosTrade) error {
+	if s == nil {
+		return nil
+	}
+	trade.UpdateTime = time.Now().UnixMilli()
+	// errors saved before restart are kept
+	trade.Errs = slices.Clone(trade.Errs)
+	for _, err := range trade.Msg.Errs {
+		trade.Errs = append(trade.Errs, err.Error())
+	}
+	data, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, trade.Id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(trade.Id))
+}
+
+// Delete removes finished trade, nil store does nothing.
+func (s *PosTradeStore) Delete(id string) error {
+	if s == nil {
+		return nil
+	}
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Load returns all unfinished trades, sorted by create time.
+func (s *PosTradeStore) Load() (trades []PosTrade, err error) {
+	if s == nil {
+		return
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var trade PosTrade
+		if err := json.Unmarshal(data, &trade); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		trades = append(trades, trade)
+	}
+	sort.SliceStable(trades, func(i, j int) bool {
+		return trades[i].CreateTime < trades[j].CreateTime
+	})
+	return trades, errors.Join(errs...)
+}
+
+// sync saves unsettled trade and deletes settled one,
+// error is only logged, trading should not be stopped by it.
+func (s *PosTradeStore) sync(trade PosTrade, settled bool) {
+	if s == nil {
+		return
+	}
+	var err error
+	if settled {
+		err = s.Delete(trade.Id)
+	} else {
+		err = s.Save(trade)
+	}
+	if err != nil {
+		s.logger.Error("Cannot Save Position Trade", "id", trade.Id, "kind", trade.Kind, "err", err)
+	}
+}
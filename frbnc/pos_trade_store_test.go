@@ -0,0 +1,183 @@
+package frbnc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPosTradeStore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store, err := NewPosTradeStore(t.TempDir(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newPosTrade(PosTradeKindSlowly)
+	first.Times = 3
+	first.Done = 1
+	first.Msg.SpOrd = VIPPortmarOrd{Order: cex.Order{OrderId: "11", Symbol: "ETHUSDT"}, Status: VIPPortmarOrderStatusOpening}
+	first.Msg.Errs = []error{errors.New("wait timeout")}
+
+	second := newPosTrade(PosTradeKindVIPPortmar)
+	second.CreateTime = first.CreateTime + 1
+
+	for _, trade := range []PosTrade{second, first, first} {
+		if err := store.Save(trade); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trades, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 || trades[0].Id != first.Id || trades[1].Id != second.Id {
+		t.Fatalf("trades %+v, want sorted by create time", trades)
+	}
+	got := trades[0]
+	if got.Done != 1 || got.Msg.SpOrd.Order.OrderId != "11" || got.Msg.Status() != VIPPortmarPosStatusSpOpening {
+		t.Errorf("loaded trade %+v", got)
+	}
+	if len(got.Errs) != 1 || got.Errs[0] != "wait timeout" {
+		t.Errorf("errs %v", got.Errs)
+	}
+
+	// errors saved before restart are kept
+	got.Msg.Errs = []error{errors.New("resume failed")}
+	if err := store.Save(got); err != nil {
+		t.Fatal(err)
+	}
+	trades, _ = store.Load()
+	if errs := trades[0].Errs; len(errs) != 2 || errs[1] != "resume failed" {
+		t.Errorf("errs after resume %v", errs)
+	}
+
+	if err := store.Delete(first.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(first.Id); err != nil {
+		t.Errorf("delete twice: %v", err)
+	}
+	if trades, _ = store.Load(); len(trades) != 1 || trades[0].Id != second.Id {
+		t.Errorf("trades after delete %+v", trades)
+	}
+}
+
+func TestResumeVIPPortmarPosTrader(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	opened := VIPPortmarOrd{Order: cex.Order{OrderId: "1"}, Status: VIPPortmarOrderStatusOpened}
+
+	tests := []struct {
+		name   string
+		msg    VIPPortmarPosMsg
+		status VIPPortmarPosStatus
+		kept   bool
+		// unknown is true if order id of a placed leg was not saved
+		unknown bool
+	}{
+		{"placing futures", VIPPortmarPosMsg{FuOrd: VIPPortmarOrd{Status: VIPPortmarOrderStatusOpening}},
+			VIPPortmarPosStatusFuWaiterFailed, true, true},
+		{"placing spot", VIPPortmarPosMsg{FuOrd: opened, SpOrd: VIPPortmarOrd{Status: VIPPortmarOrderStatusOpening}},
+			VIPPortmarPosStatusSpWaiterFailed, true, true},
+		{"spot opened", VIPPortmarPosMsg{FuOrd: opened, SpOrd: opened}, VIPPortmarPosStatusSpOpened, false, false},
+		// trade was not deleted before restart
+		{"futures failed", VIPPortmarPosMsg{FuOrd: VIPPortmarOrd{Status: VIPPortmarOrderStatusFailed}}, VIPPortmarPosStatusFuFailed, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewPosTradeStore(t.TempDir(), logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trade := newPosTrade(PosTradeKindVIPPortmar)
+			trade.SpSide = cex.OrderSideSell
+			trade.Msg = tt.msg
+			if err := store.Save(trade); err != nil {
+				t.Fatal(err)
+			}
+
+			log, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			audit := NewAuditRecorder(log, "", logger).Begin(nil)
+
+			msg := ResumeVIPPortmarPosTrader(context.Background(), bnc.NewUser("", ""), trade, store, audit).Wait()
+
+			if status := msg.Status(); status != tt.status {
+				t.Errorf("status %v, want %v", status, tt.status)
+			}
+			if err := errors.Join(msg.Errs...); errors.Is(err, ErrVIPPortmarOrderUnknown) != tt.unknown {
+				t.Errorf("err %v, unknown order %v", err, tt.unknown)
+			}
+			trades, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := len(trades) == 1; kept != tt.kept {
+				t.Errorf("trade kept %v, want %v", kept, tt.kept)
+			}
+			// legs placed before restart are not recorded again
+			if entries, err := log.Query(AuditQuery{}); err != nil || len(entries) != 0 {
+				t.Errorf("audit entries %+v, %v, want none", entries, err)
+			}
+		})
+	}
+}
+
+func TestMainResumePosTrades(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name    string
+		dryRun  bool
+		kinds   []PosTradeKind
+		skipped int
+	}{
+		{"other kind", false, []PosTradeKind{PosTradeKindVIPPortmar}, 1},
+		{"dry run", true, []PosTradeKind{PosTradeKindSlowly, PosTradeKindVIPPortmar}, 2},
+		{"empty", false, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewPosTradeStore(t.TempDir(), logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, kind := range tt.kinds {
+				if err := store.Save(newPosTrade(kind)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m, err := NewMain(bnc.NewUser("", ""), logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.SetDryRun(tt.dryRun)
+			m.SetPosTradeStore(store)
+
+			skipped, err := m.ResumePosTrades()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(skipped) != tt.skipped {
+				t.Errorf("skipped %v, want %v", len(skipped), tt.skipped)
+			}
+			// skipped trades are kept for later resuming
+			if trades, _ := store.Load(); len(trades) != len(tt.kinds) {
+				t.Errorf("trades in store %v, want %v", len(trades), len(tt.kinds))
+			}
+		})
+	}
+}
@@ -0,0 +1,465 @@
+package frbnc
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+type RiskReportMetric struct {
+	Name  string
+	Value string
+}
+
+type RiskReportTable struct {
+	Title   string
+	Headers []string
+	Rows    [][]string
+}
+
+// RiskReportAccount is one account of risk report,
+// every analysis is rendered as a table,
+// so new analyses can be added as new tables.
+type RiskReportAccount struct {
+	Name    string
+	Kind    string
+	Time    int64
+	Risky   bool
+	Metrics []RiskReportMetric
+	Tables  []RiskReportTable
+}
+
+type RiskReport struct {
+	Title    string
+	Time     int64
+	Accounts []RiskReportAccount
+}
+
+const (
+	RiskReportKindClassic = "CLASSIC"
+	RiskReportKindPortmar = "PORTFOLIO_MARGIN"
+)
+
+func reportFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func reportFloatN(v float64, n int) string {
+	return strconv.FormatFloat(v, 'f', n, 64)
+}
+
+func reportErr(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func reportTime(t int64) string {
+	return time.UnixMilli(t).UTC().Format(time.DateTime + " UTC")
+}
+
+// NewAccountRiskReport makes risk report of classic account.
+func NewAccountRiskReport(name string, acct *Account, analysis AccountAnalysis, carry CarryAnalysis) RiskReportAccount {
+	margin := analysis.Futures.Margin
+	r := RiskReportAccount{
+		Name:  name,
+		Kind:  RiskReportKindClassic,
+		Time:  acct.Time,
+		Risky: analysis.Loans.Risky || analysis.Futures.Risky || analysis.Hedges.Unhedged,
+		Metrics: []RiskReportMetric{
+			{"Futures Margin Ratio", reportFloatN(margin.CurrentMarginRatio, 4)},
+			{"Futures Margin", reportFloatN(margin.CurrentMargin, 2)},
+			{"Futures Total Position", reportFloatN(margin.CurrentTotalPos, 2)},
+			{"Risky Loans", strconv.Itoa(len(analysis.Loans.Demands))},
+			{"Unhedged Residual Value", reportFloatN(analysis.Hedges.TotalResidualValue, 2)},
+			{"Annual Net Carry", reportFloatN(carry.Net, 2)},
+		},
+	}
+
+	loans := RiskReportTable{
+		Title:   "Flexible Loans",
+		Headers: []string{"Loan Coin", "Collateral Coin", "Debt", "Collateral", "LTV"},
+	}
+	for _, ord := range acct.LoanOrders {
+		loans.Rows = append(loans.Rows, []string{
+			ord.LoanCoin, ord.CollateralCoin,
+			reportFloatN(ord.TotalDebt, 2), reportFloat(ord.CollateralAmount), reportFloatN(ord.CurrentLTV, 4),
+		})
+	}
+
+	demands := riskyLoanTable(analysis.Loans)
+
+	fu := RiskReportTable{
+		Title:   "Futures Margin",
+		Headers: []string{"Margin", "Total Position", "Margin Ratio", "Target Ratio", "Margin Demand", "Marginable Spot Value", "USDT Wallet", "Risky"},
+		Rows: [][]string{{
+			reportFloatN(margin.CurrentMargin, 2), reportFloatN(margin.CurrentTotalPos, 2),
+			reportFloatN(margin.CurrentMarginRatio, 4), reportFloatN(margin.TargetMarginRatio, 4),
+			reportFloatN(margin.MarginRemand, 2), reportFloatN(margin.TotalMarginableSpotsValue, 2),
+			reportFloatN(analysis.Futures.USDT.WalletBalance, 2), strconv.FormatBool(analysis.Futures.Risky),
+		}},
+	}
+
+	cm := RiskReportTable{
+		Title:   "COIN-M Futures Margin",
+		Headers: []string{"Asset", "Price", "Margin", "Notional", "Maint Margin", "Margin Ratio", "Maint Ratio", "Error"},
+	}
+	for _, ratio := range analysis.Futures.CM.Ratios {
+		cm.Rows = append(cm.Rows, []string{
+			ratio.Asset, reportFloat(ratio.Price), reportFloatN(ratio.Margin, 2), reportFloatN(ratio.Notional, 2),
+			reportFloatN(ratio.MaintMargin, 2), reportFloatN(ratio.InitialRatio, 4), reportFloatN(ratio.MaintRatio, 4),
+			reportErr(ratio.Err),
+		})
+	}
+
+	r.Tables = append(r.Tables, loans, demands, fu, cm, hedgeTable(analysis.Hedges), carryTable(carry))
+
+	return r
+}
+
+func riskyLoanTable(analysis LoansAnalysis) RiskReportTable {
+	t := RiskReportTable{
+		Title:   "Risky Loans",
+		Headers: []string{"Collateral Coin", "LTV", "Target LTV", "Collateral Demand", "Additional Collateral", "Additional USDT"},
+	}
+	for _, d := range analysis.Demands {
+		t.Rows = append(t.Rows, []string{
+			d.Order.CollateralCoin, reportFloatN(d.Order.CurrentLTV, 4), reportFloatN(d.TargetLtv, 4),
+			reportFloat(d.TotalColltDemand), reportFloat(d.AdditionalCollt), reportFloatN(d.AdditionalUsd, 2),
+		})
+	}
+	return t
+}
+
+func hedgeTable(analysis HedgeAnalysis) RiskReportTable {
+	t := RiskReportTable{
+		Title:   "Delta",
+		Headers: []string{"Coin", "Futures Symbol", "Spot Qty", "Futures Short Qty", "Residual", "Residual Value", "Repair", "Error"},
+	}
+	for _, m := range analysis.Mismatches {
+		var repairs []string
+		for _, o := range m.Repairs {
+			repairs = append(repairs, fmt.Sprintf("%v %v %v", o.Side, reportFloat(o.Qty), o.Symbol))
+		}
+		t.Rows = append(t.Rows, []string{
+			m.Coin, m.FuSymbol, reportFloat(m.SpotQty), reportFloat(m.FuShortQty),
+			reportFloat(m.Residual), reportFloatN(m.ResidualValue, 2), strings.Join(repairs, "; "), reportErr(m.Err),
+		})
+	}
+	return t
+}
+
+func carryTable(analysis CarryAnalysis) RiskReportTable {
+	t := RiskReportTable{
+		Title:   "Carry",
+		Headers: []string{"Kind", "Subject", "Value", "Annual Rate", "Annual Income", "Error"},
+	}
+	for _, item := range analysis.Items {
+		t.Rows = append(t.Rows, []string{
+			string(item.Kind), item.Subject, reportFloatN(item.Value, 2), reportFloatN(item.Rate, 4),
+			reportFloatN(item.Income, 2), reportErr(item.Err),
+		})
+	}
+	return t
+}
+
+// NewPortmarRiskReport makes risk report of portfolio margin account with VIP loans.
+func NewPortmarRiskReport(name string, acct *VIPPortmarAccount, pm PortmarAnalysis, loans VIPLoanAnalysis, carry CarryAnalysis) RiskReportAccount {
+	r := RiskReportAccount{
+		Name:  name,
+		Kind:  RiskReportKindPortmar,
+		Time:  acct.Time,
+		Risky: pm.Risky || loans.Risky,
+		Metrics: []RiskReportMetric{
+			{"UniMMR", reportFloatN(pm.UniMMR, 4)},
+			{"UniMMR Level", string(pm.Level)},
+			{"Maint Margin", reportFloatN(pm.MaintMargin, 2)},
+			{"Equity Need", reportFloatN(pm.EquityNeed, 2)},
+			{"VIP Loan Debt", reportFloatN(loans.TotalDebt, 2)},
+			{"Annual Net Carry", reportFloatN(carry.Net, 2)},
+		},
+	}
+
+	colls := RiskReportTable{
+		Title:   "Transferable Spot Collaterals",
+		Headers: []string{"Asset", "Free", "Price", "Collateral Rate", "Collateral Value"},
+	}
+	for _, c := range pm.TransferableSpotColls {
+		colls.Rows = append(colls.Rows, []string{
+			c.Bal.Asset, reportFloat(c.Bal.Free), reportFloat(c.Price), reportFloat(c.PmCollRate), reportFloatN(c.PmCollValue(), 2),
+		})
+	}
+
+	negs := RiskReportTable{
+		Title:   "Negative Assets",
+		Headers: []string{"Asset", "Book", "Cross Wallet Balance"},
+	}
+	for _, a := range pm.NegativeAssets {
+		book := "UM"
+		if a.IsCM {
+			book = "CM"
+		}
+		negs.Rows = append(negs.Rows, []string{a.Asset.Asset, book, reportFloat(a.Asset.CrossWalletBalance)})
+	}
+
+	poss := RiskReportTable{
+		Title:   "Positions",
+		Headers: []string{"Symbol", "Book", "Side", "Amount", "Entry Price", "Unrealized Profit USDT", "Maint Margin"},
+	}
+	for _, p := range pm.Positions {
+		book := "UM"
+		if p.IsCM {
+			book = "CM"
+		}
+		pos := p.Position
+		poss.Rows = append(poss.Rows, []string{
+			pos.Symbol, book, string(pos.PositionSide), reportFloat(pos.SignPositionAmt),
+			reportFloat(pos.EntryPrice), reportFloatN(p.UnrealizedProfitUsdt, 2), reportFloatN(pos.MaintMargin, 2),
+		})
+	}
+
+	vipLoans := RiskReportTable{
+		Title:   "VIP Loans",
+		Headers: []string{"Order Id", "Loan Coin", "Collateral Coins", "Debt", "LTV", "Margin Call LTV", "Liquidation LTV", "Locked Collateral Value", "Additional Collateral Value", "Additional USDT", "Error"},
+	}
+	for _, l := range loans.Orders {
+		vipLoans.Rows = append(vipLoans.Rows, []string{
+			l.Order.OrderId, l.Order.LoanCoin, strings.Join(l.CollateralCoins, ","), reportFloatN(l.Order.TotalDebt, 2),
+			reportFloatN(l.CurrentLTV, 4), reportFloat(l.MarginCallLTV), reportFloat(l.LiquidationLTV),
+			reportFloatN(l.LockedCollateralValue, 2), reportFloatN(l.AdditionalCollValue, 2), reportFloatN(l.AdditionalUsdt, 2),
+			reportErr(l.Err),
+		})
+	}
+
+	r.Tables = append(r.Tables, colls, negs, poss, vipLoans, carryTable(carry))
+
+	return r
+}
+
+// SummaryTable is the group summary, one row per account.
+func (r RiskReport) SummaryTable() RiskReportTable {
+	t := RiskReportTable{
+		Title:   "Summary",
+		Headers: []string{"Account", "Kind", "Time", "Risky", "Metrics"},
+	}
+	for _, acct := range r.Accounts {
+		var metrics []string
+		for _, m := range acct.Metrics {
+			metrics = append(metrics, m.Name+": "+m.Value)
+		}
+		t.Rows = append(t.Rows, []string{acct.Name, acct.Kind, reportTime(acct.Time), strconv.FormatBool(acct.Risky), strings.Join(metrics, "; ")})
+	}
+	return t
+}
+
+func mdEscape(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(s)
+}
+
+// mdHeadingEscape escapes account names and symbols in headings,
+// e.g. "_" of cm symbols is not read as emphasis.
+func mdHeadingEscape(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\", "`", "\\`", "*", "\\*", "_", "\\_", "[", "\\[", "]", "\\]",
+		"<", "\\<", ">", "\\>", "#", "\\#", "|", "\\|", "\n", " ",
+	).Replace(s)
+}
+
+func writeMdTable(b *strings.Builder, t RiskReportTable) {
+	fmt.Fprintf(b, "### %v\n\n", mdHeadingEscape(t.Title))
+	if len(t.Rows) == 0 {
+		b.WriteString("None\n\n")
+		return
+	}
+	headers := make([]string, len(t.Headers))
+	seps := make([]string, len(t.Headers))
+	for i, h := range t.Headers {
+		headers[i] = mdEscape(h)
+		seps[i] = "---"
+	}
+	fmt.Fprintf(b, "| %v |\n| %v |\n", strings.Join(headers, " | "), strings.Join(seps, " | "))
+	for _, row := range t.Rows {
+		cells := make([]string, len(row))
+		for i, c := range row {
+			cells[i] = mdEscape(c)
+		}
+		fmt.Fprintf(b, "| %v |\n", strings.Join(cells, " | "))
+	}
+	b.WriteString("\n")
+}
+
+func (r RiskReport) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %v\n\n%v\n\n", mdHeadingEscape(r.Title), reportTime(r.Time))
+	b.WriteString("## Summary\n\n")
+	summary := r.SummaryTable()
+	summary.Title = "Accounts"
+	writeMdTable(&b, summary)
+	for _, acct := range r.Accounts {
+		fmt.Fprintf(&b, "## %v\n\n", mdHeadingEscape(acct.Name))
+		for _, m := range acct.Metrics {
+			fmt.Fprintf(&b, "- %v: %v\n", m.Name, mdEscape(m.Value))
+		}
+		b.WriteString("\n")
+		for _, t := range acct.Tables {
+			writeMdTable(&b, t)
+		}
+	}
+	return b.String()
+}
+
+var riskReportHTMLTmpl = template.Must(template.New("riskReport").Funcs(template.FuncMap{
+	"time": reportTime,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 24px; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th { background: #f0f0f0; }
+.risky { color: #c00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{time .Time}}</p>
+{{define "table"}}<h3>{{.Title}}</h3>
+{{if .Rows}}<table>
+<tr>{{range .Headers}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{else}}<p>None</p>
+{{end}}{{end}}<h2>Summary</h2>
+{{template "table" .Summary}}{{range .Accounts}}<h2{{if .Risky}} class="risky"{{end}}>{{.Name}}</h2>
+<ul>
+{{range .Metrics}}<li>{{.Name}}: {{.Value}}</li>
+{{end}}</ul>
+{{range .Tables}}{{template "table" .}}{{end}}{{end}}</body>
+</html>
+`))
+
+// HTML renders a standalone html page.
+func (r RiskReport) HTML() (string, error) {
+	var buf bytes.Buffer
+	err := riskReportHTMLTmpl.Execute(&buf, struct {
+		RiskReport
+		Summary RiskReportTable
+	}{r, r.SummaryTable()})
+	return buf.String(), err
+}
+
+// xlsxSheetName makes valid and unique sheet name,
+// excel sheet name can not be longer than 31 and contain []:*?/\
+func xlsxSheetName(name string, used map[string]bool) string {
+	name = strings.NewReplacer("[", "_", "]", "_", ":", "_", "*", "_", "?", "_", "/", "_", "\\", "_").Replace(name)
+	if name == "" {
+		name = "Account"
+	}
+	runes := []rune(name)
+	if len(runes) > 31 {
+		runes = runes[:31]
+	}
+	base := string(runes)
+	name = base
+	for i := 2; used[strings.ToLower(name)]; i++ {
+		suffix := "_" + strconv.Itoa(i)
+		r := []rune(base)
+		if len(r)+len(suffix) > 31 {
+			r = r[:31-len(suffix)]
+		}
+		name = string(r) + suffix
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
+
+func writeXlsxTable(f *excelize.File, sheet string, row int, t RiskReportTable) (int, error) {
+	cell, _ := excelize.CoordinatesToCellName(1, row)
+	if err := f.SetCellStr(sheet, cell, t.Title); err != nil {
+		return row, err
+	}
+	row++
+	headers := make([]any, len(t.Headers))
+	for i, h := range t.Headers {
+		headers[i] = h
+	}
+	cell, _ = excelize.CoordinatesToCellName(1, row)
+	if err := f.SetSheetRow(sheet, cell, &headers); err != nil {
+		return row, err
+	}
+	row++
+	for _, r := range t.Rows {
+		cells := make([]any, len(r))
+		for i, c := range r {
+			// numbers should be numbers in excel
+			if v, err := strconv.ParseFloat(c, 64); err == nil {
+				cells[i] = v
+			} else {
+				cells[i] = c
+			}
+		}
+		cell, _ = excelize.CoordinatesToCellName(1, row)
+		if err := f.SetSheetRow(sheet, cell, &cells); err != nil {
+			return row, err
+		}
+		row++
+	}
+	return row + 1, nil
+}
+
+// XLSX renders group summary in the first sheet,
+// and one sheet per account.
+func (r RiskReport) XLSX() (*excelize.File, error) {
+	f := excelize.NewFile()
+	used := map[string]bool{}
+
+	summarySheet := xlsxSheetName("Summary", used)
+	if err := f.SetSheetName("Sheet1", summarySheet); err != nil {
+		return nil, err
+	}
+	if _, err := writeXlsxTable(f, summarySheet, 1, r.SummaryTable()); err != nil {
+		return nil, err
+	}
+
+	for _, acct := range r.Accounts {
+		sheet := xlsxSheetName(acct.Name, used)
+		if _, err := f.NewSheet(sheet); err != nil {
+			return nil, err
+		}
+		metrics := RiskReportTable{Title: "Metrics", Headers: []string{"Name", "Value"}}
+		for _, m := range acct.Metrics {
+			metrics.Rows = append(metrics.Rows, []string{m.Name, m.Value})
+		}
+		row, err := writeXlsxTable(f, sheet, 1, metrics)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range acct.Tables {
+			row, err = writeXlsxTable(f, sheet, row, t)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return f, nil
+}
+
+func (r RiskReport) WriteXLSX(w io.Writer) error {
+	f, err := r.XLSX()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Write(w)
+}
@@ -0,0 +1,56 @@
+package frbnc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRiskReport(t *testing.T) {
+	report := RiskReport{
+		Title: "Daily Risk",
+		Accounts: []RiskReportAccount{
+			NewAccountRiskReport("main|a_b*", &Account{}, AccountAnalysis{}, CarryAnalysis{
+				Items: []CarryItem{{Kind: CarryKindFunding, Subject: "ETHUSDT", Value: -1000, Rate: 0.1, Income: 100}},
+				Net:   100,
+			}),
+			NewPortmarRiskReport("pm/1", &VIPPortmarAccount{}, PortmarAnalysis{Level: PortmarUniMMRLevelLow, Risky: true}, VIPLoanAnalysis{}, CarryAnalysis{}),
+		},
+	}
+
+	md := report.Markdown()
+	if !strings.Contains(md, "## main\\|a\\_b\\*\n") || !strings.Contains(md, "| main\\|a_b* |") {
+		t.Errorf("markdown does not contain escaped account name:\n%v", md)
+	}
+	if !strings.Contains(md, "| FUNDING | ETHUSDT | -1000.00 | 0.1000 | 100.00 |  |") {
+		t.Errorf("markdown does not contain carry:\n%v", md)
+	}
+
+	html, err := report.HTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html, `<h2 class="risky">pm/1</h2>`) {
+		t.Errorf("html does not mark risky account:\n%v", html)
+	}
+
+	f, err := report.XLSX()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheets := f.GetSheetList()
+	want := []string{"Summary", "main|a_b_", "pm_1"}
+	if strings.Join(sheets, ",") != strings.Join(want, ",") {
+		t.Errorf("sheets %v, want %v", sheets, want)
+	}
+}
+
+func TestXlsxSheetName(t *testing.T) {
+	used := map[string]bool{}
+	long := strings.Repeat("a", 40)
+	if got := xlsxSheetName(long, used); len(got) != 31 {
+		t.Errorf("sheet name len %v, want 31", len(got))
+	}
+	if got := xlsxSheetName(long, used); got != strings.Repeat("a", 29)+"_2" {
+		t.Errorf("duplicated sheet name %v", got)
+	}
+}
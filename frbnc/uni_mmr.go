@@ -1,5 +1,172 @@
 package frbnc
 
-func CalUniMMREquity() float64 {
-	return 0
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+// PortmarCollateralTier
+// Asset value in [TierFloor, TierCap) is discounted by CollateralRate.
+type PortmarCollateralTier struct {
+	TierFloor      float64
+	TierCap        float64
+	CollateralRate float64
+}
+
+// PortmarCollValue returns value after collateral rate tiers.
+// Negative value is debt, should not be discounted.
+func PortmarCollValue(value float64, tiers []PortmarCollateralTier) (collValue float64) {
+	if value <= 0 {
+		return value
+	}
+	for _, tier := range tiers {
+		if value <= tier.TierFloor {
+			break
+		}
+		inTier := math.Min(value, tier.TierCap) - tier.TierFloor
+		collValue += inTier * tier.CollateralRate
+	}
+	return
+}
+
+type UniMMRAssetEquity struct {
+	Asset string
+	Price float64
+
+	// Equity = cross margin asset - borrowed - interest
+	//        + um wallet + um upnl + cm wallet + cm upnl
+	Equity         float64
+	Value          float64
+	AdjustedValue  float64
+	CollateralRate float64 // AdjustedValue / Value
+}
+
+type UniMMREquity struct {
+	Assets []UniMMRAssetEquity
+
+	ActualEquity   float64
+	AdjustedEquity float64
+	MaintMargin    float64
+
+	// UniMMR = AdjustedEquity / MaintMargin
+	// If MaintMargin is 0, UniMMR is +Inf.
+	UniMMR float64
+}
+
+func uniMMRAssetEquity(bal bnc.PortfolioMarginBalance) float64 {
+	return bal.CrossMarginAsset - bal.CrossMarginBorrowed - bal.CrossMarginInterest +
+		bal.UmWalletBalance + bal.UmUnrealizedPNL +
+		bal.CmWalletBalance + bal.CmUnrealizedPNL
+}
+
+// CalUniMMREquity calculates portfolio margin uniMMR locally.
+// acct can be queried account or hypothetical account made by With* methods,
+// so the effect of a transfer or trade can be predicted before making it.
+func CalUniMMREquity(acct *VIPPortmarAccount) (res UniMMREquity, err error) {
+	if acct == nil {
+		err = errors.New("nil portfolio margin account")
+		return
+	}
+
+	var errs []error
+
+	for _, bal := range acct.PortmarBalances {
+		equity := uniMMRAssetEquity(bal)
+		if equity == 0 {
+			continue
+		}
+		price, ok := acct.Price(bal.Asset)
+		if !ok || price <= 0 {
+			errs = append(errs, fmt.Errorf("no %v price", bal.Asset))
+			continue
+		}
+		value := equity * price
+		adjusted := value
+		if value > 0 {
+			tiers, ok := acct.PortmarCollateralTiers(bal.Asset)
+			if !ok {
+				// not collateral asset
+				tiers = nil
+			}
+			adjusted = PortmarCollValue(value, tiers)
+		}
+		assetEquity := UniMMRAssetEquity{
+			Asset:         bal.Asset,
+			Price:         price,
+			Equity:        equity,
+			Value:         value,
+			AdjustedValue: adjusted,
+		}
+		if value != 0 {
+			assetEquity.CollateralRate = adjusted / value
+		}
+		res.Assets = append(res.Assets, assetEquity)
+		res.ActualEquity += value
+		res.AdjustedEquity += adjusted
+	}
+
+	res.MaintMargin = acct.PortmarAccountInformation.AccountMaintMargin
+	if res.MaintMargin > 0 {
+		res.UniMMR = res.AdjustedEquity / res.MaintMargin
+	} else {
+		res.UniMMR = math.Inf(1)
+	}
+
+	err = errors.Join(errs...)
+
+	return
+}
+
+// Clone deep copies balances and loan orders of acct,
+// other fields are shared, should not be modified.
+func (a VIPPortmarAccount) Clone() *VIPPortmarAccount {
+	a.Spot.Balances = slices.Clone(a.Spot.Balances)
+	a.LoanOrders = slices.Clone(a.LoanOrders)
+	a.PortmarBalances = slices.Clone(a.PortmarBalances)
+	a.EarnPositions = slices.Clone(a.EarnPositions)
+	a.spBals = slice2map(a.Spot.Balances, func(balance bnc.SpotBalance) string { return balance.Asset })
+	a.pmBals = slice2map(a.PortmarBalances, func(bal bnc.PortfolioMarginBalance) string { return bal.Asset })
+	a.enPoss = slice2map(a.EarnPositions, func(pos bnc.SimpleEarnFlexiblePosition) string { return pos.Asset })
+	return &a
+}
+
+// WithPortmarAssetDelta returns hypothetical account,
+// whose portfolio margin cross margin asset is changed by delta.
+// e.g. a margin buy of 1 BTC at 60000 is
+// WithPortmarAssetDelta("BTC", 1).WithPortmarAssetDelta("USDT", -60000)
+func (a VIPPortmarAccount) WithPortmarAssetDelta(asset string, delta float64) *VIPPortmarAccount {
+	acct := a.Clone()
+	i := slices.IndexFunc(acct.PortmarBalances, func(bal bnc.PortfolioMarginBalance) bool {
+		return bal.Asset == asset
+	})
+	if i < 0 {
+		acct.PortmarBalances = append(acct.PortmarBalances, bnc.PortfolioMarginBalance{Asset: asset})
+		i = len(acct.PortmarBalances) - 1
+	}
+	acct.PortmarBalances[i].CrossMarginAsset += delta
+	acct.PortmarBalances[i].CrossMarginFree += delta
+	acct.PortmarBalances[i].TotalWalletBalance += delta
+	acct.pmBals[asset] = acct.PortmarBalances[i]
+	return acct
+}
+
+// WithSpotPortmarTransfer returns hypothetical account after transferring.
+// qty > 0, main -> portfolio margin,
+// qty < 0, portfolio margin -> main.
+func (a VIPPortmarAccount) WithSpotPortmarTransfer(asset string, qty float64) *VIPPortmarAccount {
+	acct := a.WithPortmarAssetDelta(asset, qty)
+	acct.addSpotBal(asset, -qty)
+	return acct
+}
+
+// WithAccountMaintMargin returns hypothetical account
+// whose maintenance margin is changed, e.g. after opening or closing positions.
+func (a VIPPortmarAccount) WithAccountMaintMargin(maintMargin float64) *VIPPortmarAccount {
+	acct := a.Clone()
+	acct.PortmarAccountInformation.AccountMaintMargin = maintMargin
+	return acct
 }
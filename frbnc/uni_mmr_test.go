@@ -0,0 +1,83 @@
+package frbnc
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestCalUniMMREquity(t *testing.T) {
+	acct := &VIPPortmarAccount{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{{Asset: "BTC", Free: 1}}},
+		PortmarAccountInformation: bnc.PortfolioMarginAccountInformation{
+			AccountMaintMargin: 1000,
+		},
+		PortmarBalances: []bnc.PortfolioMarginBalance{
+			{Asset: "USDT", CrossMarginAsset: 1000, CrossMarginBorrowed: 500, UmUnrealizedPNL: -100},
+			{Asset: "ETH", CrossMarginAsset: 1, CmUnrealizedPNL: 1},
+		},
+		Prices: map[string]float64{"BTC": 60000, "ETH": 3000},
+	}
+	acct.pmCollRates = map[string]bnc.PortfolioMarginCollateralRate{
+		"USDT": {Asset: "USDT", CollateralRate: 1},
+		"ETH":  {Asset: "ETH", CollateralRate: 0.95},
+		"BTC":  {Asset: "BTC", CollateralRate: 0.95},
+	}
+	acct = acct.Clone()
+
+	res, err := CalUniMMREquity(acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 400 + 6000 * 0.95
+	if math.Abs(res.AdjustedEquity-6100) > 1e-9 || math.Abs(res.UniMMR-6.1) > 1e-9 {
+		t.Errorf("adjusted equity %v, uniMMR %v, want 6100, 6.1", res.AdjustedEquity, res.UniMMR)
+	}
+
+	res, err = CalUniMMREquity(acct.WithSpotPortmarTransfer("BTC", 0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(res.UniMMR-34.6) > 1e-9 {
+		t.Errorf("uniMMR after transfer %v, want 34.6", res.UniMMR)
+	}
+	if bal, _ := acct.SpotBalance("BTC"); bal.Free != 1 {
+		t.Errorf("original spot balance is modified, %v", bal.Free)
+	}
+
+	acct.SetPortmarCollateralTiers("ETH", []PortmarCollateralTier{
+		{TierFloor: 0, TierCap: 1000, CollateralRate: 1},
+		{TierFloor: 1000, TierCap: math.Inf(1), CollateralRate: 0.5},
+	})
+	res, _ = CalUniMMREquity(acct)
+	// 400 + 1000 + 5000 * 0.5
+	if math.Abs(res.AdjustedEquity-3900) > 1e-9 {
+		t.Errorf("tiered adjusted equity %v, want 3900", res.AdjustedEquity)
+	}
+}
+
+func TestPortmarCollTiers(t *testing.T) {
+	body := `[{"asset":"BNB","collateralInfo":[
+		{"tierFloor":"0.0000","tierCap":"1000.0000","collateralRate":"0.9000","cum":"0.0000"},
+		{"tierFloor":"1000.0000","tierCap":"2000.0000","collateralRate":"0.5000","cum":"400.0000"}
+	]},{"asset":"XYZ","collateralInfo":[]}]`
+	var rates []PortfolioMarginTieredCollateralRate
+	if err := json.Unmarshal([]byte(body), &rates); err != nil {
+		t.Fatal(err)
+	}
+
+	acct := (&VIPPortmarAccount{pmCollTiers: portmarCollTiers(rates)}).Clone()
+	tiers, ok := acct.PortmarCollateralTiers("BNB")
+	if !ok || len(tiers) != 2 || !math.IsInf(tiers[1].TierCap, 1) {
+		t.Fatalf("tiers %+v, want 2 tiers with infinite last cap", tiers)
+	}
+	// 1000 * 0.9 + 2000 * 0.5
+	if v := PortmarCollValue(3000, tiers); math.Abs(v-1900) > 1e-9 {
+		t.Errorf("coll value %v, want 1900", v)
+	}
+	if _, ok := acct.PortmarCollateralTiers("XYZ"); ok {
+		t.Error("asset without tiers and flat rate should not be collateral")
+	}
+}
@@ -1,7 +1,10 @@
 package frbnc
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 
 	"github.com/dwdwow/cex"
@@ -16,13 +19,22 @@ func slice2map[T any, S []T](s S, key func(T) string) map[string]T {
 	return m
 }
 
-func fuPrice(pos bnc.FuturesAccountPosition) (price float64, err error) {
-	posAmt := pos.AbsPositionAmt()
+// fuPrice returns average price of positions of the same symbol,
+// in hedge mode, LONG and SHORT legs should be passed together.
+func fuPrice(poss ...bnc.FuturesAccountPosition) (price float64, err error) {
+	if len(poss) == 0 {
+		return price, errors.New("no position")
+	}
+	var notional, posAmt float64
+	for _, pos := range poss {
+		notional += pos.PositionInitialMargin * pos.Leverage
+		posAmt += pos.AbsPositionAmt()
+	}
 	if posAmt > 0 {
-		price = pos.PositionInitialMargin * pos.Leverage / posAmt
+		price = notional / posAmt
 		return
 	}
-	return fuPriceByQuerying(pos.Symbol)
+	return fuPriceByQuerying(poss[0].Symbol)
 }
 
 func fuPriceByQuerying(symbol string) (price float64, err error) {
@@ -71,6 +83,32 @@ func QueryFuPairs() (map[string]cex.Pair, error) {
 	return queryPairs(bnc.QueryFuturesPairs)
 }
 
+var fuPositionSides = []bnc.FuturesPositionSide{
+	bnc.FuturesPositionSideBoth,
+	bnc.FuturesPositionSideLong,
+	bnc.FuturesPositionSideShort,
+}
+
+// fuPosKey is key of position indexes.
+// One-way mode position side is BOTH,
+// hedge mode has LONG and SHORT positions of the same symbol.
+func fuPosKey(symbol string, side bnc.FuturesPositionSide) string {
+	if side == "" {
+		side = bnc.FuturesPositionSideBoth
+	}
+	return symbol + "_" + string(side)
+}
+
+// posGetter returns positions of symbol of all sides.
+func posGetter[U any](m map[string]U, symbol string) (poss []U) {
+	for _, side := range fuPositionSides {
+		if pos, ok := mapGetter(m, fuPosKey(symbol, side)); ok {
+			poss = append(poss, pos)
+		}
+	}
+	return
+}
+
 func mapGetter[U any](m map[string]U, key string) (U, bool) {
 	if m == nil {
 		return *new(U), false
@@ -90,3 +128,48 @@ func IsQuoteAsset(symbol, quote string) bool {
 	}
 	return strings.Index(symbol, quote) == sl-ql
 }
+
+// FuSymbolCoin splits futures symbol into coin and fuExp,
+// e.g. 1000PEPEUSDT -> PEPE, 1000.
+// fuQty * fuExp = spQty
+func FuSymbolCoin(symbol, quote string) (coin string, fuExp float64, ok bool) {
+	if !IsQuoteAsset(symbol, quote) {
+		return
+	}
+	coin = symbol[:len(symbol)-len(quote)]
+	fuExp = 1
+	ok = true
+	i := 0
+	for i < len(coin) && coin[i] >= '0' && coin[i] <= '9' {
+		i++
+	}
+	if i <= 1 || i == len(coin) {
+		return
+	}
+	exp, err := strconv.ParseFloat(coin[:i], 64)
+	if err != nil {
+		return
+	}
+	// only 10, 100, 1000, ... are multipliers, 1INCH is coin
+	if exp < 10 || math.Pow(10, math.Round(math.Log10(exp))) != exp {
+		return
+	}
+	return coin[i:], exp, true
+}
+
+// QueryUsdtPrices returns spot prices of all XXXUSDT pairs,
+// key is asset.
+func QueryUsdtPrices() (map[string]float64, error) {
+	tickers, err := bnc.QuerySpotPrices()
+	if err != nil {
+		return nil, err
+	}
+	prices := map[string]float64{}
+	for _, ticker := range tickers {
+		if !IsQuoteAsset(ticker.Symbol, "USDT") {
+			continue
+		}
+		prices[strings.TrimSuffix(ticker.Symbol, "USDT")] = ticker.Price
+	}
+	return prices, nil
+}
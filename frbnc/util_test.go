@@ -27,3 +27,28 @@ func TestIsQuoteAsset(t *testing.T) {
 		})
 	}
 }
+
+func TestFuSymbolCoin(t *testing.T) {
+	tests := []struct {
+		name   string
+		symbol string
+		coin   string
+		fuExp  float64
+		ok     bool
+	}{
+		{"Normal", "ETHUSDT", "ETH", 1, true},
+		{"Thousand", "1000PEPEUSDT", "PEPE", 1000, true},
+		{"Million", "1000000MOGUSDT", "MOG", 1000000, true},
+		{"Digit Coin", "1INCHUSDT", "1INCH", 1, true},
+		{"Not Power Of 10", "1200XUSDT", "1200X", 1, true},
+		{"Wrong Quote", "ETHUSDC", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coin, fuExp, ok := FuSymbolCoin(tt.symbol, "USDT")
+			if coin != tt.coin || fuExp != tt.fuExp || ok != tt.ok {
+				t.Errorf("FuSymbolCoin() = %v, %v, %v, want %v, %v, %v", coin, fuExp, ok, tt.coin, tt.fuExp, tt.ok)
+			}
+		})
+	}
+}
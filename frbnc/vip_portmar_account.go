@@ -1,6 +1,8 @@
 package frbnc
 
 import (
+	"math"
+	"net/http"
 	"time"
 
 	"github.com/dwdwow/cex"
@@ -19,6 +21,23 @@ type VIPPortmarAccountConfig struct {
 	MaxUniMMR      float64
 
 	VIPLoanMaxLTV float64
+	// VIPLoanTargetLTV is ltv restored by repaying or adding collateral,
+	// 0 means defaultVIPLoanTargetRatio of max ltv of every order.
+	VIPLoanTargetLTV float64
+	// AccountId is uid of this account.
+	// Vip loan collateral locked in other collateral accounts is not counted as locked here.
+	// Empty means collateral of every vip loan order is in this account.
+	AccountId string
+
+	// MaxCutLoss is max realized loss of cutting positions in 24 hours, USDT.
+	// 0 means only hedges without futures loss can be cut.
+	MaxCutLoss float64
+	// CutFillTimeout is max time waiting for every cut order to be filled,
+	// default to 10 seconds.
+	CutFillTimeout time.Duration
+
+	// AllocateIdleUsdt places idle spot USDT by PlanPortmarAllocationActions after risk is handled.
+	AllocateIdleUsdt bool
 }
 
 type VIPPortmarAccount struct {
@@ -29,16 +48,27 @@ type VIPPortmarAccount struct {
 	PortmarAccountUMDetail    bnc.PortfolioMarginAccountDetail      `json:"portmarAccountUMDetail"`
 	PortmarAccountCMDetail    bnc.PortfolioMarginAccountDetail      `json:"portmarAccountCMDetail"`
 	PortmarAccountInformation bnc.PortfolioMarginAccountInformation `json:"portmarAccountInformation"`
+	PortmarBalances           []bnc.PortfolioMarginBalance          `json:"portmarBalances"`
 
 	LoanOrders     []bnc.VIPLoanOngoingOrder          `json:"loanOrders"`
 	LoanStatusInfo []bnc.VIPLoanApplicationStatusInfo `json:"loanStatusInfo"`
 
-	PortmarCollateralRates []bnc.PortfolioMarginCollateralRate `json:"collateralRates"`
+	EarnPositions []bnc.SimpleEarnFlexiblePosition `json:"earnPositions"`
+
+	PortmarCollateralRates       []bnc.PortfolioMarginCollateralRate   `json:"collateralRates"`
+	PortmarTieredCollateralRates []PortfolioMarginTieredCollateralRate `json:"tieredCollateralRates"`
+
+	// Prices key is asset, value is USDT price
+	Prices map[string]float64 `json:"prices"`
 
 	spBals      map[string]bnc.SpotBalance
+	pmBals      map[string]bnc.PortfolioMarginBalance
 	pmAssets    map[string]bnc.PortfolioMarginAccountAsset
-	pmPoss      map[string]bnc.PortfolioMarginAccountPosition
+	pmPoss      map[string]bnc.PortfolioMarginAccountPosition // key is symbol+"_"+positionSide
+	pmCMPoss    map[string]bnc.PortfolioMarginAccountPosition // key is symbol+"_"+positionSide
 	pmCollRates map[string]bnc.PortfolioMarginCollateralRate
+	pmCollTiers map[string][]PortmarCollateralTier
+	enPoss      map[string]bnc.SimpleEarnFlexiblePosition
 
 	cmPairs map[string]cex.Pair
 }
@@ -47,22 +77,126 @@ func (a VIPPortmarAccount) SpotBalance(asset string) (bnc.SpotBalance, bool) {
 	return mapGetter(a.spBals, asset)
 }
 
+// EarnPos returns flexible earn position of asset.
+func (a VIPPortmarAccount) EarnPos(asset string) (bnc.SimpleEarnFlexiblePosition, bool) {
+	return mapGetter(a.enPoss, asset)
+}
+
+func (a VIPPortmarAccount) PortmarBalance(asset string) (bnc.PortfolioMarginBalance, bool) {
+	return mapGetter(a.pmBals, asset)
+}
+
 func (a VIPPortmarAccount) PortmarAsset(asset string) (bnc.PortfolioMarginAccountAsset, bool) {
 	return mapGetter(a.pmAssets, asset)
 }
 
-func (a VIPPortmarAccount) PortmarPosition(symbol string) (bnc.PortfolioMarginAccountPosition, bool) {
-	return mapGetter(a.pmPoss, symbol)
+// PortmarPosition returns um position,
+// side is BOTH in one-way mode, LONG or SHORT in hedge mode.
+func (a VIPPortmarAccount) PortmarPosition(symbol string, side bnc.FuturesPositionSide) (bnc.PortfolioMarginAccountPosition, bool) {
+	return mapGetter(a.pmPoss, fuPosKey(symbol, side))
+}
+
+// PortmarPositions returns um positions of all sides of symbol.
+func (a VIPPortmarAccount) PortmarPositions(symbol string) []bnc.PortfolioMarginAccountPosition {
+	return posGetter(a.pmPoss, symbol)
+}
+
+// PortmarCMPosition returns cm position,
+// side is BOTH in one-way mode, LONG or SHORT in hedge mode.
+func (a VIPPortmarAccount) PortmarCMPosition(symbol string, side bnc.FuturesPositionSide) (bnc.PortfolioMarginAccountPosition, bool) {
+	return mapGetter(a.pmCMPoss, fuPosKey(symbol, side))
+}
+
+// PortmarCMPositions returns cm positions of all sides of symbol.
+func (a VIPPortmarAccount) PortmarCMPositions(symbol string) []bnc.PortfolioMarginAccountPosition {
+	return posGetter(a.pmCMPoss, symbol)
 }
 
 func (a VIPPortmarAccount) PortmarCollateralRate(asset string) (bnc.PortfolioMarginCollateralRate, bool) {
 	return mapGetter(a.pmCollRates, asset)
 }
 
+// PortmarCollateralTiers
+// If tiers are not set, the flat collateral rate is the only tier.
+func (a VIPPortmarAccount) PortmarCollateralTiers(asset string) ([]PortmarCollateralTier, bool) {
+	tiers, ok := mapGetter(a.pmCollTiers, asset)
+	if ok {
+		return tiers, true
+	}
+	rate, ok := a.PortmarCollateralRate(asset)
+	if !ok {
+		return nil, false
+	}
+	return []PortmarCollateralTier{{TierCap: math.Inf(1), CollateralRate: rate.CollateralRate}}, true
+}
+
+func (a *VIPPortmarAccount) SetPortmarCollateralTiers(asset string, tiers []PortmarCollateralTier) {
+	if a.pmCollTiers == nil {
+		a.pmCollTiers = map[string][]PortmarCollateralTier{}
+	}
+	a.pmCollTiers[asset] = tiers
+}
+
+func (a VIPPortmarAccount) Price(asset string) (float64, bool) {
+	if usdChecker.isUsd(asset) {
+		return 1, true
+	}
+	return mapGetter(a.Prices, asset)
+}
+
 func (a VIPPortmarAccount) CMFuturesPair(symbol string) (cex.Pair, bool) {
 	return mapGetter(a.cmPairs, symbol)
 }
 
+type PortfolioMarginCollateralRateTier struct {
+	TierFloor      float64 `json:"tierFloor,string"`
+	TierCap        float64 `json:"tierCap,string"`
+	CollateralRate float64 `json:"collateralRate,string"`
+	Cum            float64 `json:"cum,string"`
+}
+
+type PortfolioMarginTieredCollateralRate struct {
+	Asset          string                              `json:"asset"`
+	CollateralInfo []PortfolioMarginCollateralRateTier `json:"collateralInfo"`
+}
+
+// PortfolioMarginTieredCollateralRatesConfig
+// bnc only supports flat collateral rates yet.
+var PortfolioMarginTieredCollateralRatesConfig = cex.ReqConfig[cex.NilReqData, []PortfolioMarginTieredCollateralRate]{
+	ReqBaseConfig: cex.ReqBaseConfig{
+		BaseUrl:          bnc.ApiBaseUrl,
+		Path:             bnc.SapiV2 + "/portfolio/collateralRate",
+		Method:           http.MethodGet,
+		IsUserData:       true,
+		UserTimeInterval: 0,
+		IpTimeInterval:   0,
+	},
+	HTTPStatusCodeChecker: bnc.HTTPStatusCodeChecker,
+	RespBodyUnmarshaler:   cex.StdBodyUnmarshaler[[]PortfolioMarginTieredCollateralRate],
+}
+
+func QueryPortfolioMarginTieredCollateralRates(user *bnc.User, opts ...cex.CltOpt) (*resty.Response, []PortfolioMarginTieredCollateralRate, cex.RequestError) {
+	return cex.Request(user, PortfolioMarginTieredCollateralRatesConfig, nil, opts...)
+}
+
+// portmarCollTiers converts tiers of exchange,
+// value above the last tier cap is still discounted by the last tier.
+func portmarCollTiers(rates []PortfolioMarginTieredCollateralRate) map[string][]PortmarCollateralTier {
+	m := map[string][]PortmarCollateralTier{}
+	for _, rate := range rates {
+		var tiers []PortmarCollateralTier
+		for _, info := range rate.CollateralInfo {
+			tiers = append(tiers, PortmarCollateralTier{TierFloor: info.TierFloor, TierCap: info.TierCap, CollateralRate: info.CollateralRate})
+		}
+		if len(tiers) == 0 {
+			continue
+		}
+		tiers[len(tiers)-1].TierCap = math.Inf(1)
+		m[rate.Asset] = tiers
+	}
+	return m
+}
+
 func QueryVIPPortmarAccount(user *bnc.User) (resp *resty.Response, acct *VIPPortmarAccount, reqErr cex.RequestError) {
 	resp, spot, reqErr := user.SpotAccount()
 	if reqErr.IsNotNil() {
@@ -80,6 +214,10 @@ func QueryVIPPortmarAccount(user *bnc.User) (resp *resty.Response, acct *VIPPort
 	if reqErr.IsNotNil() {
 		return
 	}
+	resp, pmBals, reqErr := user.PortfolioMarginBalances()
+	if reqErr.IsNotNil() {
+		return
+	}
 	resp, loanOrders, reqErr := user.VIPLoanOngoingOrders("", "", "", "")
 	if reqErr.IsNotNil() {
 		return
@@ -88,36 +226,59 @@ func QueryVIPPortmarAccount(user *bnc.User) (resp *resty.Response, acct *VIPPort
 	if reqErr.IsNotNil() {
 		return
 	}
+	resp, earnPoss, reqErr := user.SimpleEarnFlexiblePositions("", "")
+	if reqErr.IsNotNil() {
+		return
+	}
 	collRates, err := bnc.QueryPortfolioMarginCollateralRates()
 	if err != nil {
 		reqErr = cex.RequestError{Err: err}
 		return
 	}
-	cmPairs, _, err := bnc.QueryCMFuturesPairs()
+	resp, collTiers, reqErr := QueryPortfolioMarginTieredCollateralRates(user)
+	if reqErr.IsNotNil() {
+		return
+	}
+	cmPairs, err := cachedCMFuPairs()
+	if err != nil {
+		reqErr = cex.RequestError{Err: err}
+		return
+	}
+	prices, err := QueryUsdtPrices()
 	if err != nil {
 		reqErr = cex.RequestError{Err: err}
 		return
 	}
 
 	acct = &VIPPortmarAccount{
-		ApiKey:                    user.Api().ApiKey,
-		Time:                      time.Now().UnixMilli(),
-		Spot:                      spot,
-		PortmarAccountUMDetail:    pmUMDetail,
-		PortmarAccountCMDetail:    pmCMDetail,
-		PortmarAccountInformation: pmInfo,
-		LoanOrders:                loanOrders.Rows,
-		LoanStatusInfo:            loanStatusInfo.Rows,
-		PortmarCollateralRates:    collRates,
-		spBals:                    slice2map(spot.Balances, func(balance bnc.SpotBalance) string { return balance.Asset }),
-		pmAssets:                  slice2map(pmUMDetail.Assets, func(asset bnc.PortfolioMarginAccountAsset) string { return asset.Asset }),
-		pmPoss:                    slice2map(pmUMDetail.Positions, func(position bnc.PortfolioMarginAccountPosition) string { return position.Symbol }),
+		ApiKey:                       user.Api().ApiKey,
+		Time:                         time.Now().UnixMilli(),
+		Spot:                         spot,
+		PortmarAccountUMDetail:       pmUMDetail,
+		PortmarAccountCMDetail:       pmCMDetail,
+		PortmarAccountInformation:    pmInfo,
+		PortmarBalances:              pmBals,
+		LoanOrders:                   loanOrders.Rows,
+		LoanStatusInfo:               loanStatusInfo.Rows,
+		EarnPositions:                earnPoss.Rows,
+		PortmarCollateralRates:       collRates,
+		PortmarTieredCollateralRates: collTiers,
+		Prices:                       prices,
+		spBals:                       slice2map(spot.Balances, func(balance bnc.SpotBalance) string { return balance.Asset }),
+		pmBals:                       slice2map(pmBals, func(bal bnc.PortfolioMarginBalance) string { return bal.Asset }),
+		pmAssets:                     slice2map(pmUMDetail.Assets, func(asset bnc.PortfolioMarginAccountAsset) string { return asset.Asset }),
+		pmPoss: slice2map(pmUMDetail.Positions, func(position bnc.PortfolioMarginAccountPosition) string {
+			return fuPosKey(position.Symbol, position.PositionSide)
+		}),
+		pmCMPoss: slice2map(pmCMDetail.Positions, func(position bnc.PortfolioMarginAccountPosition) string {
+			return fuPosKey(position.Symbol, position.PositionSide)
+		}),
 		pmCollRates: slice2map(collRates, func(rate bnc.PortfolioMarginCollateralRate) string {
 			return rate.Asset
 		}),
-		cmPairs: slice2map(cmPairs, func(pair cex.Pair) string {
-			return pair.PairSymbol
-		}),
+		pmCollTiers: portmarCollTiers(collTiers),
+		enPoss:      slice2map(earnPoss.Rows, func(pos bnc.SimpleEarnFlexiblePosition) string { return pos.Asset }),
+		cmPairs:     cmPairs,
 	}
 
 	return
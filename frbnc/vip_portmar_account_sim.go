@@ -0,0 +1,94 @@
+package frbnc
+
+import (
+	"math"
+	"slices"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+// WithActions returns hypothetical account after all actions succeed.
+// Only transfers between spot and portfolio margin account, flexible earn redemptions
+// and vip repayments are applied.
+// UniMMR of PortmarAccountInformation is moved by the change of local uniMMR,
+// so analyses of hypothetical account see the effect of actions.
+func (a VIPPortmarAccount) WithActions(actions ...Action) *VIPPortmarAccount {
+	acct := a.Clone()
+	for _, action := range actions {
+		acct.applyAction(action)
+	}
+	acct.syncUniMMR(&a)
+	return acct
+}
+
+// WithPortmarUnwind returns hypothetical account after hedge is cut,
+// spot coin is sold for USDT and maintenance margin of futures is released.
+func (a VIPPortmarAccount) WithPortmarUnwind(u PortmarUnwind) *VIPPortmarAccount {
+	acct := a.Clone()
+	acct.addSpotBal(u.SpPair.Asset, -u.SpQty)
+	acct.addSpotBal("USDT", u.SpQty*u.Price)
+	acct.PortmarAccountInformation.AccountMaintMargin = math.Max(acct.PortmarAccountInformation.AccountMaintMargin-u.MaintMargin, 0)
+	acct.syncUniMMR(&a)
+	return acct
+}
+
+func (a *VIPPortmarAccount) applyAction(action Action) {
+	switch action.Type {
+	case ActionTypeTransfer:
+		switch action.TransferType {
+		case bnc.TransferTypeMainPortfolioMargin:
+			*a = *a.WithSpotPortmarTransfer(action.Asset, action.Qty)
+		case bnc.TransferTypePortfolioMarginMain:
+			*a = *a.WithSpotPortmarTransfer(action.Asset, -action.Qty)
+		}
+	case ActionTypeRedeem:
+		a.addSpotBal(action.Asset, action.Qty)
+		i := slices.IndexFunc(a.EarnPositions, func(pos bnc.SimpleEarnFlexiblePosition) bool {
+			return pos.Asset == action.Asset
+		})
+		if i < 0 {
+			return
+		}
+		a.EarnPositions[i].TotalAmount -= action.Qty
+		a.enPoss[action.Asset] = a.EarnPositions[i]
+	case ActionTypeVIPRepay:
+		a.addSpotBal(action.LoanCoin, -action.Qty)
+		i := slices.IndexFunc(a.LoanOrders, func(ord bnc.VIPLoanOngoingOrder) bool {
+			return ord.OrderId == action.OrderId
+		})
+		if i < 0 {
+			return
+		}
+		ord := &a.LoanOrders[i]
+		ord.TotalDebt = math.Max(ord.TotalDebt-action.Qty, 0)
+		if ord.TotalCollateralValueAfterHaircut > 0 {
+			ord.CurrentLTV = (ord.TotalDebt + ord.ResidualInterest) / ord.TotalCollateralValueAfterHaircut
+		}
+	}
+}
+
+func (a *VIPPortmarAccount) addSpotBal(asset string, qty float64) {
+	i := slices.IndexFunc(a.Spot.Balances, func(bal bnc.SpotBalance) bool {
+		return bal.Asset == asset
+	})
+	if i < 0 {
+		a.Spot.Balances = append(a.Spot.Balances, bnc.SpotBalance{Asset: asset})
+		i = len(a.Spot.Balances) - 1
+	}
+	a.Spot.Balances[i].Free += qty
+	a.spBals[asset] = a.Spot.Balances[i]
+}
+
+// syncUniMMR moves UniMMR of a by the change of local uniMMR from before,
+// UniMMR is kept if local uniMMR can not be calculated.
+func (a *VIPPortmarAccount) syncUniMMR(before *VIPPortmarAccount) {
+	prev, err := CalUniMMREquity(before)
+	if err != nil || math.IsInf(prev.UniMMR, 0) {
+		return
+	}
+	next, err := CalUniMMREquity(a)
+	if err != nil || math.IsInf(next.UniMMR, 0) {
+		return
+	}
+	a.PortmarAccountInformation.UniMMR += next.UniMMR - prev.UniMMR
+}
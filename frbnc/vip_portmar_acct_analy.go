@@ -1,9 +1,394 @@
 package frbnc
 
-func AnalyseVIPLoan(acct *VIPPortmarAccount) {
-	//acct.LoanOrders
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+// defaultVIPLoanTargetRatio target ltv is 80% of max ltv if VIPLoanTargetLTV is not set.
+const defaultVIPLoanTargetRatio = 0.8
+
+type VIPLoanOrderAnalysis struct {
+	Order  bnc.VIPLoanOngoingOrder
+	Status bnc.VIPLoanApplicationStatusInfo // empty if not found in LoanStatusInfo
+	// Active is false if status of order is not accruing interest or overdue,
+	// e.g. repaying or liquidating, no repay or collateral is planned for it.
+	Active bool
+
+	// Debt is TotalDebt + ResidualInterest
+	Debt       float64
+	CurrentLTV float64
+	// MaxLTV is min of VIPLoanMaxLTV and MarginCallLTV
+	MaxLTV         float64
+	MarginCallLTV  float64
+	LiquidationLTV float64
+	TargetLTV      float64
+
+	// CollateralCoins are locked in collateral account,
+	// can not be transferred or used as portfolio margin collateral.
+	CollateralAccountId   string
+	CollateralCoins       []string
+	LockedCollateralValue float64
+
+	// AdditionalCollValue is collateral value after haircut should be added
+	// to restore TargetLTV, or AdditionalUsdt should be repaid.
+	// Only one of them is needed.
+	AdditionalCollValue float64
+	AdditionalUsdt      float64
+
+	Risky    bool
+	Findings []Finding
+	Err      error
+}
+
+type VIPLoanAnalysis struct {
+	Orders    []VIPLoanOrderAnalysis
+	TotalDebt float64
+
+	// LockedCollateralValue is sum of all orders
+	LockedCollateralValue float64
+	Risky                 bool
+	Findings              []Finding
+	Err                   error
+}
+
+func AnalyseVIPLoanOrder(ord bnc.VIPLoanOngoingOrder, status bnc.VIPLoanApplicationStatusInfo, cfg VIPPortmarAccountConfig) (analysis VIPLoanOrderAnalysis) {
+	analysis.Order = ord
+	analysis.Status = status
+	analysis.CollateralAccountId = ord.CollateralAccountId
+	analysis.LockedCollateralValue = ord.LockedCollateralValue
+
+	for _, coin := range strings.Split(ord.CollateralCoin, ",") {
+		if coin = strings.TrimSpace(coin); coin != "" {
+			analysis.CollateralCoins = append(analysis.CollateralCoins, coin)
+		}
+	}
+
+	var errs []error
+
+	subject := ord.OrderId
+
+	marginCallLTV, err := parseRate(ord.MarginCallLtv)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("parse margin call ltv %q: %w", ord.MarginCallLtv, err))
+	}
+	liquidationLTV, err := parseRate(ord.LiquidationLtv)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("parse liquidation ltv %q: %w", ord.LiquidationLtv, err))
+	}
+	if len(errs) > 0 {
+		analysis.Findings = append(analysis.Findings, Finding{
+			Code:     FindingVIPLoanBadLtv,
+			Severity: FindingSeverityWarn,
+			Subject:  subject,
+		})
+	}
+	analysis.MarginCallLTV = marginCallLTV
+	analysis.LiquidationLTV = liquidationLTV
+
+	collValue := ord.TotalCollateralValueAfterHaircut
+	debt := ord.TotalDebt + ord.ResidualInterest
+	analysis.Debt = debt
+
+	currentLTV := ord.CurrentLTV
+	if currentLTV <= 0 && collValue > 0 {
+		currentLTV = debt / collValue
+	}
+	analysis.CurrentLTV = currentLTV
+
+	maxLTV := cfg.VIPLoanMaxLTV
+	if maxLTV <= 0 || (marginCallLTV > 0 && maxLTV > marginCallLTV) {
+		maxLTV = marginCallLTV
+	}
+	analysis.MaxLTV = maxLTV
+
+	targetLTV := cfg.VIPLoanTargetLTV
+	if targetLTV <= 0 {
+		targetLTV = maxLTV * defaultVIPLoanTargetRatio
+	}
+	analysis.TargetLTV = targetLTV
+
+	// empty status is seen as active, order may not be in application status
+	switch status.Status {
+	case "", bnc.VIPLoanOrderStatusAccruingInterest, bnc.VIPLoanOrderStatusOverdue:
+		analysis.Active = true
+	default:
+		analysis.Findings = append(analysis.Findings, Finding{
+			Code:     FindingVIPLoanNotActive,
+			Severity: FindingSeverityWarn,
+			Subject:  subject,
+			Skipped:  true,
+			Inputs:   map[string]float64{"debt": debt},
+		})
+	}
+
+	analysis.Risky = analysis.Active && maxLTV > 0 && currentLTV > maxLTV
+
+	finding := Finding{
+		Code:     FindingVIPLoanLtvNormal,
+		Severity: FindingSeverityInfo,
+		Subject:  subject,
+		Thresholds: map[string]float64{
+			"maxLtv":         maxLTV,
+			"targetLtv":      targetLTV,
+			"marginCallLtv":  marginCallLTV,
+			"liquidationLtv": liquidationLTV,
+		},
+		Inputs: map[string]float64{
+			"currentLtv":                  currentLTV,
+			"debt":                        debt,
+			"collateralValueAfterHaircut": collValue,
+			"lockedCollateralValue":       ord.LockedCollateralValue,
+		},
+	}
+	if analysis.Risky {
+		finding.Code = FindingVIPLoanLtvHigh
+		finding.Severity = FindingSeverityCritical
+	}
+	analysis.Findings = append(analysis.Findings, finding)
+
+	switch {
+	case !analysis.Active:
+	case targetLTV <= 0:
+		errs = append(errs, errors.New("vip loan target ltv <= 0"))
+		analysis.Findings = append(analysis.Findings, Finding{
+			Code:       FindingVIPLoanBadConfig,
+			Severity:   FindingSeverityWarn,
+			Subject:    subject,
+			Skipped:    true,
+			Thresholds: map[string]float64{"targetLtv": targetLTV},
+		})
+	case currentLTV > targetLTV:
+		analysis.AdditionalCollValue = debt/targetLTV - collValue
+		analysis.AdditionalUsdt = debt - collValue*targetLTV
+	}
+
+	analysis.Err = errors.Join(errs...)
+
+	return
+}
+
+func AnalyseVIPLoan(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig) (analysis VIPLoanAnalysis) {
+	statuses := slice2map(acct.LoanStatusInfo, func(info bnc.VIPLoanApplicationStatusInfo) string {
+		return info.OrderId
+	})
+
+	var errs []error
+
+	for _, ord := range acct.LoanOrders {
+		status := statuses[ord.OrderId]
+		ordAnalysis := AnalyseVIPLoanOrder(ord, status, cfg)
+		if ordAnalysis.Err != nil {
+			errs = append(errs, fmt.Errorf("vip loan order %v: %w", ord.OrderId, ordAnalysis.Err))
+		}
+		analysis.Orders = append(analysis.Orders, ordAnalysis)
+		analysis.Findings = append(analysis.Findings, ordAnalysis.Findings...)
+		analysis.TotalDebt += ordAnalysis.Debt
+		analysis.LockedCollateralValue += ord.LockedCollateralValue
+		analysis.Risky = analysis.Risky || ordAnalysis.Risky
+	}
+
+	sort.SliceStable(analysis.Orders, func(i, j int) bool {
+		return analysis.Orders[i].CurrentLTV > analysis.Orders[j].CurrentLTV
+	})
+
+	analysis.Err = errors.Join(errs...)
+
+	return
+}
+
+type PortmarUniMMRLevel string
+
+const (
+	PortmarUniMMRLevelLow      PortmarUniMMRLevel = "LOW"
+	PortmarUniMMRLevelBalanced PortmarUniMMRLevel = "BALANCED"
+	PortmarUniMMRLevelHigh     PortmarUniMMRLevel = "HIGH"
+)
+
+type PortmarNegativeAsset struct {
+	Asset bnc.PortfolioMarginAccountAsset
+	IsCM  bool
+}
+
+type PortmarPosition struct {
+	Position bnc.PortfolioMarginAccountPosition
+	IsCM     bool
+	// UnrealizedProfitUsdt is unrealized profit in USDT,
+	// unrealized profit of cm position is in margin coin.
+	UnrealizedProfitUsdt float64
+}
+
+// portmarCMAsset returns margin coin of cm symbol, e.g. BTC of BTCUSD_PERP.
+func portmarCMAsset(acct *VIPPortmarAccount, symbol string) string {
+	if pair, ok := acct.CMFuturesPair(symbol); ok && pair.Asset != "" {
+		return pair.Asset
+	}
+	asset, _, _ := strings.Cut(symbol, "USD_")
+	return asset
+}
+
+type PortmarAnalysis struct {
+	UniMMR      float64
+	Level       PortmarUniMMRLevel
+	MaintMargin float64
+
+	// EquityNeed > 0, should add equity to restore BalancedUniMMR,
+	// EquityNeed < 0, -EquityNeed is surplus equity.
+	EquityNeed float64
+
+	// TransferableSpotColls sorted by collateral rate, from high to low,
+	// spot locked as vip loan collateral is not transferable
+	TransferableSpotColls      []SpotCollInfo
+	TotalTransferableCollValue float64
+
+	NegativeAssets []PortmarNegativeAsset
+
+	// Positions sorted by unrealized profit in USDT, from low to high
+	Positions []PortmarPosition
+
+	Warned   bool
+	Alerted  bool
+	Risky    bool
+	Findings []Finding
+	Err      error
 }
 
-func AnalysePortmar(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig) {
+func AnalysePortmar(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig) (analysis PortmarAnalysis) {
+	info := acct.PortmarAccountInformation
+	uniMMR := info.UniMMR
+
+	analysis.UniMMR = uniMMR
+	analysis.MaintMargin = info.AccountMaintMargin
+	analysis.EquityNeed = (cfg.BalancedUniMMR - uniMMR) * info.AccountMaintMargin
+	analysis.Warned = uniMMR < WarnedUniMMR
+	analysis.Alerted = uniMMR < AlertedUniMMR
+
+	finding := Finding{
+		Code:     FindingPmUniMMRBalanced,
+		Severity: FindingSeverityInfo,
+		Subject:  "UNIMMR",
+		Thresholds: map[string]float64{
+			"minUniMMR":      cfg.MinUniMMR,
+			"balancedUniMMR": cfg.BalancedUniMMR,
+			"maxUniMMR":      cfg.MaxUniMMR,
+		},
+		Inputs: map[string]float64{
+			"uniMMR":      uniMMR,
+			"maintMargin": info.AccountMaintMargin,
+			"equityNeed":  analysis.EquityNeed,
+		},
+	}
+
+	switch {
+	case uniMMR < cfg.MinUniMMR:
+		analysis.Level = PortmarUniMMRLevelLow
+		analysis.Risky = true
+		finding.Code = FindingPmUniMMRLow
+		finding.Severity = FindingSeverityCritical
+	// unset MaxUniMMR never releases surplus equity
+	case cfg.MaxUniMMR > 0 && uniMMR > cfg.MaxUniMMR:
+		analysis.Level = PortmarUniMMRLevelHigh
+		finding.Code = FindingPmUniMMRHigh
+	default:
+		analysis.Level = PortmarUniMMRLevelBalanced
+	}
+
+	analysis.Findings = append(analysis.Findings, finding)
+
+	var errs []error
+
+	locked := VIPLoanLockedQtys(acct, cfg)
+
+	for _, bal := range acct.Spot.Balances {
+		if bal.Free-locked[bal.Asset] <= 0 {
+			continue
+		}
+		rate, ok := acct.PortmarCollateralRate(bal.Asset)
+		if !ok || rate.CollateralRate <= 0 {
+			analysis.Findings = append(analysis.Findings, Finding{
+				Code:     FindingPmCollNotEligible,
+				Severity: FindingSeverityInfo,
+				Subject:  bal.Asset,
+				Skipped:  true,
+				Inputs:   map[string]float64{"free": bal.Free, "collateralRate": rate.CollateralRate},
+			})
+			continue
+		}
+		price, ok := acct.Price(bal.Asset)
+		if !ok {
+			errs = append(errs, fmt.Errorf("no %v price", bal.Asset))
+			analysis.Findings = append(analysis.Findings, Finding{
+				Code:     FindingPmCollNoPrice,
+				Severity: FindingSeverityWarn,
+				Subject:  bal.Asset,
+				Skipped:  true,
+				Inputs:   map[string]float64{"free": bal.Free},
+			})
+			continue
+		}
+		collInfo := SpotCollInfo{
+			Bal:               bal,
+			Price:             price,
+			PmCollRate:        rate.CollateralRate,
+			LoanCollUsedValue: locked[bal.Asset] * price,
+		}
+		analysis.TransferableSpotColls = append(analysis.TransferableSpotColls, collInfo)
+		analysis.TotalTransferableCollValue += collInfo.PmCollValue()
+	}
+
+	sort.SliceStable(analysis.TransferableSpotColls, func(i, j int) bool {
+		return analysis.TransferableSpotColls[i].PmCollRate > analysis.TransferableSpotColls[j].PmCollRate
+	})
+
+	for _, asset := range acct.PortmarAccountUMDetail.Assets {
+		if asset.CrossWalletBalance < 0 {
+			analysis.NegativeAssets = append(analysis.NegativeAssets, PortmarNegativeAsset{Asset: asset})
+		}
+	}
+	for _, asset := range acct.PortmarAccountCMDetail.Assets {
+		if asset.CrossWalletBalance < 0 {
+			analysis.NegativeAssets = append(analysis.NegativeAssets, PortmarNegativeAsset{Asset: asset, IsCM: true})
+		}
+	}
+	for _, neg := range analysis.NegativeAssets {
+		subject := "UM_" + neg.Asset.Asset
+		if neg.IsCM {
+			subject = "CM_" + neg.Asset.Asset
+		}
+		analysis.Findings = append(analysis.Findings, Finding{
+			Code:     FindingPmNegativeAsset,
+			Severity: FindingSeverityWarn,
+			Subject:  subject,
+			Inputs:   map[string]float64{"crossWalletBalance": neg.Asset.CrossWalletBalance},
+		})
+	}
+
+	for _, pos := range acct.PortmarAccountUMDetail.Positions {
+		if pos.SignPositionAmt != 0 {
+			analysis.Positions = append(analysis.Positions, PortmarPosition{Position: pos, UnrealizedProfitUsdt: pos.UnrealizedProfit})
+		}
+	}
+	for _, pos := range acct.PortmarAccountCMDetail.Positions {
+		if pos.SignPositionAmt == 0 {
+			continue
+		}
+		asset := portmarCMAsset(acct, pos.Symbol)
+		price, ok := acct.Price(asset)
+		if !ok {
+			errs = append(errs, fmt.Errorf("no %v price of cm position %v", asset, pos.Symbol))
+		}
+		analysis.Positions = append(analysis.Positions, PortmarPosition{Position: pos, IsCM: true, UnrealizedProfitUsdt: pos.UnrealizedProfit * price})
+	}
+
+	sort.SliceStable(analysis.Positions, func(i, j int) bool {
+		return analysis.Positions[i].UnrealizedProfitUsdt < analysis.Positions[j].UnrealizedProfitUsdt
+	})
+
+	analysis.Err = errors.Join(errs...)
 
+	return
 }
@@ -0,0 +1,169 @@
+package frbnc
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestAnalyseVIPLoanOrder(t *testing.T) {
+	cfg := VIPPortmarAccountConfig{VIPLoanMaxLTV: 0.75, VIPLoanTargetLTV: 0.6}
+
+	tests := []struct {
+		name   string
+		ord    bnc.VIPLoanOngoingOrder
+		status bnc.VIPLoanOrderStatus
+		cfg    VIPPortmarAccountConfig
+
+		marginCall  float64
+		liquidation float64
+		maxLtv      float64
+		targetLtv   float64
+		risky       bool
+		addUsdt     float64
+		addColl     float64
+		codes       []FindingCode
+		err         bool
+	}{
+		{"normal", bnc.VIPLoanOngoingOrder{OrderId: "1", TotalDebt: 500, TotalCollateralValueAfterHaircut: 1000, CurrentLTV: 0.5, MarginCallLtv: "85%", LiquidationLtv: "91%"}, "",
+			cfg, 0.85, 0.91, 0.75, 0.6, false, 0, 0, []FindingCode{FindingVIPLoanLtvNormal}, false},
+		{"above target", bnc.VIPLoanOngoingOrder{OrderId: "2", TotalDebt: 700, TotalCollateralValueAfterHaircut: 1000, CurrentLTV: 0.7, MarginCallLtv: "85%", LiquidationLtv: "91%"}, "",
+			cfg, 0.85, 0.91, 0.75, 0.6, false, 100, 1000.0 / 6, []FindingCode{FindingVIPLoanLtvNormal}, false},
+		{"risky", bnc.VIPLoanOngoingOrder{OrderId: "3", TotalDebt: 800, TotalCollateralValueAfterHaircut: 1000, CurrentLTV: 0.8, MarginCallLtv: "85%", LiquidationLtv: "91%"}, bnc.VIPLoanOrderStatusAccruingInterest,
+			cfg, 0.85, 0.91, 0.75, 0.6, true, 200, 1000.0 / 3, []FindingCode{FindingVIPLoanLtvHigh}, false},
+		// max ltv is margin call ltv if it is lower than config
+		{"low margin call", bnc.VIPLoanOngoingOrder{OrderId: "4", TotalDebt: 720, TotalCollateralValueAfterHaircut: 1000, MarginCallLtv: "70%", LiquidationLtv: "80%"}, "",
+			cfg, 0.7, 0.8, 0.7, 0.6, true, 120, 200, []FindingCode{FindingVIPLoanLtvHigh}, false},
+		{"bad ltv", bnc.VIPLoanOngoingOrder{OrderId: "5", TotalDebt: 500, TotalCollateralValueAfterHaircut: 1000, CurrentLTV: 0.5, MarginCallLtv: "bad", LiquidationLtv: "91%"}, "",
+			cfg, 0, 0.91, 0.75, 0.6, false, 0, 0, []FindingCode{FindingVIPLoanBadLtv, FindingVIPLoanLtvNormal}, true},
+		// unset target ltv is 80% of max ltv, residual interest is debt
+		{"target unset", bnc.VIPLoanOngoingOrder{OrderId: "6", TotalDebt: 790, ResidualInterest: 10, TotalCollateralValueAfterHaircut: 1000, MarginCallLtv: "85%", LiquidationLtv: "91%"}, "",
+			VIPPortmarAccountConfig{VIPLoanMaxLTV: 0.75}, 0.85, 0.91, 0.75, 0.6, true, 200, 1000.0 / 3, []FindingCode{FindingVIPLoanLtvHigh}, false},
+		{"no target", bnc.VIPLoanOngoingOrder{OrderId: "7", TotalDebt: 800, TotalCollateralValueAfterHaircut: 1000, MarginCallLtv: "bad", LiquidationLtv: "91%"}, "",
+			VIPPortmarAccountConfig{}, 0, 0.91, 0, 0, false, 0, 0, []FindingCode{FindingVIPLoanBadLtv, FindingVIPLoanLtvNormal, FindingVIPLoanBadConfig}, true},
+		{"not active", bnc.VIPLoanOngoingOrder{OrderId: "8", TotalDebt: 800, TotalCollateralValueAfterHaircut: 1000, CurrentLTV: 0.8, MarginCallLtv: "85%", LiquidationLtv: "91%"}, bnc.VIPLoanOrderStatusRepaying,
+			cfg, 0.85, 0.91, 0.75, 0.6, false, 0, 0, []FindingCode{FindingVIPLoanNotActive, FindingVIPLoanLtvNormal}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AnalyseVIPLoanOrder(tt.ord, bnc.VIPLoanApplicationStatusInfo{OrderId: tt.ord.OrderId, Status: tt.status}, tt.cfg)
+			if got.MarginCallLTV != tt.marginCall || got.LiquidationLTV != tt.liquidation {
+				t.Errorf("margin call ltv %v, liquidation ltv %v, want %v, %v", got.MarginCallLTV, got.LiquidationLTV, tt.marginCall, tt.liquidation)
+			}
+			if got.MaxLTV != tt.maxLtv || math.Abs(got.TargetLTV-tt.targetLtv) > 1e-9 || got.Risky != tt.risky {
+				t.Errorf("max ltv %v, target ltv %v, risky %v, want %v, %v, %v", got.MaxLTV, got.TargetLTV, got.Risky, tt.maxLtv, tt.targetLtv, tt.risky)
+			}
+			if math.Abs(got.AdditionalUsdt-tt.addUsdt) > 1e-9 || math.Abs(got.AdditionalCollValue-tt.addColl) > 1e-9 {
+				t.Errorf("additional usdt %v, coll value %v, want %v, %v", got.AdditionalUsdt, got.AdditionalCollValue, tt.addUsdt, tt.addColl)
+			}
+			if (got.Err != nil) != tt.err {
+				t.Errorf("err %v, want err %v", got.Err, tt.err)
+			}
+			var codes []FindingCode
+			for _, f := range got.Findings {
+				codes = append(codes, f.Code)
+			}
+			if !slices.Equal(codes, tt.codes) {
+				t.Errorf("findings %v, want %v", codes, tt.codes)
+			}
+		})
+	}
+}
+
+func TestAnalyseVIPLoan(t *testing.T) {
+	cfg := VIPPortmarAccountConfig{VIPLoanMaxLTV: 0.75, VIPLoanTargetLTV: 0.6}
+	acct := &VIPPortmarAccount{
+		LoanOrders: []bnc.VIPLoanOngoingOrder{
+			{OrderId: "1", TotalDebt: 500, TotalCollateralValueAfterHaircut: 1000, LockedCollateralValue: 1200, MarginCallLtv: "85%", LiquidationLtv: "91%"},
+			{OrderId: "2", TotalDebt: 800, TotalCollateralValueAfterHaircut: 1000, LockedCollateralValue: 1100, MarginCallLtv: "85%", LiquidationLtv: "91%"},
+		},
+		LoanStatusInfo: []bnc.VIPLoanApplicationStatusInfo{{OrderId: "2"}},
+	}
+
+	got := AnalyseVIPLoan(acct, cfg)
+	if got.Err != nil {
+		t.Fatal(got.Err)
+	}
+	if len(got.Orders) != 2 || got.Orders[0].Order.OrderId != "2" || got.Orders[1].Order.OrderId != "1" {
+		t.Fatalf("orders %+v, want sorted by current ltv", got.Orders)
+	}
+	if got.Orders[0].Status.OrderId != "2" {
+		t.Errorf("status %+v", got.Orders[0].Status)
+	}
+	if !got.Risky || got.TotalDebt != 1300 || got.LockedCollateralValue != 2300 || len(got.Findings) != 2 {
+		t.Errorf("risky %v, debt %v, locked %v, findings %v", got.Risky, got.TotalDebt, got.LockedCollateralValue, len(got.Findings))
+	}
+}
+
+func TestAnalysePortmar(t *testing.T) {
+	cfg := VIPPortmarAccountConfig{MinUniMMR: 1.5, BalancedUniMMR: 2, MaxUniMMR: 2.5}
+
+	newAcct := func(uniMMR float64) *VIPPortmarAccount {
+		return &VIPPortmarAccount{
+			PortmarAccountInformation: bnc.PortfolioMarginAccountInformation{UniMMR: uniMMR, AccountMaintMargin: 1000},
+			PortmarAccountUMDetail: bnc.PortfolioMarginAccountDetail{
+				Assets: []bnc.PortfolioMarginAccountAsset{{Asset: "USDT", CrossWalletBalance: -100}, {Asset: "BNB", CrossWalletBalance: 1}},
+				Positions: []bnc.PortfolioMarginAccountPosition{
+					{Symbol: "ETHUSDT", SignPositionAmt: -1, UnrealizedProfit: -1},
+					{Symbol: "BNBUSDT", SignPositionAmt: -1, UnrealizedProfit: 5},
+					{Symbol: "XRPUSDT"},
+				},
+			},
+			PortmarAccountCMDetail: bnc.PortfolioMarginAccountDetail{
+				Assets:    []bnc.PortfolioMarginAccountAsset{{Asset: "BTC", CrossWalletBalance: -0.1}},
+				Positions: []bnc.PortfolioMarginAccountPosition{{Symbol: "BTCUSD_PERP", SignPositionAmt: -100, UnrealizedProfit: -0.5}},
+			},
+			Prices: map[string]float64{"BTC": 50000},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		acct       *VIPPortmarAccount
+		cfg        VIPPortmarAccountConfig
+		level      PortmarUniMMRLevel
+		risky      bool
+		equityNeed float64
+		code       FindingCode
+	}{
+		{"low", newAcct(1.2), cfg, PortmarUniMMRLevelLow, true, 800, FindingPmUniMMRLow},
+		{"balanced", newAcct(2.2), cfg, PortmarUniMMRLevelBalanced, false, -200, FindingPmUniMMRBalanced},
+		{"high", newAcct(3), cfg, PortmarUniMMRLevelHigh, false, -1000, FindingPmUniMMRHigh},
+		// unset max uniMMR is never high
+		{"max unset", newAcct(3), VIPPortmarAccountConfig{MinUniMMR: 1.5, BalancedUniMMR: 2}, PortmarUniMMRLevelBalanced, false, -1000, FindingPmUniMMRBalanced},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AnalysePortmar(tt.acct, tt.cfg)
+			if got.Err != nil {
+				t.Fatal(got.Err)
+			}
+			if got.Level != tt.level || got.Risky != tt.risky || got.Findings[0].Code != tt.code {
+				t.Errorf("level %v, risky %v, finding %v, want %v, %v, %v", got.Level, got.Risky, got.Findings[0].Code, tt.level, tt.risky, tt.code)
+			}
+			if math.Abs(got.EquityNeed-tt.equityNeed) > 1e-9 {
+				t.Errorf("equity need %v, want %v", got.EquityNeed, tt.equityNeed)
+			}
+
+			if len(got.NegativeAssets) != 2 || got.NegativeAssets[0].Asset.Asset != "USDT" || !got.NegativeAssets[1].IsCM {
+				t.Errorf("negative assets %+v, want um USDT and cm BTC", got.NegativeAssets)
+			}
+
+			// cm loss of 0.5 BTC is 25000 USDT, larger than um loss
+			var symbols []string
+			for _, pos := range got.Positions {
+				symbols = append(symbols, pos.Position.Symbol)
+			}
+			if want := []string{"BTCUSD_PERP", "ETHUSDT", "BNBUSDT"}; !slices.Equal(symbols, want) {
+				t.Errorf("positions %v, want %v", symbols, want)
+			}
+			if pnl := got.Positions[0].UnrealizedProfitUsdt; math.Abs(pnl+25000) > 1e-9 {
+				t.Errorf("cm unrealized profit %v, want -25000", pnl)
+			}
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package frbnc
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"math"
+	"os"
 	"slices"
-	"sort"
+	"sync"
+	"time"
 
 	"github.com/dwdwow/cex"
 	"github.com/dwdwow/cex/bnc"
@@ -13,28 +17,266 @@ import (
 )
 
 type VIPPortmarAcctSimple struct {
-	user   *bnc.User
-	cfg    VIPPortmarAccountConfig
-	chAcct chan VIPPortmarAcctWatcherMsg
+	user    *bnc.User
+	cfg     VIPPortmarAccountConfig
+	watcher *VIPPortmarAcctWatcher
+	chAcct  chan VIPPortmarAcctWatcherMsg
+	// Audit of executor is recorder of current handle cycle,
+	// only changed while muxHandling is held.
+	executor *ActionExecutor
+	audit    *AuditRecorder
+	posStore *PosTradeStore
+
+	repayPolicy RepayPolicy
+	// earnAPRs key is asset, used by negative carry trigger of repayPolicy.
+	earnAPRs map[string]float64
+
+	// pairs returns spot and um futures pairs for cutting positions.
+	pairs func() (spPairs, umPairs map[string]cex.Pair, err error)
+
+	// cutLosses are realized losses of cutting positions
+	cutLosses []portmarCutLoss
+
+	muxHandling sync.Mutex
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+
+	muxClosed sync.Mutex
+	closed    bool
+	started   bool
 
 	logger *slog.Logger
 }
 
+type portmarCutLoss struct {
+	loss float64
+	time time.Time
+}
+
+func NewVIPPortmarAcctSimple(user *bnc.User, cfg VIPPortmarAccountConfig, logger *slog.Logger) *VIPPortmarAcctSimple {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+	logger = logger.With("cex", user.Api().Cex, "apiKey", user.Api().ApiKey)
+	policy := DefaultRepayPolicy()
+	policy.Triggers = map[RepayTrigger]bool{RepayTriggerLtvHigh: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &VIPPortmarAcctSimple{
+		user:        user,
+		cfg:         cfg,
+		watcher:     NewVIPPortmarAcctWatcher(user, logger),
+		executor:    NewActionExecutor(user, logger),
+		repayPolicy: policy,
+		pairs:       queryPortmarPairs,
+		ctx:         ctx,
+		ctxCancel:   cancel,
+		logger:      logger,
+	}
+}
+
+func queryPortmarPairs() (spPairs, umPairs map[string]cex.Pair, err error) {
+	spPairs, err = QuerySpotPairs()
+	if err != nil {
+		return
+	}
+	umPairs, err = QueryFuPairs()
+	return
+}
+
+// SetDryRun
+// In dry run, mutating exchange calls are only logged,
+// the account snapshot is updated as if they had succeeded.
+// Should be set before starting.
+func (v *VIPPortmarAcctSimple) SetDryRun(dryRun bool) {
+	v.executor.DryRun = dryRun
+}
+
+// SetRepayPolicy
+// Only LTV_HIGH trigger is enabled by default.
+// earnAPRs key is loan coin, used by NEGATIVE_CARRY trigger.
+// Should be set before starting.
+func (v *VIPPortmarAcctSimple) SetRepayPolicy(policy RepayPolicy, earnAPRs map[string]float64) {
+	v.repayPolicy = policy
+	v.earnAPRs = earnAPRs
+}
+
+// SetAuditLog writes every mutating action and order to log.
+// Should be set before starting.
+func (v *VIPPortmarAcctSimple) SetAuditLog(log *AuditLog) {
+	v.audit = NewAuditRecorder(log, v.user.Api().ApiKey, v.logger)
+}
+
+// SetPosTradeStore saves in-flight cuts of positions to store,
+// unfinished ones are resumed by Start.
+// Should be set before starting.
+func (v *VIPPortmarAcctSimple) SetPosTradeStore(store *PosTradeStore) {
+	v.posStore = store
+}
+
+// Start starts account watcher and handles every account it fans out.
+func (v *VIPPortmarAcctSimple) Start() error {
+	v.muxClosed.Lock()
+	if v.closed {
+		v.muxClosed.Unlock()
+		return errors.New("vip portfolio margin account simple is closed")
+	}
+	if v.started {
+		v.muxClosed.Unlock()
+		return errors.New("vip portfolio margin account simple is started")
+	}
+	v.started = true
+	v.muxClosed.Unlock()
+
+	// resuming waits for orders, Close should not be blocked by it
+	v.resumePosTrades()
+
+	v.muxClosed.Lock()
+	defer v.muxClosed.Unlock()
+	if v.closed {
+		return errors.New("vip portfolio margin account simple is closed")
+	}
+	if err := v.watcher.Start(); err != nil {
+		return err
+	}
+	v.chAcct = v.watcher.Sub()
+	go v.start()
+	return nil
+}
+
+// Close stops handling new accounts and closes account watcher,
+// account being handled is not interrupted.
+func (v *VIPPortmarAcctSimple) Close() {
+	v.muxClosed.Lock()
+	defer v.muxClosed.Unlock()
+	if v.closed {
+		return
+	}
+	v.closed = true
+	v.ctxCancel()
+	if v.chAcct != nil {
+		v.watcher.Unsub(v.chAcct)
+	}
+	v.watcher.Close()
+}
+
+// resumePosTrades resumes cuts of positions left in position trade store by a crash,
+// before any new account is handled.
+// In dry run, they are only logged.
+func (v *VIPPortmarAcctSimple) resumePosTrades() {
+	trades, err := v.posStore.Load()
+	if err != nil {
+		v.logger.Error("Cannot Load Position Trades", "err", err)
+	}
+	for _, trade := range trades {
+		if trade.Kind != PosTradeKindVIPPortmar {
+			continue
+		}
+		logger := v.logger.With("tradeId", trade.Id, "spPair", trade.SpPair.PairSymbol, "fuPair", trade.FuPair.PairSymbol, "isCM", trade.IsCM,
+			"spQty", trade.SpQty, "fuQty", trade.FuQty, "status", trade.Msg.Status(), "errs", trade.Errs)
+		if v.executor.DryRun {
+			logger.Warn("Dry Run Unfinished Position Trade")
+			continue
+		}
+		logger.Warn("Resuming Position Trade")
+		ctx, cancel := context.WithTimeout(v.ctx, v.cutFillTimeout())
+		msg := ResumeVIPPortmarPosTrader(ctx, v.user, trade, v.posStore, v.audit.Begin(nil)).Wait()
+		cancel()
+		if status := msg.Status(); status.isSettled() {
+			logger.Info("Position Trade Resumed", "newStatus", status)
+		} else {
+			logger.Error("Position Trade Not Settled, Check It Manually", "newStatus", status, "err", errors.Join(msg.Errs...))
+		}
+	}
+}
+
+func (v *VIPPortmarAcctSimple) cutFillTimeout() time.Duration {
+	if v.cfg.CutFillTimeout <= 0 {
+		return time.Second * 10
+	}
+	return v.cfg.CutFillTimeout
+}
+
 func (v *VIPPortmarAcctSimple) start() {
 	for {
-		msg := <-v.chAcct
-		if msg.Err != nil {
-
+		select {
+		case <-v.ctx.Done():
+			v.logger.Info("VIP Portmar Acct Simple Ctx Done", "err", v.ctx.Err())
+			return
+		case msg := <-v.chAcct:
+			if msg.Err != nil {
+				v.logger.Error("Receive Account Error", "err", msg.Err)
+				continue
+			}
+			if msg.Acct == nil {
+				continue
+			}
+			go v.handle(msg.Acct)
 		}
 	}
 }
 
-func (v *VIPPortmarAcctSimple) handle(acct *VIPPortmarAccount) {}
+// handle brings uniMMR back into band, repays vip loans by repay policy,
+// then places idle spot USDT if AllocateIdleUsdt is set.
+// Returns account after handling, hypothetical account in dry run.
+func (v *VIPPortmarAcctSimple) handle(acct *VIPPortmarAccount) *VIPPortmarAccount {
+	if !v.muxHandling.TryLock() {
+		return acct
+	}
+	defer v.muxHandling.Unlock()
+
+	v.executor.Audit = v.audit.Begin(acct)
+
+	pm := AnalysePortmar(acct, v.cfg)
+	loans := AnalyseVIPLoan(acct, v.cfg)
+	LogFindings(v.logger, slices.Concat(pm.Findings, loans.Findings))
+
+	switch pm.Level {
+	case PortmarUniMMRLevelLow:
+		acct = v.handleMMR(acct)
+	case PortmarUniMMRLevelHigh:
+		acct = v.handleHighMMR(acct)
+	}
+
+	acct = v.handleHighLtv(acct)
+	if v.cfg.AllocateIdleUsdt {
+		acct = v.handleAllocation(acct)
+	}
+	return acct
+}
+
+// refreshAccount returns account after actions,
+// hypothetical account in dry run, or account queried again.
+func (v *VIPPortmarAcctSimple) refreshAccount(acct *VIPPortmarAccount, actions ...Action) *VIPPortmarAccount {
+	acct = v.nextAccount(acct, actions...)
+	v.executor.Audit.Snapshot(acct)
+	return acct
+}
+
+func (v *VIPPortmarAcctSimple) nextAccount(acct *VIPPortmarAccount, actions ...Action) *VIPPortmarAccount {
+	if v.executor.DryRun {
+		return acct.WithActions(actions...)
+	}
+	for range 3 {
+		updating, newAcct, err := v.watcher.Update()
+		if err != nil {
+			v.logger.Error("Cannot Update Account", "err", err)
+			return acct
+		}
+		if !updating && newAcct != nil {
+			return newAcct
+		}
+		v.logger.Warn("Account Is Updating")
+		time.Sleep(time.Second)
+	}
+	return acct
+}
 
 type SpotCollInfo struct {
-	Bal               bnc.SpotBalance
-	Price             float64
-	PmCollRate        float64
+	Bal        bnc.SpotBalance
+	Price      float64
+	PmCollRate float64
+	// LoanCollUsedValue is value locked as vip loan collateral
 	LoanCollUsedValue float64
 }
 
@@ -42,177 +284,279 @@ func (s SpotCollInfo) Value() float64 {
 	return s.Bal.Free * s.Price
 }
 
+// PmCollValue returns value can be added to portfolio margin account after haircut,
+// value locked as vip loan collateral is excluded.
 func (s SpotCollInfo) PmCollValue() float64 {
-	return s.Value() * s.PmCollRate
+	return math.Max(s.Value()-s.LoanCollUsedValue, 0) * s.PmCollRate
 }
 
-func (v *VIPPortmarAcctSimple) handleMMR(acct *VIPPortmarAccount) {
+// handleMMR transfers spot collaterals to portfolio margin account,
+// then cuts positions if equity is still not enough.
+func (v *VIPPortmarAcctSimple) handleMMR(acct *VIPPortmarAccount) *VIPPortmarAccount {
 	if acct.PortmarAccountInformation.UniMMR > v.cfg.MinUniMMR {
-		return
+		return acct
+	}
+
+	if local, err := CalUniMMREquity(acct); err != nil {
+		v.logger.Warn("Cannot Calculate Local UniMMR", "err", err)
+	} else {
+		v.logger.Info("UniMMR", "cex", acct.PortmarAccountInformation.UniMMR, "local", local.UniMMR)
 	}
 
 	deltaMMR := v.cfg.BalancedUniMMR - acct.PortmarAccountInformation.UniMMR
 
 	equityNeed := acct.PortmarAccountInformation.AccountMaintMargin * deltaMMR
 
-	remainingEquityNeed, err := v.handleLowMMR(acct, equityNeed)
+	done, remainingEquityNeed, err := v.handleLowMMR(acct, equityNeed)
 
 	if err != nil {
+		v.logger.Error("Handle Low UniMMR Failed", "err", err)
+	}
 
+	if len(done) > 0 {
+		acct = v.refreshAccount(acct, done...)
 	}
 
 	// some perpetual should trade 50 usdt at least
 
 	if remainingEquityNeed > 50 {
-
+		acct, remainingEquityNeed, err = v.cutPositions(acct, remainingEquityNeed)
+		if err != nil {
+			v.logger.Error("Cut Positions Failed", "err", err)
+		}
+		if remainingEquityNeed > 50 {
+			v.logger.Error("UniMMR Still Low After Cutting Positions", "remainingEquityNeed", remainingEquityNeed)
+		}
 	}
 
+	return acct
 }
 
-func (v *VIPPortmarAcctSimple) handleLowMMR(acct *VIPPortmarAccount, equityNeed float64) (remainingEquityNeed float64, err error) {
+// handleLowMMR transfers spot collaterals selected by SelectPortmarCollaterals
+// to portfolio margin account.
+// Returns transfers done and equity still needed.
+func (v *VIPPortmarAcctSimple) handleLowMMR(acct *VIPPortmarAccount, equityNeed float64) (done []Action, remainingEquityNeed float64, err error) {
 	remainingEquityNeed = equityNeed
 
-	_prices, err := bnc.QueryCMPremiumIndex("", "")
-
-	// TODO should add some other price getters
-	if err != nil {
-		v.logger.Error("QueryCMPremiumIndex", "err", err)
+	sel := SelectPortmarCollaterals(acct, v.cfg, equityNeed)
+	if len(sel.Transfers) == 0 {
+		v.logger.Error("Spot Suitable Collaterals Are Not Enough", "locked", sel.Locked)
+		err = errors.New("spot suitable collaterals are not enough")
 		return
 	}
+	v.logger.Info("Portmar Collaterals Selected", "adjustedValue", sel.AdjustedValue, "haircutLoss", sel.HaircutLoss, "remaining", sel.Remaining)
 
-	prices := slice2map(_prices, func(index bnc.CMPremiumIndex) string {
-		return index.Symbol
-	})
-
-	var collInfos, suitableCollInfos []SpotCollInfo
+	simAcct := acct
 
-	spots := acct.Spot.Balances
-	for _, s := range spots {
-		rate, ok := acct.PortmarCollateralRate(s.Asset)
-		if !ok {
-			v.logger.Error("No Portmar Collateral Rate", "asset", s.Asset)
-			continue
+	for _, trans := range sel.Transfers {
+		nextAcct := simAcct.WithSpotPortmarTransfer(trans.Asset, trans.Qty)
+		if predicted, err := CalUniMMREquity(nextAcct); err == nil {
+			v.logger.Info("Predicted UniMMR After Transfer", "asset", trans.Asset, "qty", trans.Qty, "uniMMR", predicted.UniMMR)
 		}
-		price, ok := prices[s.Asset]
-		if !ok {
-			v.logger.Error("No Portmar Collateral Index Price Info", "asset", s.Asset)
+		res := v.executor.Execute([]Action{{
+			Type:         ActionTypeTransfer,
+			Reason:       FindingPmUniMMRLow,
+			Asset:        trans.Asset,
+			Qty:          trans.Qty,
+			TransferType: bnc.TransferTypeMainPortfolioMargin,
+		}})[0]
+		if res.Err != nil {
+			v.logger.Error("Transfer Main -> PM Account Failed", "asset", trans.Asset, "qty", trans.Qty, "err", res.Err)
 			continue
 		}
-		collInfos = append(collInfos, SpotCollInfo{
-			Bal:        s,
-			Price:      price.IndexPrice,
-			PmCollRate: rate.CollateralRate,
-		})
+		v.logger.Info("Main -> PM Account", "asset", trans.Asset, "qty", trans.Qty, "result", res.Result, "dryRun", res.Estimated)
+		done = append(done, res.Action)
+		simAcct = nextAcct
+		remainingEquityNeed -= trans.AdjustedValue
 	}
 
-	sort.Slice(collInfos, func(i, j int) bool {
-		collI := collInfos[i]
-		collJ := collInfos[j]
-		sybI := collI.Bal.Asset
-		sybJ := collJ.Bal.Asset
-		if sybI == "ETH" || sybI == "BTC" {
-			return true
-		}
-		if sybJ == "ETH" || sybJ == "BTC" {
-			return false
-		}
-		return collI.PmCollRate > collJ.PmCollRate
+	if remainingEquityNeed >= 10 {
+		v.logger.Warn("Remaining Equity Not Enough", "remainingEquityNeed", remainingEquityNeed)
+	}
+
+	return
+}
+
+// cutLossLeft returns realized loss can be taken by cutting positions now,
+// MaxCutLoss minus realized loss of last 24 hours.
+func (v *VIPPortmarAcctSimple) cutLossLeft() float64 {
+	from := time.Now().Add(-time.Hour * 24)
+	v.cutLosses = slices.DeleteFunc(v.cutLosses, func(l portmarCutLoss) bool {
+		return l.time.Before(from)
 	})
+	left := v.cfg.MaxCutLoss
+	for _, l := range v.cutLosses {
+		left -= l.loss
+	}
+	return math.Max(left, 0)
+}
+
+// cutPositions cuts hedges until equityNeed is restored,
+// realized loss is capped by MaxCutLoss of 24 hours.
+// USDT of spot coin sold is transferred to portfolio margin account.
+// Returns account after cutting, hypothetical account in dry run.
+func (v *VIPPortmarAcctSimple) cutPositions(acct *VIPPortmarAccount, equityNeed float64) (next *VIPPortmarAccount, remainingEquityNeed float64, err error) {
+	next = acct
+	remainingEquityNeed = equityNeed
 
-	var totalDebt float64
-	for _, ord := range acct.LoanOrders {
-		totalDebt += ord.TotalDebt
+	spPairs, umPairs, err := v.pairs()
+	if err != nil {
+		v.logger.Error("Cannot Query Pairs", "err", err)
+		return
 	}
 
-	minSpotCollValue := totalDebt / v.cfg.VIPLoanMaxLTV
-	remainSpotCollValue := minSpotCollValue
+	lossLeft := v.cutLossLeft()
+	unwinds, planned := PlanPortmarCutPositions(acct, spPairs, umPairs, v.cfg.BalancedUniMMR, equityNeed, lossLeft)
+	if len(unwinds) == 0 {
+		v.logger.Warn("No Position Can Be Cut", "equityNeed", equityNeed, "lossLeft", lossLeft)
+		return
+	}
+	v.logger.Info("Cutting Positions", "equityNeed", equityNeed, "planned", planned, "lossLeft", lossLeft)
 
-	slices.Reverse(collInfos)
-	for _, collInfo := range collInfos {
-		value := collInfo.Value()
-		if value < remainSpotCollValue {
-			remainSpotCollValue -= value
+	var proceeds float64
+	for _, u := range unwinds {
+		usdt, err := v.cutPosition(u)
+		if err != nil {
 			continue
 		}
-		if remainSpotCollValue > 0 {
-			remainSpotCollValue = 0
-			collInfo.LoanCollUsedValue = remainSpotCollValue
+		v.cutLosses = append(v.cutLosses, portmarCutLoss{u.Loss, time.Now()})
+		remainingEquityNeed -= u.Equity - u.SpQty*u.Price
+		proceeds += usdt
+		if v.executor.DryRun {
+			next = next.WithPortmarUnwind(u)
 		}
-		suitableCollInfos = append(suitableCollInfos, collInfo)
 	}
 
-	if len(suitableCollInfos) <= 0 {
-		// TODO Dangerous Situation
-		v.logger.Error("Spot Suitable Collaterals Are Not Enough")
-		err = errors.New("spot suitable collaterals are enough")
-		return
+	var done []Action
+	proceeds = mathy.RoundFloor(proceeds, 2)
+	if proceeds >= minUsdt {
+		res := v.executor.Execute([]Action{{
+			Type:         ActionTypeTransfer,
+			Reason:       FindingPmUniMMRLow,
+			Asset:        "USDT",
+			Qty:          proceeds,
+			TransferType: bnc.TransferTypeMainPortfolioMargin,
+		}})[0]
+		if res.Err != nil {
+			v.logger.Error("Transfer Main -> PM Account Failed", "asset", "USDT", "qty", proceeds, "err", res.Err)
+		} else {
+			remainingEquityNeed -= proceeds
+			done = append(done, res.Action)
+		}
 	}
 
-	slices.Reverse(suitableCollInfos)
+	v.logger.Info("Positions Cut", "equityNeed", equityNeed, "remainingEquityNeed", remainingEquityNeed, "proceeds", proceeds)
 
-	const maxRemainNeed = 10
+	next = v.refreshAccount(next, done...)
 
-	for _, collInfo := range suitableCollInfos {
-		if remainingEquityNeed < maxRemainNeed {
-			break
-		}
-		value := collInfo.PmCollValue()
-		transValue := math.Min(value, remainSpotCollValue)
-		transQty := collInfo.Bal.Free * math.Min(1, transValue/value)
-		transQty = mathy.RoundFloor(transQty, 6)
-		_, transRes, reqErr := v.user.Transfer(bnc.TransferTypeMainPortfolioMargin, collInfo.Bal.Asset, transQty)
-		if reqErr.IsNotNil() {
-			v.logger.Error("Transfer Main -> PM Account Failed", "asset", collInfo.Bal.Asset, "qyt", transQty, "err", reqErr.Err)
-			continue
-		}
-		v.logger.Info("Main -> PM Account", "asset", collInfo.Bal.Asset, "qyt", transQty, "result", transRes)
-		remainingEquityNeed -= transValue
-	}
+	return
+}
 
-	if remainingEquityNeed >= maxRemainNeed {
-		v.logger.Warn("Remaining Equity Not Enough", "remainingEquityNeed", remainingEquityNeed)
+// cutPosition buys back futures short, then sells spot coin by VIPPortmarPosTrader.
+// If spot order fails, futures is sold again, so the hedge is kept.
+// Returns USDT of spot coin sold.
+func (v *VIPPortmarAcctSimple) cutPosition(u PortmarUnwind) (usdt float64, err error) {
+	if v.executor.DryRun {
+		v.logger.Info("Dry Run Cut Position", "symbol", u.Symbol, "isCM", u.IsCM, "spQty", u.SpQty, "fuQty", u.FuQty, "equity", u.Equity, "loss", u.Loss)
+		return u.SpQty * u.Price, nil
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), v.cutFillTimeout())
+	defer cancel()
+
+	msg := VIPPortmarPosTrader(ctx, VIPPortmarPosTraderParams{
+		User:   v.user,
+		SpSide: cex.OrderSideSell,
+		IsCM:   u.IsCM,
+		SpPair: u.SpPair,
+		SpQty:  u.SpQty,
+		FuPair: u.FuPair,
+		FuQty:  u.FuQty,
+		Audit:  v.executor.Audit,
+		Store:  v.posStore,
+	}).Wait()
+
+	status := msg.Status()
+	err = errors.Join(msg.Errs...)
+	switch status {
+	case VIPPortmarPosStatusSpOpened:
+		v.logger.Info("Position Cut", "symbol", u.Symbol, "isCM", u.IsCM, "spQty", u.SpQty, "fuQty", u.FuQty, "loss", u.Loss)
+		return msg.SpOrd.Order.FilledQuote, nil
+	case VIPPortmarPosStatusFuFailed, VIPPortmarPosStatusReFuOpened:
+		v.logger.Error("Cut Position Failed", "symbol", u.Symbol, "isCM", u.IsCM, "status", status, "err", err)
+	default:
+		v.logger.Error("Cut Position Leg Failed, Spot Is Unhedged", "symbol", u.Symbol, "isCM", u.IsCM, "status", status, "err", err)
+	}
+	if err == nil {
+		err = fmt.Errorf("cut position %v, status %v", u.Symbol, status)
+	}
 	return
 }
 
-func (v *VIPPortmarAcctSimple) cutPositions(acct *VIPPortmarAccount, equityNeed float64, forLowMMR bool) (remainingEquityNeed float64, err error) {
-	// should care about 5000 real loss
-
-	//_prices, err := bnc.QueryCMPremiumIndex("", "")
-	//if err != nil {
-	//	v.logger.Error("Can't Query CM Premium Index", "err", err)
-	//}
-	//
-	//prices := slice2map(_prices, func(index bnc.CMPremiumIndex) string {
-	//	return index.Symbol
-	//})
-	//
-	//type Pos struct {
-	//	Position bnc.PortfolioMarginAccountPosition
-	//	NPL      float64
-	//}
-	//
-	//umPoss := acct.PortmarAccountUMDetail.Positions
-	//cmPoss := acct.PortmarAccountCMDetail.Positions
-	//_poss := slices.Concat(umPoss, cmPoss)
-	//
-	//var poss []Pos
-	//
-	//for _, pos := range _poss {
-	//
-	//}
-	//
-	//sort.Slice(umPoss, func(i, j int) bool {
-	//	posI, posJ := umPoss[i], umPoss[j]
-	//	return posI.UnrealizedProfit < posJ.UnrealizedProfit
-	//})
+// handleHighMMR transfers surplus collaterals above BalancedUniMMR back to spot account,
+// collaterals with lowest collateral rate are transferred first.
+func (v *VIPPortmarAcctSimple) handleHighMMR(acct *VIPPortmarAccount) *VIPPortmarAccount {
+	actions, res, err := PlanPortmarSurplusActions(acct, v.cfg)
+	if err != nil {
+		v.logger.Error("Cannot Plan PM Surplus Transfers", "err", err)
+		return acct
+	}
+	if len(actions) == 0 {
+		return acct
+	}
+	v.logger.Info("Transfer PM Surplus", "actions", len(actions), "uniMMR", acct.PortmarAccountInformation.UniMMR, "localAfter", res.UniMMR)
 
-	return
+	var done []Action
+	for _, r := range v.executor.Execute(actions) {
+		if r.Err != nil {
+			v.logger.Error("Transfer PM Account -> Main Failed", "asset", r.Action.Asset, "qty", r.Action.Qty, "err", r.Err)
+			continue
+		}
+		done = append(done, r.Action)
+	}
+	if len(done) == 0 {
+		return acct
+	}
+	return v.refreshAccount(acct, done...)
 }
 
-func (v *VIPPortmarAcctSimple) cutPosition(spotPair, fuPair cex.Pair, qty float64) error {
-	return nil
+// handleAllocation places idle spot USDT in vip loans or portfolio margin account by yield.
+func (v *VIPPortmarAcctSimple) handleAllocation(acct *VIPPortmarAccount) *VIPPortmarAccount {
+	fundingRates, err := QueryFundingRateMap()
+	if err != nil {
+		v.logger.Warn("Cannot Query Funding Rates", "err", err)
+	}
+	actions := PlanPortmarAllocationActions(acct, v.cfg, fundingRates)
+	if len(actions) == 0 {
+		return acct
+	}
+	var done []Action
+	for _, res := range v.executor.Execute(actions) {
+		if res.Err != nil {
+			v.logger.Error("Allocation Action Failed", "action", res.Action, "err", res.Err)
+			continue
+		}
+		done = append(done, res.Action)
+	}
+	if len(done) == 0 {
+		return acct
+	}
+	return v.refreshAccount(acct, done...)
 }
 
-func (v *VIPPortmarAcctSimple) handleHighLtv(acct *VIPPortmarAccount) {}
+// handleHighLtv repays vip loans by repay policy,
+// account is refreshed after every action.
+func (v *VIPPortmarAcctSimple) handleHighLtv(acct *VIPPortmarAccount) *VIPPortmarAccount {
+	actions, unmet := PlanVIPRepayActions(acct, v.cfg, v.repayPolicy, v.earnAPRs, time.Now())
+	for _, action := range actions {
+		v.logger.Info("VIP Repay Action Planned", "action", action)
+		if res := v.executor.Execute([]Action{action})[0]; res.Err != nil {
+			continue
+		}
+		acct = v.refreshAccount(acct, action)
+	}
+	for _, need := range unmet {
+		v.logger.Warn("VIP Loan Repay Need Unmet", "trigger", need.Trigger, "orderId", need.Subject, "qty", need.Qty)
+	}
+	return acct
+}
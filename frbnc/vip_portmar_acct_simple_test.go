@@ -0,0 +1,99 @@
+package frbnc
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestVIPPortmarAcctSimpleHandle(t *testing.T) {
+	cfg := VIPPortmarAccountConfig{
+		MinUniMMR:        1.5,
+		BalancedUniMMR:   2,
+		MaxUniMMR:        4,
+		VIPLoanMaxLTV:    0.75,
+		VIPLoanTargetLTV: 0.6,
+	}
+
+	newAcct := func(uniMMR, pmUsdt, spUsdt float64) *VIPPortmarAccount {
+		acct := &VIPPortmarAccount{
+			Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{
+				{Asset: "USDT", Free: spUsdt},
+				{Asset: "ETH", Free: 10},
+			}},
+			PortmarAccountInformation: bnc.PortfolioMarginAccountInformation{UniMMR: uniMMR, AccountMaintMargin: 1000},
+			PortmarBalances: []bnc.PortfolioMarginBalance{
+				{Asset: "USDT", CrossMarginAsset: pmUsdt, CrossMarginFree: pmUsdt},
+			},
+			PortmarAccountUMDetail: bnc.PortfolioMarginAccountDetail{Positions: []bnc.PortfolioMarginAccountPosition{
+				{Symbol: "ETHUSDT", SignPositionAmt: -10, EntryPrice: 2100, UnrealizedProfit: 1000, MaintMargin: 50},
+			}},
+			Prices: map[string]float64{"ETH": 2000},
+		}
+		// ETH is not portfolio margin collateral, so it can only be released by cutting the hedge
+		acct.pmCollRates = map[string]bnc.PortfolioMarginCollateralRate{"USDT": {Asset: "USDT", CollateralRate: 1}}
+		return acct.Clone()
+	}
+
+	highLtv := newAcct(3, 3000, 50)
+	highLtv.LoanOrders = []bnc.VIPLoanOngoingOrder{
+		{OrderId: "1", LoanCoin: "USDT", TotalDebt: 800, TotalCollateralValueAfterHaircut: 1000, CurrentLTV: 0.8, MarginCallLtv: "85%", LiquidationLtv: "91%"},
+	}
+
+	tests := []struct {
+		name   string
+		acct   *VIPPortmarAccount
+		uniMMR float64
+		pmUsdt float64
+		spUsdt float64
+		spEth  float64
+		debt   float64
+	}{
+		// 300 spot USDT is transferred, 0.248 ETH hedge is cut for the rest 500, and its 496 USDT is transferred
+		{"low uniMMR", newAcct(1.2, 1200, 300), 1996 / (1000 - 0.248*5), 1996, 0, 9.752, 0},
+		{"high uniMMR", newAcct(6, 6000, 0), 2, 2000, 4000, 10, 0},
+		// 200 is needed to restore target ltv, 5 USDT is reserved in spot, 155 is withdrawn from surplus
+		{"high vip loan ltv", highLtv, 2.845, 2845, 5, 10, 600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVIPPortmarAcctSimple(bnc.NewUser("", ""), cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			v.SetDryRun(true)
+			v.pairs = func() (map[string]cex.Pair, map[string]cex.Pair, error) {
+				return map[string]cex.Pair{"ETHUSDT": {Asset: "ETH", Quote: "USDT", QPrecision: 4, Tradable: true}},
+					map[string]cex.Pair{"ETHUSDT": {Asset: "ETH", Quote: "USDT", QPrecision: 3, Tradable: true}},
+					nil
+			}
+
+			acct := v.handle(tt.acct)
+
+			if got := acct.PortmarAccountInformation.UniMMR; math.Abs(got-tt.uniMMR) > 1e-6 {
+				t.Errorf("uniMMR %v, want %v", got, tt.uniMMR)
+			}
+			if bal, _ := acct.PortmarBalance("USDT"); math.Abs(bal.CrossMarginAsset-tt.pmUsdt) > 1e-6 {
+				t.Errorf("pm USDT %v, want %v", bal.CrossMarginAsset, tt.pmUsdt)
+			}
+			if bal, _ := acct.SpotBalance("USDT"); math.Abs(bal.Free-tt.spUsdt) > 1e-6 {
+				t.Errorf("spot USDT %v, want %v", bal.Free, tt.spUsdt)
+			}
+			if bal, _ := acct.SpotBalance("ETH"); math.Abs(bal.Free-tt.spEth) > 1e-9 {
+				t.Errorf("spot ETH %v, want %v", bal.Free, tt.spEth)
+			}
+			var debt float64
+			for _, ord := range acct.LoanOrders {
+				debt += ord.TotalDebt
+			}
+			if math.Abs(debt-tt.debt) > 1e-6 {
+				t.Errorf("vip loan debt %v, want %v", debt, tt.debt)
+			}
+			if bal, _ := tt.acct.SpotBalance("ETH"); bal.Free != 10 {
+				t.Errorf("original account is modified, spot ETH %v", bal.Free)
+			}
+		})
+	}
+}
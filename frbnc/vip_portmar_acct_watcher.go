@@ -89,7 +89,7 @@ func (aw *VIPPortmarAcctWatcher) remove(c chan VIPPortmarAcctWatcherMsg) {
 	defer aw.muxSubbers.Unlock()
 	for i, suber := range aw.subbers {
 		if suber == c {
-			aw.subbers = slices.Delete(aw.subbers, i, i)
+			aw.subbers = slices.Delete(aw.subbers, i, i+1)
 			return
 		}
 	}
@@ -0,0 +1,322 @@
+package frbnc
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dwdwow/cex/bnc"
+	"github.com/dwdwow/mathy"
+)
+
+// VIPLoanLockedQtys returns spot qty locked as vip loan collateral, key is asset.
+// Collateral coins of every order are locked in listed order,
+// until their value reaches debt / MaxLTV of the order.
+// If MaxLTV is unknown, all collateral coins of the order are locked.
+// Value is before haircut, so locked qty is never less than needed.
+// Orders whose collateral account is not cfg.AccountId are skipped.
+func VIPLoanLockedQtys(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig) map[string]float64 {
+	locked := map[string]float64{}
+	for _, analysis := range AnalyseVIPLoan(acct, cfg).Orders {
+		ord := analysis.Order
+		if !isCollateralAccount(ord.CollateralAccountId, cfg.AccountId) {
+			continue
+		}
+		need := math.Inf(1)
+		if analysis.MaxLTV > 0 {
+			need = (ord.TotalDebt + ord.ResidualInterest) / analysis.MaxLTV
+		}
+		for _, coin := range analysis.CollateralCoins {
+			if need <= 0 {
+				break
+			}
+			bal, _ := acct.SpotBalance(coin)
+			free := bal.Free - locked[coin]
+			if free <= 0 {
+				continue
+			}
+			qty := free
+			if price, ok := acct.Price(coin); ok && price > 0 {
+				qty = math.Min(free, need/price)
+				need -= qty * price
+			}
+			locked[coin] += qty
+		}
+	}
+	return locked
+}
+
+// isCollateralAccount returns true if accountId is one of collateralAccountIds, split by ",".
+// If any of them is empty, it is unknown, and returns true.
+func isCollateralAccount(collateralAccountIds, accountId string) bool {
+	if collateralAccountIds == "" || accountId == "" {
+		return true
+	}
+	for _, id := range strings.Split(collateralAccountIds, ",") {
+		if strings.TrimSpace(id) == accountId {
+			return true
+		}
+	}
+	return false
+}
+
+// PortmarCollTransfer is spot collateral transferred to portfolio margin account.
+type PortmarCollTransfer struct {
+	Asset string
+	Qty   float64
+	Price float64
+	// Value is USDT value of Qty.
+	Value float64
+	// AdjustedValue is equity added after collateral rate tiers.
+	AdjustedValue float64
+}
+
+type PortmarCollSelection struct {
+	// Transfers sorted by collateral rate, from high to low.
+	Transfers []PortmarCollTransfer
+	// Locked is spot qty locked as vip loan collateral, key is asset.
+	Locked        map[string]float64
+	AdjustedValue float64
+	// HaircutLoss is value minus adjusted value of all transfers.
+	HaircutLoss float64
+	// Remaining is equity still needed after all transfers.
+	Remaining float64
+}
+
+// portmarCollSegment is part of spot asset in one collateral rate tier.
+type portmarCollSegment struct {
+	asset string
+	floor float64
+	value float64
+	rate  float64
+}
+
+// SelectPortmarCollaterals selects spot collaterals to add equityNeed to portfolio margin account,
+// with least haircut loss.
+// Qty locked as vip loan collateral is never selected.
+// Collateral rate tiers are applied on value already in portfolio margin account,
+// so every part of asset is valued at its marginal rate,
+// and parts with higher rate are selected first.
+// Transfer below minUsdt is raised to minUsdt, or dropped if spot is not enough.
+func SelectPortmarCollaterals(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig, equityNeed float64) (sel PortmarCollSelection) {
+	sel.Locked = VIPLoanLockedQtys(acct, cfg)
+	sel.Remaining = math.Max(equityNeed, 0)
+
+	prices := map[string]float64{}
+	frees := map[string]float64{}
+	existing := map[string]float64{}
+	tiers := map[string][]PortmarCollateralTier{}
+
+	var segments []portmarCollSegment
+	for _, bal := range acct.Spot.Balances {
+		free := bal.Free - sel.Locked[bal.Asset]
+		if free <= 0 {
+			continue
+		}
+		assetTiers, ok := acct.PortmarCollateralTiers(bal.Asset)
+		if !ok {
+			continue
+		}
+		price, ok := acct.Price(bal.Asset)
+		if !ok || price <= 0 {
+			continue
+		}
+		var held float64
+		if pmBal, ok := acct.PortmarBalance(bal.Asset); ok {
+			held = math.Max(uniMMRAssetEquity(pmBal), 0) * price
+		}
+		prices[bal.Asset] = price
+		frees[bal.Asset] = free
+		existing[bal.Asset] = held
+		tiers[bal.Asset] = assetTiers
+
+		from, to := held, held+free*price
+		for _, tier := range assetTiers {
+			lo, hi := math.Max(tier.TierFloor, from), math.Min(tier.TierCap, to)
+			if hi <= lo || tier.CollateralRate <= 0 {
+				continue
+			}
+			segments = append(segments, portmarCollSegment{bal.Asset, lo, hi - lo, tier.CollateralRate})
+		}
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		si, sj := segments[i], segments[j]
+		if si.rate != sj.rate {
+			return si.rate > sj.rate
+		}
+		if si.asset != sj.asset {
+			return si.asset < sj.asset
+		}
+		return si.floor < sj.floor
+	})
+
+	values := map[string]float64{}
+	var assets []string
+	remain := sel.Remaining
+	for _, seg := range segments {
+		if remain <= 0 {
+			break
+		}
+		value := math.Min(seg.value, remain/seg.rate)
+		if !slices.Contains(assets, seg.asset) {
+			assets = append(assets, seg.asset)
+		}
+		values[seg.asset] += value
+		remain -= value * seg.rate
+	}
+
+	for _, asset := range assets {
+		price := prices[asset]
+		value := math.Max(values[asset], minUsdt)
+		qty := mathy.RoundFloor(math.Min(value/price, frees[asset]), 6)
+		value = qty * price
+		if qty <= 0 || value < minUsdt {
+			continue
+		}
+		adjusted := PortmarCollValue(existing[asset]+value, tiers[asset]) - PortmarCollValue(existing[asset], tiers[asset])
+		sel.Transfers = append(sel.Transfers, PortmarCollTransfer{
+			Asset:         asset,
+			Qty:           qty,
+			Price:         price,
+			Value:         value,
+			AdjustedValue: adjusted,
+		})
+		sel.AdjustedValue += adjusted
+		sel.HaircutLoss += value - adjusted
+	}
+	sel.Remaining = math.Max(sel.Remaining-sel.AdjustedValue, 0)
+	return
+}
+
+// PlanPortmarSurplusActions plans transfers of surplus collaterals
+// from portfolio margin account back to spot account, if uniMMR is above MaxUniMMR.
+// Surplus is adjusted equity above BalancedUniMMR,
+// parts of assets with lowest collateral rate are transferred first,
+// so least adjusted equity is lost for the same value.
+// Transferred assets stay in spot account, can be used to repay loans,
+// back vip loans or be subscribed to earn.
+// Returns actions and local uniMMR equity after all actions,
+// actions are dropped from the last one until uniMMR is not below BalancedUniMMR.
+func PlanPortmarSurplusActions(acct *VIPPortmarAccount, cfg VIPPortmarAccountConfig) (actions []Action, res UniMMREquity, err error) {
+	res, err = CalUniMMREquity(acct)
+	if err != nil {
+		return
+	}
+	info := acct.PortmarAccountInformation
+	if cfg.MaxUniMMR <= 0 || info.UniMMR <= cfg.MaxUniMMR || res.UniMMR <= cfg.MaxUniMMR || res.MaintMargin <= 0 {
+		return
+	}
+	// both cex and local uniMMR should stay at or above BalancedUniMMR
+	surplus := math.Min(res.AdjustedEquity, info.UniMMR*res.MaintMargin) - cfg.BalancedUniMMR*res.MaintMargin
+	if surplus <= 0 {
+		return
+	}
+
+	prices := map[string]float64{}
+	frees := map[string]float64{}
+
+	var segments []portmarCollSegment
+	for _, asset := range res.Assets {
+		bal, _ := acct.PortmarBalance(asset.Asset)
+		free := math.Min(bal.CrossMarginFree, asset.Equity)
+		if free <= 0 {
+			continue
+		}
+		prices[asset.Asset] = asset.Price
+		frees[asset.Asset] = free
+
+		from, to := asset.Value-free*asset.Price, asset.Value
+		tiers, ok := acct.PortmarCollateralTiers(asset.Asset)
+		if !ok {
+			// not collateral asset, transferring it loses no adjusted equity
+			segments = append(segments, portmarCollSegment{asset.Asset, from, to - from, 0})
+			continue
+		}
+		for _, tier := range tiers {
+			lo, hi := math.Max(tier.TierFloor, from), math.Min(tier.TierCap, to)
+			if hi <= lo {
+				continue
+			}
+			segments = append(segments, portmarCollSegment{asset.Asset, lo, hi - lo, tier.CollateralRate})
+		}
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		si, sj := segments[i], segments[j]
+		if si.rate != sj.rate {
+			return si.rate < sj.rate
+		}
+		if si.asset != sj.asset {
+			return si.asset < sj.asset
+		}
+		// higher part of asset is transferred first
+		return si.floor > sj.floor
+	})
+
+	values := map[string]float64{}
+	var assets []string
+	remain := surplus
+	for _, seg := range segments {
+		if remain <= 0 {
+			break
+		}
+		value := seg.value
+		if seg.rate > 0 {
+			value = math.Min(value, remain/seg.rate)
+		}
+		if !slices.Contains(assets, seg.asset) {
+			assets = append(assets, seg.asset)
+		}
+		values[seg.asset] += value
+		remain -= value * seg.rate
+	}
+
+	for _, asset := range assets {
+		price := prices[asset]
+		qty := mathy.RoundFloor(math.Min(values[asset]/price, frees[asset]), 6)
+		if qty*price < minUsdt {
+			continue
+		}
+		actions = append(actions, Action{
+			Type:         ActionTypeTransfer,
+			Reason:       FindingPmUniMMRHigh,
+			Asset:        asset,
+			Qty:          qty,
+			TransferType: bnc.TransferTypePortfolioMarginMain,
+		})
+	}
+
+	before := res.UniMMR
+	for len(actions) > 0 {
+		res, err = CalUniMMREquity(acct.WithActions(actions...))
+		if err != nil {
+			return nil, res, err
+		}
+		if res.UniMMR >= cfg.BalancedUniMMR-1e-9 {
+			break
+		}
+		actions = actions[:len(actions)-1]
+	}
+	if len(actions) == 0 {
+		res, err = CalUniMMREquity(acct)
+		return
+	}
+	for i := range actions {
+		after := res.UniMMR
+		if i < len(actions)-1 {
+			if prefix, err := CalUniMMREquity(acct.WithActions(actions[:i+1]...)); err == nil {
+				after = prefix.UniMMR
+			}
+		}
+		actions[i].Effects = append(actions[i].Effects, ActionEffect{
+			Subject: "UNIMMR",
+			Metric:  "uniMMR",
+			Before:  before,
+			After:   after,
+		})
+		before = after
+	}
+	return
+}
@@ -0,0 +1,185 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestSelectPortmarCollaterals(t *testing.T) {
+	cfg := VIPPortmarAccountConfig{VIPLoanMaxLTV: 0.75, AccountId: "1001"}
+
+	newAcct := func(spBals []bnc.SpotBalance, pmBals []bnc.PortfolioMarginBalance) *VIPPortmarAccount {
+		acct := &VIPPortmarAccount{
+			Spot:            bnc.SpotAccount{Balances: spBals},
+			PortmarBalances: pmBals,
+			Prices:          map[string]float64{"BTC": 50000, "ETH": 2000, "BNB": 500},
+		}
+		acct.pmCollRates = map[string]bnc.PortfolioMarginCollateralRate{
+			"USDT": {Asset: "USDT", CollateralRate: 1},
+			"BTC":  {Asset: "BTC", CollateralRate: 0.95},
+			"ETH":  {Asset: "ETH", CollateralRate: 0.9},
+			"BNB":  {Asset: "BNB", CollateralRate: 0.7},
+		}
+		return acct.Clone()
+	}
+
+	byRate := newAcct([]bnc.SpotBalance{
+		{Asset: "ETH", Free: 10},
+		{Asset: "BTC", Free: 1},
+		{Asset: "USDT", Free: 100},
+	}, nil)
+
+	// 1000 of ETH is already in portfolio margin, so more ETH is only valued at 0.5
+	tiered := newAcct([]bnc.SpotBalance{
+		{Asset: "ETH", Free: 1},
+		{Asset: "BNB", Free: 1},
+	}, []bnc.PortfolioMarginBalance{{Asset: "ETH", CrossMarginAsset: 0.5}})
+	tiered.SetPortmarCollateralTiers("ETH", []PortmarCollateralTier{
+		{TierFloor: 0, TierCap: 1000, CollateralRate: 0.9},
+		{TierFloor: 1000, TierCap: math.Inf(1), CollateralRate: 0.5},
+	})
+
+	// 6000 debt at 0.75 max ltv locks 4 ETH
+	locked := newAcct([]bnc.SpotBalance{{Asset: "ETH", Free: 10}}, nil)
+	locked.LoanOrders = []bnc.VIPLoanOngoingOrder{
+		{OrderId: "1", LoanCoin: "USDT", TotalDebt: 6000, CollateralCoin: "ETH", MarginCallLtv: "80%", LiquidationLtv: "91%"},
+	}
+
+	// collateral of vip loan is locked in other account
+	lockedElsewhere := newAcct([]bnc.SpotBalance{{Asset: "ETH", Free: 10}}, nil)
+	lockedElsewhere.LoanOrders = []bnc.VIPLoanOngoingOrder{
+		{OrderId: "1", LoanCoin: "USDT", TotalDebt: 6000, CollateralAccountId: "2002", CollateralCoin: "ETH", MarginCallLtv: "80%", LiquidationLtv: "91%"},
+	}
+	lockedHere := newAcct([]bnc.SpotBalance{{Asset: "ETH", Free: 10}}, nil)
+	lockedHere.LoanOrders = []bnc.VIPLoanOngoingOrder{
+		{OrderId: "1", LoanCoin: "USDT", TotalDebt: 6000, CollateralAccountId: "2002,1001", CollateralCoin: "ETH", MarginCallLtv: "80%", LiquidationLtv: "91%"},
+	}
+
+	tests := []struct {
+		name       string
+		acct       *VIPPortmarAccount
+		equityNeed float64
+		transfers  map[string]float64
+		locked     map[string]float64
+		adjusted   float64
+		remaining  float64
+	}{
+		{"by rate", byRate, 195, map[string]float64{"USDT": 100, "BTC": 0.002}, nil, 195, 0},
+		{"tiered", tiered, 70, map[string]float64{"BNB": 0.2}, nil, 70, 0},
+		{"tiered all", tiered, 1500, map[string]float64{"BNB": 1, "ETH": 1}, nil, 350 + 1000, 150},
+		{"vip loan locked", locked, 100000, map[string]float64{"ETH": 6}, map[string]float64{"ETH": 4}, 10800, 89200},
+		{"vip loan locked in this account", lockedHere, 100000, map[string]float64{"ETH": 6}, map[string]float64{"ETH": 4}, 10800, 89200},
+		{"vip loan locked in other account", lockedElsewhere, 100000, map[string]float64{"ETH": 10}, map[string]float64{"ETH": 0}, 18000, 82000},
+		{"raised to min", byRate, 2, map[string]float64{"USDT": minUsdt}, nil, minUsdt, 0},
+		{"dropped below min", newAcct([]bnc.SpotBalance{{Asset: "USDT", Free: 3}}, nil), 2, nil, nil, 0, 2},
+		{"nothing needed", byRate, 0, nil, nil, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := SelectPortmarCollaterals(tt.acct, cfg, tt.equityNeed)
+
+			if len(sel.Transfers) != len(tt.transfers) {
+				t.Fatalf("transfers %+v, want %v", sel.Transfers, tt.transfers)
+			}
+			for _, trans := range sel.Transfers {
+				if qty := tt.transfers[trans.Asset]; math.Abs(trans.Qty-qty) > 1e-9 {
+					t.Errorf("%v qty %v, want %v", trans.Asset, trans.Qty, qty)
+				}
+			}
+			for asset, qty := range tt.locked {
+				if math.Abs(sel.Locked[asset]-qty) > 1e-9 {
+					t.Errorf("%v locked %v, want %v", asset, sel.Locked[asset], qty)
+				}
+			}
+			if math.Abs(sel.AdjustedValue-tt.adjusted) > 1e-6 {
+				t.Errorf("adjusted value %v, want %v", sel.AdjustedValue, tt.adjusted)
+			}
+			if math.Abs(sel.Remaining-tt.remaining) > 1e-6 {
+				t.Errorf("remaining %v, want %v", sel.Remaining, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestPlanPortmarSurplusActions(t *testing.T) {
+	cfg := VIPPortmarAccountConfig{BalancedUniMMR: 2, MaxUniMMR: 2.5}
+
+	newAcct := func(cexUniMMR float64, pmBals []bnc.PortfolioMarginBalance, bnbTiers []PortmarCollateralTier) *VIPPortmarAccount {
+		for i := range pmBals {
+			pmBals[i].CrossMarginFree = pmBals[i].CrossMarginAsset
+		}
+		acct := &VIPPortmarAccount{
+			PortmarAccountInformation: bnc.PortfolioMarginAccountInformation{UniMMR: cexUniMMR, AccountMaintMargin: 1000},
+			PortmarBalances:           pmBals,
+			Prices:                    map[string]float64{"ETH": 2000, "BNB": 500},
+		}
+		// ETH is not collateral
+		acct.pmCollRates = map[string]bnc.PortfolioMarginCollateralRate{
+			"USDT": {Asset: "USDT", CollateralRate: 1},
+			"BNB":  {Asset: "BNB", CollateralRate: 0.7},
+		}
+		acct = acct.Clone()
+		if bnbTiers != nil {
+			acct.SetPortmarCollateralTiers("BNB", bnbTiers)
+		}
+		return acct
+	}
+
+	// adjusted equity 3000 + 4 * 500 * 0.7 = 4400
+	bals := func() []bnc.PortfolioMarginBalance {
+		return []bnc.PortfolioMarginBalance{
+			{Asset: "USDT", CrossMarginAsset: 3000},
+			{Asset: "BNB", CrossMarginAsset: 4},
+			{Asset: "ETH", CrossMarginAsset: 1},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		acct      *VIPPortmarAccount
+		transfers []Action
+		uniMMR    float64
+	}{
+		{"lowest rate first", newAcct(4.4, bals(), nil),
+			[]Action{{Asset: "ETH", Qty: 1}, {Asset: "BNB", Qty: 4}, {Asset: "USDT", Qty: 1000}}, 2},
+		// cex uniMMR is lower than local one, surplus is 4200 - 2000
+		{"cex uniMMR lower", newAcct(4.2, bals(), nil),
+			[]Action{{Asset: "ETH", Qty: 1}, {Asset: "BNB", Qty: 4}, {Asset: "USDT", Qty: 800}}, 2.2},
+		// adjusted equity 1500 + 900 + 300, higher BNB tier at 0.3 goes first, then 400 of lower tier at 0.9
+		{"tiered", newAcct(2.7, []bnc.PortfolioMarginBalance{
+			{Asset: "USDT", CrossMarginAsset: 1500},
+			{Asset: "BNB", CrossMarginAsset: 4},
+		}, []PortmarCollateralTier{
+			{TierFloor: 0, TierCap: 1000, CollateralRate: 0.9},
+			{TierFloor: 1000, TierCap: math.Inf(1), CollateralRate: 0.3},
+		}), []Action{{Asset: "BNB", Qty: 2.888888}}, 2.0000004},
+		{"not high", newAcct(2.4, bals(), nil), nil, 4.4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions, res, err := PlanPortmarSurplusActions(tt.acct, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(actions) != len(tt.transfers) {
+				t.Fatalf("actions %+v, want %+v", actions, tt.transfers)
+			}
+			for i, action := range actions {
+				want := tt.transfers[i]
+				if action.Asset != want.Asset || math.Abs(action.Qty-want.Qty) > 1e-9 {
+					t.Errorf("action %v %v %v, want %v %v", i, action.Asset, action.Qty, want.Asset, want.Qty)
+				}
+				if action.TransferType != bnc.TransferTypePortfolioMarginMain {
+					t.Errorf("action %v transfer type %v", i, action.TransferType)
+				}
+			}
+			if math.Abs(res.UniMMR-tt.uniMMR) > 1e-6 {
+				t.Errorf("uniMMR %v, want %v", res.UniMMR, tt.uniMMR)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package frbnc
 
 import (
 	"context"
+	"errors"
 	"sync"
 
 	"github.com/dwdwow/cex"
@@ -34,16 +35,16 @@ const (
 )
 
 type VIPPortmarOrd struct {
-	Order  cex.Order
-	Status VIPPortmarOrderStatus
-	Err    error
+	Order  cex.Order             `json:"order"`
+	Status VIPPortmarOrderStatus `json:"status"`
+	Err    error                 `json:"-"`
 }
 
 type VIPPortmarPosMsg struct {
-	FuOrd   VIPPortmarOrd
-	SpOrd   VIPPortmarOrd
-	ReFuOrd VIPPortmarOrd
-	Errs    []error
+	FuOrd   VIPPortmarOrd `json:"fuOrd"`
+	SpOrd   VIPPortmarOrd `json:"spOrd"`
+	ReFuOrd VIPPortmarOrd `json:"reFuOrd"`
+	Errs    []error       `json:"-"`
 }
 
 func (v VIPPortmarPosMsg) Status() VIPPortmarPosStatus {
@@ -82,16 +83,45 @@ func (v VIPPortmarPosMsg) Status() VIPPortmarPosStatus {
 	return VIPPortmarPosStatusNone
 }
 
+// IsDone returns true if trader sends no more message after this status.
+func (s VIPPortmarPosStatus) IsDone() bool {
+	switch s {
+	case VIPPortmarPosStatusSpOpened,
+		VIPPortmarPosStatusFuFailed, VIPPortmarPosStatusFuWaiterFailed,
+		VIPPortmarPosStatusSpWaiterFailed,
+		VIPPortmarPosStatusReFuOpened, VIPPortmarPosStatusReFuFailed, VIPPortmarPosStatusReFuWaiterFailed:
+		return true
+	}
+	return false
+}
+
+// isSettled returns true if trade is finished and hedged,
+// or nothing is traded.
+// Other done statuses should be checked after restart.
+func (s VIPPortmarPosStatus) isSettled() bool {
+	switch s {
+	case VIPPortmarPosStatusSpOpened, VIPPortmarPosStatusFuFailed, VIPPortmarPosStatusReFuOpened:
+		return true
+	}
+	return false
+}
+
 type VIPPortmarPosMsger struct {
 	mux       sync.RWMutex
 	latestMsg VIPPortmarPosMsg
 	chMsg     chan VIPPortmarPosMsg
+
+	store *PosTradeStore
+	trade PosTrade
 }
 
+// SendMsg saves msg to trade store before sending it.
 func (v *VIPPortmarPosMsger) SendMsg(msg VIPPortmarPosMsg) {
 	v.mux.Lock()
 	defer v.mux.Unlock()
 	v.latestMsg = msg
+	v.trade.Msg = msg
+	v.store.sync(v.trade, msg.Status().isSettled())
 	v.chMsg <- msg
 }
 
@@ -107,38 +137,77 @@ func (v *VIPPortmarPosMsger) Status() VIPPortmarPosStatus {
 	return v.latestMsg.Status()
 }
 
+// Wait returns the last message of trader.
+func (v *VIPPortmarPosMsger) Wait() VIPPortmarPosMsg {
+	for msg := range v.chMsg {
+		if msg.Status().IsDone() {
+			return msg
+		}
+	}
+	return v.GetLatestMsg()
+}
+
+var ErrVIPPortmarOrderUnknown = errors.New("order may be placed, but order id is unknown")
+
 func VIPPortmarMarketTraderFunc(ctx context.Context, user *bnc.User, pair cex.Pair, trader cex.MarketTraderFunc, qty float64) (ord VIPPortmarOrd, err error) {
-	ord.Status = VIPPortmarOrderStatusOpening
+	err = tradeVIPPortmarOrd(ctx, user, pair, trader, qty, &ord, func() {})
+	return
+}
 
-	_, oriOrd, reqErr := trader(pair.Asset, pair.Quote, qty)
+// tradeVIPPortmarOrd places order if ord is not placed, then waits it.
+// If ord was placed before restart, it is only waited,
+// and if its order id was not saved, ErrVIPPortmarOrderUnknown is returned.
+// save is called after every change of ord.
+func tradeVIPPortmarOrd(ctx context.Context, user *bnc.User, pair cex.Pair, trader cex.MarketTraderFunc, qty float64, ord *VIPPortmarOrd, save func()) error {
+	switch ord.Status {
+	case VIPPortmarOrderStatusOpened:
+		return nil
+	case VIPPortmarOrderStatusFailed:
+		if ord.Err == nil {
+			ord.Err = errors.New("order failed")
+		}
+		return ord.Err
+	case VIPPortmarOrderStatusNone:
+		ord.Status = VIPPortmarOrderStatusOpening
+		save()
 
-	if oriOrd != nil {
-		ord.Order = *oriOrd
-	}
+		_, oriOrd, reqErr := trader(pair.Asset, pair.Quote, qty)
 
-	if reqErr.IsNotNil() {
-		ord.Status = VIPPortmarOrderStatusFailed
-		ord.Err = reqErr.Err
-		err = reqErr.Err
-		return
+		if oriOrd != nil {
+			ord.Order = *oriOrd
+		}
+
+		if reqErr.IsNotNil() {
+			ord.Status = VIPPortmarOrderStatusFailed
+			ord.Err = reqErr.Err
+			return reqErr.Err
+		}
+
+		// order id is saved before waiting
+		save()
+	default:
+		if ord.Order.OrderId == "" {
+			ord.Status = VIPPortmarOrderStatusWaiterFailed
+			ord.Err = ErrVIPPortmarOrderUnknown
+			return ord.Err
+		}
+		ord.Status = VIPPortmarOrderStatusOpening
+		ord.Err = nil
 	}
 
-	reqErr = <-user.WaitOrder(ctx, oriOrd)
+	oriOrd := ord.Order
+	reqErr := <-user.WaitOrder(ctx, &oriOrd)
+	ord.Order = oriOrd
 
 	if reqErr.IsNotNil() {
 		ord.Status = VIPPortmarOrderStatusWaiterFailed
 		ord.Err = reqErr.Err
-		err = reqErr.Err
-		return
-	}
-
-	if oriOrd != nil {
-		ord.Order = *oriOrd
+		return reqErr.Err
 	}
 
 	ord.Status = VIPPortmarOrderStatusOpened
 
-	return
+	return nil
 }
 
 type VIPPortmarPosTraderParams struct {
@@ -149,13 +218,53 @@ type VIPPortmarPosTraderParams struct {
 	SpQty  float64
 	FuPair cex.Pair
 	FuQty  float64
+	// Audit records every order, nil means no audit log.
+	Audit *AuditRecorder
+	// Store saves trade after every transition, nil means no persistence.
+	Store *PosTradeStore
 }
 
 func VIPPortmarPosTrader(ctx context.Context, params VIPPortmarPosTraderParams) *VIPPortmarPosMsger {
+	trade := newPosTrade(PosTradeKindVIPPortmar)
+	trade.SpSide = params.SpSide
+	trade.IsCM = params.IsCM
+	trade.SpPair = params.SpPair
+	trade.SpQty = params.SpQty
+	trade.FuPair = params.FuPair
+	trade.FuQty = params.FuQty
+	return runVIPPortmarPosTrader(ctx, params, trade)
+}
+
+// ResumeVIPPortmarPosTrader continues trade saved by VIPPortmarPosTrader before restart.
+// Orders placed before restart are waited by their order ids, unplaced legs are traded,
+// so the trade ends hedged, or futures is reversed if spot failed.
+// Reversing futures is retried if it failed before restart.
+// Leg whose order id is unknown is WAITER_FAILED with ErrVIPPortmarOrderUnknown,
+// trade is kept in store and should be checked manually.
+func ResumeVIPPortmarPosTrader(ctx context.Context, user *bnc.User, trade PosTrade, store *PosTradeStore, audit *AuditRecorder) *VIPPortmarPosMsger {
+	if trade.Msg.ReFuOrd.Status == VIPPortmarOrderStatusFailed {
+		trade.Msg.ReFuOrd = VIPPortmarOrd{}
+	}
+	return runVIPPortmarPosTrader(ctx, VIPPortmarPosTraderParams{
+		User:   user,
+		SpSide: trade.SpSide,
+		IsCM:   trade.IsCM,
+		SpPair: trade.SpPair,
+		SpQty:  trade.SpQty,
+		FuPair: trade.FuPair,
+		FuQty:  trade.FuQty,
+		Audit:  audit,
+		Store:  store,
+	}, trade)
+}
+
+func runVIPPortmarPosTrader(ctx context.Context, params VIPPortmarPosTraderParams, trade PosTrade) *VIPPortmarPosMsger {
 
 	var spFunc, fuFunc, reFuFunc cex.MarketTraderFunc
+	fuSide := cex.OrderSideBuy
 
 	if params.SpSide == cex.OrderSideBuy {
+		fuSide = cex.OrderSideSell
 		spFunc = params.User.NewSpotMarketBuyOrder
 		if params.IsCM {
 			fuFunc = params.User.NewFuturesMarketSellCMOrder
@@ -176,59 +285,61 @@ func VIPPortmarPosTrader(ctx context.Context, params VIPPortmarPosTraderParams)
 	}
 
 	msger := &VIPPortmarPosMsger{
-		chMsg: make(chan VIPPortmarPosMsg, 6),
+		// opening, placed and result of every leg
+		chMsg: make(chan VIPPortmarPosMsg, 9),
+		store: params.Store,
+		trade: trade,
 	}
 
 	go func() {
-		var msg VIPPortmarPosMsg
+		msg := trade.Msg
+		send := func() { msger.SendMsg(msg) }
+		leg := func(ord *VIPPortmarOrd, pair cex.Pair, trader cex.MarketTraderFunc, side cex.OrderSide, isCM bool, qty float64) error {
+			// only new order is recorded, leg placed before restart is only waited
+			placing := ord.Status == VIPPortmarOrderStatusNone
+			err := tradeVIPPortmarOrd(ctx, params.User, pair, trader, qty, ord, send)
+			if placing {
+				params.Audit.RecordOrder(pair, side, isCM, qty, &ord.Order, err)
+			}
+			return err
+		}
 
 		// must trade futures firstly
 
-		msg.FuOrd.Status = VIPPortmarOrderStatusOpening
-		msger.SendMsg(msg)
-
-		fuOrd, err := VIPPortmarMarketTraderFunc(ctx, params.User, params.FuPair, fuFunc, params.FuQty)
-
-		msg.FuOrd = fuOrd
+		err := leg(&msg.FuOrd, params.FuPair, fuFunc, fuSide, params.IsCM, params.FuQty)
 
 		if err != nil {
 			msg.Errs = append(msg.Errs, err)
-			msger.SendMsg(msg)
+			send()
 			return
 		}
 
-		msger.SendMsg(msg)
+		send()
 
 		// trade spot
 
-		msg.SpOrd.Status = VIPPortmarOrderStatusOpening
-		msger.SendMsg(msg)
-
-		spOrd, err := VIPPortmarMarketTraderFunc(ctx, params.User, params.SpPair, spFunc, params.SpQty)
-
-		msg.SpOrd = spOrd
+		err = leg(&msg.SpOrd, params.SpPair, spFunc, params.SpSide, false, params.SpQty)
 
 		if err != nil {
 			msg.Errs = append(msg.Errs, err)
-			msger.SendMsg(msg)
-			if spOrd.Status == VIPPortmarOrderStatusWaiterFailed {
+			send()
+			if msg.SpOrd.Status == VIPPortmarOrderStatusWaiterFailed {
 				return
 			}
 
 			// reverse futures
 
-			reFuOrd, err := VIPPortmarMarketTraderFunc(ctx, params.User, params.FuPair, reFuFunc, params.FuQty)
-			msg.ReFuOrd = reFuOrd
+			err = leg(&msg.ReFuOrd, params.FuPair, reFuFunc, params.SpSide, params.IsCM, params.FuQty)
 			if err != nil {
 				msg.Errs = append(msg.Errs, err)
-				msger.SendMsg(msg)
+				send()
 				return
 			}
-			msger.SendMsg(msg)
+			send()
 			return
 		}
 
-		msger.SendMsg(msg)
+		send()
 	}()
 
 	return msger
@@ -0,0 +1,197 @@
+package frbnc
+
+import (
+	"math"
+	"sort"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/mathy"
+)
+
+// PortmarUnwind is a planned cut of one portfolio margin hedge,
+// futures short is bought back, then spot coin is sold.
+type PortmarUnwind struct {
+	Symbol string
+	IsCM   bool
+	SpPair cex.Pair
+	FuPair cex.Pair
+	// SpQty is spot coin qty sold.
+	SpQty float64
+	// FuQty is futures qty bought back, contracts for cm.
+	FuQty float64
+	// Price is spot coin USDT price.
+	Price float64
+	// Equity is estimated equity restored at balanced uniMMR,
+	// released maintenance margin and USDT of spot coin sold.
+	Equity float64
+	// MaintMargin is maintenance margin released, USDT.
+	MaintMargin float64
+	// Loss is realized loss of futures position, USDT.
+	Loss float64
+	// Score is profit ratio of futures position minus basis,
+	// hedge with higher score is cut first.
+	Score float64
+}
+
+type portmarHedge struct {
+	symbol string
+	isCM   bool
+	spPair cex.Pair
+	fuPair cex.Pair
+	// fuExp is coin qty of one um contract unit, e.g. 1000 of 1000PEPEUSDT
+	fuExp float64
+	// contractSize is USD of one cm contract
+	contractSize float64
+	mark         float64
+	price        float64
+	qty          float64
+	mmPerQty     float64
+	equityPerQty float64
+	lossPerQty   float64
+	score        float64
+}
+
+// portmarHedges returns hedges of acct, futures shorts with spot coin in spot account.
+// UM symbols are in umPairs, cm symbols are in cm pairs of acct.
+func portmarHedges(acct *VIPPortmarAccount, spPairs, umPairs map[string]cex.Pair, balancedUniMMR float64) (hedges []portmarHedge) {
+	var poss []PortmarPosition
+	for _, pos := range acct.PortmarAccountUMDetail.Positions {
+		poss = append(poss, PortmarPosition{Position: pos})
+	}
+	for _, pos := range acct.PortmarAccountCMDetail.Positions {
+		poss = append(poss, PortmarPosition{Position: pos, IsCM: true})
+	}
+
+	for _, p := range poss {
+		pos := p.Position
+		if pos.SignPositionAmt >= 0 || pos.EntryPrice <= 0 {
+			continue
+		}
+		h := portmarHedge{symbol: pos.Symbol, isCM: p.IsCM, fuExp: 1}
+		var coin string
+		var ok bool
+		var posQty, mmUsd, upnlUsd float64
+		if p.IsCM {
+			h.fuPair, ok = acct.CMFuturesPair(pos.Symbol)
+			if !ok || h.fuPair.ContractSize <= 0 {
+				continue
+			}
+			coin = h.fuPair.Asset
+			h.contractSize = h.fuPair.ContractSize
+			// inverse contract, upnl = amt * contractSize * (1/entry - 1/mark), in coin
+			inv := 1/pos.EntryPrice - pos.UnrealizedProfit/(pos.SignPositionAmt*h.contractSize)
+			if inv <= 0 {
+				continue
+			}
+			h.mark = 1 / inv
+			posQty = -pos.SignPositionAmt * h.contractSize / h.mark
+		} else {
+			coin, h.fuExp, ok = FuSymbolCoin(pos.Symbol, "USDT")
+			if !ok {
+				continue
+			}
+			h.fuPair, ok = umPairs[pos.Symbol]
+			if !ok {
+				continue
+			}
+			h.mark = pos.EntryPrice + pos.UnrealizedProfit/pos.SignPositionAmt
+			posQty = -pos.SignPositionAmt * h.fuExp
+		}
+		if !h.fuPair.Tradable || h.mark <= 0 {
+			continue
+		}
+		h.spPair, ok = spPairs[coin+"USDT"]
+		if !ok || !h.spPair.Tradable {
+			continue
+		}
+		h.price, ok = acct.Price(coin)
+		if !ok || h.price <= 0 {
+			continue
+		}
+		if p.IsCM {
+			// cm margin and profit are in coin
+			mmUsd = pos.MaintMargin * h.price
+			upnlUsd = pos.UnrealizedProfit * h.price
+		} else {
+			mmUsd = pos.MaintMargin
+			upnlUsd = pos.UnrealizedProfit
+		}
+		bal, _ := acct.SpotBalance(coin)
+		h.qty = math.Min(bal.Free, posQty)
+		if h.qty <= 0 {
+			continue
+		}
+		basis := h.mark/h.fuExp/h.price - 1
+		h.mmPerQty = mmUsd / posQty
+		h.equityPerQty = h.mmPerQty*balancedUniMMR + h.price
+		h.lossPerQty = math.Max(-upnlUsd, 0) / posQty
+		h.score = upnlUsd/(posQty*h.price) - basis
+		hedges = append(hedges, h)
+	}
+
+	sort.SliceStable(hedges, func(i, j int) bool {
+		return hedges[i].score > hedges[j].score
+	})
+	return
+}
+
+// PlanPortmarCutPositions plans cutting hedges of acct until equityNeed is restored.
+// Hedges with profitable futures and low basis are cut first.
+// Realized loss of all cuts stays at or below maxLoss,
+// so hedges with losing futures are only cut partly when maxLoss is nearly used.
+// Qty respects precision, min qty and min notional of both pairs.
+// Returns unwinds and estimated equity restored.
+func PlanPortmarCutPositions(acct *VIPPortmarAccount, spPairs, umPairs map[string]cex.Pair, balancedUniMMR, equityNeed, maxLoss float64) (unwinds []PortmarUnwind, equity float64) {
+	var loss float64
+	for _, h := range portmarHedges(acct, spPairs, umPairs, balancedUniMMR) {
+		remain := equityNeed - equity
+		if remain < minUsdt {
+			break
+		}
+		qty := math.Min(h.qty, remain/h.equityPerQty)
+		if h.lossPerQty > 0 {
+			qty = math.Min(qty, (maxLoss-loss)/h.lossPerQty)
+		}
+		if qty <= 0 {
+			continue
+		}
+
+		var fuQty, spQty float64
+		if h.isCM {
+			fuQty = math.Floor(qty * h.mark / h.contractSize)
+			spQty = mathy.RoundFloor(fuQty*h.contractSize/h.mark, int32(h.spPair.QPrecision))
+			if fuQty < 1 {
+				continue
+			}
+		} else {
+			fuQty = mathy.RoundFloor(qty/h.fuExp, int32(h.fuPair.QPrecision))
+			spQty = mathy.RoundFloor(fuQty*h.fuExp, int32(h.spPair.QPrecision))
+			// spot qty may be floored more than futures qty
+			fuQty = mathy.RoundFloor(spQty/h.fuExp, int32(h.fuPair.QPrecision))
+			if fuQty <= 0 || fuQty < h.fuPair.MinTradeQty || spQty*h.price < math.Max(minFuTradeUsdt, h.fuPair.MinTradeQuote) {
+				continue
+			}
+		}
+		if spQty <= 0 || spQty < h.spPair.MinTradeQty || spQty*h.price < math.Max(minSpotTradeUsdt, h.spPair.MinTradeQuote) {
+			continue
+		}
+
+		u := PortmarUnwind{
+			Symbol:      h.symbol,
+			IsCM:        h.isCM,
+			SpPair:      h.spPair,
+			FuPair:      h.fuPair,
+			SpQty:       spQty,
+			FuQty:       fuQty,
+			Price:       h.price,
+			Equity:      spQty * h.equityPerQty,
+			MaintMargin: spQty * h.mmPerQty,
+			Loss:        spQty * h.lossPerQty,
+			Score:       h.score,
+		}
+		unwinds = append(unwinds, u)
+		equity += u.Equity
+		loss += u.Loss
+	}
+	return
+}
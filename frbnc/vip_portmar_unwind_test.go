@@ -0,0 +1,90 @@
+package frbnc
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dwdwow/cex"
+	"github.com/dwdwow/cex/bnc"
+)
+
+func TestPlanPortmarCutPositions(t *testing.T) {
+	// cm short of 60000 USD, opened at 58000, marked at 60000
+	cmUpnl := -600 * 100 * (1.0/58000 - 1.0/60000)
+	btcLossPerQty := -cmUpnl * 60000
+
+	acct := &VIPPortmarAccount{
+		Spot: bnc.SpotAccount{Balances: []bnc.SpotBalance{
+			{Asset: "ETH", Free: 10},
+			{Asset: "BTC", Free: 1},
+		}},
+		PortmarAccountUMDetail: bnc.PortfolioMarginAccountDetail{Positions: []bnc.PortfolioMarginAccountPosition{
+			// marked at 2000, profit ratio 0.05
+			{Symbol: "ETHUSDT", SignPositionAmt: -10, EntryPrice: 2100, UnrealizedProfit: 1000, MaintMargin: 200},
+			// no spot coin
+			{Symbol: "SOLUSDT", SignPositionAmt: -10, EntryPrice: 150, UnrealizedProfit: 100, MaintMargin: 20},
+		}},
+		PortmarAccountCMDetail: bnc.PortfolioMarginAccountDetail{Positions: []bnc.PortfolioMarginAccountPosition{
+			{Symbol: "BTCUSD_PERP", SignPositionAmt: -600, EntryPrice: 58000, UnrealizedProfit: cmUpnl, MaintMargin: 0.01},
+		}},
+		Prices:  map[string]float64{"ETH": 2000, "BTC": 60000, "SOL": 140},
+		cmPairs: map[string]cex.Pair{"BTCUSD_PERP": {Asset: "BTC", Quote: "USD", ContractSize: 100, Tradable: true}},
+	}
+	acct = acct.Clone()
+	spPairs := map[string]cex.Pair{
+		"ETHUSDT": {Asset: "ETH", Quote: "USDT", QPrecision: 4, Tradable: true},
+		"BTCUSDT": {Asset: "BTC", Quote: "USDT", QPrecision: 5, Tradable: true},
+		"SOLUSDT": {Asset: "SOL", Quote: "USDT", QPrecision: 2, Tradable: true},
+	}
+	umPairs := map[string]cex.Pair{
+		"ETHUSDT": {Asset: "ETH", Quote: "USDT", QPrecision: 3, Tradable: true},
+		"SOLUSDT": {Asset: "SOL", Quote: "USDT", QPrecision: 0, Tradable: true},
+	}
+
+	// balanced uniMMR 4, 200 / 10 * 4 + 2000 per ETH, 600 * 4 + 60000 per BTC
+	const ethEquity, btcEquity = 2080.0, 62400.0
+
+	type cut struct {
+		symbol string
+		spQty  float64
+		fuQty  float64
+	}
+
+	tests := []struct {
+		name    string
+		need    float64
+		maxLoss float64
+		want    []cut
+		equity  float64
+		loss    float64
+	}{
+		{"profitable part", 2 * ethEquity, 0, []cut{{"ETHUSDT", 2, 2}}, 2 * ethEquity, 0},
+		{"loss not allowed", 100000, 0, []cut{{"ETHUSDT", 10, 10}}, 10 * ethEquity, 0},
+		{"loss allowed", 100000, 10000, []cut{{"ETHUSDT", 10, 10}, {"BTCUSD_PERP", 1, 600}}, 10*ethEquity + btcEquity, btcLossPerQty},
+		{"loss capped", 100000, 1050, []cut{{"ETHUSDT", 10, 10}, {"BTCUSD_PERP", 0.50666, 304}}, 10*ethEquity + 0.50666*btcEquity, 0.50666 * btcLossPerQty},
+		{"below min notional", 10, 10000, nil, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unwinds, equity := PlanPortmarCutPositions(acct, spPairs, umPairs, 4, tt.need, tt.maxLoss)
+			if math.Abs(equity-tt.equity) > 1e-6 {
+				t.Errorf("equity %v, want %v", equity, tt.equity)
+			}
+			if len(unwinds) != len(tt.want) {
+				t.Fatalf("unwinds %+v, want %+v", unwinds, tt.want)
+			}
+			var loss float64
+			for i, w := range tt.want {
+				u := unwinds[i]
+				if u.Symbol != w.symbol || math.Abs(u.SpQty-w.spQty) > 1e-9 || u.FuQty != w.fuQty {
+					t.Errorf("unwind %v: %v %v %v, want %v %v %v", i, u.Symbol, u.SpQty, u.FuQty, w.symbol, w.spQty, w.fuQty)
+				}
+				loss += u.Loss
+			}
+			if math.Abs(loss-tt.loss) > 1e-6 || loss > tt.maxLoss {
+				t.Errorf("loss %v, want %v, max %v", loss, tt.loss, tt.maxLoss)
+			}
+		})
+	}
+}
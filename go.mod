@@ -7,6 +7,7 @@ require (
 	github.com/dwdwow/mathy v0.0.1
 	github.com/dwdwow/props v0.0.4
 	github.com/go-resty/resty/v2 v2.11.0
+	github.com/xuri/excelize/v2 v2.8.0
 )
 
 require (
@@ -23,7 +24,6 @@ require (
 	github.com/richardlehane/msoleps v1.0.3 // indirect
 	github.com/shopspring/decimal v1.3.1 // indirect
 	github.com/xuri/efp v0.0.0-20230802181842-ad255f2331ca // indirect
-	github.com/xuri/excelize/v2 v2.8.0 // indirect
 	github.com/xuri/nfp v0.0.0-20230819163627-dc951e3ffe1a // indirect
 	golang.org/x/crypto v0.19.0 // indirect
 	golang.org/x/net v0.21.0 // indirect